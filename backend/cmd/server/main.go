@@ -2,18 +2,36 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
 	"os"
+	"slices"
+	"strings"
 	"time"
 
+	"connectrpc.com/connect"
+	"ehedges.net/ccgui/backend/gen/audit/v1/auditv1connect"
 	"ehedges.net/ccgui/backend/gen/auth/v1/authv1connect"
+	"ehedges.net/ccgui/backend/gen/command/v1/commandv1connect"
+	"ehedges.net/ccgui/backend/gen/computer/v1/computerv1connect"
+	"ehedges.net/ccgui/backend/gen/enrollment/v1/enrollmentv1connect"
 	"ehedges.net/ccgui/backend/gen/hello/v1/hellov1connect"
+	"ehedges.net/ccgui/backend/gen/log/v1/logv1connect"
+	"ehedges.net/ccgui/backend/gen/lua/v1/luav1connect"
+	"ehedges.net/ccgui/backend/gen/metrics/v1/metricsv1connect"
+	"ehedges.net/ccgui/backend/gen/peripheral/v1/peripheralv1connect"
+	"ehedges.net/ccgui/backend/gen/terminal/v1/terminalv1connect"
+	"ehedges.net/ccgui/backend/gen/user/v1/userv1connect"
 	"ehedges.net/ccgui/backend/internal/controller"
+	"ehedges.net/ccgui/backend/internal/oidc"
+	"ehedges.net/ccgui/backend/internal/otlp"
+	"ehedges.net/ccgui/backend/internal/recording"
 	"ehedges.net/ccgui/backend/internal/repository"
 	"ehedges.net/ccgui/backend/internal/service"
+	"ehedges.net/ccgui/backend/internal/telemetry"
 	"ehedges.net/ccgui/backend/internal/websocket"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -44,24 +62,149 @@ func main() {
 		slog.Error("failed to migrate database", "err", err)
 		return
 	}
+	otlpEndpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	if otlpEndpoint == "" {
+		otlpEndpoint = "http://localhost:4318"
+	}
+	otlpExporter := otlp.NewExporter(otlpEndpoint)
+	go otlpExporter.Run(context.Background())
+	serverTelemetry := telemetry.New(otlpExporter, "ccgui-backend")
+	go serverTelemetry.Run(context.Background())
+	keyFailures := telemetry.NewKeyFailureCounter(serverTelemetry)
 	apiKeyRepo := repository.NewGormAPIKeyRepository(db)
 	apiKeyService := service.NewAPIKeyService(apiKeyRepo)
+	adminKey, err := apiKeyService.Bootstrap(context.Background())
+	if err != nil {
+		slog.Error("failed to create initial admin key", "err", err)
+		return
+	}
+	if adminKey != nil {
+		fmt.Printf("\nNo API key could manage keys, so an admin key with every scope was created.\nIt will not be shown again:\n\n    %s\n\n", adminKey.Key)
+	}
 	baseRouter := websocket.NewBaseRouter()
-	wsHub := websocket.NewHub(apiKeyService)
+	wsHub := websocket.NewHub(keyFailures.Wrap(apiKeyService, "websocket"))
 	wsHub.SetRouter(baseRouter)
+	wsHub.SetInstrumentation(telemetry.NewHubInstrumentation(serverTelemetry))
+	computerRepo := repository.NewGormComputerRepository(db)
+	computerService := service.NewComputerService(computerRepo, wsHub)
+	wsHub.SetComputerTracker(computerService)
+	if err := wsHub.HandleCall(service.MethodComputerTags, computerService.TagsCall); err != nil {
+		slog.Error("failed to register call handler", "method", service.MethodComputerTags, "err", err)
+		return
+	}
+	keyAuthorizer := service.NewKeyAuthorizer(apiKeyService, computerService)
+	wsHub.SetSessionAuthorizer(keyAuthorizer)
+	auditRepo := repository.NewGormAuditRepository(db)
+	auditService := service.NewAuditService(auditRepo, apiKeyService)
+	wsHub.SetSessionAuditor(auditService)
+	recordingStore, err := recording.NewStore("data/recordings", recording.Options{
+		MaxAge:              7 * 24 * time.Hour,
+		MaxBytesPerComputer: 256 << 20,
+	})
+	if err != nil {
+		slog.Error("failed to open recording store", "err", err)
+		return
+	}
+	if err := recordingStore.Prune(); err != nil {
+		slog.Warn("failed to prune recordings", "err", err)
+	}
+	terminalService := service.NewTerminalService(wsHub, recordingStore)
+	wsHub.SetTerminalSink(terminalService)
+	metricsOptions, err := metricsStoreOptions()
+	if err != nil {
+		slog.Error("invalid metrics store configuration", "err", err)
+		return
+	}
+	metricRepo := repository.NewGormMetricRepository(db)
+	metricsService := service.NewMetricsService(otlpExporter, metricRepo, computerService, metricsOptions)
+	go metricsService.Run(context.Background())
+	wsHub.SetMetricsSink(metricsService)
+	logService := service.NewLogService(otlpExporter, computerService)
+	wsHub.SetLogSink(logService)
+	peripheralService := service.NewPeripheralService(wsHub)
+	luaService := service.NewLuaService(wsHub)
+	commandService := service.NewCommandService(wsHub, computerService)
 	deleteCh, deleteUnsub := apiKeyService.SubscribeDeletes()
 	defer deleteUnsub()
 	go func() {
 		for id := range deleteCh {
-			wsHub.CloseByKeyID(id)
+			wsHub.CloseByKeyID(id, "key deleted")
+		}
+	}()
+	expiryCh, expiryUnsub := apiKeyService.SubscribeExpiries()
+	defer expiryUnsub()
+	go func() {
+		for id := range expiryCh {
+			wsHub.CloseByKeyID(id, "key expired")
+		}
+	}()
+	retiredCh, retiredUnsub := apiKeyService.SubscribeRetiredSecrets()
+	defer retiredUnsub()
+	go func() {
+		for hash := range retiredCh {
+			wsHub.CloseBySecretHash(hash, "key rotated")
 		}
 	}()
+	go apiKeyService.Run(context.Background())
+	userRepo := repository.NewGormUserRepository(db)
+	userService := service.NewUserService(userRepo)
+	go userService.Run(context.Background())
+	enrollmentService := service.NewEnrollmentService(apiKeyService, keyAuthorizer)
+	wsHub.SetEnroller(enrollmentService)
 	mux.HandleFunc("/ws", wsHub.HandleWS)
-	path, connectHandler := hellov1connect.NewHelloServiceHandler(&controller.HelloController{})
+	mux.HandleFunc("/enroll", wsHub.HandleEnroll)
+	handlerOptions := connect.WithInterceptors(
+		telemetry.NewConnectInterceptor(serverTelemetry),
+		controller.NewAuthInterceptor(keyAuthorizer, auditService,
+			service.NewSessionAuthenticator(userService),
+			service.NewKeyAuthenticator(keyFailures.Wrap(apiKeyService, "connect")),
+		),
+	)
+	path, connectHandler := hellov1connect.NewHelloServiceHandler(&controller.HelloController{}, handlerOptions)
 	mux.Handle(path, connectHandler)
 	authController := controller.NewAuthController(apiKeyService)
-	authHandlerPath, authHandler := authv1connect.NewAuthServiceHandler(authController)
+	authHandlerPath, authHandler := authv1connect.NewAuthServiceHandler(authController, handlerOptions)
 	mux.Handle(authHandlerPath, authHandler)
+	computerController := controller.NewComputerController(computerService)
+	computerHandlerPath, computerHandler := computerv1connect.NewComputerServiceHandler(computerController, handlerOptions)
+	mux.Handle(computerHandlerPath, computerHandler)
+	terminalController := controller.NewTerminalController(terminalService)
+	terminalHandlerPath, terminalHandler := terminalv1connect.NewTerminalServiceHandler(terminalController, handlerOptions)
+	mux.Handle(terminalHandlerPath, terminalHandler)
+	metricsController := controller.NewMetricsController(metricsService)
+	metricsHandlerPath, metricsHandler := metricsv1connect.NewMetricsServiceHandler(metricsController, handlerOptions)
+	mux.Handle(metricsHandlerPath, metricsHandler)
+	logController := controller.NewLogController(logService)
+	logServiceHandlerPath, logServiceHandler := logv1connect.NewLogServiceHandler(logController, handlerOptions)
+	mux.Handle(logServiceHandlerPath, logServiceHandler)
+	peripheralController := controller.NewPeripheralController(peripheralService)
+	peripheralHandlerPath, peripheralHandler := peripheralv1connect.NewPeripheralServiceHandler(peripheralController, handlerOptions)
+	mux.Handle(peripheralHandlerPath, peripheralHandler)
+	luaController := controller.NewLuaController(luaService)
+	luaHandlerPath, luaHandler := luav1connect.NewLuaServiceHandler(luaController, handlerOptions)
+	mux.Handle(luaHandlerPath, luaHandler)
+	commandController := controller.NewCommandController(commandService)
+	commandHandlerPath, commandHandler := commandv1connect.NewCommandServiceHandler(commandController, handlerOptions)
+	mux.Handle(commandHandlerPath, commandHandler)
+	oidcConfig, groupRoles, err := oidcOptions()
+	if err != nil {
+		slog.Error("invalid OIDC configuration", "err", err)
+		return
+	}
+	if oidcConfig != nil {
+		oidcHandler := oidc.NewHandler(*oidcConfig, service.NewOIDCSessions(userService, groupRoles, auditService))
+		mux.HandleFunc("/oidc/login", oidcHandler.Login)
+		mux.HandleFunc("/oidc/callback", oidcHandler.Callback)
+	}
+	userController := controller.NewUserController(userService, oidcConfig != nil)
+	userHandlerPath, userHandler := userv1connect.NewUserServiceHandler(userController, handlerOptions)
+	mux.Handle(userHandlerPath, userHandler)
+	enrollmentController := controller.NewEnrollmentController(enrollmentService)
+	enrollmentHandlerPath, enrollmentHandler := enrollmentv1connect.NewEnrollmentServiceHandler(enrollmentController, handlerOptions)
+	mux.Handle(enrollmentHandlerPath, enrollmentHandler)
+	auditController := controller.NewAuditController(auditService)
+	auditHandlerPath, auditHandler := auditv1connect.NewAuditServiceHandler(auditController, handlerOptions)
+	mux.Handle(auditHandlerPath, auditHandler)
 
 	srv := &http.Server{
 		Addr:              ":8080",
@@ -75,13 +218,94 @@ func main() {
 	}
 }
 
+// metricsStoreOptions reads the embedded metrics store's resolution and
+// retention from CCGUI_METRICS_RESOLUTION and CCGUI_METRICS_RETENTION, as Go
+// durations.
+func metricsStoreOptions() (service.MetricsStoreOptions, error) {
+	opts := service.MetricsStoreOptions{
+		Resolution: time.Minute,
+		Retention:  7 * 24 * time.Hour,
+	}
+	if value := os.Getenv("CCGUI_METRICS_RESOLUTION"); value != "" {
+		resolution, err := time.ParseDuration(value)
+		if err != nil || resolution <= 0 {
+			return opts, fmt.Errorf("CCGUI_METRICS_RESOLUTION must be a positive duration, got %q", value)
+		}
+		opts.Resolution = resolution
+	}
+	if value := os.Getenv("CCGUI_METRICS_RETENTION"); value != "" {
+		retention, err := time.ParseDuration(value)
+		if err != nil || retention < 0 {
+			return opts, fmt.Errorf("CCGUI_METRICS_RETENTION must be a non-negative duration, got %q", value)
+		}
+		opts.Retention = retention
+	}
+	return opts, nil
+}
+
+// oidcOptions reads how to sign users in with an OpenID Connect provider
+// from CCGUI_OIDC_* variables, returning a nil config if CCGUI_OIDC_ISSUER is
+// unset. Groups in CCGUI_OIDC_ADMIN_GROUPS, CCGUI_OIDC_OPERATOR_GROUPS and
+// CCGUI_OIDC_VIEWER_GROUPS, separated by commas, get those roles; other users
+// get CCGUI_OIDC_DEFAULT_ROLE, or may not sign in if it is unset.
+func oidcOptions() (*oidc.Config, service.GroupRoles, error) {
+	var roles service.GroupRoles
+	issuer := os.Getenv("CCGUI_OIDC_ISSUER")
+	if issuer == "" {
+		return nil, roles, nil
+	}
+	config := &oidc.Config{
+		Issuer:       issuer,
+		ClientID:     os.Getenv("CCGUI_OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("CCGUI_OIDC_CLIENT_SECRET"),
+		RedirectURL:  envOr("CCGUI_OIDC_REDIRECT_URL", "http://localhost:8080/oidc/callback"),
+		Scopes:       strings.Fields(envOr("CCGUI_OIDC_SCOPES", "openid profile email")),
+		GroupsClaim:  envOr("CCGUI_OIDC_GROUPS_CLAIM", "groups"),
+		FrontendURL:  envOr("CCGUI_OIDC_FRONTEND_URL", "http://localhost:5173/"),
+	}
+	if config.ClientID == "" {
+		return nil, roles, fmt.Errorf("CCGUI_OIDC_CLIENT_ID is required with CCGUI_OIDC_ISSUER")
+	}
+	if !slices.Contains(config.Scopes, "openid") {
+		return nil, roles, fmt.Errorf("CCGUI_OIDC_SCOPES must include openid, got %q", os.Getenv("CCGUI_OIDC_SCOPES"))
+	}
+	roles.Admins = splitList(os.Getenv("CCGUI_OIDC_ADMIN_GROUPS"))
+	roles.Operators = splitList(os.Getenv("CCGUI_OIDC_OPERATOR_GROUPS"))
+	roles.Viewers = splitList(os.Getenv("CCGUI_OIDC_VIEWER_GROUPS"))
+	if value := os.Getenv("CCGUI_OIDC_DEFAULT_ROLE"); value != "" {
+		roles.Default = service.Role(value)
+		if len(service.RoleScopes(roles.Default)) == 0 {
+			return nil, roles, fmt.Errorf("CCGUI_OIDC_DEFAULT_ROLE must be viewer, operator or admin, got %q", value)
+		}
+	}
+	return config, roles, nil
+}
+
+func envOr(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for item := range strings.SplitSeq(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func withCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
 		w.Header().Set(
 			"Access-Control-Allow-Headers",
-			"Content-Type, Connect-Protocol-Version, Connect-Timeout-Ms, Connect-Accept-Encoding, Authorization",
+			"Content-Type, Connect-Protocol-Version, Connect-Timeout-Ms, Connect-Accept-Encoding, Authorization, Traceparent",
 		)
 
 		if r.Method == http.MethodOptions {
@@ -110,6 +334,12 @@ func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	return hijacker.Hijack()
 }
 
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 func withLogging(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -0,0 +1,102 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"connectrpc.com/connect"
+	auditv1 "ehedges.net/ccgui/backend/gen/audit/v1"
+	authv1 "ehedges.net/ccgui/backend/gen/auth/v1"
+	commandv1 "ehedges.net/ccgui/backend/gen/command/v1"
+	computerv1 "ehedges.net/ccgui/backend/gen/computer/v1"
+	enrollmentv1 "ehedges.net/ccgui/backend/gen/enrollment/v1"
+	userv1 "ehedges.net/ccgui/backend/gen/user/v1"
+	"ehedges.net/ccgui/backend/internal/service"
+)
+
+type AuditController struct {
+	service service.AuditService
+}
+
+func NewAuditController(service service.AuditService) *AuditController {
+	return &AuditController{
+		service: service,
+	}
+}
+
+func (c *AuditController) ListAuditEvents(ctx context.Context, req *connect.Request[auditv1.ListAuditEventsRequest]) (*connect.Response[auditv1.ListAuditEventsResponse], error) {
+	response, err := c.service.List(ctx, req.Msg)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidAuditQuery) {
+			return nil, connect.NewError(connect.CodeInvalidArgument, err)
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	return connect.NewResponse(response), nil
+}
+
+// auditOutcome classifies the result of an audited call.
+func auditOutcome(err error) auditv1.AuditOutcome {
+	switch {
+	case err == nil:
+		return auditv1.AuditOutcome_AUDIT_OUTCOME_SUCCESS
+	case connect.CodeOf(err) == connect.CodeUnauthenticated, connect.CodeOf(err) == connect.CodePermissionDenied:
+		return auditv1.AuditOutcome_AUDIT_OUTCOME_DENIED
+	}
+	return auditv1.AuditOutcome_AUDIT_OUTCOME_FAILED
+}
+
+// auditTarget describes what an audited request acted on, given the request
+// and its response, which is nil if the call failed.
+func auditTarget(req any, resp any) string {
+	switch req := req.(type) {
+	case *authv1.GenerateKeyRequest:
+		if resp, ok := resp.(*authv1.GenerateKeyResponse); ok {
+			return "key:" + resp.GetKey().GetId()
+		}
+		return ""
+	case *authv1.DeleteKeyRequest:
+		return "key:" + req.GetId()
+	case *authv1.RotateKeyRequest:
+		return "key:" + req.GetId()
+	case *userv1.LoginRequest:
+		if resp, ok := resp.(*userv1.LoginResponse); ok {
+			return "user:" + resp.GetUser().GetId()
+		}
+		// Record who failed to log in by the username they gave.
+		return "username:" + req.GetUsername()
+	case *userv1.CreateUserRequest:
+		if resp, ok := resp.(*userv1.CreateUserResponse); ok {
+			return "user:" + resp.GetUser().GetId()
+		}
+		return ""
+	case *userv1.DeleteUserRequest:
+		return "user:" + req.GetId()
+	case *userv1.SetPasswordRequest:
+		return "user:" + req.GetId()
+	case interface{ GetComputerId() int32 }:
+		return fmt.Sprintf("computer:%d", req.GetComputerId())
+	case *computerv1.ForgetComputerRequest:
+		return fmt.Sprintf("computer:%d", req.GetId())
+	case *computerv1.SetComputerTagsRequest:
+		return fmt.Sprintf("computer:%d", req.GetId())
+	case *computerv1.PutGroupRequest:
+		return "group:" + req.GetName()
+	case *computerv1.DeleteGroupRequest:
+		return "group:" + req.GetName()
+	case *commandv1.SendCommandRequest:
+		return "command:" + req.GetName()
+	case *enrollmentv1.ApproveEnrollmentRequest:
+		if resp, ok := resp.(*enrollmentv1.ApproveEnrollmentResponse); ok {
+			return fmt.Sprintf("computer:%d", resp.GetEnrollment().GetComputerId())
+		}
+		return ""
+	case *enrollmentv1.DenyEnrollmentRequest:
+		if resp, ok := resp.(*enrollmentv1.DenyEnrollmentResponse); ok {
+			return fmt.Sprintf("computer:%d", resp.GetEnrollment().GetComputerId())
+		}
+		return "enrollment:" + req.GetId()
+	}
+	return ""
+}
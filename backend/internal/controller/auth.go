@@ -3,6 +3,7 @@ package controller
 import (
 	"context"
 	"errors"
+	"fmt"
 
 	"connectrpc.com/connect"
 	authv1 "ehedges.net/ccgui/backend/gen/auth/v1"
@@ -25,17 +26,40 @@ func (c *AuthController) GenerateKey(ctx context.Context, req *connect.Request[a
 		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("name is required"))
 	}
 
-	key, err := c.service.Generate(ctx, name)
+	opts := service.KeyOptions{
+		ComputerTags:   req.Msg.GetComputerTags(),
+		BindToComputer: req.Msg.GetBindToComputer(),
+	}
+	if req.Msg.GetExpiresAt() != nil {
+		if err := req.Msg.GetExpiresAt().CheckValid(); err != nil {
+			return nil, connect.NewError(connect.CodeInvalidArgument, err)
+		}
+		opts.ExpiresAt = req.Msg.GetExpiresAt().AsTime()
+	}
+	principal, _ := service.PrincipalFromContext(ctx)
+	for _, scope := range req.Msg.GetScopes() {
+		// Callers may not grant scopes they do not hold themselves.
+		if principal != nil && !principal.HasScope(service.Scope(scope)) {
+			return nil, connect.NewError(connect.CodePermissionDenied, fmt.Errorf("%s may not grant the %s scope", principal, scope))
+		}
+		opts.Scopes = append(opts.Scopes, service.Scope(scope))
+	}
+	for _, id := range req.Msg.GetComputerIds() {
+		opts.ComputerIDs = append(opts.ComputerIDs, int(id))
+	}
+
+	key, err := c.service.Generate(ctx, name, opts)
 	if err != nil {
+		if errors.Is(err, service.ErrInvalidScope) || errors.Is(err, service.ErrInvalidComputerID) ||
+			errors.Is(err, service.ErrInvalidTag) || errors.Is(err, service.ErrInvalidExpiry) ||
+			errors.Is(err, service.ErrInvalidBinding) {
+			return nil, connect.NewError(connect.CodeInvalidArgument, err)
+		}
 		return nil, connect.NewError(connect.CodeInternal, err)
 	}
 
 	return connect.NewResponse(&authv1.GenerateKeyResponse{
-		Key: &authv1.Key{
-			Id:   key.Id,
-			Name: key.Name,
-			Key:  key.Key,
-		},
+		Key: key,
 	}), nil
 }
 
@@ -57,10 +81,7 @@ func (c *AuthController) DeleteKey(ctx context.Context, req *connect.Request[aut
 	}
 
 	return connect.NewResponse(&authv1.DeleteKeyResponse{
-		Summary: &authv1.KeySummary{
-			Id:   summary.Id,
-			Name: summary.Name,
-		},
+		Summary: summary,
 	}), nil
 }
 
@@ -74,3 +95,32 @@ func (c *AuthController) GetAllKeys(ctx context.Context, req *connect.Request[au
 		Keys: summaries,
 	}), nil
 }
+
+func (c *AuthController) RotateKey(ctx context.Context, req *connect.Request[authv1.RotateKeyRequest]) (*connect.Response[authv1.RotateKeyResponse], error) {
+	id := req.Msg.GetId()
+	if id == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("id is required"))
+	}
+	grace := service.DefaultRotationGrace
+	if req.Msg.GetGracePeriod() != nil {
+		if err := req.Msg.GetGracePeriod().CheckValid(); err != nil {
+			return nil, connect.NewError(connect.CodeInvalidArgument, err)
+		}
+		grace = req.Msg.GetGracePeriod().AsDuration()
+	}
+
+	key, err := c.service.Rotate(ctx, id, grace)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidKeyID) || errors.Is(err, service.ErrInvalidExpiry) {
+			return nil, connect.NewError(connect.CodeInvalidArgument, err)
+		}
+		if errors.Is(err, service.ErrKeyNotFound) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	return connect.NewResponse(&authv1.RotateKeyResponse{
+		Key: key,
+	}), nil
+}
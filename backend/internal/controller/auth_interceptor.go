@@ -0,0 +1,355 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"connectrpc.com/connect"
+	"ehedges.net/ccgui/backend/gen/audit/v1/auditv1connect"
+	"ehedges.net/ccgui/backend/gen/auth/v1/authv1connect"
+	commandv1 "ehedges.net/ccgui/backend/gen/command/v1"
+	"ehedges.net/ccgui/backend/gen/command/v1/commandv1connect"
+	computerv1 "ehedges.net/ccgui/backend/gen/computer/v1"
+	"ehedges.net/ccgui/backend/gen/computer/v1/computerv1connect"
+	"ehedges.net/ccgui/backend/gen/enrollment/v1/enrollmentv1connect"
+	"ehedges.net/ccgui/backend/gen/log/v1/logv1connect"
+	"ehedges.net/ccgui/backend/gen/lua/v1/luav1connect"
+	metricsv1 "ehedges.net/ccgui/backend/gen/metrics/v1"
+	"ehedges.net/ccgui/backend/gen/metrics/v1/metricsv1connect"
+	"ehedges.net/ccgui/backend/gen/peripheral/v1/peripheralv1connect"
+	terminalv1 "ehedges.net/ccgui/backend/gen/terminal/v1"
+	"ehedges.net/ccgui/backend/gen/terminal/v1/terminalv1connect"
+	userv1 "ehedges.net/ccgui/backend/gen/user/v1"
+	"ehedges.net/ccgui/backend/gen/user/v1/userv1connect"
+	"ehedges.net/ccgui/backend/internal/recording"
+	"ehedges.net/ccgui/backend/internal/service"
+)
+
+// procedureScopes are the scopes needed to call privileged procedures. Other
+// procedures only need the caller to authenticate.
+var procedureScopes = map[string]service.Scope{
+	authv1connect.AuthServiceGenerateKeyProcedure:                   service.ScopeKeysAdmin,
+	authv1connect.AuthServiceDeleteKeyProcedure:                     service.ScopeKeysAdmin,
+	authv1connect.AuthServiceGetAllKeysProcedure:                    service.ScopeKeysAdmin,
+	authv1connect.AuthServiceRotateKeyProcedure:                     service.ScopeKeysAdmin,
+	auditv1connect.AuditServiceListAuditEventsProcedure:             service.ScopeKeysAdmin,
+	userv1connect.UserServiceCreateUserProcedure:                    service.ScopeKeysAdmin,
+	userv1connect.UserServiceListUsersProcedure:                     service.ScopeKeysAdmin,
+	userv1connect.UserServiceDeleteUserProcedure:                    service.ScopeKeysAdmin,
+	computerv1connect.ComputerServiceListComputersProcedure:         service.ScopeTerminalView,
+	computerv1connect.ComputerServiceGetComputerProcedure:           service.ScopeTerminalView,
+	computerv1connect.ComputerServiceWatchComputersProcedure:        service.ScopeTerminalView,
+	computerv1connect.ComputerServiceListGroupsProcedure:            service.ScopeTerminalView,
+	logv1connect.LogServiceTailLogsProcedure:                        service.ScopeTerminalView,
+	metricsv1connect.MetricsServiceQueryMetricsProcedure:            service.ScopeTerminalView,
+	terminalv1connect.TerminalServiceListWindowsProcedure:           service.ScopeTerminalView,
+	terminalv1connect.TerminalServiceWatchTerminalProcedure:         service.ScopeTerminalView,
+	terminalv1connect.TerminalServiceListRecordingsProcedure:        service.ScopeTerminalView,
+	terminalv1connect.TerminalServiceReplaySessionProcedure:         service.ScopeTerminalView,
+	terminalv1connect.TerminalServiceSendInputProcedure:             service.ScopeTerminalInput,
+	peripheralv1connect.PeripheralServiceListPeripheralsProcedure:   service.ScopePeripheralCall,
+	peripheralv1connect.PeripheralServiceCallPeripheralProcedure:    service.ScopePeripheralCall,
+	luav1connect.LuaServiceExecuteLuaProcedure:                      service.ScopeLuaExec,
+	commandv1connect.CommandServiceSendCommandProcedure:             service.ScopeCommandSend,
+	computerv1connect.ComputerServiceForgetComputerProcedure:        service.ScopeComputerAdmin,
+	computerv1connect.ComputerServiceSetComputerTagsProcedure:       service.ScopeComputerAdmin,
+	computerv1connect.ComputerServicePutGroupProcedure:              service.ScopeComputerAdmin,
+	computerv1connect.ComputerServiceDeleteGroupProcedure:           service.ScopeComputerAdmin,
+	enrollmentv1connect.EnrollmentServiceListEnrollmentsProcedure:   service.ScopeComputerAdmin,
+	enrollmentv1connect.EnrollmentServiceApproveEnrollmentProcedure: service.ScopeComputerAdmin,
+	enrollmentv1connect.EnrollmentServiceDenyEnrollmentProcedure:    service.ScopeComputerAdmin,
+}
+
+// publicProcedures may be called without authenticating.
+var publicProcedures = map[string]bool{
+	userv1connect.UserServiceGetLoginOptionsProcedure: true,
+	userv1connect.UserServiceLoginProcedure:           true,
+}
+
+// auditedProcedures are the procedures recorded in the audit log: those that
+// sign users in or change keys, users or computers, or act on computers.
+var auditedProcedures = map[string]bool{
+	authv1connect.AuthServiceGenerateKeyProcedure:                   true,
+	authv1connect.AuthServiceDeleteKeyProcedure:                     true,
+	authv1connect.AuthServiceRotateKeyProcedure:                     true,
+	userv1connect.UserServiceLoginProcedure:                         true,
+	userv1connect.UserServiceCreateUserProcedure:                    true,
+	userv1connect.UserServiceDeleteUserProcedure:                    true,
+	userv1connect.UserServiceSetPasswordProcedure:                   true,
+	terminalv1connect.TerminalServiceSendInputProcedure:             true,
+	peripheralv1connect.PeripheralServiceCallPeripheralProcedure:    true,
+	luav1connect.LuaServiceExecuteLuaProcedure:                      true,
+	commandv1connect.CommandServiceSendCommandProcedure:             true,
+	computerv1connect.ComputerServiceForgetComputerProcedure:        true,
+	computerv1connect.ComputerServiceSetComputerTagsProcedure:       true,
+	computerv1connect.ComputerServicePutGroupProcedure:              true,
+	computerv1connect.ComputerServiceDeleteGroupProcedure:           true,
+	enrollmentv1connect.EnrollmentServiceApproveEnrollmentProcedure: true,
+	enrollmentv1connect.EnrollmentServiceDenyEnrollmentProcedure:    true,
+}
+
+type authInterceptor struct {
+	authorizer     *service.KeyAuthorizer
+	audit          service.AuditService
+	authenticators []service.Authenticator
+}
+
+// NewAuthInterceptor returns an interceptor that requires every RPC but
+// publicProcedures to carry a bearer token one of the authenticators
+// accepts, and the scope in
+// procedureScopes for privileged procedures, checking that the caller may
+// act on the computers each request is about. Callers restricted to some
+// computers only see those in lists and streams. The caller's principal is put
+// in the request context for controllers. Calls to auditedProcedures are
+// recorded in the audit log, whether they are allowed or not.
+func NewAuthInterceptor(authorizer *service.KeyAuthorizer, audit service.AuditService, authenticators ...service.Authenticator) connect.Interceptor {
+	return &authInterceptor{
+		authorizer:     authorizer,
+		audit:          audit,
+		authenticators: authenticators,
+	}
+}
+
+func (i *authInterceptor) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
+	return func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		if req.Spec().IsClient {
+			return next(ctx, req)
+		}
+		principal, resp, err := i.handleUnary(ctx, req, next)
+		if auditedProcedures[req.Spec().Procedure] {
+			var msg any
+			if err == nil {
+				msg = resp.Any()
+			}
+			i.audit.Record(ctx, service.AuditEvent{
+				Principal:  principal,
+				RemoteAddr: req.Peer().Addr,
+				Action:     req.Spec().Procedure,
+				Target:     auditTarget(req.Any(), msg),
+				Outcome:    auditOutcome(err),
+				Err:        err,
+			})
+		}
+		return resp, err
+	}
+}
+
+// handleUnary authenticates and authorizes a unary call before handling it,
+// returning the caller's principal if it authenticated.
+func (i *authInterceptor) handleUnary(ctx context.Context, req connect.AnyRequest, next connect.UnaryFunc) (*service.Principal, connect.AnyResponse, error) {
+	if publicProcedures[req.Spec().Procedure] {
+		resp, err := next(ctx, req)
+		if err != nil {
+			return nil, nil, err
+		}
+		// Users act as themselves once logged in.
+		if login, ok := resp.Any().(*userv1.LoginResponse); ok {
+			return service.UserPrincipal(login.GetUser()), resp, nil
+		}
+		return nil, resp, nil
+	}
+	principal, err := i.authenticate(ctx, req.Header())
+	if err != nil {
+		return nil, nil, err
+	}
+	if scope, ok := procedureScopes[req.Spec().Procedure]; ok {
+		if err := i.authorizeMessage(ctx, principal, scope, req.Any()); err != nil {
+			return principal, nil, err
+		}
+	}
+	resp, err := next(service.ContextWithPrincipal(ctx, principal), req)
+	if err != nil {
+		return principal, nil, err
+	}
+	if err := i.filterMessage(ctx, principal, resp.Any()); err != nil {
+		return principal, nil, err
+	}
+	return principal, resp, nil
+}
+
+func (i *authInterceptor) WrapStreamingClient(next connect.StreamingClientFunc) connect.StreamingClientFunc {
+	return next
+}
+
+func (i *authInterceptor) WrapStreamingHandler(next connect.StreamingHandlerFunc) connect.StreamingHandlerFunc {
+	return func(ctx context.Context, conn connect.StreamingHandlerConn) error {
+		principal, err := i.authenticate(ctx, conn.RequestHeader())
+		if err != nil {
+			return err
+		}
+		ctx = service.ContextWithPrincipal(ctx, principal)
+		scope, ok := procedureScopes[conn.Spec().Procedure]
+		if !ok {
+			return next(ctx, conn)
+		}
+		return next(ctx, &authorizedConn{
+			StreamingHandlerConn: conn,
+			authorize: func(msg any) error {
+				return i.authorizeMessage(ctx, principal, scope, msg)
+			},
+			visible: func(msg any) (bool, error) {
+				return i.visibleMessage(ctx, principal, msg)
+			},
+		})
+	}
+}
+
+// authorizedConn checks each message a streaming handler receives, and
+// drops those it sends that the caller may not see.
+type authorizedConn struct {
+	connect.StreamingHandlerConn
+	authorize func(msg any) error
+	visible   func(msg any) (bool, error)
+}
+
+func (c *authorizedConn) Receive(msg any) error {
+	if err := c.StreamingHandlerConn.Receive(msg); err != nil {
+		return err
+	}
+	return c.authorize(msg)
+}
+
+func (c *authorizedConn) Send(msg any) error {
+	visible, err := c.visible(msg)
+	if err != nil {
+		return err
+	}
+	if !visible {
+		return nil
+	}
+	return c.StreamingHandlerConn.Send(msg)
+}
+
+// authenticate returns the principal of the bearer token in header, trying
+// each authenticator in turn.
+func (i *authInterceptor) authenticate(ctx context.Context, header http.Header) (*service.Principal, error) {
+	token, ok := bearerToken(header)
+	if !ok {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("a bearer token is required"))
+	}
+	for _, authenticator := range i.authenticators {
+		principal, err := authenticator.Authenticate(ctx, token)
+		if err == nil {
+			return principal, nil
+		}
+		if !errors.Is(err, service.ErrUnauthenticated) {
+			return nil, connect.NewError(connect.CodeInternal, err)
+		}
+	}
+	return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("invalid bearer token"))
+}
+
+// authorizeMessage checks that principal may make the request msg to a procedure
+// needing scope, given the computers the request is about.
+func (i *authInterceptor) authorizeMessage(ctx context.Context, principal *service.Principal, scope service.Scope, msg any) error {
+	var err error
+	switch msg := msg.(type) {
+	case *metricsv1.QueryMetricsRequest:
+		if msg.ComputerId != nil {
+			err = i.authorizer.AuthorizeComputer(ctx, principal, scope, int(msg.GetComputerId()))
+		} else {
+			err = i.authorizer.AuthorizeListing(principal, scope)
+		}
+	case *computerv1.ListComputersRequest, *computerv1.WatchComputersRequest:
+		err = i.authorizer.AuthorizeListing(principal, scope)
+	case interface{ GetComputerId() int32 }:
+		err = i.authorizer.AuthorizeComputer(ctx, principal, scope, int(msg.GetComputerId()))
+	case *computerv1.GetComputerRequest:
+		err = i.authorizer.AuthorizeComputer(ctx, principal, scope, int(msg.GetId()))
+	case *computerv1.ForgetComputerRequest:
+		err = i.authorizer.AuthorizeComputer(ctx, principal, scope, int(msg.GetId()))
+	case *computerv1.SetComputerTagsRequest:
+		err = i.authorizer.AuthorizeComputer(ctx, principal, scope, int(msg.GetId()))
+	case *terminalv1.ReplaySessionRequest:
+		computerID, parseErr := recording.ComputerID(msg.GetRecordingId())
+		if parseErr != nil {
+			return connect.NewError(connect.CodeInvalidArgument, parseErr)
+		}
+		err = i.authorizer.AuthorizeComputer(ctx, principal, scope, computerID)
+	case *commandv1.SendCommandRequest:
+		target := msg.GetTarget()
+		selector := service.ComputerSelector{
+			Tags:   target.GetTags(),
+			Groups: target.GetGroups(),
+		}
+		for _, id := range target.GetComputerIds() {
+			selector.ComputerIDs = append(selector.ComputerIDs, int(id))
+		}
+		err = i.authorizer.AuthorizeSelection(ctx, principal, scope, target.GetAll(), selector)
+	default:
+		err = i.authorizer.Authorize(principal, scope)
+	}
+	if err != nil {
+		if errors.Is(err, service.ErrPermissionDenied) {
+			return connect.NewError(connect.CodePermissionDenied, err)
+		}
+		return connect.NewError(connect.CodeInternal, err)
+	}
+	return nil
+}
+
+// filterMessage removes the computers principal may not act on from a
+// response listing computers or their data.
+func (i *authInterceptor) filterMessage(ctx context.Context, principal *service.Principal, msg any) error {
+	if !principal.Restricted() {
+		return nil
+	}
+	// Several entries may be about the same computer.
+	allowed := make(map[int]bool)
+	allows := func(computerID int32) (bool, error) {
+		ok, seen := allowed[int(computerID)]
+		if !seen {
+			var err error
+			ok, err = i.authorizer.Allows(ctx, principal, int(computerID))
+			if err != nil {
+				return false, err
+			}
+			allowed[int(computerID)] = ok
+		}
+		return ok, nil
+	}
+	var err error
+	switch msg := msg.(type) {
+	case *computerv1.ListComputersResponse:
+		msg.Computers, err = filterAllowed(msg.Computers, func(computer *computerv1.Computer) (bool, error) {
+			return allows(computer.GetId())
+		})
+	case *metricsv1.QueryMetricsResponse:
+		msg.Series, err = filterAllowed(msg.Series, func(series *metricsv1.MetricSeries) (bool, error) {
+			return allows(series.GetComputerId())
+		})
+	}
+	if err != nil {
+		return connect.NewError(connect.CodeInternal, err)
+	}
+	return nil
+}
+
+// visibleMessage reports whether principal may see a message streamed to
+// it.
+func (i *authInterceptor) visibleMessage(ctx context.Context, principal *service.Principal, msg any) (bool, error) {
+	event, ok := msg.(*computerv1.WatchComputersResponse)
+	if !ok || !principal.Restricted() || event.GetEvent() == nil {
+		return true, nil
+	}
+	allowed, err := i.authorizer.Allows(ctx, principal, int(event.GetEvent().GetComputer().GetId()))
+	if err != nil {
+		return false, connect.NewError(connect.CodeInternal, err)
+	}
+	return allowed, nil
+}
+
+func filterAllowed[T any](items []T, allowed func(T) (bool, error)) ([]T, error) {
+	kept := items[:0]
+	for _, item := range items {
+		ok, err := allowed(item)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			kept = append(kept, item)
+		}
+	}
+	return kept, nil
+}
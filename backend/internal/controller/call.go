@@ -0,0 +1,34 @@
+package controller
+
+import (
+	"context"
+	"errors"
+
+	"connectrpc.com/connect"
+	"ehedges.net/ccgui/backend/internal/websocket"
+)
+
+// callError maps the error of a call to a computer to a Connect error.
+func callError(err error) error {
+	var callErr *websocket.CallError
+	switch {
+	case errors.Is(err, websocket.ErrComputerOffline):
+		return connect.NewError(connect.CodeUnavailable, err)
+	case errors.Is(err, context.DeadlineExceeded):
+		return connect.NewError(connect.CodeDeadlineExceeded, err)
+	case errors.Is(err, context.Canceled):
+		return connect.NewError(connect.CodeCanceled, err)
+	case errors.As(err, &callErr):
+		return connect.NewError(callErrorCode(callErr.Code), errors.New(callErr.Message))
+	}
+	return connect.NewError(connect.CodeInternal, err)
+}
+
+// callErrorCode maps the code of a computer's call error to a Connect code.
+func callErrorCode(code websocket.CallErrorCode) connect.Code {
+	var connectCode connect.Code
+	if err := connectCode.UnmarshalText([]byte(code)); err != nil {
+		return connect.CodeUnknown
+	}
+	return connectCode
+}
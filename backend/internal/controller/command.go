@@ -0,0 +1,35 @@
+package controller
+
+import (
+	"context"
+	"errors"
+
+	"connectrpc.com/connect"
+	commandv1 "ehedges.net/ccgui/backend/gen/command/v1"
+	"ehedges.net/ccgui/backend/internal/service"
+	"ehedges.net/ccgui/backend/internal/websocket"
+)
+
+type CommandController struct {
+	service service.CommandService
+}
+
+func NewCommandController(service service.CommandService) *CommandController {
+	return &CommandController{
+		service: service,
+	}
+}
+
+func (c *CommandController) SendCommand(ctx context.Context, req *connect.Request[commandv1.SendCommandRequest]) (*connect.Response[commandv1.SendCommandResponse], error) {
+	deliveries, err := c.service.Send(ctx, req.Msg.GetTarget(), req.Msg.GetName(), req.Msg.GetData())
+	if err != nil {
+		if errors.Is(err, websocket.ErrInvalidCommand) || errors.Is(err, service.ErrInvalidComputerID) {
+			return nil, connect.NewError(connect.CodeInvalidArgument, err)
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	return connect.NewResponse(&commandv1.SendCommandResponse{
+		Deliveries: deliveries,
+	}), nil
+}
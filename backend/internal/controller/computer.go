@@ -0,0 +1,154 @@
+package controller
+
+import (
+	"context"
+	"errors"
+
+	"connectrpc.com/connect"
+	computerv1 "ehedges.net/ccgui/backend/gen/computer/v1"
+	"ehedges.net/ccgui/backend/internal/service"
+)
+
+type ComputerController struct {
+	service service.ComputerService
+}
+
+func NewComputerController(service service.ComputerService) *ComputerController {
+	return &ComputerController{
+		service: service,
+	}
+}
+
+func (c *ComputerController) ListComputers(ctx context.Context, req *connect.Request[computerv1.ListComputersRequest]) (*connect.Response[computerv1.ListComputersResponse], error) {
+	// Read the sequence first so that a watcher resuming from it sees every
+	// change that could have been missed by the listing.
+	sequence := c.service.EventSequence()
+	computers, err := c.service.List(ctx, service.ComputerSelector{
+		Tags:   req.Msg.GetTags(),
+		Groups: req.Msg.GetGroups(),
+	})
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	return connect.NewResponse(&computerv1.ListComputersResponse{
+		Computers: computers,
+		Sequence:  sequence,
+	}), nil
+}
+
+func (c *ComputerController) GetComputer(ctx context.Context, req *connect.Request[computerv1.GetComputerRequest]) (*connect.Response[computerv1.GetComputerResponse], error) {
+	computer, err := c.service.Get(ctx, int(req.Msg.GetId()))
+	if err != nil {
+		return nil, computerError(err)
+	}
+
+	return connect.NewResponse(&computerv1.GetComputerResponse{
+		Computer: computer,
+	}), nil
+}
+
+func (c *ComputerController) ForgetComputer(ctx context.Context, req *connect.Request[computerv1.ForgetComputerRequest]) (*connect.Response[computerv1.ForgetComputerResponse], error) {
+	computer, err := c.service.Forget(ctx, int(req.Msg.GetId()))
+	if err != nil {
+		return nil, computerError(err)
+	}
+
+	return connect.NewResponse(&computerv1.ForgetComputerResponse{
+		Computer: computer,
+	}), nil
+}
+
+func (c *ComputerController) WatchComputers(ctx context.Context, req *connect.Request[computerv1.WatchComputersRequest], stream *connect.ServerStream[computerv1.WatchComputersResponse]) error {
+	replay, resync, events, unsubscribe := c.service.Watch(req.Msg.GetAfterSequence())
+	defer unsubscribe()
+
+	for i, event := range replay {
+		if err := stream.Send(&computerv1.WatchComputersResponse{
+			Event:  event,
+			Resync: resync && i == 0,
+		}); err != nil {
+			return err
+		}
+	}
+	if resync && len(replay) == 0 {
+		if err := stream.Send(&computerv1.WatchComputersResponse{Resync: true}); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-events:
+			if !ok {
+				return connect.NewError(connect.CodeUnavailable, errors.New("watcher fell behind; resume from the last received sequence"))
+			}
+			if err := stream.Send(&computerv1.WatchComputersResponse{Event: event}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *ComputerController) SetComputerTags(ctx context.Context, req *connect.Request[computerv1.SetComputerTagsRequest]) (*connect.Response[computerv1.SetComputerTagsResponse], error) {
+	computer, err := c.service.SetTags(ctx, int(req.Msg.GetId()), req.Msg.GetTags())
+	if err != nil {
+		return nil, computerError(err)
+	}
+
+	return connect.NewResponse(&computerv1.SetComputerTagsResponse{
+		Computer: computer,
+	}), nil
+}
+
+func (c *ComputerController) ListGroups(ctx context.Context, req *connect.Request[computerv1.ListGroupsRequest]) (*connect.Response[computerv1.ListGroupsResponse], error) {
+	groups, err := c.service.ListGroups(ctx)
+	if err != nil {
+		return nil, computerError(err)
+	}
+
+	return connect.NewResponse(&computerv1.ListGroupsResponse{
+		Groups: groups,
+	}), nil
+}
+
+func (c *ComputerController) PutGroup(ctx context.Context, req *connect.Request[computerv1.PutGroupRequest]) (*connect.Response[computerv1.PutGroupResponse], error) {
+	ids := make([]int, 0, len(req.Msg.GetComputerIds()))
+	for _, id := range req.Msg.GetComputerIds() {
+		ids = append(ids, int(id))
+	}
+	group, err := c.service.PutGroup(ctx, req.Msg.GetName(), req.Msg.GetDescription(), ids)
+	if err != nil {
+		return nil, computerError(err)
+	}
+
+	return connect.NewResponse(&computerv1.PutGroupResponse{
+		Group: group,
+	}), nil
+}
+
+func (c *ComputerController) DeleteGroup(ctx context.Context, req *connect.Request[computerv1.DeleteGroupRequest]) (*connect.Response[computerv1.DeleteGroupResponse], error) {
+	if req.Msg.GetName() == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("name is required"))
+	}
+	group, err := c.service.DeleteGroup(ctx, req.Msg.GetName())
+	if err != nil {
+		return nil, computerError(err)
+	}
+
+	return connect.NewResponse(&computerv1.DeleteGroupResponse{
+		Group: group,
+	}), nil
+}
+
+func computerError(err error) error {
+	if errors.Is(err, service.ErrInvalidComputerID) || errors.Is(err, service.ErrInvalidTag) {
+		return connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	if errors.Is(err, service.ErrComputerNotFound) || errors.Is(err, service.ErrGroupNotFound) {
+		return connect.NewError(connect.CodeNotFound, err)
+	}
+	return connect.NewError(connect.CodeInternal, err)
+}
@@ -0,0 +1,69 @@
+package controller
+
+import (
+	"context"
+	"errors"
+
+	"connectrpc.com/connect"
+	enrollmentv1 "ehedges.net/ccgui/backend/gen/enrollment/v1"
+	"ehedges.net/ccgui/backend/internal/service"
+)
+
+type EnrollmentController struct {
+	service service.EnrollmentService
+}
+
+func NewEnrollmentController(service service.EnrollmentService) *EnrollmentController {
+	return &EnrollmentController{
+		service: service,
+	}
+}
+
+func (c *EnrollmentController) ListEnrollments(ctx context.Context, req *connect.Request[enrollmentv1.ListEnrollmentsRequest]) (*connect.Response[enrollmentv1.ListEnrollmentsResponse], error) {
+	return connect.NewResponse(&enrollmentv1.ListEnrollmentsResponse{
+		Enrollments: c.service.List(ctx),
+	}), nil
+}
+
+func (c *EnrollmentController) ApproveEnrollment(ctx context.Context, req *connect.Request[enrollmentv1.ApproveEnrollmentRequest]) (*connect.Response[enrollmentv1.ApproveEnrollmentResponse], error) {
+	if req.Msg.GetCode() == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("code is required"))
+	}
+	principal, ok := service.PrincipalFromContext(ctx)
+	if !ok {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("not authenticated"))
+	}
+
+	response, err := c.service.Approve(ctx, principal, req.Msg.GetCode())
+	if err != nil {
+		return nil, enrollmentError(err)
+	}
+	return connect.NewResponse(response), nil
+}
+
+func (c *EnrollmentController) DenyEnrollment(ctx context.Context, req *connect.Request[enrollmentv1.DenyEnrollmentRequest]) (*connect.Response[enrollmentv1.DenyEnrollmentResponse], error) {
+	if req.Msg.GetId() == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("id is required"))
+	}
+
+	enrollment, err := c.service.Deny(ctx, req.Msg.GetId())
+	if err != nil {
+		return nil, enrollmentError(err)
+	}
+	return connect.NewResponse(&enrollmentv1.DenyEnrollmentResponse{
+		Enrollment: enrollment,
+	}), nil
+}
+
+func enrollmentError(err error) error {
+	if errors.Is(err, service.ErrEnrollmentNotFound) {
+		return connect.NewError(connect.CodeNotFound, err)
+	}
+	if errors.Is(err, service.ErrPermissionDenied) {
+		return connect.NewError(connect.CodePermissionDenied, err)
+	}
+	if errors.Is(err, service.ErrEnrollmentNotDelivered) {
+		return connect.NewError(connect.CodeUnavailable, err)
+	}
+	return connect.NewError(connect.CodeInternal, err)
+}
@@ -0,0 +1,17 @@
+package controller
+
+import (
+	"net/http"
+	"strings"
+)
+
+// bearerToken extracts the token from an "Authorization: Bearer" header.
+func bearerToken(header http.Header) (string, bool) {
+	const prefix = "Bearer "
+	authHeader := header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, prefix) {
+		return "", false
+	}
+	token := strings.TrimPrefix(authHeader, prefix)
+	return token, token != ""
+}
@@ -0,0 +1,40 @@
+package controller
+
+import (
+	"context"
+	"errors"
+
+	"connectrpc.com/connect"
+	logv1 "ehedges.net/ccgui/backend/gen/log/v1"
+	"ehedges.net/ccgui/backend/internal/service"
+)
+
+type LogController struct {
+	service service.LogService
+}
+
+func NewLogController(service service.LogService) *LogController {
+	return &LogController{
+		service: service,
+	}
+}
+
+func (c *LogController) TailLogs(ctx context.Context, req *connect.Request[logv1.TailLogsRequest]) (*connect.Response[logv1.TailLogsResponse], error) {
+	records, sequence, err := c.service.Tail(
+		int(req.Msg.GetComputerId()),
+		int(req.Msg.GetLimit()),
+		req.Msg.GetAfterSequence(),
+		req.Msg.GetMinLevel(),
+	)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidComputerID) {
+			return nil, connect.NewError(connect.CodeInvalidArgument, err)
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	return connect.NewResponse(&logv1.TailLogsResponse{
+		Records:  records,
+		Sequence: sequence,
+	}), nil
+}
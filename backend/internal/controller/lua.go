@@ -0,0 +1,31 @@
+package controller
+
+import (
+	"context"
+	"errors"
+
+	"connectrpc.com/connect"
+	luav1 "ehedges.net/ccgui/backend/gen/lua/v1"
+	"ehedges.net/ccgui/backend/internal/service"
+)
+
+type LuaController struct {
+	service service.LuaService
+}
+
+func NewLuaController(service service.LuaService) *LuaController {
+	return &LuaController{
+		service: service,
+	}
+}
+
+func (c *LuaController) ExecuteLua(ctx context.Context, req *connect.Request[luav1.ExecuteLuaRequest]) (*connect.Response[luav1.ExecuteLuaResponse], error) {
+	response, err := c.service.Execute(ctx, int(req.Msg.GetComputerId()), req.Msg.GetCode(), req.Msg.GetTimeout().AsDuration())
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidComputerID) || errors.Is(err, service.ErrInvalidLuaChunk) {
+			return nil, connect.NewError(connect.CodeInvalidArgument, err)
+		}
+		return nil, callError(err)
+	}
+	return connect.NewResponse(response), nil
+}
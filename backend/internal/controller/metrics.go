@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"context"
+	"errors"
+
+	"connectrpc.com/connect"
+	metricsv1 "ehedges.net/ccgui/backend/gen/metrics/v1"
+	"ehedges.net/ccgui/backend/internal/service"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+type MetricsController struct {
+	service service.MetricsService
+}
+
+func NewMetricsController(service service.MetricsService) *MetricsController {
+	return &MetricsController{
+		service: service,
+	}
+}
+
+func (c *MetricsController) QueryMetrics(ctx context.Context, req *connect.Request[metricsv1.QueryMetricsRequest]) (*connect.Response[metricsv1.QueryMetricsResponse], error) {
+	query := service.MetricsQuery{
+		Name: req.Msg.GetName(),
+		Computers: service.ComputerSelector{
+			Tags:   req.Msg.GetComputerTags(),
+			Groups: req.Msg.GetComputerGroups(),
+		},
+		Labels: req.Msg.GetLabels(),
+	}
+	if req.Msg.ComputerId != nil {
+		computerID := int(req.Msg.GetComputerId())
+		query.ComputerID = &computerID
+	}
+	if req.Msg.Start != nil {
+		query.Start = req.Msg.GetStart().AsTime()
+	}
+	if req.Msg.End != nil {
+		query.End = req.Msg.GetEnd().AsTime()
+	}
+	if req.Msg.Step != nil {
+		query.Step = req.Msg.GetStep().AsDuration()
+	}
+	series, step, err := c.service.Query(ctx, query)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidMetricsQuery) || errors.Is(err, service.ErrInvalidComputerID) {
+			return nil, connect.NewError(connect.CodeInvalidArgument, err)
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	return connect.NewResponse(&metricsv1.QueryMetricsResponse{
+		Series: series,
+		Step:   durationpb.New(step),
+	}), nil
+}
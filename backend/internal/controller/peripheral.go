@@ -0,0 +1,48 @@
+package controller
+
+import (
+	"context"
+	"errors"
+
+	"connectrpc.com/connect"
+	peripheralv1 "ehedges.net/ccgui/backend/gen/peripheral/v1"
+	"ehedges.net/ccgui/backend/internal/service"
+)
+
+type PeripheralController struct {
+	service service.PeripheralService
+}
+
+func NewPeripheralController(service service.PeripheralService) *PeripheralController {
+	return &PeripheralController{
+		service: service,
+	}
+}
+
+func (c *PeripheralController) ListPeripherals(ctx context.Context, req *connect.Request[peripheralv1.ListPeripheralsRequest]) (*connect.Response[peripheralv1.ListPeripheralsResponse], error) {
+	peripherals, err := c.service.List(ctx, int(req.Msg.GetComputerId()))
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidComputerID) || errors.Is(err, service.ErrInvalidPeripheralCall) {
+			return nil, connect.NewError(connect.CodeInvalidArgument, err)
+		}
+		return nil, callError(err)
+	}
+
+	return connect.NewResponse(&peripheralv1.ListPeripheralsResponse{
+		Peripherals: peripherals,
+	}), nil
+}
+
+func (c *PeripheralController) CallPeripheral(ctx context.Context, req *connect.Request[peripheralv1.CallPeripheralRequest]) (*connect.Response[peripheralv1.CallPeripheralResponse], error) {
+	results, err := c.service.Call(ctx, int(req.Msg.GetComputerId()), req.Msg.GetName(), req.Msg.GetMethod(), req.Msg.GetArgs())
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidComputerID) || errors.Is(err, service.ErrInvalidPeripheralCall) {
+			return nil, connect.NewError(connect.CodeInvalidArgument, err)
+		}
+		return nil, callError(err)
+	}
+
+	return connect.NewResponse(&peripheralv1.CallPeripheralResponse{
+		Results: results,
+	}), nil
+}
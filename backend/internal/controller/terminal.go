@@ -0,0 +1,149 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"connectrpc.com/connect"
+	terminalv1 "ehedges.net/ccgui/backend/gen/terminal/v1"
+	"ehedges.net/ccgui/backend/internal/recording"
+	"ehedges.net/ccgui/backend/internal/service"
+	"ehedges.net/ccgui/backend/internal/websocket"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type TerminalController struct {
+	service service.TerminalService
+}
+
+func NewTerminalController(service service.TerminalService) *TerminalController {
+	return &TerminalController{
+		service: service,
+	}
+}
+
+func (c *TerminalController) ListWindows(ctx context.Context, req *connect.Request[terminalv1.ListWindowsRequest]) (*connect.Response[terminalv1.ListWindowsResponse], error) {
+	windows, err := c.service.ListWindows(ctx, int(req.Msg.GetComputerId()))
+	if err != nil {
+		if errors.Is(err, service.ErrTerminalNotFound) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	return connect.NewResponse(&terminalv1.ListWindowsResponse{
+		Windows: windows,
+	}), nil
+}
+
+func (c *TerminalController) WatchTerminal(ctx context.Context, req *connect.Request[terminalv1.WatchTerminalRequest], stream *connect.ServerStream[terminalv1.WatchTerminalResponse]) error {
+	if req.Msg.GetComputerId() < 0 {
+		return connect.NewError(connect.CodeInvalidArgument, service.ErrInvalidComputerID)
+	}
+	snapshot, updates, unsubscribe := c.service.Watch(int(req.Msg.GetComputerId()), req.Msg.WindowId)
+	defer unsubscribe()
+
+	for _, packet := range snapshot {
+		if err := stream.Send(packet); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case packet, ok := <-updates:
+			if !ok {
+				return connect.NewError(connect.CodeUnavailable, errors.New("viewer fell behind; reconnect for a fresh screen"))
+			}
+			if err := stream.Send(packet); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *TerminalController) SendInput(ctx context.Context, req *connect.Request[terminalv1.SendInputRequest]) (*connect.Response[terminalv1.SendInputResponse], error) {
+	if len(req.Msg.GetEvents()) == 0 {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("events are required"))
+	}
+
+	err := c.service.SendInput(ctx, int(req.Msg.GetComputerId()), req.Msg.GetWindowId(), req.Msg.GetEvents())
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidInput) {
+			return nil, connect.NewError(connect.CodeInvalidArgument, err)
+		}
+		if errors.Is(err, service.ErrTerminalNotFound) || errors.Is(err, service.ErrWindowNotFound) {
+			return nil, connect.NewError(connect.CodeNotFound, err)
+		}
+		if errors.Is(err, websocket.ErrComputerOffline) {
+			return nil, connect.NewError(connect.CodeUnavailable, err)
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	return connect.NewResponse(&terminalv1.SendInputResponse{}), nil
+}
+
+func (c *TerminalController) ListRecordings(ctx context.Context, req *connect.Request[terminalv1.ListRecordingsRequest]) (*connect.Response[terminalv1.ListRecordingsResponse], error) {
+	if req.Msg.GetComputerId() < 0 {
+		return nil, connect.NewError(connect.CodeInvalidArgument, service.ErrInvalidComputerID)
+	}
+	infos, err := c.service.ListRecordings(ctx, int(req.Msg.GetComputerId()))
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	recordings := make([]*terminalv1.Recording, 0, len(infos))
+	for _, info := range infos {
+		recordings = append(recordings, &terminalv1.Recording{
+			Id:         info.ID,
+			ComputerId: int32(info.ComputerID),
+			StartedAt:  timestamppb.New(info.StartedAt),
+			EndedAt:    timestamppb.New(info.EndedAt),
+			Size:       uint64(info.Size),
+			Active:     info.Active,
+		})
+	}
+	return connect.NewResponse(&terminalv1.ListRecordingsResponse{
+		Recordings: recordings,
+	}), nil
+}
+
+func (c *TerminalController) ReplaySession(ctx context.Context, req *connect.Request[terminalv1.ReplaySessionRequest], stream *connect.ServerStream[terminalv1.ReplaySessionResponse]) error {
+	var from time.Duration
+	if req.Msg.GetStartOffset() != nil {
+		if err := req.Msg.GetStartOffset().CheckValid(); err != nil {
+			return connect.NewError(connect.CodeInvalidArgument, err)
+		}
+		from = req.Msg.GetStartOffset().AsDuration()
+	}
+
+	err := c.service.Replay(ctx, req.Msg.GetRecordingId(), req.Msg.GetSpeed(), from, func(offset time.Duration, update *terminalv1.WatchTerminalResponse) error {
+		return stream.Send(&terminalv1.ReplaySessionResponse{
+			Offset: durationpb.New(offset),
+			Update: update,
+		})
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		var connectErr *connect.Error
+		switch {
+		case errors.As(err, &connectErr):
+			return err
+		case errors.Is(err, service.ErrInvalidReplay), errors.Is(err, recording.ErrInvalidID):
+			return connect.NewError(connect.CodeInvalidArgument, err)
+		case errors.Is(err, recording.ErrNotFound):
+			return connect.NewError(connect.CodeNotFound, err)
+		case errors.Is(err, recording.ErrCorrupt):
+			return connect.NewError(connect.CodeDataLoss, err)
+		}
+		return connect.NewError(connect.CodeInternal, err)
+	}
+	return nil
+}
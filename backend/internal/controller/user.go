@@ -0,0 +1,191 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"connectrpc.com/connect"
+	userv1 "ehedges.net/ccgui/backend/gen/user/v1"
+	"ehedges.net/ccgui/backend/internal/service"
+)
+
+type UserController struct {
+	service     service.UserService
+	oidcEnabled bool
+}
+
+// NewUserController returns a controller for service. oidcEnabled says
+// whether users may also sign in with an OpenID Connect provider.
+func NewUserController(service service.UserService, oidcEnabled bool) *UserController {
+	return &UserController{
+		service:     service,
+		oidcEnabled: oidcEnabled,
+	}
+}
+
+func (c *UserController) GetLoginOptions(ctx context.Context, req *connect.Request[userv1.GetLoginOptionsRequest]) (*connect.Response[userv1.GetLoginOptionsResponse], error) {
+	return connect.NewResponse(&userv1.GetLoginOptionsResponse{
+		OidcEnabled: c.oidcEnabled,
+	}), nil
+}
+
+func (c *UserController) Login(ctx context.Context, req *connect.Request[userv1.LoginRequest]) (*connect.Response[userv1.LoginResponse], error) {
+	if req.Msg.GetUsername() == "" || req.Msg.GetPassword() == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("username and password are required"))
+	}
+
+	response, err := c.service.Login(ctx, req.Msg.GetUsername(), req.Msg.GetPassword(), req.Peer().Addr)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidCredentials) {
+			return nil, connect.NewError(connect.CodeUnauthenticated, err)
+		}
+		if errors.Is(err, service.ErrTooManyLogins) {
+			return nil, connect.NewError(connect.CodeResourceExhausted, err)
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	return connect.NewResponse(response), nil
+}
+
+func (c *UserController) Logout(ctx context.Context, req *connect.Request[userv1.LogoutRequest]) (*connect.Response[userv1.LogoutResponse], error) {
+	principal, ok := service.PrincipalFromContext(ctx)
+	token, hasToken := bearerToken(req.Header())
+	if !ok || principal.UserID == "" || !hasToken {
+		return nil, connect.NewError(connect.CodeFailedPrecondition, errors.New("only sessions can be logged out"))
+	}
+
+	if err := c.service.Logout(ctx, token); err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	return connect.NewResponse(&userv1.LogoutResponse{}), nil
+}
+
+func (c *UserController) WhoAmI(ctx context.Context, req *connect.Request[userv1.WhoAmIRequest]) (*connect.Response[userv1.WhoAmIResponse], error) {
+	principal, ok := service.PrincipalFromContext(ctx)
+	if !ok {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("not authenticated"))
+	}
+
+	response := &userv1.WhoAmIResponse{
+		KeyId:        principal.KeyID,
+		Name:         principal.Name,
+		ComputerTags: principal.ComputerTags,
+	}
+	for _, scope := range principal.Scopes {
+		response.Scopes = append(response.Scopes, string(scope))
+	}
+	for _, id := range principal.ComputerIDs {
+		response.ComputerIds = append(response.ComputerIds, int32(id))
+	}
+	if principal.UserID != "" {
+		user, err := c.service.Get(ctx, principal.UserID)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInternal, err)
+		}
+		response.User = user
+	}
+	return connect.NewResponse(response), nil
+}
+
+func (c *UserController) CreateUser(ctx context.Context, req *connect.Request[userv1.CreateUserRequest]) (*connect.Response[userv1.CreateUserResponse], error) {
+	role, err := service.RoleFromProto(req.Msg.GetRole())
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	principal, _ := service.PrincipalFromContext(ctx)
+	for _, scope := range service.RoleScopes(role) {
+		// Callers may not grant scopes they do not hold themselves.
+		if principal != nil && !principal.HasScope(scope) {
+			return nil, connect.NewError(connect.CodePermissionDenied, fmt.Errorf("%s may not grant the %s role", principal, role))
+		}
+	}
+
+	user, err := c.service.Create(ctx, req.Msg.GetUsername(), req.Msg.GetPassword(), role)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidUsername) || errors.Is(err, service.ErrInvalidPassword) ||
+			errors.Is(err, service.ErrInvalidRole) {
+			return nil, connect.NewError(connect.CodeInvalidArgument, err)
+		}
+		if errors.Is(err, service.ErrUserExists) {
+			return nil, connect.NewError(connect.CodeAlreadyExists, err)
+		}
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	return connect.NewResponse(&userv1.CreateUserResponse{
+		User: user,
+	}), nil
+}
+
+func (c *UserController) ListUsers(ctx context.Context, req *connect.Request[userv1.ListUsersRequest]) (*connect.Response[userv1.ListUsersResponse], error) {
+	users, err := c.service.List(ctx)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	return connect.NewResponse(&userv1.ListUsersResponse{
+		Users: users,
+	}), nil
+}
+
+func (c *UserController) DeleteUser(ctx context.Context, req *connect.Request[userv1.DeleteUserRequest]) (*connect.Response[userv1.DeleteUserResponse], error) {
+	id := req.Msg.GetId()
+	if id == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("id is required"))
+	}
+
+	user, err := c.service.Delete(ctx, id)
+	if err != nil {
+		return nil, userError(err)
+	}
+	return connect.NewResponse(&userv1.DeleteUserResponse{
+		User: user,
+	}), nil
+}
+
+func (c *UserController) SetPassword(ctx context.Context, req *connect.Request[userv1.SetPasswordRequest]) (*connect.Response[userv1.SetPasswordResponse], error) {
+	id := req.Msg.GetId()
+	if id == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("id is required"))
+	}
+	principal, ok := service.PrincipalFromContext(ctx)
+	if !ok {
+		return nil, connect.NewError(connect.CodeUnauthenticated, errors.New("not authenticated"))
+	}
+	if principal.UserID == id {
+		// Users changing their own password must know it, so a stolen
+		// session cannot take over the account.
+		if err := c.service.CheckPassword(ctx, id, req.Msg.GetCurrentPassword()); err != nil {
+			if errors.Is(err, service.ErrInvalidCredentials) {
+				return nil, connect.NewError(connect.CodePermissionDenied, errors.New("current password is incorrect"))
+			}
+			if errors.Is(err, service.ErrExternalUser) {
+				return nil, connect.NewError(connect.CodeFailedPrecondition, err)
+			}
+			return nil, userError(err)
+		}
+	} else if !principal.HasScope(service.ScopeKeysAdmin) || principal.Restricted() {
+		return nil, connect.NewError(connect.CodePermissionDenied, fmt.Errorf("%s may not set other users' passwords", principal))
+	}
+
+	if err := c.service.SetPassword(ctx, id, req.Msg.GetNewPassword()); err != nil {
+		if errors.Is(err, service.ErrInvalidPassword) {
+			return nil, connect.NewError(connect.CodeInvalidArgument, err)
+		}
+		if errors.Is(err, service.ErrExternalUser) {
+			return nil, connect.NewError(connect.CodeFailedPrecondition, err)
+		}
+		return nil, userError(err)
+	}
+	return connect.NewResponse(&userv1.SetPasswordResponse{}), nil
+}
+
+// userError maps errors about looking up a user to connect errors.
+func userError(err error) error {
+	if errors.Is(err, service.ErrInvalidUserID) {
+		return connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	if errors.Is(err, service.ErrUserNotFound) {
+		return connect.NewError(connect.CodeNotFound, err)
+	}
+	return connect.NewError(connect.CodeInternal, err)
+}
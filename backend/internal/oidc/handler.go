@@ -0,0 +1,233 @@
+package oidc
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	stateCookie = "ccgui_oidc_state"
+	// loginTimeout is how long users have to sign in with the provider.
+	loginTimeout = 10 * time.Minute
+)
+
+// Identity is a user the provider signed in.
+type Identity struct {
+	Issuer  string
+	Subject string
+	// Username is the user's preferred username, or their email address or
+	// subject if the provider did not give one.
+	Username string
+	Groups   []string
+}
+
+// SessionIssuer starts sessions for users the provider signs in.
+type SessionIssuer interface {
+	// IssueSession returns a session token for identity, or an error saying
+	// why they may not sign in.
+	IssueSession(ctx context.Context, identity Identity, remoteAddr string) (string, error)
+}
+
+// pendingLogin is a sign-in in progress. It is kept in the browser that
+// started it, in a cookie sealed with the handler's key, so the server keeps
+// nothing for sign-ins anyone may start.
+type pendingLogin struct {
+	State    string `json:"s"`
+	Verifier string `json:"v"`
+	Nonce    string `json:"n"`
+	Expires  int64  `json:"e"`
+}
+
+// Handler serves the endpoints users sign in through: Login sends them to
+// the provider, which sends them back to Callback.
+type Handler struct {
+	config   Config
+	provider *provider
+	sessions SessionIssuer
+	// cookies seals pending logins. Its key is made on start, so sign-ins
+	// in progress fail across restarts.
+	cookies cipher.AEAD
+}
+
+func NewHandler(config Config, sessions SessionIssuer) *Handler {
+	key := make([]byte, 32)
+	rand.Read(key)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	cookies, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return &Handler{
+		config:   config,
+		provider: newProvider(config),
+		sessions: sessions,
+		cookies:  cookies,
+	}
+}
+
+// Login starts signing a user in, redirecting them to the provider.
+func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
+	login := pendingLogin{
+		State:    randomString(),
+		Verifier: randomString(),
+		Nonce:    randomString(),
+		Expires:  time.Now().Add(loginTimeout).Unix(),
+	}
+	challenge := sha256.Sum256([]byte(login.Verifier))
+	authURL, err := h.provider.authCodeURL(r.Context(), login.State, login.Nonce, base64.RawURLEncoding.EncodeToString(challenge[:]))
+	if err != nil {
+		slog.Error("failed to start OIDC login", "err", err)
+		http.Error(w, "the identity provider is unavailable", http.StatusBadGateway)
+		return
+	}
+	sealed, err := h.seal(login)
+	if err != nil {
+		slog.Error("failed to start OIDC login", "err", err)
+		http.Error(w, "failed to start signing in", http.StatusInternalServerError)
+		return
+	}
+	// The login is kept in a cookie, so only the browser that started
+	// signing in can finish.
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookie,
+		Value:    sealed,
+		Path:     "/oidc",
+		MaxAge:   int(loginTimeout / time.Second),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(h.config.RedirectURL, "https:"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// Callback finishes signing a user in, redirecting them to the frontend with
+// their session token, or the reason they could not sign in.
+func (h *Handler) Callback(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: stateCookie, Path: "/oidc", MaxAge: -1})
+	query := r.URL.Query()
+	if providerErr := query.Get("error"); providerErr != "" {
+		if description := query.Get("error_description"); description != "" {
+			providerErr = description
+		}
+		h.finish(w, r, url.Values{"login_error": {providerErr}})
+		return
+	}
+	state := query.Get("state")
+	cookie, err := r.Cookie(stateCookie)
+	if err != nil {
+		h.finish(w, r, url.Values{"login_error": {"the sign-in was started in another browser"}})
+		return
+	}
+	login, err := h.open(cookie.Value)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(login.State), []byte(state)) != 1 {
+		h.finish(w, r, url.Values{"login_error": {"the sign-in was started in another browser"}})
+		return
+	}
+	if time.Now().Unix() > login.Expires {
+		h.finish(w, r, url.Values{"login_error": {"the sign-in expired; try again"}})
+		return
+	}
+
+	claims, err := h.provider.exchange(r.Context(), query.Get("code"), login.Verifier, login.Nonce)
+	if err != nil {
+		slog.Warn("OIDC login failed", "err", err)
+		h.finish(w, r, url.Values{"login_error": {"the identity provider's response could not be verified"}})
+		return
+	}
+	identity := Identity{
+		Issuer:   h.config.Issuer,
+		Subject:  claims.Subject,
+		Username: claims.PreferredUsername,
+		Groups:   stringsClaim(claims.Raw[h.config.GroupsClaim]),
+	}
+	if identity.Username == "" {
+		identity.Username = claims.Email
+	}
+	if identity.Username == "" {
+		identity.Username = claims.Subject
+	}
+	token, err := h.sessions.IssueSession(r.Context(), identity, r.RemoteAddr)
+	if err != nil {
+		slog.Warn("OIDC user may not sign in", "subject", identity.Subject, "username", identity.Username, "err", err)
+		h.finish(w, r, url.Values{"login_error": {err.Error()}})
+		return
+	}
+	h.finish(w, r, url.Values{"session": {token}})
+}
+
+// finish sends the user to the frontend with params in the URL fragment,
+// which browsers do not send to servers.
+func (h *Handler) finish(w http.ResponseWriter, r *http.Request, params url.Values) {
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	http.Redirect(w, r, h.config.FrontendURL+"#"+params.Encode(), http.StatusFound)
+}
+
+// seal encrypts and authenticates login for a cookie.
+func (h *Handler) seal(login pendingLogin) (string, error) {
+	plaintext, err := json.Marshal(login)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, h.cookies.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(h.cookies.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+// open returns the login sealed in a cookie.
+func (h *Handler) open(sealed string) (pendingLogin, error) {
+	var login pendingLogin
+	data, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil {
+		return login, err
+	}
+	if len(data) < h.cookies.NonceSize() {
+		return login, errors.New("sealed login too short")
+	}
+	nonce, ciphertext := data[:h.cookies.NonceSize()], data[h.cookies.NonceSize():]
+	plaintext, err := h.cookies.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return login, err
+	}
+	err = json.Unmarshal(plaintext, &login)
+	return login, err
+}
+
+// stringsClaim reads a claim holding a string or an array of strings.
+func stringsClaim(claim any) []string {
+	switch claim := claim.(type) {
+	case string:
+		return []string{claim}
+	case []any:
+		values := make([]string, 0, len(claim))
+		for _, value := range claim {
+			if s, ok := value.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func randomString() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,218 @@
+// Package otlp holds the OpenTelemetry data model as sent by computers and an
+// exporter that forwards it to an OTLP/HTTP collector.
+//
+// Metric types decode from the msgpack form produced by cc-tstl/src/api
+// (snake_case field names, as in the OTLP protobuf definitions) and encode to
+// the OTLP JSON form (camelCase names, 64-bit integers as strings). Log and
+// trace types are built server-side and only encode to JSON.
+package otlp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+var ErrInvalidData = errors.New("invalid telemetry data")
+
+// Uint64 is an unsigned 64-bit field. Lua numbers are doubles, so it decodes
+// from any msgpack number that is a whole number; JSON encodes it as a string.
+type Uint64 uint64
+
+func (v *Uint64) DecodeMsgpack(dec *msgpack.Decoder) error {
+	value, err := dec.DecodeInterfaceLoose()
+	if err != nil {
+		return err
+	}
+	switch n := value.(type) {
+	case int64:
+		if n >= 0 {
+			*v = Uint64(n)
+			return nil
+		}
+	case uint64:
+		*v = Uint64(n)
+		return nil
+	case float64:
+		if n >= 0 && n < math.MaxUint64 && n == math.Trunc(n) {
+			*v = Uint64(n)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %v is not an unsigned 64-bit integer", ErrInvalidData, value)
+}
+
+func (v Uint64) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatUint(uint64(v), 10))
+}
+
+// Int64 is a signed 64-bit field, decoded and encoded like Uint64.
+type Int64 int64
+
+func (v *Int64) DecodeMsgpack(dec *msgpack.Decoder) error {
+	value, err := dec.DecodeInterfaceLoose()
+	if err != nil {
+		return err
+	}
+	switch n := value.(type) {
+	case int64:
+		*v = Int64(n)
+		return nil
+	case uint64:
+		if n <= math.MaxInt64 {
+			*v = Int64(n)
+			return nil
+		}
+	case float64:
+		if n >= math.MinInt64 && n < math.MaxInt64 && n == math.Trunc(n) {
+			*v = Int64(n)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %v is not a 64-bit integer", ErrInvalidData, value)
+}
+
+func (v Int64) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatInt(int64(v), 10))
+}
+
+type AnyValue struct {
+	StringValue *string       `msgpack:"string_value,omitempty" json:"stringValue,omitempty"`
+	BoolValue   *bool         `msgpack:"bool_value,omitempty" json:"boolValue,omitempty"`
+	IntValue    *Int64        `msgpack:"int_value,omitempty" json:"intValue,omitempty"`
+	DoubleValue *float64      `msgpack:"double_value,omitempty" json:"doubleValue,omitempty"`
+	BytesValue  []byte        `msgpack:"bytes_value,omitempty" json:"bytesValue,omitempty"`
+	ArrayValue  *ArrayValue   `msgpack:"array_value,omitempty" json:"arrayValue,omitempty"`
+	KvlistValue *KeyValueList `msgpack:"kvlist_value,omitempty" json:"kvlistValue,omitempty"`
+}
+
+type ArrayValue struct {
+	Values []AnyValue `msgpack:"values" json:"values"`
+}
+
+type KeyValueList struct {
+	Values []KeyValue `msgpack:"values" json:"values"`
+}
+
+type KeyValue struct {
+	Key   string   `msgpack:"key" json:"key"`
+	Value AnyValue `msgpack:"value" json:"value"`
+}
+
+type Resource struct {
+	Attributes             []KeyValue `msgpack:"attributes,omitempty" json:"attributes,omitempty"`
+	DroppedAttributesCount uint32     `msgpack:"dropped_attributes_count,omitempty" json:"droppedAttributesCount,omitempty"`
+}
+
+type InstrumentationScope struct {
+	Name                   string     `msgpack:"name,omitempty" json:"name,omitempty"`
+	Version                string     `msgpack:"version,omitempty" json:"version,omitempty"`
+	Attributes             []KeyValue `msgpack:"attributes,omitempty" json:"attributes,omitempty"`
+	DroppedAttributesCount uint32     `msgpack:"dropped_attributes_count,omitempty" json:"droppedAttributesCount,omitempty"`
+}
+
+func StringValue(v string) AnyValue {
+	return AnyValue{StringValue: &v}
+}
+
+func BoolValue(v bool) AnyValue {
+	return AnyValue{BoolValue: &v}
+}
+
+func IntValue(v int64) AnyValue {
+	i := Int64(v)
+	return AnyValue{IntValue: &i}
+}
+
+func StringArrayValue(v []string) AnyValue {
+	values := make([]AnyValue, 0, len(v))
+	for _, s := range v {
+		values = append(values, StringValue(s))
+	}
+	return AnyValue{ArrayValue: &ArrayValue{Values: values}}
+}
+
+// String returns the value as a string attribute would be displayed.
+func (v AnyValue) String() string {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return strconv.FormatBool(*v.BoolValue)
+	case v.IntValue != nil:
+		return strconv.FormatInt(int64(*v.IntValue), 10)
+	case v.DoubleValue != nil:
+		return strconv.FormatFloat(*v.DoubleValue, 'g', -1, 64)
+	case v.BytesValue != nil:
+		return string(v.BytesValue)
+	}
+	return ""
+}
+
+// maxValueDepth bounds how deeply array and kvlist values may nest.
+const maxValueDepth = 8
+
+func (v AnyValue) validate(depth int) error {
+	if depth > maxValueDepth {
+		return fmt.Errorf("%w: attribute value nested too deeply", ErrInvalidData)
+	}
+	set := 0
+	for _, present := range []bool{
+		v.StringValue != nil, v.BoolValue != nil, v.IntValue != nil, v.DoubleValue != nil,
+		v.BytesValue != nil, v.ArrayValue != nil, v.KvlistValue != nil,
+	} {
+		if present {
+			set++
+		}
+	}
+	if set > 1 {
+		return fmt.Errorf("%w: attribute value has more than one type", ErrInvalidData)
+	}
+	if v.ArrayValue != nil {
+		for _, value := range v.ArrayValue.Values {
+			if err := value.validate(depth + 1); err != nil {
+				return err
+			}
+		}
+	}
+	if v.KvlistValue != nil {
+		if err := validateAttributes(v.KvlistValue.Values, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateAttributes(attributes []KeyValue, depth int) error {
+	for _, attribute := range attributes {
+		if attribute.Key == "" {
+			return fmt.Errorf("%w: attribute key is required", ErrInvalidData)
+		}
+		if err := attribute.Value.validate(depth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setAttributes replaces the values of the given keys, appending any that are
+// missing.
+func setAttributes(attributes []KeyValue, set []KeyValue) []KeyValue {
+	for _, attribute := range set {
+		replaced := false
+		for i := range attributes {
+			if attributes[i].Key == attribute.Key {
+				attributes[i].Value = attribute.Value
+				replaced = true
+			}
+		}
+		if !replaced {
+			attributes = append(attributes, attribute)
+		}
+	}
+	return attributes
+}
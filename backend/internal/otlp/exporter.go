@@ -0,0 +1,112 @@
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	exporterQueueSize = 256
+	exportTimeout     = 10 * time.Second
+)
+
+var ErrQueueFull = errors.New("telemetry export queue is full")
+
+type exportRequest struct {
+	path string
+	body []byte
+}
+
+// Exporter sends telemetry to an OTLP/HTTP collector using the JSON
+// encoding. Exports are queued and sent in the background so a slow or
+// missing collector never blocks the caller.
+type Exporter struct {
+	endpoint string
+	client   *http.Client
+	queue    chan exportRequest
+}
+
+// NewExporter creates an exporter for the collector at endpoint, e.g.
+// "http://localhost:4318". Call Run to start sending.
+func NewExporter(endpoint string) *Exporter {
+	return &Exporter{
+		endpoint: strings.TrimRight(endpoint, "/"),
+		client:   &http.Client{Timeout: exportTimeout},
+		queue:    make(chan exportRequest, exporterQueueSize),
+	}
+}
+
+// ExportMetrics queues metrics for sending to the collector's /v1/metrics.
+func (e *Exporter) ExportMetrics(data *MetricsData) error {
+	return e.enqueue("/v1/metrics", data)
+}
+
+// ExportTraces queues spans for sending to the collector's /v1/traces.
+func (e *Exporter) ExportTraces(data *TracesData) error {
+	return e.enqueue("/v1/traces", data)
+}
+
+// ExportLogs queues logs for sending to the collector's /v1/logs.
+func (e *Exporter) ExportLogs(data *LogsData) error {
+	return e.enqueue("/v1/logs", data)
+}
+
+func (e *Exporter) enqueue(path string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	select {
+	case e.queue <- exportRequest{path: path, body: body}:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Run sends queued exports until ctx is cancelled. Failures are logged once
+// until an export succeeds again, so a collector that is down does not flood
+// the log.
+func (e *Exporter) Run(ctx context.Context) {
+	failing := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case req := <-e.queue:
+			err := e.send(ctx, req)
+			if err != nil && !failing {
+				slog.Warn("failed to export telemetry", "endpoint", e.endpoint+req.path, "err", err)
+			} else if err == nil && failing {
+				slog.Info("telemetry export recovered", "endpoint", e.endpoint)
+			}
+			failing = err != nil
+		}
+	}
+}
+
+func (e *Exporter) send(ctx context.Context, req exportRequest) error {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint+req.path, bytes.NewReader(req.body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("collector returned %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package otlp
+
+// SeverityNumber is the OTLP log severity. Each level spans four numbers, e.g.
+// SeverityInfo to SeverityInfo4.
+type SeverityNumber int32
+
+const (
+	SeverityUnspecified SeverityNumber = 0
+	SeverityTrace       SeverityNumber = 1
+	SeverityDebug       SeverityNumber = 5
+	SeverityInfo        SeverityNumber = 9
+	SeverityWarn        SeverityNumber = 13
+	SeverityError       SeverityNumber = 17
+	SeverityFatal       SeverityNumber = 21
+)
+
+type LogsData struct {
+	ResourceLogs []ResourceLogs `json:"resourceLogs"`
+}
+
+type ResourceLogs struct {
+	Resource  *Resource   `json:"resource,omitempty"`
+	ScopeLogs []ScopeLogs `json:"scopeLogs,omitempty"`
+	SchemaURL string      `json:"schemaUrl,omitempty"`
+}
+
+type ScopeLogs struct {
+	Scope      *InstrumentationScope `json:"scope,omitempty"`
+	LogRecords []LogRecord           `json:"logRecords,omitempty"`
+	SchemaURL  string                `json:"schemaUrl,omitempty"`
+}
+
+type LogRecord struct {
+	TimeUnixNano         Uint64         `json:"timeUnixNano,omitempty"`
+	ObservedTimeUnixNano Uint64         `json:"observedTimeUnixNano,omitempty"`
+	SeverityNumber       SeverityNumber `json:"severityNumber,omitempty"`
+	SeverityText         string         `json:"severityText,omitempty"`
+	Body                 *AnyValue      `json:"body,omitempty"`
+	Attributes           []KeyValue     `json:"attributes,omitempty"`
+	Flags                uint32         `json:"flags,omitempty"`
+	TraceID              string         `json:"traceId,omitempty"`
+	SpanID               string         `json:"spanId,omitempty"`
+}
@@ -0,0 +1,332 @@
+package otlp
+
+import (
+	"encoding/hex"
+	"fmt"
+)
+
+type AggregationTemporality int32
+
+const (
+	AggregationTemporalityUnspecified AggregationTemporality = iota
+	AggregationTemporalityDelta
+	AggregationTemporalityCumulative
+)
+
+// MaxDataPoints bounds the number of data points accepted in one MetricsData.
+const MaxDataPoints = 10000
+
+type MetricsData struct {
+	ResourceMetrics []ResourceMetrics `msgpack:"resource_metrics" json:"resourceMetrics"`
+}
+
+type ResourceMetrics struct {
+	Resource     *Resource      `msgpack:"resource,omitempty" json:"resource,omitempty"`
+	ScopeMetrics []ScopeMetrics `msgpack:"scope_metrics,omitempty" json:"scopeMetrics,omitempty"`
+	SchemaURL    string         `msgpack:"schema_url,omitempty" json:"schemaUrl,omitempty"`
+}
+
+type ScopeMetrics struct {
+	Scope     *InstrumentationScope `msgpack:"scope,omitempty" json:"scope,omitempty"`
+	Metrics   []Metric              `msgpack:"metrics,omitempty" json:"metrics,omitempty"`
+	SchemaURL string                `msgpack:"schema_url,omitempty" json:"schemaUrl,omitempty"`
+}
+
+type Metric struct {
+	Name                 string                `msgpack:"name" json:"name"`
+	Description          string                `msgpack:"description,omitempty" json:"description,omitempty"`
+	Unit                 string                `msgpack:"unit,omitempty" json:"unit,omitempty"`
+	Gauge                *Gauge                `msgpack:"gauge,omitempty" json:"gauge,omitempty"`
+	Sum                  *Sum                  `msgpack:"sum,omitempty" json:"sum,omitempty"`
+	Histogram            *Histogram            `msgpack:"histogram,omitempty" json:"histogram,omitempty"`
+	ExponentialHistogram *ExponentialHistogram `msgpack:"exponential_histogram,omitempty" json:"exponentialHistogram,omitempty"`
+	Summary              *Summary              `msgpack:"summary,omitempty" json:"summary,omitempty"`
+	Metadata             []KeyValue            `msgpack:"metadata,omitempty" json:"metadata,omitempty"`
+}
+
+type Gauge struct {
+	DataPoints []NumberDataPoint `msgpack:"data_points" json:"dataPoints"`
+}
+
+type Sum struct {
+	DataPoints             []NumberDataPoint      `msgpack:"data_points" json:"dataPoints"`
+	AggregationTemporality AggregationTemporality `msgpack:"aggregation_temporality" json:"aggregationTemporality"`
+	IsMonotonic            bool                   `msgpack:"is_monotonic,omitempty" json:"isMonotonic,omitempty"`
+}
+
+type Histogram struct {
+	DataPoints             []HistogramDataPoint   `msgpack:"data_points" json:"dataPoints"`
+	AggregationTemporality AggregationTemporality `msgpack:"aggregation_temporality" json:"aggregationTemporality"`
+}
+
+type ExponentialHistogram struct {
+	DataPoints             []ExponentialHistogramDataPoint `msgpack:"data_points" json:"dataPoints"`
+	AggregationTemporality AggregationTemporality          `msgpack:"aggregation_temporality" json:"aggregationTemporality"`
+}
+
+type Summary struct {
+	DataPoints []SummaryDataPoint `msgpack:"data_points" json:"dataPoints"`
+}
+
+type NumberDataPoint struct {
+	Attributes        []KeyValue `msgpack:"attributes,omitempty" json:"attributes,omitempty"`
+	StartTimeUnixNano Uint64     `msgpack:"start_time_unix_nano,omitempty" json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      Uint64     `msgpack:"time_unix_nano" json:"timeUnixNano"`
+	AsDouble          *float64   `msgpack:"as_double,omitempty" json:"asDouble,omitempty"`
+	AsInt             *Int64     `msgpack:"as_int,omitempty" json:"asInt,omitempty"`
+	Exemplars         []Exemplar `msgpack:"exemplars,omitempty" json:"exemplars,omitempty"`
+	Flags             uint32     `msgpack:"flags,omitempty" json:"flags,omitempty"`
+}
+
+// Value returns the data point's value as a float64.
+func (p NumberDataPoint) Value() float64 {
+	if p.AsInt != nil {
+		return float64(*p.AsInt)
+	}
+	if p.AsDouble != nil {
+		return *p.AsDouble
+	}
+	return 0
+}
+
+type HistogramDataPoint struct {
+	Attributes        []KeyValue `msgpack:"attributes,omitempty" json:"attributes,omitempty"`
+	StartTimeUnixNano Uint64     `msgpack:"start_time_unix_nano,omitempty" json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      Uint64     `msgpack:"time_unix_nano" json:"timeUnixNano"`
+	Count             Uint64     `msgpack:"count" json:"count"`
+	Sum               *float64   `msgpack:"sum,omitempty" json:"sum,omitempty"`
+	BucketCounts      []Uint64   `msgpack:"bucket_counts,omitempty" json:"bucketCounts,omitempty"`
+	ExplicitBounds    []float64  `msgpack:"explicit_bounds,omitempty" json:"explicitBounds,omitempty"`
+	Exemplars         []Exemplar `msgpack:"exemplars,omitempty" json:"exemplars,omitempty"`
+	Flags             uint32     `msgpack:"flags,omitempty" json:"flags,omitempty"`
+	Min               *float64   `msgpack:"min,omitempty" json:"min,omitempty"`
+	Max               *float64   `msgpack:"max,omitempty" json:"max,omitempty"`
+}
+
+type ExponentialHistogramDataPoint struct {
+	Attributes        []KeyValue                  `msgpack:"attributes,omitempty" json:"attributes,omitempty"`
+	StartTimeUnixNano Uint64                      `msgpack:"start_time_unix_nano,omitempty" json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      Uint64                      `msgpack:"time_unix_nano" json:"timeUnixNano"`
+	Count             Uint64                      `msgpack:"count" json:"count"`
+	Sum               *float64                    `msgpack:"sum,omitempty" json:"sum,omitempty"`
+	Scale             int32                       `msgpack:"scale" json:"scale"`
+	ZeroCount         Uint64                      `msgpack:"zero_count" json:"zeroCount"`
+	Positive          ExponentialHistogramBuckets `msgpack:"positive" json:"positive"`
+	Negative          ExponentialHistogramBuckets `msgpack:"negative" json:"negative"`
+	Flags             uint32                      `msgpack:"flags,omitempty" json:"flags,omitempty"`
+	Exemplars         []Exemplar                  `msgpack:"exemplars,omitempty" json:"exemplars,omitempty"`
+	Min               *float64                    `msgpack:"min,omitempty" json:"min,omitempty"`
+	Max               *float64                    `msgpack:"max,omitempty" json:"max,omitempty"`
+	ZeroThreshold     float64                     `msgpack:"zero_threshold,omitempty" json:"zeroThreshold,omitempty"`
+}
+
+type ExponentialHistogramBuckets struct {
+	Offset       int32    `msgpack:"offset" json:"offset"`
+	BucketCounts []Uint64 `msgpack:"bucket_counts" json:"bucketCounts"`
+}
+
+type SummaryDataPoint struct {
+	Attributes        []KeyValue        `msgpack:"attributes,omitempty" json:"attributes,omitempty"`
+	StartTimeUnixNano Uint64            `msgpack:"start_time_unix_nano,omitempty" json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      Uint64            `msgpack:"time_unix_nano" json:"timeUnixNano"`
+	Count             Uint64            `msgpack:"count" json:"count"`
+	Sum               float64           `msgpack:"sum" json:"sum"`
+	QuantileValues    []ValueAtQuantile `msgpack:"quantile_values,omitempty" json:"quantileValues,omitempty"`
+	Flags             uint32            `msgpack:"flags,omitempty" json:"flags,omitempty"`
+}
+
+type ValueAtQuantile struct {
+	Quantile float64 `msgpack:"quantile" json:"quantile"`
+	Value    float64 `msgpack:"value" json:"value"`
+}
+
+type Exemplar struct {
+	FilteredAttributes []KeyValue `msgpack:"filtered_attributes,omitempty" json:"filteredAttributes,omitempty"`
+	TimeUnixNano       Uint64     `msgpack:"time_unix_nano" json:"timeUnixNano"`
+	AsDouble           *float64   `msgpack:"as_double,omitempty" json:"asDouble,omitempty"`
+	AsInt              *Int64     `msgpack:"as_int,omitempty" json:"asInt,omitempty"`
+	SpanID             string     `msgpack:"span_id,omitempty" json:"spanId,omitempty"`
+	TraceID            string     `msgpack:"trace_id,omitempty" json:"traceId,omitempty"`
+}
+
+// SetResourceAttributes sets attributes on the resource of every
+// ResourceMetrics, overwriting any values the sender supplied for the same
+// keys.
+func (d *MetricsData) SetResourceAttributes(attributes ...KeyValue) {
+	for i := range d.ResourceMetrics {
+		rm := &d.ResourceMetrics[i]
+		if rm.Resource == nil {
+			rm.Resource = &Resource{}
+		}
+		rm.Resource.Attributes = setAttributes(rm.Resource.Attributes, attributes)
+	}
+}
+
+// DataPointCount returns the total number of data points across all metrics.
+func (d *MetricsData) DataPointCount() int {
+	count := 0
+	for _, rm := range d.ResourceMetrics {
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				switch {
+				case m.Gauge != nil:
+					count += len(m.Gauge.DataPoints)
+				case m.Sum != nil:
+					count += len(m.Sum.DataPoints)
+				case m.Histogram != nil:
+					count += len(m.Histogram.DataPoints)
+				case m.ExponentialHistogram != nil:
+					count += len(m.ExponentialHistogram.DataPoints)
+				case m.Summary != nil:
+					count += len(m.Summary.DataPoints)
+				}
+			}
+		}
+	}
+	return count
+}
+
+// Validate checks the structural rules of the OTLP metrics model that a
+// collector would otherwise reject the whole batch for.
+func (d *MetricsData) Validate() error {
+	if n := d.DataPointCount(); n > MaxDataPoints {
+		return fmt.Errorf("%w: %d data points exceeds limit of %d", ErrInvalidData, n, MaxDataPoints)
+	}
+	for _, rm := range d.ResourceMetrics {
+		if rm.Resource != nil {
+			if err := validateAttributes(rm.Resource.Attributes, 0); err != nil {
+				return err
+			}
+		}
+		for _, sm := range rm.ScopeMetrics {
+			if sm.Scope != nil {
+				if err := validateAttributes(sm.Scope.Attributes, 0); err != nil {
+					return err
+				}
+			}
+			for _, m := range sm.Metrics {
+				if err := m.validate(); err != nil {
+					return fmt.Errorf("metric %q: %w", m.Name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (m Metric) validate() error {
+	if m.Name == "" {
+		return fmt.Errorf("%w: metric name is required", ErrInvalidData)
+	}
+	types := 0
+	for _, present := range []bool{m.Gauge != nil, m.Sum != nil, m.Histogram != nil, m.ExponentialHistogram != nil, m.Summary != nil} {
+		if present {
+			types++
+		}
+	}
+	if types != 1 {
+		return fmt.Errorf("%w: metric must have exactly one of gauge, sum, histogram, exponential_histogram or summary", ErrInvalidData)
+	}
+	if err := validateAttributes(m.Metadata, 0); err != nil {
+		return err
+	}
+	switch {
+	case m.Gauge != nil:
+		return validateNumberDataPoints(m.Gauge.DataPoints)
+	case m.Sum != nil:
+		if err := validateTemporality(m.Sum.AggregationTemporality); err != nil {
+			return err
+		}
+		return validateNumberDataPoints(m.Sum.DataPoints)
+	case m.Histogram != nil:
+		if err := validateTemporality(m.Histogram.AggregationTemporality); err != nil {
+			return err
+		}
+		for _, p := range m.Histogram.DataPoints {
+			if err := validatePoint(p.Attributes, p.TimeUnixNano, p.Exemplars); err != nil {
+				return err
+			}
+			if len(p.BucketCounts) > 0 && len(p.BucketCounts) != len(p.ExplicitBounds)+1 {
+				return fmt.Errorf("%w: histogram needs one more bucket count than explicit bounds", ErrInvalidData)
+			}
+			for i := 1; i < len(p.ExplicitBounds); i++ {
+				if p.ExplicitBounds[i] <= p.ExplicitBounds[i-1] {
+					return fmt.Errorf("%w: histogram bounds must be increasing", ErrInvalidData)
+				}
+			}
+		}
+	case m.ExponentialHistogram != nil:
+		if err := validateTemporality(m.ExponentialHistogram.AggregationTemporality); err != nil {
+			return err
+		}
+		for _, p := range m.ExponentialHistogram.DataPoints {
+			if err := validatePoint(p.Attributes, p.TimeUnixNano, p.Exemplars); err != nil {
+				return err
+			}
+		}
+	case m.Summary != nil:
+		for _, p := range m.Summary.DataPoints {
+			if err := validatePoint(p.Attributes, p.TimeUnixNano, nil); err != nil {
+				return err
+			}
+			for _, q := range p.QuantileValues {
+				if q.Quantile < 0 || q.Quantile > 1 {
+					return fmt.Errorf("%w: quantile %v out of range", ErrInvalidData, q.Quantile)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func validateTemporality(t AggregationTemporality) error {
+	if t != AggregationTemporalityDelta && t != AggregationTemporalityCumulative {
+		return fmt.Errorf("%w: aggregation temporality must be delta or cumulative", ErrInvalidData)
+	}
+	return nil
+}
+
+func validateNumberDataPoints(points []NumberDataPoint) error {
+	for _, p := range points {
+		if err := validatePoint(p.Attributes, p.TimeUnixNano, p.Exemplars); err != nil {
+			return err
+		}
+		if p.AsDouble != nil && p.AsInt != nil {
+			return fmt.Errorf("%w: data point has both as_double and as_int", ErrInvalidData)
+		}
+	}
+	return nil
+}
+
+func validatePoint(attributes []KeyValue, timeUnixNano Uint64, exemplars []Exemplar) error {
+	if timeUnixNano == 0 {
+		return fmt.Errorf("%w: data point time_unix_nano is required", ErrInvalidData)
+	}
+	if err := validateAttributes(attributes, 0); err != nil {
+		return err
+	}
+	for _, e := range exemplars {
+		if err := validateAttributes(e.FilteredAttributes, 0); err != nil {
+			return err
+		}
+		if err := validateID(e.SpanID, 8); err != nil {
+			return err
+		}
+		if err := validateID(e.TraceID, 16); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateID checks an optional hex encoded span or trace ID.
+func validateID(id string, size int) error {
+	if id == "" {
+		return nil
+	}
+	raw, err := hex.DecodeString(id)
+	if err != nil || len(raw) != size {
+		return fmt.Errorf("%w: ID %q must be %d hex encoded bytes", ErrInvalidData, id, size)
+	}
+	return nil
+}
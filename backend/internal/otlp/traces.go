@@ -0,0 +1,56 @@
+package otlp
+
+type SpanKind int32
+
+const (
+	SpanKindUnspecified SpanKind = iota
+	SpanKindInternal
+	SpanKindServer
+	SpanKindClient
+	SpanKindProducer
+	SpanKindConsumer
+)
+
+type StatusCode int32
+
+const (
+	StatusCodeUnset StatusCode = iota
+	StatusCodeOk
+	StatusCodeError
+)
+
+type TracesData struct {
+	ResourceSpans []ResourceSpans `json:"resourceSpans"`
+}
+
+type ResourceSpans struct {
+	Resource   *Resource    `json:"resource,omitempty"`
+	ScopeSpans []ScopeSpans `json:"scopeSpans,omitempty"`
+	SchemaURL  string       `json:"schemaUrl,omitempty"`
+}
+
+type ScopeSpans struct {
+	Scope     *InstrumentationScope `json:"scope,omitempty"`
+	Spans     []Span                `json:"spans,omitempty"`
+	SchemaURL string                `json:"schemaUrl,omitempty"`
+}
+
+// Span is a finished span. TraceID and SpanID are hex encoded, as in the OTLP
+// JSON encoding.
+type Span struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	TraceState        string     `json:"traceState,omitempty"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              SpanKind   `json:"kind,omitempty"`
+	StartTimeUnixNano Uint64     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   Uint64     `json:"endTimeUnixNano"`
+	Attributes        []KeyValue `json:"attributes,omitempty"`
+	Status            *Status    `json:"status,omitempty"`
+}
+
+type Status struct {
+	Message string     `json:"message,omitempty"`
+	Code    StatusCode `json:"code,omitempty"`
+}
@@ -0,0 +1,109 @@
+package rawterm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+const (
+	keyFlagUp   = 1 << 0
+	keyFlagHeld = 1 << 1
+	keyFlagChar = 1 << 3
+)
+
+type MouseEventType uint8
+
+const (
+	MouseClick MouseEventType = iota
+	MouseUp
+	MouseScroll
+	MouseDrag
+)
+
+const (
+	eventParamInteger = 0
+	eventParamDouble  = 1
+	eventParamBoolean = 2
+	eventParamString  = 3
+	eventParamNil     = 5
+)
+
+// KeyPacket builds a key or key_up event for the given rawterm key code.
+func KeyPacket(window uint8, key uint8, up bool, held bool) Packet {
+	var flags byte
+	if up {
+		flags |= keyFlagUp
+	}
+	if held {
+		flags |= keyFlagHeld
+	}
+	return Packet{Type: PacketKey, Window: window, Data: []byte{key, flags}}
+}
+
+// CharPacket builds a char event for a single byte of text.
+func CharPacket(window uint8, char byte) Packet {
+	return Packet{Type: PacketKey, Window: window, Data: []byte{char, keyFlagChar}}
+}
+
+// MousePacket builds a mouse event. For scrolls, button is 0 for up and 1
+// for down. Coordinates are 1-based character cells.
+func MousePacket(window uint8, eventType MouseEventType, button uint8, x, y uint32) Packet {
+	data := make([]byte, 10)
+	data[0] = byte(eventType)
+	data[1] = button
+	binary.LittleEndian.PutUint32(data[2:6], x)
+	binary.LittleEndian.PutUint32(data[6:10], y)
+	return Packet{Type: PacketMouse, Window: window, Data: data}
+}
+
+// EventPacket builds a generic event queued verbatim on the computer. Params
+// may be nil, bool, string, or any integer or float type; strings must not
+// contain NUL bytes.
+func EventPacket(window uint8, name string, params ...any) (Packet, error) {
+	if len(params) > math.MaxUint8 {
+		return Packet{}, fmt.Errorf("too many event parameters: %d", len(params))
+	}
+	data := []byte{byte(len(params))}
+	data = append(data, name...)
+	data = append(data, 0)
+	for _, param := range params {
+		switch v := param.(type) {
+		case nil:
+			data = append(data, eventParamNil)
+		case bool:
+			var b byte
+			if v {
+				b = 1
+			}
+			data = append(data, eventParamBoolean, b)
+		case string:
+			data = append(data, eventParamString)
+			data = append(data, v...)
+			data = append(data, 0)
+		case int:
+			data = appendInteger(data, int64(v))
+		case int32:
+			data = appendInteger(data, int64(v))
+		case int64:
+			data = appendInteger(data, v)
+		case uint32:
+			data = appendInteger(data, int64(v))
+		case float64:
+			data = append(data, eventParamDouble)
+			data = binary.LittleEndian.AppendUint64(data, math.Float64bits(v))
+		default:
+			return Packet{}, fmt.Errorf("unsupported event parameter type %T", param)
+		}
+	}
+	return Packet{Type: PacketEvent, Window: window, Data: data}, nil
+}
+
+func appendInteger(data []byte, v int64) []byte {
+	if v < math.MinInt32 || v > math.MaxInt32 {
+		data = append(data, eventParamDouble)
+		return binary.LittleEndian.AppendUint64(data, math.Float64bits(float64(v)))
+	}
+	data = append(data, eventParamInteger)
+	return binary.LittleEndian.AppendUint32(data, uint32(int32(v)))
+}
@@ -0,0 +1,198 @@
+// Package rawterm implements the CraftOS-PC raw mode protocol spoken by the
+// rawterm API: "!CPC"/"!CPD" framed, base64 encoded, CRC32 checked packets.
+package rawterm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+)
+
+type PacketType uint8
+
+const (
+	PacketTerminalContents PacketType = iota
+	PacketKey
+	PacketMouse
+	PacketEvent
+	PacketWindowChange
+	PacketShowMessage
+	PacketVersionSupport
+)
+
+type WindowChange uint8
+
+const (
+	WindowChangeUpdate WindowChange = iota
+	WindowChangeClosed
+	WindowChangeQuit
+)
+
+const (
+	shortHeader = "!CPC"
+	longHeader  = "!CPD"
+	// maxShortLength is the largest payload a "!CPC" frame can describe.
+	maxShortLength = 0xFFFF
+)
+
+var ErrInvalidFrame = errors.New("invalid rawterm frame")
+var ErrChecksum = errors.New("rawterm checksum mismatch")
+
+// Packet is a decoded raw mode packet.
+type Packet struct {
+	Type   PacketType
+	Window uint8
+	Data   []byte
+}
+
+// Bytes returns the packet as it is laid out before base64 encoding.
+func (p Packet) Bytes() []byte {
+	buf := make([]byte, 0, len(p.Data)+2)
+	buf = append(buf, byte(p.Type), p.Window)
+	return append(buf, p.Data...)
+}
+
+// ParsePacket splits a decoded packet into its type, window and body.
+func ParsePacket(raw []byte) (Packet, error) {
+	if len(raw) < 2 {
+		return Packet{}, fmt.Errorf("%w: packet too short", ErrInvalidFrame)
+	}
+	return Packet{
+		Type:   PacketType(raw[0]),
+		Window: raw[1],
+		Data:   raw[2:],
+	}, nil
+}
+
+// EncodeFrame frames a packet for sending to a rawterm peer.
+func EncodeFrame(p Packet) []byte {
+	payload := base64.StdEncoding.EncodeToString(p.Bytes())
+	var buf bytes.Buffer
+	if len(payload) > maxShortLength {
+		fmt.Fprintf(&buf, "%s%012X", longHeader, len(payload))
+	} else {
+		fmt.Fprintf(&buf, "%s%04X", shortHeader, len(payload))
+	}
+	buf.WriteString(payload)
+	fmt.Fprintf(&buf, "%08X\n", crc32.ChecksumIEEE([]byte(payload)))
+	return buf.Bytes()
+}
+
+// DecodeFrame decodes a single frame, with or without its trailing newline.
+// The checksum may cover either the base64 text or the binary packet,
+// depending on what the peer negotiated, so both are accepted.
+func DecodeFrame(frame []byte) (Packet, error) {
+	frame = bytes.TrimRight(frame, "\r\n")
+	var lengthDigits int
+	switch {
+	case bytes.HasPrefix(frame, []byte(shortHeader)):
+		lengthDigits = 4
+	case bytes.HasPrefix(frame, []byte(longHeader)):
+		lengthDigits = 12
+	default:
+		return Packet{}, fmt.Errorf("%w: missing header", ErrInvalidFrame)
+	}
+	headerLength := len(shortHeader) + lengthDigits
+	if len(frame) < headerLength {
+		return Packet{}, fmt.Errorf("%w: truncated header", ErrInvalidFrame)
+	}
+	length, err := strconv.ParseUint(string(frame[len(shortHeader):headerLength]), 16, 64)
+	if err != nil {
+		return Packet{}, fmt.Errorf("%w: bad length: %v", ErrInvalidFrame, err)
+	}
+	if uint64(len(frame)) != uint64(headerLength)+length+8 {
+		return Packet{}, fmt.Errorf("%w: length %d does not match frame", ErrInvalidFrame, length)
+	}
+	payload := frame[headerLength : headerLength+int(length)]
+	sum, err := strconv.ParseUint(string(frame[headerLength+int(length):]), 16, 32)
+	if err != nil {
+		return Packet{}, fmt.Errorf("%w: bad checksum: %v", ErrInvalidFrame, err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(string(payload))
+	if err != nil {
+		return Packet{}, fmt.Errorf("%w: %v", ErrInvalidFrame, err)
+	}
+	if uint32(sum) != crc32.ChecksumIEEE(payload) && uint32(sum) != crc32.ChecksumIEEE(raw) {
+		return Packet{}, ErrChecksum
+	}
+	return ParsePacket(raw)
+}
+
+// FrameReader reassembles frames from a byte stream that may split or join
+// them arbitrarily, as happens when the sender chunks large packets.
+type FrameReader struct {
+	buf []byte
+}
+
+// maxBuffered bounds how much unterminated data a FrameReader will hold.
+const maxBuffered = 16 << 20
+
+// Write appends data to the reader and returns every complete frame it now
+// holds. Frames that fail to decode are reported in errs and skipped.
+func (r *FrameReader) Write(data []byte) (packets []Packet, errs []error) {
+	r.buf = append(r.buf, data...)
+	for {
+		idx := bytes.IndexByte(r.buf, '\n')
+		if idx < 0 {
+			break
+		}
+		line := r.buf[:idx]
+		r.buf = r.buf[idx+1:]
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		packet, err := DecodeFrame(line)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		packets = append(packets, packet)
+	}
+	if len(r.buf) > maxBuffered {
+		r.buf = nil
+		errs = append(errs, fmt.Errorf("%w: unterminated frame exceeds %d bytes", ErrInvalidFrame, maxBuffered))
+	}
+	if len(r.buf) == 0 {
+		r.buf = nil
+	} else {
+		r.buf = append([]byte(nil), r.buf...)
+	}
+	return packets, errs
+}
+
+// WindowInfo is the body of a window change packet.
+type WindowInfo struct {
+	Change WindowChange
+	Width  int
+	Height int
+	Title  string
+}
+
+func ParseWindowChange(data []byte) (WindowInfo, error) {
+	if len(data) < 6 {
+		return WindowInfo{}, fmt.Errorf("%w: window change too short", ErrInvalidFrame)
+	}
+	title := data[6:]
+	if idx := bytes.IndexByte(title, 0); idx >= 0 {
+		title = title[:idx]
+	}
+	return WindowInfo{
+		Change: WindowChange(data[0]),
+		Width:  int(binary.LittleEndian.Uint16(data[2:4])),
+		Height: int(binary.LittleEndian.Uint16(data[4:6])),
+		Title:  string(title),
+	}, nil
+}
+
+func (w WindowInfo) Encode() []byte {
+	data := make([]byte, 6, 6+len(w.Title)+1)
+	data[0] = byte(w.Change)
+	binary.LittleEndian.PutUint16(data[2:4], uint16(w.Width))
+	binary.LittleEndian.PutUint16(data[4:6], uint16(w.Height))
+	data = append(data, w.Title...)
+	return append(data, 0)
+}
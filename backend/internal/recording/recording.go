@@ -0,0 +1,422 @@
+// Package recording stores timestamped rawterm packets on disk so terminal
+// sessions can be replayed after the computer has gone away.
+//
+// Recordings live at <dir>/<computer id>/<start unix ms>.rec. Each file starts
+// with a magic string and the start time in unix nanoseconds, followed by
+// frames of: offset from start in nanoseconds (int64), packet length
+// (uint32) and the decoded packet, all little-endian.
+package recording
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ehedges.net/ccgui/backend/internal/rawterm"
+)
+
+const (
+	magic     = "CCGREC1\n"
+	extension = ".rec"
+	// maxFrameSize bounds a single frame when reading, to reject corrupt files.
+	maxFrameSize = 16 << 20
+	// flushInterval is how often buffered frames are written to the file, and
+	// so how much of a recording is lost if the server goes down.
+	flushInterval = time.Second
+	// maxPendingSize bounds the frames buffered between flushes. A recording
+	// that outgrows it because writes to the disk are stalled ends there.
+	maxPendingSize = 8 << 20
+)
+
+var ErrNotFound = errors.New("recording not found")
+var ErrInvalidID = errors.New("invalid recording id")
+var ErrCorrupt = errors.New("corrupt recording")
+var ErrBacklog = errors.New("recording buffer full")
+
+// Options is the retention policy applied to stored recordings.
+type Options struct {
+	// MaxAge deletes recordings that ended longer ago than this. Zero keeps
+	// recordings regardless of age.
+	MaxAge time.Duration
+	// MaxBytesPerComputer deletes a computer's oldest recordings once their
+	// total size exceeds this. Zero disables the limit.
+	MaxBytesPerComputer int64
+}
+
+// Info describes a stored recording.
+type Info struct {
+	ID         string
+	ComputerID int
+	StartedAt  time.Time
+	EndedAt    time.Time
+	Size       int64
+	Active     bool
+}
+
+type Store struct {
+	dir  string
+	opts Options
+
+	mu     sync.Mutex
+	active map[string]*Writer
+}
+
+func NewStore(dir string, opts Options) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Store{
+		dir:    dir,
+		opts:   opts,
+		active: make(map[string]*Writer),
+	}, nil
+}
+
+// Create starts a new recording for the computer, pruning old recordings
+// first.
+func (s *Store) Create(computerID int) (*Writer, error) {
+	if err := s.Prune(); err != nil {
+		slog.Warn("failed to prune recordings", "err", err)
+	}
+	start := time.Now()
+	dir := filepath.Join(s.dir, strconv.Itoa(computerID))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	id := formatID(computerID, start)
+	file, err := os.OpenFile(filepath.Join(dir, strconv.FormatInt(start.UnixMilli(), 10)+extension), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, len(magic)+8)
+	header = append(header, magic...)
+	header = binary.LittleEndian.AppendUint64(header, uint64(start.UnixNano()))
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	w := &Writer{
+		store:   s,
+		id:      id,
+		file:    file,
+		start:   start,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	s.mu.Lock()
+	s.active[id] = w
+	s.mu.Unlock()
+	go w.run()
+	return w, nil
+}
+
+// List returns the computer's recordings, newest first.
+func (s *Store) List(computerID int) ([]Info, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, strconv.Itoa(computerID)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var infos []Info
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, extension) {
+			continue
+		}
+		startMillis, err := strconv.ParseInt(strings.TrimSuffix(name, extension), 10, 64)
+		if err != nil {
+			continue
+		}
+		stat, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		start := time.UnixMilli(startMillis)
+		id := formatID(computerID, start)
+		s.mu.Lock()
+		_, active := s.active[id]
+		s.mu.Unlock()
+		infos = append(infos, Info{
+			ID:         id,
+			ComputerID: computerID,
+			StartedAt:  start,
+			EndedAt:    stat.ModTime(),
+			Size:       stat.Size(),
+			Active:     active,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].StartedAt.After(infos[j].StartedAt) })
+	return infos, nil
+}
+
+// Get returns a single recording by ID.
+func (s *Store) Get(id string) (Info, error) {
+	computerID, _, err := parseID(id)
+	if err != nil {
+		return Info{}, err
+	}
+	infos, err := s.List(computerID)
+	if err != nil {
+		return Info{}, err
+	}
+	for _, info := range infos {
+		if info.ID == id {
+			return info, nil
+		}
+	}
+	return Info{}, ErrNotFound
+}
+
+// Open opens a recording for reading. Recordings still being written can be
+// read up to the last complete frame flushed to the file.
+func (s *Store) Open(id string) (*Reader, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	r := &Reader{file: file, buf: bufio.NewReader(file)}
+	header := make([]byte, len(magic)+8)
+	if _, err := io.ReadFull(r.buf, header); err != nil || string(header[:len(magic)]) != magic {
+		file.Close()
+		return nil, ErrCorrupt
+	}
+	r.start = time.Unix(0, int64(binary.LittleEndian.Uint64(header[len(magic):])))
+	return r, nil
+}
+
+// Prune applies the retention policy. Active recordings are never deleted.
+func (s *Store) Prune() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		computerID, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		infos, err := s.List(computerID)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		var total int64
+		for _, info := range infos {
+			if info.Active {
+				total += info.Size
+				continue
+			}
+			expired := s.opts.MaxAge > 0 && time.Since(info.EndedAt) > s.opts.MaxAge
+			oversize := s.opts.MaxBytesPerComputer > 0 && total+info.Size > s.opts.MaxBytesPerComputer
+			if expired || oversize {
+				if err := s.remove(info.ID); err != nil {
+					errs = append(errs, err)
+				}
+				continue
+			}
+			total += info.Size
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Store) remove(id string) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (s *Store) path(id string) (string, error) {
+	computerID, startMillis, err := parseID(id)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, strconv.Itoa(computerID), strconv.FormatInt(startMillis, 10)+extension), nil
+}
+
+func formatID(computerID int, start time.Time) string {
+	return fmt.Sprintf("%d-%d", computerID, start.UnixMilli())
+}
+
+// ComputerID returns the ID of the computer a recording is of.
+func ComputerID(id string) (int, error) {
+	computerID, _, err := parseID(id)
+	return computerID, err
+}
+
+func parseID(id string) (int, int64, error) {
+	computerPart, startPart, ok := strings.Cut(id, "-")
+	if !ok {
+		return 0, 0, ErrInvalidID
+	}
+	computerID, err := strconv.Atoi(computerPart)
+	if err != nil || computerID < 0 {
+		return 0, 0, ErrInvalidID
+	}
+	startMillis, err := strconv.ParseInt(startPart, 10, 64)
+	if err != nil || startMillis < 0 {
+		return 0, 0, ErrInvalidID
+	}
+	return computerID, startMillis, nil
+}
+
+// Writer appends frames to a recording. Frames are buffered and written to
+// the file every flushInterval, so Write never waits on the disk.
+type Writer struct {
+	store *Store
+	id    string
+	file  *os.File
+	start time.Time
+
+	done    chan struct{}
+	stopped chan struct{}
+
+	mu      sync.Mutex
+	pending []byte
+	// err ended the recording, after which frames are dropped. reported is
+	// whether Write has returned it.
+	err      error
+	reported bool
+}
+
+func (w *Writer) ID() string {
+	return w.id
+}
+
+// Write appends a packet stamped with the current time. Once the recording
+// has ended early, Write returns the reason once and then drops packets.
+func (w *Writer) Write(packet rawterm.Packet) error {
+	raw := packet.Bytes()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil && len(w.pending)+12+len(raw) > maxPendingSize {
+		w.err = ErrBacklog
+	}
+	if w.err != nil {
+		if w.reported {
+			return nil
+		}
+		w.reported = true
+		return w.err
+	}
+	w.pending = binary.LittleEndian.AppendUint64(w.pending, uint64(time.Since(w.start)))
+	w.pending = binary.LittleEndian.AppendUint32(w.pending, uint32(len(raw)))
+	w.pending = append(w.pending, raw...)
+	return nil
+}
+
+// Close writes the buffered frames and closes the file.
+func (w *Writer) Close() error {
+	close(w.done)
+	<-w.stopped
+	err := w.flush()
+	w.store.mu.Lock()
+	delete(w.store.active, w.id)
+	w.store.mu.Unlock()
+	return errors.Join(err, w.file.Close())
+}
+
+// run flushes the buffered frames every flushInterval until Close.
+func (w *Writer) run() {
+	defer close(w.stopped)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			if err := w.flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// flush writes the buffered frames to the file. Only one goroutine flushes at
+// a time: run until Close stops it, then Close.
+func (w *Writer) flush() error {
+	w.mu.Lock()
+	pending := w.pending
+	w.pending = nil
+	err := w.err
+	w.mu.Unlock()
+	if err != nil && !errors.Is(err, ErrBacklog) {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	if _, err := w.file.Write(pending); err != nil {
+		w.mu.Lock()
+		w.err = err
+		w.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Reader reads frames from a recording in order.
+type Reader struct {
+	file  *os.File
+	buf   *bufio.Reader
+	start time.Time
+}
+
+func (r *Reader) StartedAt() time.Time {
+	return r.start
+}
+
+// Next returns the next frame and its offset from the start of the
+// recording. It returns io.EOF at the end of the recording, including when the
+// last frame was only partly written.
+func (r *Reader) Next() (time.Duration, rawterm.Packet, error) {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r.buf, header); err != nil {
+		return 0, rawterm.Packet{}, io.EOF
+	}
+	offset := time.Duration(binary.LittleEndian.Uint64(header[:8]))
+	length := binary.LittleEndian.Uint32(header[8:])
+	if length > maxFrameSize {
+		return 0, rawterm.Packet{}, ErrCorrupt
+	}
+	raw := make([]byte, length)
+	if _, err := io.ReadFull(r.buf, raw); err != nil {
+		return 0, rawterm.Packet{}, io.EOF
+	}
+	packet, err := rawterm.ParsePacket(raw)
+	if err != nil {
+		return 0, rawterm.Packet{}, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	return offset, packet, nil
+}
+
+func (r *Reader) Close() error {
+	return r.file.Close()
+}
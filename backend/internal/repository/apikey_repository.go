@@ -13,16 +13,57 @@ type APIKeyRecord struct {
 	Name      string
 	Hash      string
 	CreatedAt time.Time
+	// Scopes lists what the key may do, e.g. "terminal:view".
+	Scopes []string
+	// ComputerIDs and ComputerTags restrict the key to those computers, if
+	// either is set.
+	ComputerIDs  []int
+	ComputerTags []string
+	// BoundToComputer is set if the key is bound to its one computer ID,
+	// which it may only connect as by one session at a time.
+	BoundToComputer bool
+	// ExpiresAt is when the key stops working, if it expires.
+	ExpiresAt *time.Time
+	// LastUsedAt and LastUsedAddr record the key's last websocket
+	// authentication.
+	LastUsedAt   *time.Time
+	LastUsedAddr string
+	// PreviousHash is the hash of the secret the key had before it was last
+	// rotated, which works until PreviousExpiresAt.
+	PreviousHash      string
+	PreviousExpiresAt *time.Time
 }
 
 type APIKeyCreate struct {
-	Name string
-	Hash string
+	Name            string
+	Hash            string
+	Scopes          []string
+	ComputerIDs     []int
+	ComputerTags    []string
+	BoundToComputer bool
+	ExpiresAt       *time.Time
 }
 
 type APIKeyRepository interface {
 	Create(ctx context.Context, record APIKeyCreate) (*APIKeyRecord, error)
 	DeleteByID(ctx context.Context, id string) (*APIKeyRecord, error)
+	GetByID(ctx context.Context, id string) (*APIKeyRecord, error)
+	// GetByHash returns the key whose current or previous secret has the
+	// given hash.
 	GetByHash(ctx context.Context, hash string) (*APIKeyRecord, error)
 	List(ctx context.Context) ([]*APIKeyRecord, error)
+	// CountWithScope returns how many keys hold scope.
+	CountWithScope(ctx context.Context, scope string) (int64, error)
+	// Touch records that the key authenticated from addr at the given time.
+	Touch(ctx context.Context, id string, at time.Time, addr string) error
+	// Rotate replaces the key's secret hash, keeping the old one as its
+	// previous hash until previousExpiresAt, or dropping it if that is nil.
+	// It also returns the hashes of secrets that stopped working.
+	Rotate(ctx context.Context, id string, hash string, previousExpiresAt *time.Time) (*APIKeyRecord, []string, error)
+	// ListExpiring returns keys that expire after after and at or before
+	// until.
+	ListExpiring(ctx context.Context, after time.Time, until time.Time) ([]*APIKeyRecord, error)
+	// ListPreviousExpiring returns keys whose previous secret stops working
+	// after after and at or before until.
+	ListPreviousExpiring(ctx context.Context, after time.Time, until time.Time) ([]*APIKeyRecord, error)
 }
@@ -0,0 +1,47 @@
+package repository
+
+import (
+	"context"
+	"time"
+)
+
+type AuditOutcome string
+
+const (
+	AuditOutcomeSuccess AuditOutcome = "success"
+	AuditOutcomeDenied  AuditOutcome = "denied"
+	AuditOutcomeFailed  AuditOutcome = "failed"
+)
+
+type AuditEventRecord struct {
+	ID          uint64
+	Time        time.Time
+	ActorKeyID  string
+	ActorUserID string
+	ActorName   string
+	RemoteAddr  string
+	Action      string
+	Target      string
+	Outcome     AuditOutcome
+	Error       string
+}
+
+// AuditEventQuery filters audit events. Zero fields match everything.
+type AuditEventQuery struct {
+	ActorKeyID  string
+	ActorUserID string
+	Action      string
+	Target      string
+	Outcome     AuditOutcome
+	Start       time.Time
+	End         time.Time
+	// BeforeID only matches events older than the event with this ID.
+	BeforeID uint64
+	Limit    int
+}
+
+type AuditRepository interface {
+	Create(ctx context.Context, record AuditEventRecord) (*AuditEventRecord, error)
+	// List returns matching events, newest first.
+	List(ctx context.Context, query AuditEventQuery) ([]*AuditEventRecord, error)
+}
@@ -0,0 +1,55 @@
+package repository
+
+import (
+	"context"
+	"time"
+)
+
+type ComputerRecord struct {
+	ID        int
+	Label     string
+	Host      string
+	CCVersion string
+	Kind      string
+	Advanced  bool
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// Tags and Groups are sorted.
+	Tags   []string
+	Groups []string
+}
+
+// ComputerGroupRecord is a named set of computers.
+type ComputerGroupRecord struct {
+	Name        string
+	Description string
+	// ComputerIDs is sorted.
+	ComputerIDs []int
+	CreatedAt   time.Time
+}
+
+type ComputerUpsert struct {
+	ID        int
+	Label     string
+	Host      string
+	CCVersion string
+	Kind      string
+	Advanced  bool
+	SeenAt    time.Time
+}
+
+type ComputerRepository interface {
+	Upsert(ctx context.Context, record ComputerUpsert) (*ComputerRecord, error)
+	TouchLastSeen(ctx context.Context, id int, seenAt time.Time) error
+	GetByID(ctx context.Context, id int) (*ComputerRecord, error)
+	DeleteByID(ctx context.Context, id int) (*ComputerRecord, error)
+	List(ctx context.Context) ([]*ComputerRecord, error)
+	// SetTags replaces the tags of a computer.
+	SetTags(ctx context.Context, id int, tags []string) (*ComputerRecord, error)
+	ListGroups(ctx context.Context) ([]*ComputerGroupRecord, error)
+	GetGroup(ctx context.Context, name string) (*ComputerGroupRecord, error)
+	// PutGroup creates a group or replaces the description and members of the
+	// group with the same name.
+	PutGroup(ctx context.Context, group ComputerGroupRecord) (*ComputerGroupRecord, error)
+	DeleteGroup(ctx context.Context, name string) (*ComputerGroupRecord, error)
+}
@@ -2,6 +2,7 @@ package repository
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"time"
 
@@ -10,10 +11,21 @@ import (
 )
 
 type gormAPIKey struct {
-	ID        string    `gorm:"primaryKey;type:text"`
-	Name      string    `gorm:"not null"`
-	Hash      string    `gorm:"uniqueIndex;not null"`
-	CreatedAt time.Time `gorm:"not null"`
+	ID           string    `gorm:"primaryKey;type:text"`
+	Name         string    `gorm:"not null"`
+	Hash         string    `gorm:"uniqueIndex;not null"`
+	CreatedAt    time.Time `gorm:"not null"`
+	Scopes       []string  `gorm:"serializer:json"`
+	ComputerIDs  []int     `gorm:"serializer:json"`
+	ComputerTags []string  `gorm:"serializer:json"`
+	// BoundToComputer is set if the key is bound to its one computer ID.
+	BoundToComputer bool       `gorm:"not null;default:false"`
+	ExpiresAt       *time.Time `gorm:"index"`
+	LastUsedAt      *time.Time
+	LastUsedAddr    string
+	// PreviousHash is the hash of the secret replaced by the last rotation.
+	PreviousHash      *string `gorm:"index"`
+	PreviousExpiresAt *time.Time
 }
 
 func (k *gormAPIKey) BeforeCreate(tx *gorm.DB) error {
@@ -23,6 +35,10 @@ func (k *gormAPIKey) BeforeCreate(tx *gorm.DB) error {
 	return nil
 }
 
+// legacyKeyScopes are granted to keys created before keys had scopes. Those
+// keys are kept in computers' startup files, so they may only connect.
+var legacyKeyScopes = []string{"computer:connect"}
+
 type GormAPIKeyRepository struct {
 	db *gorm.DB
 }
@@ -32,23 +48,37 @@ func NewGormAPIKeyRepository(db *gorm.DB) *GormAPIKeyRepository {
 }
 
 func AutoMigrate(db *gorm.DB) error {
-	return db.AutoMigrate(&gormAPIKey{})
+	if err := db.AutoMigrate(&gormAPIKey{}, &gormComputer{}, &gormComputerTag{}, &gormComputerGroup{}, &gormComputerGroupMember{}, &gormMetricSeries{}, &gormMetricPoint{}, &gormAuditEvent{}, &gormUser{}, &gormUserSession{}); err != nil {
+		return err
+	}
+	return migrateLegacyKeyScopes(db)
+}
+
+// migrateLegacyKeyScopes lets keys without scopes connect computers and
+// nothing else.
+func migrateLegacyKeyScopes(db *gorm.DB) error {
+	legacy, err := json.Marshal(legacyKeyScopes)
+	if err != nil {
+		return err
+	}
+	return db.Model(&gormAPIKey{}).Where("scopes IS NULL").
+		UpdateColumn("scopes", gorm.Expr("?", string(legacy))).Error
 }
 
 func (r *GormAPIKeyRepository) Create(ctx context.Context, record APIKeyCreate) (*APIKeyRecord, error) {
 	model := gormAPIKey{
-		Name: record.Name,
-		Hash: record.Hash,
+		Name:            record.Name,
+		Hash:            record.Hash,
+		Scopes:          record.Scopes,
+		ComputerIDs:     record.ComputerIDs,
+		ComputerTags:    record.ComputerTags,
+		BoundToComputer: record.BoundToComputer,
+		ExpiresAt:       record.ExpiresAt,
 	}
 	if err := r.db.WithContext(ctx).Create(&model).Error; err != nil {
 		return nil, err
 	}
-	return &APIKeyRecord{
-		ID:        model.ID,
-		Name:      model.Name,
-		Hash:      model.Hash,
-		CreatedAt: model.CreatedAt,
-	}, nil
+	return toAPIKeyRecord(&model), nil
 }
 
 func (r *GormAPIKeyRepository) DeleteByID(ctx context.Context, id string) (*APIKeyRecord, error) {
@@ -62,28 +92,29 @@ func (r *GormAPIKeyRepository) DeleteByID(ctx context.Context, id string) (*APIK
 	if err := r.db.WithContext(ctx).Delete(&gormAPIKey{}, "id = ?", id).Error; err != nil {
 		return nil, err
 	}
-	return &APIKeyRecord{
-		ID:        model.ID,
-		Name:      model.Name,
-		Hash:      model.Hash,
-		CreatedAt: model.CreatedAt,
-	}, nil
+	return toAPIKeyRecord(&model), nil
+}
+
+func (r *GormAPIKeyRepository) GetByID(ctx context.Context, id string) (*APIKeyRecord, error) {
+	var model gormAPIKey
+	if err := r.db.WithContext(ctx).First(&model, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return toAPIKeyRecord(&model), nil
 }
 
 func (r *GormAPIKeyRepository) GetByHash(ctx context.Context, hash string) (*APIKeyRecord, error) {
 	var model gormAPIKey
-	if err := r.db.WithContext(ctx).First(&model, "hash = ?", hash).Error; err != nil {
+	if err := r.db.WithContext(ctx).First(&model, "hash = ? OR previous_hash = ?", hash, hash).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil, ErrNotFound
 		}
 		return nil, err
 	}
-	return &APIKeyRecord{
-		ID:        model.ID,
-		Name:      model.Name,
-		Hash:      model.Hash,
-		CreatedAt: model.CreatedAt,
-	}, nil
+	return toAPIKeyRecord(&model), nil
 }
 
 func (r *GormAPIKeyRepository) List(ctx context.Context) ([]*APIKeyRecord, error) {
@@ -92,13 +123,114 @@ func (r *GormAPIKeyRepository) List(ctx context.Context) ([]*APIKeyRecord, error
 		return nil, err
 	}
 	records := make([]*APIKeyRecord, 0, len(models))
-	for _, model := range models {
-		records = append(records, &APIKeyRecord{
-			ID:        model.ID,
-			Name:      model.Name,
-			Hash:      model.Hash,
-			CreatedAt: model.CreatedAt,
-		})
+	for i := range models {
+		records = append(records, toAPIKeyRecord(&models[i]))
 	}
 	return records, nil
 }
+
+func (r *GormAPIKeyRepository) CountWithScope(ctx context.Context, scope string) (int64, error) {
+	var count int64
+	err := r.db.WithContext(ctx).Model(&gormAPIKey{}).
+		Where("EXISTS (SELECT 1 FROM json_each(scopes) WHERE json_each.value = ?)", scope).
+		Count(&count).Error
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (r *GormAPIKeyRepository) Touch(ctx context.Context, id string, at time.Time, addr string) error {
+	return r.db.WithContext(ctx).Model(&gormAPIKey{}).Where("id = ?", id).
+		UpdateColumns(map[string]any{"last_used_at": at, "last_used_addr": addr}).Error
+}
+
+func (r *GormAPIKeyRepository) Rotate(ctx context.Context, id string, hash string, previousExpiresAt *time.Time) (*APIKeyRecord, []string, error) {
+	var model gormAPIKey
+	var retired []string
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&model, "id = ?", id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotFound
+			}
+			return err
+		}
+		// A previous secret still in its grace period is replaced either way.
+		if model.PreviousHash != nil && model.PreviousExpiresAt != nil && time.Now().Before(*model.PreviousExpiresAt) {
+			retired = append(retired, *model.PreviousHash)
+		}
+		if previousExpiresAt == nil {
+			retired = append(retired, model.Hash)
+		}
+		model.PreviousHash = nil
+		model.PreviousExpiresAt = nil
+		if previousExpiresAt != nil {
+			previousHash := model.Hash
+			model.PreviousHash = &previousHash
+			model.PreviousExpiresAt = previousExpiresAt
+		}
+		model.Hash = hash
+		return tx.Model(&gormAPIKey{}).Where("id = ?", id).UpdateColumns(map[string]any{
+			"hash":                model.Hash,
+			"previous_hash":       model.PreviousHash,
+			"previous_expires_at": model.PreviousExpiresAt,
+		}).Error
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return toAPIKeyRecord(&model), retired, nil
+}
+
+func (r *GormAPIKeyRepository) ListExpiring(ctx context.Context, after time.Time, until time.Time) ([]*APIKeyRecord, error) {
+	var models []gormAPIKey
+	err := r.db.WithContext(ctx).
+		Where("expires_at > ? AND expires_at <= ?", after, until).
+		Order("expires_at").
+		Find(&models).Error
+	if err != nil {
+		return nil, err
+	}
+	records := make([]*APIKeyRecord, 0, len(models))
+	for i := range models {
+		records = append(records, toAPIKeyRecord(&models[i]))
+	}
+	return records, nil
+}
+
+func (r *GormAPIKeyRepository) ListPreviousExpiring(ctx context.Context, after time.Time, until time.Time) ([]*APIKeyRecord, error) {
+	var models []gormAPIKey
+	err := r.db.WithContext(ctx).
+		Where("previous_hash IS NOT NULL AND previous_expires_at > ? AND previous_expires_at <= ?", after, until).
+		Order("previous_expires_at").
+		Find(&models).Error
+	if err != nil {
+		return nil, err
+	}
+	records := make([]*APIKeyRecord, 0, len(models))
+	for i := range models {
+		records = append(records, toAPIKeyRecord(&models[i]))
+	}
+	return records, nil
+}
+
+func toAPIKeyRecord(model *gormAPIKey) *APIKeyRecord {
+	record := &APIKeyRecord{
+		ID:                model.ID,
+		Name:              model.Name,
+		Hash:              model.Hash,
+		CreatedAt:         model.CreatedAt,
+		Scopes:            model.Scopes,
+		ComputerIDs:       model.ComputerIDs,
+		ComputerTags:      model.ComputerTags,
+		BoundToComputer:   model.BoundToComputer,
+		ExpiresAt:         model.ExpiresAt,
+		LastUsedAt:        model.LastUsedAt,
+		LastUsedAddr:      model.LastUsedAddr,
+		PreviousExpiresAt: model.PreviousExpiresAt,
+	}
+	if model.PreviousHash != nil {
+		record.PreviousHash = *model.PreviousHash
+	}
+	return record
+}
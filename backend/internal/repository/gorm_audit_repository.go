@@ -0,0 +1,102 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type gormAuditEvent struct {
+	ID          uint64    `gorm:"primaryKey"`
+	Time        time.Time `gorm:"not null;index"`
+	ActorKeyID  string    `gorm:"index"`
+	ActorUserID string    `gorm:"index"`
+	ActorName   string
+	RemoteAddr  string
+	Action      string `gorm:"not null;index"`
+	Target      string `gorm:"index"`
+	Outcome     string `gorm:"not null"`
+	Error       string
+}
+
+type GormAuditRepository struct {
+	db *gorm.DB
+}
+
+func NewGormAuditRepository(db *gorm.DB) *GormAuditRepository {
+	return &GormAuditRepository{db: db}
+}
+
+func (r *GormAuditRepository) Create(ctx context.Context, record AuditEventRecord) (*AuditEventRecord, error) {
+	model := gormAuditEvent{
+		Time:        record.Time,
+		ActorKeyID:  record.ActorKeyID,
+		ActorUserID: record.ActorUserID,
+		ActorName:   record.ActorName,
+		RemoteAddr:  record.RemoteAddr,
+		Action:      record.Action,
+		Target:      record.Target,
+		Outcome:     string(record.Outcome),
+		Error:       record.Error,
+	}
+	if err := r.db.WithContext(ctx).Create(&model).Error; err != nil {
+		return nil, err
+	}
+	return toAuditEventRecord(&model), nil
+}
+
+func (r *GormAuditRepository) List(ctx context.Context, query AuditEventQuery) ([]*AuditEventRecord, error) {
+	db := r.db.WithContext(ctx).Order("id desc")
+	if query.ActorKeyID != "" {
+		db = db.Where("actor_key_id = ?", query.ActorKeyID)
+	}
+	if query.ActorUserID != "" {
+		db = db.Where("actor_user_id = ?", query.ActorUserID)
+	}
+	if query.Action != "" {
+		db = db.Where("action = ?", query.Action)
+	}
+	if query.Target != "" {
+		db = db.Where("target = ?", query.Target)
+	}
+	if query.Outcome != "" {
+		db = db.Where("outcome = ?", string(query.Outcome))
+	}
+	if !query.Start.IsZero() {
+		db = db.Where("time >= ?", query.Start)
+	}
+	if !query.End.IsZero() {
+		db = db.Where("time < ?", query.End)
+	}
+	if query.BeforeID > 0 {
+		db = db.Where("id < ?", query.BeforeID)
+	}
+	if query.Limit > 0 {
+		db = db.Limit(query.Limit)
+	}
+	var models []gormAuditEvent
+	if err := db.Find(&models).Error; err != nil {
+		return nil, err
+	}
+	records := make([]*AuditEventRecord, 0, len(models))
+	for i := range models {
+		records = append(records, toAuditEventRecord(&models[i]))
+	}
+	return records, nil
+}
+
+func toAuditEventRecord(model *gormAuditEvent) *AuditEventRecord {
+	return &AuditEventRecord{
+		ID:          model.ID,
+		Time:        model.Time,
+		ActorKeyID:  model.ActorKeyID,
+		ActorUserID: model.ActorUserID,
+		ActorName:   model.ActorName,
+		RemoteAddr:  model.RemoteAddr,
+		Action:      model.Action,
+		Target:      model.Target,
+		Outcome:     AuditOutcome(model.Outcome),
+		Error:       model.Error,
+	}
+}
@@ -0,0 +1,127 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type gormComputerGroup struct {
+	Name        string    `gorm:"primaryKey"`
+	Description string    `gorm:"not null"`
+	CreatedAt   time.Time `gorm:"not null"`
+}
+
+type gormComputerGroupMember struct {
+	GroupName  string `gorm:"primaryKey"`
+	ComputerID int    `gorm:"primaryKey;autoIncrement:false;index"`
+}
+
+func (r *GormComputerRepository) ListGroups(ctx context.Context) ([]*ComputerGroupRecord, error) {
+	var models []gormComputerGroup
+	if err := r.db.WithContext(ctx).Order("name").Find(&models).Error; err != nil {
+		return nil, err
+	}
+	var members []gormComputerGroupMember
+	if err := r.db.WithContext(ctx).Order("computer_id").Find(&members).Error; err != nil {
+		return nil, err
+	}
+	byName := make(map[string][]int, len(models))
+	for _, member := range members {
+		byName[member.GroupName] = append(byName[member.GroupName], member.ComputerID)
+	}
+	records := make([]*ComputerGroupRecord, 0, len(models))
+	for i := range models {
+		records = append(records, toComputerGroupRecord(&models[i], byName[models[i].Name]))
+	}
+	return records, nil
+}
+
+func (r *GormComputerRepository) GetGroup(ctx context.Context, name string) (*ComputerGroupRecord, error) {
+	return r.getGroup(r.db.WithContext(ctx), name)
+}
+
+func (r *GormComputerRepository) getGroup(tx *gorm.DB, name string) (*ComputerGroupRecord, error) {
+	var model gormComputerGroup
+	if err := tx.First(&model, "name = ?", name).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	var members []gormComputerGroupMember
+	if err := tx.Where("group_name = ?", name).Order("computer_id").Find(&members).Error; err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0, len(members))
+	for _, member := range members {
+		ids = append(ids, member.ComputerID)
+	}
+	return toComputerGroupRecord(&model, ids), nil
+}
+
+func (r *GormComputerRepository) PutGroup(ctx context.Context, group ComputerGroupRecord) (*ComputerGroupRecord, error) {
+	var record *ComputerGroupRecord
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var model gormComputerGroup
+		err := tx.First(&model, "name = ?", group.Name).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			model = gormComputerGroup{Name: group.Name}
+		}
+		model.Description = group.Description
+		if err := tx.Save(&model).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&gormComputerGroupMember{}, "group_name = ?", group.Name).Error; err != nil {
+			return err
+		}
+		if len(group.ComputerIDs) > 0 {
+			members := make([]gormComputerGroupMember, 0, len(group.ComputerIDs))
+			for _, id := range group.ComputerIDs {
+				members = append(members, gormComputerGroupMember{GroupName: group.Name, ComputerID: id})
+			}
+			if err := tx.Create(&members).Error; err != nil {
+				return err
+			}
+		}
+		record, err = r.getGroup(tx, group.Name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (r *GormComputerRepository) DeleteGroup(ctx context.Context, name string) (*ComputerGroupRecord, error) {
+	var record *ComputerGroupRecord
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var err error
+		record, err = r.getGroup(tx, name)
+		if err != nil {
+			return err
+		}
+		if err := tx.Delete(&gormComputerGroupMember{}, "group_name = ?", name).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&gormComputerGroup{}, "name = ?", name).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func toComputerGroupRecord(model *gormComputerGroup, computerIDs []int) *ComputerGroupRecord {
+	return &ComputerGroupRecord{
+		Name:        model.Name,
+		Description: model.Description,
+		ComputerIDs: computerIDs,
+		CreatedAt:   model.CreatedAt,
+	}
+}
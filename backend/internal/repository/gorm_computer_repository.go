@@ -0,0 +1,207 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type gormComputer struct {
+	ID        int       `gorm:"primaryKey;autoIncrement:false"`
+	Label     string    `gorm:"not null"`
+	Host      string    `gorm:"not null"`
+	CCVersion string    `gorm:"not null"`
+	Kind      string    `gorm:"not null"`
+	Advanced  bool      `gorm:"not null"`
+	FirstSeen time.Time `gorm:"not null"`
+	LastSeen  time.Time `gorm:"not null"`
+}
+
+type gormComputerTag struct {
+	ComputerID int    `gorm:"primaryKey;autoIncrement:false"`
+	Tag        string `gorm:"primaryKey;index"`
+}
+
+type GormComputerRepository struct {
+	db *gorm.DB
+}
+
+func NewGormComputerRepository(db *gorm.DB) *GormComputerRepository {
+	return &GormComputerRepository{db: db}
+}
+
+func (r *GormComputerRepository) Upsert(ctx context.Context, record ComputerUpsert) (*ComputerRecord, error) {
+	var model gormComputer
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.First(&model, "id = ?", record.ID).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			model = gormComputer{
+				ID:        record.ID,
+				FirstSeen: record.SeenAt,
+			}
+		}
+		model.Label = record.Label
+		model.Host = record.Host
+		model.CCVersion = record.CCVersion
+		model.Kind = record.Kind
+		model.Advanced = record.Advanced
+		model.LastSeen = record.SeenAt
+		// Save would insert computer 0 every time, taking its zero primary
+		// key for unset.
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "id"}},
+			UpdateAll: true,
+		}).Create(&model).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.withSelectors(ctx, toComputerRecord(&model))
+}
+
+func (r *GormComputerRepository) TouchLastSeen(ctx context.Context, id int, seenAt time.Time) error {
+	result := r.db.WithContext(ctx).Model(&gormComputer{}).Where("id = ?", id).Update("last_seen", seenAt)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *GormComputerRepository) GetByID(ctx context.Context, id int) (*ComputerRecord, error) {
+	var model gormComputer
+	if err := r.db.WithContext(ctx).First(&model, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return r.withSelectors(ctx, toComputerRecord(&model))
+}
+
+func (r *GormComputerRepository) DeleteByID(ctx context.Context, id int) (*ComputerRecord, error) {
+	var model gormComputer
+	if err := r.db.WithContext(ctx).First(&model, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	record, err := r.withSelectors(ctx, toComputerRecord(&model))
+	if err != nil {
+		return nil, err
+	}
+	err = r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&gormComputerTag{}, "computer_id = ?", id).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&gormComputerGroupMember{}, "computer_id = ?", id).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&gormComputer{}, "id = ?", id).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (r *GormComputerRepository) List(ctx context.Context) ([]*ComputerRecord, error) {
+	var models []gormComputer
+	if err := r.db.WithContext(ctx).Order("id asc").Find(&models).Error; err != nil {
+		return nil, err
+	}
+	records := make([]*ComputerRecord, 0, len(models))
+	for i := range models {
+		records = append(records, toComputerRecord(&models[i]))
+	}
+	if err := r.loadSelectors(ctx, records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (r *GormComputerRepository) SetTags(ctx context.Context, id int, tags []string) (*ComputerRecord, error) {
+	var model gormComputer
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&model, "id = ?", id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotFound
+			}
+			return err
+		}
+		if err := tx.Delete(&gormComputerTag{}, "computer_id = ?", id).Error; err != nil {
+			return err
+		}
+		if len(tags) == 0 {
+			return nil
+		}
+		rows := make([]gormComputerTag, 0, len(tags))
+		for _, tag := range tags {
+			rows = append(rows, gormComputerTag{ComputerID: id, Tag: tag})
+		}
+		return tx.Create(&rows).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.withSelectors(ctx, toComputerRecord(&model))
+}
+
+func (r *GormComputerRepository) withSelectors(ctx context.Context, record *ComputerRecord) (*ComputerRecord, error) {
+	if err := r.loadSelectors(ctx, []*ComputerRecord{record}); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// loadSelectors fills in the tags and groups of the records.
+func (r *GormComputerRepository) loadSelectors(ctx context.Context, records []*ComputerRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	byID := make(map[int]*ComputerRecord, len(records))
+	ids := make([]int, 0, len(records))
+	for _, record := range records {
+		byID[record.ID] = record
+		ids = append(ids, record.ID)
+	}
+	var tags []gormComputerTag
+	if err := r.db.WithContext(ctx).Where("computer_id IN ?", ids).Order("tag").Find(&tags).Error; err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		record := byID[tag.ComputerID]
+		record.Tags = append(record.Tags, tag.Tag)
+	}
+	var members []gormComputerGroupMember
+	if err := r.db.WithContext(ctx).Where("computer_id IN ?", ids).Order("group_name").Find(&members).Error; err != nil {
+		return err
+	}
+	for _, member := range members {
+		record := byID[member.ComputerID]
+		record.Groups = append(record.Groups, member.GroupName)
+	}
+	return nil
+}
+
+func toComputerRecord(model *gormComputer) *ComputerRecord {
+	return &ComputerRecord{
+		ID:        model.ID,
+		Label:     model.Label,
+		Host:      model.Host,
+		CCVersion: model.CCVersion,
+		Kind:      model.Kind,
+		Advanced:  model.Advanced,
+		FirstSeen: model.FirstSeen,
+		LastSeen:  model.LastSeen,
+	}
+}
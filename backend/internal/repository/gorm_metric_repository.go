@@ -0,0 +1,240 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type gormMetricSeries struct {
+	ID         int64  `gorm:"primaryKey"`
+	ComputerID int    `gorm:"not null;uniqueIndex:idx_metric_series_key,priority:2"`
+	Name       string `gorm:"not null;uniqueIndex:idx_metric_series_key,priority:1"`
+	// Labels is the JSON encoding of the label map. encoding/json sorts map
+	// keys, so equal label sets encode identically.
+	Labels     string `gorm:"not null;uniqueIndex:idx_metric_series_key,priority:3"`
+	Unit       string `gorm:"not null"`
+	Kind       string `gorm:"not null"`
+	Cumulative bool   `gorm:"not null"`
+	Monotonic  bool   `gorm:"not null"`
+	Bounds     string `gorm:"not null"`
+}
+
+type gormMetricPoint struct {
+	SeriesID     int64 `gorm:"primaryKey;autoIncrement:false"`
+	Bucket       int64 `gorm:"primaryKey;autoIncrement:false;index"`
+	LastTime     int64 `gorm:"not null"`
+	Last         float64
+	Min          float64
+	Max          float64
+	Sum          float64
+	Count        uint64
+	BucketCounts string `gorm:"not null"`
+}
+
+type GormMetricRepository struct {
+	db *gorm.DB
+}
+
+func NewGormMetricRepository(db *gorm.DB) *GormMetricRepository {
+	return &GormMetricRepository{db: db}
+}
+
+func (r *GormMetricRepository) MergeSamples(ctx context.Context, samples []MetricSample) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		type seriesKey struct {
+			computerID int
+			name       string
+			labels     string
+		}
+		seriesIDs := make(map[seriesKey]int64)
+		for _, sample := range samples {
+			if sample.Key.Labels == nil {
+				sample.Key.Labels = map[string]string{}
+			}
+			labels, err := json.Marshal(sample.Key.Labels)
+			if err != nil {
+				return err
+			}
+			cacheKey := seriesKey{sample.Key.ComputerID, sample.Key.Name, string(labels)}
+			seriesID, ok := seriesIDs[cacheKey]
+			if !ok {
+				series, err := upsertMetricSeries(tx, sample, string(labels))
+				if err != nil {
+					return err
+				}
+				seriesID = series.ID
+				seriesIDs[cacheKey] = seriesID
+			}
+			if err := mergeMetricPoint(tx, seriesID, sample); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func upsertMetricSeries(tx *gorm.DB, sample MetricSample, labels string) (*gormMetricSeries, error) {
+	bounds, err := json.Marshal(sample.Bounds)
+	if err != nil {
+		return nil, err
+	}
+	var model gormMetricSeries
+	err = tx.First(&model, "name = ? AND computer_id = ? AND labels = ?", sample.Key.Name, sample.Key.ComputerID, labels).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		model = gormMetricSeries{
+			ComputerID: sample.Key.ComputerID,
+			Name:       sample.Key.Name,
+			Labels:     labels,
+		}
+	}
+	// A computer may redefine a metric, e.g. after a program update; the
+	// series follows the newest definition.
+	changed := model.Unit != sample.Unit || model.Kind != string(sample.Kind) ||
+		model.Cumulative != sample.Cumulative || model.Monotonic != sample.Monotonic ||
+		model.Bounds != string(bounds)
+	if model.ID != 0 && !changed {
+		return &model, nil
+	}
+	model.Unit = sample.Unit
+	model.Kind = string(sample.Kind)
+	model.Cumulative = sample.Cumulative
+	model.Monotonic = sample.Monotonic
+	model.Bounds = string(bounds)
+	if err := tx.Save(&model).Error; err != nil {
+		return nil, err
+	}
+	return &model, nil
+}
+
+func mergeMetricPoint(tx *gorm.DB, seriesID int64, sample MetricSample) error {
+	bucket := sample.Point.Bucket.UnixNano()
+	var model gormMetricPoint
+	err := tx.First(&model, "series_id = ? AND bucket = ?", seriesID, bucket).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	var point MetricPointRecord
+	if err == nil {
+		existing, err := toMetricPointRecord(&model)
+		if err != nil {
+			return err
+		}
+		point = *existing
+	}
+	point.Merge(sample.Point, sample.Cumulative)
+	bucketCounts, err := json.Marshal(point.BucketCounts)
+	if err != nil {
+		return err
+	}
+	model = gormMetricPoint{
+		SeriesID:     seriesID,
+		Bucket:       bucket,
+		LastTime:     point.LastTime.UnixNano(),
+		Last:         point.Last,
+		Min:          point.Min,
+		Max:          point.Max,
+		Sum:          point.Sum,
+		Count:        point.Count,
+		BucketCounts: string(bucketCounts),
+	}
+	return tx.Save(&model).Error
+}
+
+func (r *GormMetricRepository) ListSeries(ctx context.Context, name string, computerID *int) ([]*MetricSeriesRecord, error) {
+	query := r.db.WithContext(ctx).Where("name = ?", name)
+	if computerID != nil {
+		query = query.Where("computer_id = ?", *computerID)
+	}
+	var models []gormMetricSeries
+	if err := query.Order("computer_id, labels").Find(&models).Error; err != nil {
+		return nil, err
+	}
+	records := make([]*MetricSeriesRecord, 0, len(models))
+	for i := range models {
+		record, err := toMetricSeriesRecord(&models[i])
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func (r *GormMetricRepository) ListPoints(ctx context.Context, seriesIDs []int64, start time.Time, end time.Time) ([]*MetricPointRecord, error) {
+	if len(seriesIDs) == 0 {
+		return nil, nil
+	}
+	var models []gormMetricPoint
+	err := r.db.WithContext(ctx).
+		Where("series_id IN ? AND bucket >= ? AND bucket < ?", seriesIDs, start.UnixNano(), end.UnixNano()).
+		Order("series_id, bucket").
+		Find(&models).Error
+	if err != nil {
+		return nil, err
+	}
+	records := make([]*MetricPointRecord, 0, len(models))
+	for i := range models {
+		record, err := toMetricPointRecord(&models[i])
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func (r *GormMetricRepository) DeletePointsBefore(ctx context.Context, t time.Time) (int64, error) {
+	var deleted int64
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("bucket < ?", t.UnixNano()).Delete(&gormMetricPoint{})
+		if result.Error != nil {
+			return result.Error
+		}
+		deleted = result.RowsAffected
+		return tx.Where("id NOT IN (?)", tx.Model(&gormMetricPoint{}).Distinct("series_id")).Delete(&gormMetricSeries{}).Error
+	})
+	return deleted, err
+}
+
+func toMetricSeriesRecord(model *gormMetricSeries) (*MetricSeriesRecord, error) {
+	record := &MetricSeriesRecord{
+		ID:         model.ID,
+		ComputerID: model.ComputerID,
+		Name:       model.Name,
+		Unit:       model.Unit,
+		Kind:       MetricKind(model.Kind),
+		Cumulative: model.Cumulative,
+		Monotonic:  model.Monotonic,
+	}
+	if err := json.Unmarshal([]byte(model.Labels), &record.Labels); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(model.Bounds), &record.Bounds); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func toMetricPointRecord(model *gormMetricPoint) (*MetricPointRecord, error) {
+	record := &MetricPointRecord{
+		SeriesID: model.SeriesID,
+		Bucket:   time.Unix(0, model.Bucket),
+		LastTime: time.Unix(0, model.LastTime),
+		Last:     model.Last,
+		Min:      model.Min,
+		Max:      model.Max,
+		Sum:      model.Sum,
+		Count:    model.Count,
+	}
+	if err := json.Unmarshal([]byte(model.BucketCounts), &record.BucketCounts); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
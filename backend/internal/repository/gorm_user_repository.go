@@ -0,0 +1,233 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type gormUser struct {
+	ID           string    `gorm:"primaryKey;type:text"`
+	Username     string    `gorm:"uniqueIndex;not null"`
+	PasswordHash string    `gorm:"not null"`
+	Role         string    `gorm:"not null"`
+	CreatedAt    time.Time `gorm:"not null"`
+	// Issuer and Subject are null for users with passwords.
+	Issuer  *string `gorm:"uniqueIndex:idx_user_external_id"`
+	Subject *string `gorm:"uniqueIndex:idx_user_external_id"`
+}
+
+func (u *gormUser) BeforeCreate(tx *gorm.DB) error {
+	if u.ID == "" {
+		u.ID = uuid.NewString()
+	}
+	return nil
+}
+
+type gormUserSession struct {
+	TokenHash  string    `gorm:"primaryKey;type:text"`
+	UserID     string    `gorm:"not null;index"`
+	CreatedAt  time.Time `gorm:"not null"`
+	ExpiresAt  time.Time `gorm:"not null;index"`
+	RemoteAddr string
+}
+
+type GormUserRepository struct {
+	db *gorm.DB
+}
+
+func NewGormUserRepository(db *gorm.DB) *GormUserRepository {
+	return &GormUserRepository{db: db}
+}
+
+func (r *GormUserRepository) Create(ctx context.Context, record UserCreate) (*UserRecord, error) {
+	model := gormUser{
+		Username:     record.Username,
+		PasswordHash: record.PasswordHash,
+		Role:         record.Role,
+	}
+	if record.Issuer != "" {
+		model.Issuer = &record.Issuer
+		model.Subject = &record.Subject
+	}
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&gormUser{}).Where("username = ?", record.Username).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrDuplicate
+		}
+		return tx.Create(&model).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return toUserRecord(&model), nil
+}
+
+func (r *GormUserRepository) DeleteByID(ctx context.Context, id string) (*UserRecord, error) {
+	var model gormUser
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&model, "id = ?", id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotFound
+			}
+			return err
+		}
+		if err := tx.Delete(&gormUserSession{}, "user_id = ?", id).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&gormUser{}, "id = ?", id).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return toUserRecord(&model), nil
+}
+
+func (r *GormUserRepository) GetByID(ctx context.Context, id string) (*UserRecord, error) {
+	var model gormUser
+	if err := r.db.WithContext(ctx).First(&model, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return toUserRecord(&model), nil
+}
+
+func (r *GormUserRepository) GetByUsername(ctx context.Context, username string) (*UserRecord, error) {
+	var model gormUser
+	if err := r.db.WithContext(ctx).First(&model, "username = ?", username).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return toUserRecord(&model), nil
+}
+
+func (r *GormUserRepository) GetByExternalID(ctx context.Context, issuer string, subject string) (*UserRecord, error) {
+	var model gormUser
+	if err := r.db.WithContext(ctx).First(&model, "issuer = ? AND subject = ?", issuer, subject).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return toUserRecord(&model), nil
+}
+
+func (r *GormUserRepository) UpdateProfile(ctx context.Context, id string, username string, role string) (*UserRecord, error) {
+	var model gormUser
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&model, "id = ?", id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotFound
+			}
+			return err
+		}
+		var count int64
+		if err := tx.Model(&gormUser{}).Where("username = ? AND id <> ?", username, id).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrDuplicate
+		}
+		model.Username = username
+		model.Role = role
+		return tx.Model(&gormUser{}).Where("id = ?", id).UpdateColumns(map[string]any{
+			"username": username,
+			"role":     role,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return toUserRecord(&model), nil
+}
+
+func (r *GormUserRepository) List(ctx context.Context) ([]*UserRecord, error) {
+	var models []gormUser
+	if err := r.db.WithContext(ctx).Order("username").Find(&models).Error; err != nil {
+		return nil, err
+	}
+	records := make([]*UserRecord, 0, len(models))
+	for i := range models {
+		records = append(records, toUserRecord(&models[i]))
+	}
+	return records, nil
+}
+
+func (r *GormUserRepository) SetPasswordHash(ctx context.Context, id string, hash string) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&gormUser{}).Where("id = ?", id).UpdateColumn("password_hash", hash)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		return tx.Delete(&gormUserSession{}, "user_id = ?", id).Error
+	})
+}
+
+func (r *GormUserRepository) RehashPassword(ctx context.Context, id string, hash string) error {
+	return r.db.WithContext(ctx).Model(&gormUser{}).Where("id = ?", id).UpdateColumn("password_hash", hash).Error
+}
+
+func (r *GormUserRepository) CreateSession(ctx context.Context, record UserSessionRecord) error {
+	model := gormUserSession{
+		TokenHash:  record.TokenHash,
+		UserID:     record.UserID,
+		CreatedAt:  record.CreatedAt,
+		ExpiresAt:  record.ExpiresAt,
+		RemoteAddr: record.RemoteAddr,
+	}
+	return r.db.WithContext(ctx).Create(&model).Error
+}
+
+func (r *GormUserRepository) GetSession(ctx context.Context, tokenHash string) (*UserSessionRecord, error) {
+	var model gormUserSession
+	if err := r.db.WithContext(ctx).First(&model, "token_hash = ?", tokenHash).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &UserSessionRecord{
+		TokenHash:  model.TokenHash,
+		UserID:     model.UserID,
+		CreatedAt:  model.CreatedAt,
+		ExpiresAt:  model.ExpiresAt,
+		RemoteAddr: model.RemoteAddr,
+	}, nil
+}
+
+func (r *GormUserRepository) DeleteSession(ctx context.Context, tokenHash string) error {
+	return r.db.WithContext(ctx).Delete(&gormUserSession{}, "token_hash = ?", tokenHash).Error
+}
+
+func (r *GormUserRepository) DeleteExpiredSessions(ctx context.Context, before time.Time) (int64, error) {
+	result := r.db.WithContext(ctx).Delete(&gormUserSession{}, "expires_at <= ?", before)
+	return result.RowsAffected, result.Error
+}
+
+func toUserRecord(model *gormUser) *UserRecord {
+	record := &UserRecord{
+		ID:           model.ID,
+		Username:     model.Username,
+		PasswordHash: model.PasswordHash,
+		Role:         model.Role,
+		CreatedAt:    model.CreatedAt,
+	}
+	if model.Issuer != nil && model.Subject != nil {
+		record.Issuer = *model.Issuer
+		record.Subject = *model.Subject
+	}
+	return record
+}
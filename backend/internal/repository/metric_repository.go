@@ -0,0 +1,123 @@
+package repository
+
+import (
+	"context"
+	"time"
+)
+
+type MetricKind string
+
+const (
+	MetricKindGauge     MetricKind = "gauge"
+	MetricKindSum       MetricKind = "sum"
+	MetricKindHistogram MetricKind = "histogram"
+)
+
+// MetricSeriesKey identifies a series: one metric of one computer with one set
+// of data point attributes.
+type MetricSeriesKey struct {
+	ComputerID int
+	Name       string
+	Labels     map[string]string
+}
+
+type MetricSeriesRecord struct {
+	ID         int64
+	ComputerID int
+	Name       string
+	Unit       string
+	Kind       MetricKind
+	// Cumulative is true for sums and histograms whose data points report a
+	// running total rather than the change since the previous point.
+	Cumulative bool
+	Monotonic  bool
+	Labels     map[string]string
+	// Bounds are the explicit bucket bounds of a histogram.
+	Bounds []float64
+}
+
+// MetricPointRecord is the aggregate of every data point of a series that fell
+// into one bucket of the store's resolution.
+type MetricPointRecord struct {
+	SeriesID int64
+	Bucket   time.Time
+	// LastTime is the time of the newest data point merged into the bucket.
+	LastTime time.Time
+	// Last is the value of the newest data point: the gauge or sum value, or
+	// the histogram's mean.
+	Last float64
+	Min  float64
+	Max  float64
+	// Sum and Count total the values of gauges and delta sums, or hold the
+	// histogram sum and count.
+	Sum          float64
+	Count        uint64
+	BucketCounts []uint64
+}
+
+// Merge folds other into p. Cumulative points replace the sum, count and
+// bucket counts with the newest reading; all others add up.
+func (p *MetricPointRecord) Merge(other MetricPointRecord, cumulative bool) {
+	if p.LastTime.IsZero() {
+		bucket := p.Bucket
+		*p = other
+		p.BucketCounts = append([]uint64(nil), other.BucketCounts...)
+		if !bucket.IsZero() {
+			p.Bucket = bucket
+		}
+		return
+	}
+	p.Min = min(p.Min, other.Min)
+	p.Max = max(p.Max, other.Max)
+	newer := !other.LastTime.Before(p.LastTime)
+	if newer {
+		p.LastTime = other.LastTime
+		p.Last = other.Last
+	}
+	if cumulative {
+		if newer {
+			p.Sum = other.Sum
+			p.Count = other.Count
+			p.BucketCounts = append(p.BucketCounts[:0], other.BucketCounts...)
+		}
+		return
+	}
+	p.Sum += other.Sum
+	p.Count += other.Count
+	if len(p.BucketCounts) != len(other.BucketCounts) {
+		// The histogram's bounds changed; keep the newest layout.
+		if newer {
+			p.BucketCounts = append(p.BucketCounts[:0], other.BucketCounts...)
+		}
+		return
+	}
+	for i, count := range other.BucketCounts {
+		p.BucketCounts[i] += count
+	}
+}
+
+// MetricSample is a data point to merge into the store.
+type MetricSample struct {
+	Key        MetricSeriesKey
+	Unit       string
+	Kind       MetricKind
+	Cumulative bool
+	Monotonic  bool
+	Bounds     []float64
+	Point      MetricPointRecord
+}
+
+type MetricRepository interface {
+	// MergeSamples merges each sample into its series' point for the sample's
+	// bucket, creating the series and point as needed.
+	MergeSamples(ctx context.Context, samples []MetricSample) error
+	// ListSeries returns the series of a metric, optionally limited to one
+	// computer.
+	ListSeries(ctx context.Context, name string, computerID *int) ([]*MetricSeriesRecord, error)
+	// ListPoints returns the points of the given series with buckets in
+	// [start, end), ordered by series then bucket.
+	ListPoints(ctx context.Context, seriesIDs []int64, start time.Time, end time.Time) ([]*MetricPointRecord, error)
+	// DeletePointsBefore deletes points with buckets before t and any series
+	// left without points.
+	DeletePointsBefore(ctx context.Context, t time.Time) (int64, error)
+}
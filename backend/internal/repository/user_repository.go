@@ -0,0 +1,72 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var ErrDuplicate = errors.New("record already exists")
+
+type UserRecord struct {
+	ID       string
+	Username string
+	// PasswordHash is the encoded hash of the user's password, including the
+	// algorithm and parameters used. It is empty for users signed in by an
+	// identity provider.
+	PasswordHash string
+	// Role names what the user may do, e.g. "operator".
+	Role      string
+	CreatedAt time.Time
+	// Issuer and Subject identify the user at the OpenID Connect provider
+	// that signs them in, if any.
+	Issuer  string
+	Subject string
+}
+
+type UserCreate struct {
+	Username     string
+	PasswordHash string
+	Role         string
+	Issuer       string
+	Subject      string
+}
+
+// UserSessionRecord is a signed-in user's session.
+type UserSessionRecord struct {
+	// TokenHash is the hash of the session's bearer token.
+	TokenHash  string
+	UserID     string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	RemoteAddr string
+}
+
+type UserRepository interface {
+	// Create adds a user, returning ErrDuplicate if the username is taken.
+	Create(ctx context.Context, record UserCreate) (*UserRecord, error)
+	// DeleteByID deletes a user and their sessions.
+	DeleteByID(ctx context.Context, id string) (*UserRecord, error)
+	GetByID(ctx context.Context, id string) (*UserRecord, error)
+	GetByUsername(ctx context.Context, username string) (*UserRecord, error)
+	// GetByExternalID returns the user with the given subject at the
+	// provider with the given issuer.
+	GetByExternalID(ctx context.Context, issuer string, subject string) (*UserRecord, error)
+	// UpdateProfile sets a user's username and role, returning ErrDuplicate
+	// if the username is taken.
+	UpdateProfile(ctx context.Context, id string, username string, role string) (*UserRecord, error)
+	// List returns every user, sorted by username.
+	List(ctx context.Context) ([]*UserRecord, error)
+	// SetPasswordHash replaces a user's password hash and deletes their
+	// sessions.
+	SetPasswordHash(ctx context.Context, id string, hash string) error
+	// RehashPassword replaces a user's password hash with another hash of
+	// the same password, keeping their sessions.
+	RehashPassword(ctx context.Context, id string, hash string) error
+	CreateSession(ctx context.Context, record UserSessionRecord) error
+	GetSession(ctx context.Context, tokenHash string) (*UserSessionRecord, error)
+	DeleteSession(ctx context.Context, tokenHash string) error
+	// DeleteExpiredSessions deletes sessions that expired at or before
+	// before, returning how many were deleted.
+	DeleteExpiredSessions(ctx context.Context, before time.Time) (int64, error)
+}
@@ -0,0 +1,197 @@
+// Package screen models the contents of a ComputerCraft text terminal as sent
+// in rawterm terminal contents packets, and computes compact differences
+// between successive frames.
+package screen
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	PaletteSize = 16
+
+	// MaxWidth and MaxHeight bound the terminals accepted from computers,
+	// well above the largest monitor ComputerCraft can build.
+	MaxWidth  = 1024
+	MaxHeight = 1024
+
+	headerSize = 14
+	modeText   = 0
+)
+
+var ErrInvalidScreen = errors.New("invalid terminal contents")
+var ErrUnsupportedMode = errors.New("unsupported graphics mode")
+
+const blitDigits = "0123456789abcdef"
+
+// Screen is a decoded text mode terminal. Foreground and Background hold blit
+// characters ("0" to "f"), matching term.blit.
+type Screen struct {
+	Width       int
+	Height      int
+	Text        [][]byte
+	Foreground  [][]byte
+	Background  [][]byte
+	Palette     [PaletteSize]uint32
+	CursorX     int
+	CursorY     int
+	CursorBlink bool
+}
+
+// Decode parses the body of a rawterm terminal contents packet. Only text mode
+// is modelled; graphics mode frames return ErrUnsupportedMode.
+func Decode(data []byte) (*Screen, error) {
+	if len(data) < headerSize {
+		return nil, fmt.Errorf("%w: header too short", ErrInvalidScreen)
+	}
+	if data[0] != modeText {
+		return nil, ErrUnsupportedMode
+	}
+	s := &Screen{
+		CursorBlink: data[1] != 0,
+		Width:       int(binary.LittleEndian.Uint16(data[2:4])),
+		Height:      int(binary.LittleEndian.Uint16(data[4:6])),
+		CursorX:     int(binary.LittleEndian.Uint16(data[6:8])),
+		CursorY:     int(binary.LittleEndian.Uint16(data[8:10])),
+	}
+	if s.Width > MaxWidth || s.Height > MaxHeight {
+		return nil, fmt.Errorf("%w: %dx%d is larger than %dx%d", ErrInvalidScreen, s.Width, s.Height, MaxWidth, MaxHeight)
+	}
+	cells := s.Width * s.Height
+	rest := data[headerSize:]
+
+	text, rest, err := decodeRLE(rest, cells)
+	if err != nil {
+		return nil, fmt.Errorf("%w: text: %v", ErrInvalidScreen, err)
+	}
+	colors, rest, err := decodeRLE(rest, cells)
+	if err != nil {
+		return nil, fmt.Errorf("%w: colors: %v", ErrInvalidScreen, err)
+	}
+	if len(rest) < PaletteSize*3 {
+		return nil, fmt.Errorf("%w: palette too short", ErrInvalidScreen)
+	}
+	for i := range s.Palette {
+		s.Palette[i] = uint32(rest[i*3])<<16 | uint32(rest[i*3+1])<<8 | uint32(rest[i*3+2])
+	}
+
+	s.Text = make([][]byte, s.Height)
+	s.Foreground = make([][]byte, s.Height)
+	s.Background = make([][]byte, s.Height)
+	for y := 0; y < s.Height; y++ {
+		row := text[y*s.Width : (y+1)*s.Width]
+		s.Text[y] = row
+		fg := make([]byte, s.Width)
+		bg := make([]byte, s.Width)
+		for x, color := range colors[y*s.Width : (y+1)*s.Width] {
+			fg[x] = blitDigits[color&0x0F]
+			bg[x] = blitDigits[color>>4]
+		}
+		s.Foreground[y] = fg
+		s.Background[y] = bg
+	}
+	return s, nil
+}
+
+// decodeRLE expands (value, count) pairs until n bytes have been produced.
+func decodeRLE(data []byte, n int) ([]byte, []byte, error) {
+	// Each pair produces at most 255 bytes, so data too short for n is
+	// rejected before anything is allocated.
+	if len(data)/2*255 < n {
+		return nil, nil, errors.New("run-length data truncated")
+	}
+	out := make([]byte, 0, n)
+	i := 0
+	for len(out) < n {
+		if i+1 >= len(data) {
+			return nil, nil, errors.New("run-length data truncated")
+		}
+		value, count := data[i], int(data[i+1])
+		i += 2
+		if len(out)+count > n {
+			return nil, nil, errors.New("run-length data overflows screen")
+		}
+		for j := 0; j < count; j++ {
+			out = append(out, value)
+		}
+	}
+	return out, data[i:], nil
+}
+
+// Span is a run of changed cells within one row.
+type Span struct {
+	Row        int
+	Column     int
+	Text       []byte
+	Foreground []byte
+	Background []byte
+}
+
+// Diff describes how to turn one screen into another. When Resized is set the
+// other fields are empty and the new screen must be sent in full.
+type Diff struct {
+	Resized       bool
+	Spans         []Span
+	Palette       map[int]uint32
+	CursorChanged bool
+}
+
+func (d Diff) Empty() bool {
+	return !d.Resized && len(d.Spans) == 0 && len(d.Palette) == 0 && !d.CursorChanged
+}
+
+// spanGap is how many unchanged cells may separate two changes before they are
+// sent as separate spans. Bridging short gaps costs less than another span's
+// row and column.
+const spanGap = 4
+
+// Diff returns the changes between s and next.
+func (s *Screen) Diff(next *Screen) Diff {
+	if s.Width != next.Width || s.Height != next.Height {
+		return Diff{Resized: true}
+	}
+	var d Diff
+	for y := 0; y < s.Height; y++ {
+		start, end := -1, -1
+		for x := 0; x < s.Width; x++ {
+			if s.Text[y][x] == next.Text[y][x] &&
+				s.Foreground[y][x] == next.Foreground[y][x] &&
+				s.Background[y][x] == next.Background[y][x] {
+				continue
+			}
+			if start >= 0 && x-end > spanGap {
+				d.Spans = append(d.Spans, next.span(y, start, end))
+				start = -1
+			}
+			if start < 0 {
+				start = x
+			}
+			end = x + 1
+		}
+		if start >= 0 {
+			d.Spans = append(d.Spans, next.span(y, start, end))
+		}
+	}
+	for i, color := range next.Palette {
+		if s.Palette[i] != color {
+			if d.Palette == nil {
+				d.Palette = make(map[int]uint32)
+			}
+			d.Palette[i] = color
+		}
+	}
+	d.CursorChanged = s.CursorX != next.CursorX || s.CursorY != next.CursorY || s.CursorBlink != next.CursorBlink
+	return d
+}
+
+func (s *Screen) span(row, start, end int) Span {
+	return Span{
+		Row:        row,
+		Column:     start,
+		Text:       s.Text[row][start:end],
+		Foreground: s.Foreground[row][start:end],
+		Background: s.Background[row][start:end],
+	}
+}
@@ -7,41 +7,153 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"log/slog"
+	"slices"
 	"sync"
+	"time"
 
 	authv1 "ehedges.net/ccgui/backend/gen/auth/v1"
 	"ehedges.net/ccgui/backend/internal/repository"
 	"github.com/google/uuid"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
-const keyLength = 64
+const (
+	keyLength = 64
+
+	// DefaultRotationGrace is how long a rotated key's old secret keeps
+	// working unless another grace period is given.
+	DefaultRotationGrace = 24 * time.Hour
+	maxRotationGrace     = 30 * 24 * time.Hour
+	// keyExpiryInterval is how often expired keys are looked for.
+	keyExpiryInterval = 15 * time.Second
+)
 
 var ErrKeyNotFound = errors.New("key not found")
 var ErrInvalidKeyID = errors.New("invalid key id")
+var ErrInvalidScope = errors.New("invalid scope")
+var ErrInvalidExpiry = errors.New("invalid expiry")
+var ErrInvalidBinding = errors.New("invalid computer binding")
+
+// Scope is something an API key may do.
+type Scope string
+
+const (
+	// ScopeComputerConnect lets a key connect to /ws as a computer.
+	ScopeComputerConnect Scope = "computer:connect"
+	// ScopeTerminalView lets a key see computers, their terminals, logs and
+	// metrics.
+	ScopeTerminalView   Scope = "terminal:view"
+	ScopeTerminalInput  Scope = "terminal:input"
+	ScopePeripheralCall Scope = "peripheral:call"
+	// ScopeLuaExec lets a key run arbitrary Lua on computers.
+	ScopeLuaExec       Scope = "lua:exec"
+	ScopeCommandSend   Scope = "command:send"
+	ScopeComputerAdmin Scope = "computers:admin"
+	ScopeKeysAdmin     Scope = "keys:admin"
+)
+
+// Scopes lists every scope a key may be granted.
+var Scopes = []Scope{
+	ScopeComputerConnect,
+	ScopeTerminalView,
+	ScopeTerminalInput,
+	ScopePeripheralCall,
+	ScopeLuaExec,
+	ScopeCommandSend,
+	ScopeComputerAdmin,
+	ScopeKeysAdmin,
+}
+
+// KeyOptions are the permissions of a new key.
+type KeyOptions struct {
+	// Scopes lists what the key may do. At least one is required.
+	Scopes []Scope
+	// ComputerIDs and ComputerTags restrict the key to those computers, or
+	// to computers with any of those tags, if either is set.
+	ComputerIDs  []int
+	ComputerTags []string
+	// BindToComputer binds the key to its one computer ID: it may only
+	// connect as that computer, by one session at a time. It requires
+	// ScopeComputerConnect and exactly one computer ID, and no tags.
+	BindToComputer bool
+	// ExpiresAt is when the key stops working. The zero time never expires.
+	ExpiresAt time.Time
+}
 
 type APIKeyService interface {
-	Generate(ctx context.Context, name string) (*authv1.Key, error)
+	Generate(ctx context.Context, name string, opts KeyOptions) (*authv1.Key, error)
 	Delete(ctx context.Context, id string) (*authv1.KeySummary, error)
+	Get(ctx context.Context, id string) (*authv1.KeySummary, error)
 	GetAll(ctx context.Context) ([]*authv1.KeySummary, error)
+	// Rotate gives a key a new secret, returned once. The old secret keeps
+	// working for grace.
+	Rotate(ctx context.Context, id string, grace time.Duration) (*authv1.Key, error)
 	Validate(plain string) bool
-	ResolveID(plain string) (string, bool)
+	// ResolveID returns the ID of the key with the given secret value and
+	// the hash of that secret, recording that it was used from remoteAddr.
+	ResolveID(plain string, remoteAddr string) (id string, secretHash string, ok bool)
+	// Lookup returns the summary of the key with the given secret value.
+	Lookup(plain string) (*authv1.KeySummary, bool)
 	SubscribeDeletes() (<-chan string, func())
+	// SubscribeExpiries notifies the IDs of keys as they expire.
+	SubscribeExpiries() (<-chan string, func())
+	// SubscribeRetiredSecrets notifies the hashes of secrets that stop
+	// working while their key lives on: when a key is rotated without a
+	// grace period, or when the grace period ends.
+	SubscribeRetiredSecrets() (<-chan string, func())
 }
 
 type APIKeyServiceImpl struct {
-	repo repository.APIKeyRepository
-	mu   sync.RWMutex
-	subs map[chan string]struct{}
+	repo     repository.APIKeyRepository
+	deletes  keySubscribers
+	expiries keySubscribers
+	retired  keySubscribers
 }
 
 func NewAPIKeyService(repo repository.APIKeyRepository) *APIKeyServiceImpl {
 	return &APIKeyServiceImpl{
-		repo: repo,
-		subs: make(map[chan string]struct{}),
+		repo:     repo,
+		deletes:  keySubscribers{subs: make(map[chan string]chan struct{})},
+		expiries: keySubscribers{subs: make(map[chan string]chan struct{})},
+		retired:  keySubscribers{subs: make(map[chan string]chan struct{})},
 	}
 }
 
-func (s *APIKeyServiceImpl) Generate(ctx context.Context, name string) (*authv1.Key, error) {
+func (s *APIKeyServiceImpl) Generate(ctx context.Context, name string, opts KeyOptions) (*authv1.Key, error) {
+	scopes, err := normalizeScopes(opts.Scopes)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range opts.ComputerIDs {
+		if id < 0 {
+			return nil, ErrInvalidComputerID
+		}
+	}
+	computerIDs := slices.Clone(opts.ComputerIDs)
+	slices.Sort(computerIDs)
+	computerIDs = slices.Compact(computerIDs)
+	computerTags, err := normalizeTags(opts.ComputerTags)
+	if err != nil {
+		return nil, err
+	}
+	if opts.BindToComputer {
+		switch {
+		case !slices.Contains(scopes, string(ScopeComputerConnect)):
+			return nil, fmt.Errorf("%w: bound keys need the %s scope", ErrInvalidBinding, ScopeComputerConnect)
+		case len(computerIDs) != 1 || len(computerTags) != 0:
+			return nil, fmt.Errorf("%w: bound keys need exactly one computer id and no tags", ErrInvalidBinding)
+		}
+	}
+	var expiresAt *time.Time
+	if !opts.ExpiresAt.IsZero() {
+		if !opts.ExpiresAt.After(time.Now()) {
+			return nil, fmt.Errorf("%w: expiry must be in the future", ErrInvalidExpiry)
+		}
+		expiresAt = new(time.Time)
+		*expiresAt = opts.ExpiresAt.UTC()
+	}
+
 	rawKey, err := generateRandomBytes(keyLength)
 	if err != nil {
 		return nil, err
@@ -50,18 +162,63 @@ func (s *APIKeyServiceImpl) Generate(ctx context.Context, name string) (*authv1.
 	hash := hashAPIKey(key)
 
 	record, err := s.repo.Create(ctx, repository.APIKeyCreate{
-		Name: name,
-		Hash: hash,
+		Name:            name,
+		Hash:            hash,
+		Scopes:          scopes,
+		ComputerIDs:     computerIDs,
+		ComputerTags:    computerTags,
+		BoundToComputer: opts.BindToComputer,
+		ExpiresAt:       expiresAt,
 	})
 	if err != nil {
 		return nil, err
 	}
+	return secretKey(record, key), nil
+}
 
-	return &authv1.Key{
-		Id:   record.ID,
-		Name: record.Name,
-		Key:  key,
-	}, nil
+func (s *APIKeyServiceImpl) Rotate(ctx context.Context, id string, grace time.Duration) (*authv1.Key, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKeyID, err)
+	}
+	if grace < 0 || grace > maxRotationGrace {
+		return nil, fmt.Errorf("%w: grace period must be between 0 and %s", ErrInvalidExpiry, maxRotationGrace)
+	}
+	rawKey, err := generateRandomBytes(keyLength)
+	if err != nil {
+		return nil, err
+	}
+	key := base64.RawURLEncoding.EncodeToString(rawKey)
+
+	var previousExpiresAt *time.Time
+	if grace > 0 {
+		previousExpiresAt = new(time.Time)
+		*previousExpiresAt = time.Now().Add(grace).UTC()
+	}
+	record, retired, err := s.repo.Rotate(ctx, id, hashAPIKey(key), previousExpiresAt)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return nil, ErrKeyNotFound
+		}
+		return nil, err
+	}
+	// The secrets are retired even if the caller goes away now, so their
+	// sessions must still be closed.
+	notifyCtx := context.WithoutCancel(ctx)
+	for _, hash := range retired {
+		s.retired.notify(notifyCtx, hash)
+	}
+	return secretKey(record, key), nil
+}
+
+// Bootstrap creates an admin key holding every scope if no key may manage
+// keys, so the server can be administered. It returns nil if such a key
+// exists.
+func (s *APIKeyServiceImpl) Bootstrap(ctx context.Context) (*authv1.Key, error) {
+	count, err := s.repo.CountWithScope(ctx, string(ScopeKeysAdmin))
+	if err != nil || count > 0 {
+		return nil, err
+	}
+	return s.Generate(ctx, "admin", KeyOptions{Scopes: Scopes})
 }
 
 func (s *APIKeyServiceImpl) Delete(ctx context.Context, id string) (*authv1.KeySummary, error) {
@@ -75,11 +232,22 @@ func (s *APIKeyServiceImpl) Delete(ctx context.Context, id string) (*authv1.KeyS
 		}
 		return nil, err
 	}
-	s.notifyDelete(id)
-	return &authv1.KeySummary{
-		Id:   record.ID,
-		Name: record.Name,
-	}, nil
+	s.notifyDelete(context.WithoutCancel(ctx), id)
+	return keySummary(record), nil
+}
+
+func (s *APIKeyServiceImpl) Get(ctx context.Context, id string) (*authv1.KeySummary, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKeyID, err)
+	}
+	record, err := s.repo.GetByID(ctx, id)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return nil, ErrKeyNotFound
+		}
+		return nil, err
+	}
+	return keySummary(record), nil
 }
 
 func (s *APIKeyServiceImpl) GetAll(ctx context.Context) ([]*authv1.KeySummary, error) {
@@ -89,50 +257,191 @@ func (s *APIKeyServiceImpl) GetAll(ctx context.Context) ([]*authv1.KeySummary, e
 	}
 	summaries := make([]*authv1.KeySummary, 0, len(records))
 	for _, record := range records {
-		summaries = append(summaries, &authv1.KeySummary{
-			Id:   record.ID,
-			Name: record.Name,
-		})
+		summaries = append(summaries, keySummary(record))
 	}
 	return summaries, nil
 }
 
 func (s *APIKeyServiceImpl) Validate(plain string) bool {
-	_, ok := s.ResolveID(plain)
+	_, ok := s.Lookup(plain)
 	return ok
 }
 
-func (s *APIKeyServiceImpl) ResolveID(plain string) (string, bool) {
+func (s *APIKeyServiceImpl) ResolveID(plain string, remoteAddr string) (string, string, bool) {
+	summary, ok := s.Lookup(plain)
+	if !ok {
+		return "", "", false
+	}
+	if err := s.repo.Touch(context.Background(), summary.Id, time.Now().UTC(), remoteAddr); err != nil {
+		slog.Warn("failed to record key use", "key_id", summary.Id, "err", err)
+	}
+	return summary.Id, hashAPIKey(plain), true
+}
+
+func (s *APIKeyServiceImpl) Lookup(plain string) (*authv1.KeySummary, bool) {
 	hash := hashAPIKey(plain)
 	record, err := s.repo.GetByHash(context.Background(), hash)
 	if err != nil {
-		return "", false
+		return nil, false
 	}
-	return record.ID, true
+	now := time.Now()
+	if record.ExpiresAt != nil && !now.Before(*record.ExpiresAt) {
+		return nil, false
+	}
+	if record.Hash != hash && (record.PreviousExpiresAt == nil || !now.Before(*record.PreviousExpiresAt)) {
+		return nil, false
+	}
+	return keySummary(record), true
 }
 
 func (s *APIKeyServiceImpl) SubscribeDeletes() (<-chan string, func()) {
-	ch := make(chan string, 1)
-	s.mu.Lock()
-	s.subs[ch] = struct{}{}
-	s.mu.Unlock()
+	return s.deletes.subscribe(1)
+}
+
+func (s *APIKeyServiceImpl) SubscribeExpiries() (<-chan string, func()) {
+	return s.expiries.subscribe(16)
+}
+
+func (s *APIKeyServiceImpl) SubscribeRetiredSecrets() (<-chan string, func()) {
+	return s.retired.subscribe(16)
+}
+
+func (s *APIKeyServiceImpl) notifyDelete(ctx context.Context, id string) {
+	s.deletes.notify(ctx, id)
+}
+
+// Run notifies expiry subscribers as keys expire, and retired secret
+// subscribers as rotation grace periods end, until ctx is done.
+func (s *APIKeyServiceImpl) Run(ctx context.Context) {
+	ticker := time.NewTicker(keyExpiryInterval)
+	defer ticker.Stop()
+	var checked, previousChecked time.Time
+	for {
+		now := time.Now().UTC()
+		records, err := s.repo.ListExpiring(ctx, checked, now)
+		if err != nil {
+			slog.Warn("failed to list expired keys", "err", err)
+		} else {
+			for _, record := range records {
+				slog.Info("key expired", "key_id", record.ID, "name", record.Name)
+				s.expiries.notify(ctx, record.ID)
+			}
+			checked = now
+		}
+		records, err = s.repo.ListPreviousExpiring(ctx, previousChecked, now)
+		if err != nil {
+			slog.Warn("failed to list expired previous secrets", "err", err)
+		} else {
+			for _, record := range records {
+				slog.Info("previous key secret expired", "key_id", record.ID, "name", record.Name)
+				s.retired.notify(ctx, record.PreviousHash)
+			}
+			previousChecked = now
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// keySubscribers fans key IDs out to subscribers. Subscribers close
+// sessions that are no longer allowed, so notify waits for each of them
+// to take the ID rather than dropping it.
+type keySubscribers struct {
+	mu   sync.RWMutex
+	subs map[chan string]chan struct{}
+}
+
+func (k *keySubscribers) subscribe(buffer int) (<-chan string, func()) {
+	ch := make(chan string, buffer)
+	done := make(chan struct{})
+	k.mu.Lock()
+	k.subs[ch] = done
+	k.mu.Unlock()
 	return ch, func() {
-		s.mu.Lock()
-		delete(s.subs, ch)
+		// Closing done first releases a notify waiting on this subscriber,
+		// which holds the read lock.
+		close(done)
+		k.mu.Lock()
+		delete(k.subs, ch)
 		close(ch)
-		s.mu.Unlock()
+		k.mu.Unlock()
 	}
 }
 
-func (s *APIKeyServiceImpl) notifyDelete(id string) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	for ch := range s.subs {
+// notify sends id to every subscriber, waiting for those whose buffers are
+// full until they unsubscribe or ctx is done.
+func (k *keySubscribers) notify(ctx context.Context, id string) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for ch, done := range k.subs {
 		select {
 		case ch <- id:
-		default:
+		case <-done:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func keySummary(record *repository.APIKeyRecord) *authv1.KeySummary {
+	computerIDs := make([]int32, 0, len(record.ComputerIDs))
+	for _, id := range record.ComputerIDs {
+		computerIDs = append(computerIDs, int32(id))
+	}
+	return &authv1.KeySummary{
+		Id:                      record.ID,
+		Name:                    record.Name,
+		Scopes:                  record.Scopes,
+		ComputerIds:             computerIDs,
+		ComputerTags:            record.ComputerTags,
+		BoundToComputer:         record.BoundToComputer,
+		ExpiresAt:               optionalTimestamp(record.ExpiresAt),
+		LastUsedAt:              optionalTimestamp(record.LastUsedAt),
+		LastUsedAddr:            record.LastUsedAddr,
+		PreviousSecretExpiresAt: optionalTimestamp(record.PreviousExpiresAt),
+	}
+}
+
+// secretKey returns the key of record with its secret value.
+func secretKey(record *repository.APIKeyRecord, secret string) *authv1.Key {
+	summary := keySummary(record)
+	return &authv1.Key{
+		Id:              summary.Id,
+		Name:            summary.Name,
+		Key:             secret,
+		Scopes:          summary.Scopes,
+		ComputerIds:     summary.ComputerIds,
+		ComputerTags:    summary.ComputerTags,
+		BoundToComputer: summary.BoundToComputer,
+		ExpiresAt:       summary.ExpiresAt,
+	}
+}
+
+func optionalTimestamp(t *time.Time) *timestamppb.Timestamp {
+	if t == nil {
+		return nil
+	}
+	return timestamppb.New(*t)
+}
+
+// normalizeScopes checks scopes are known, returning them sorted without
+// duplicates.
+func normalizeScopes(scopes []Scope) ([]string, error) {
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("%w: at least one scope is required", ErrInvalidScope)
+	}
+	names := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		if !slices.Contains(Scopes, scope) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidScope, scope)
 		}
+		names = append(names, string(scope))
 	}
+	slices.Sort(names)
+	return slices.Compact(names), nil
 }
 
 func hashAPIKey(plain string) string {
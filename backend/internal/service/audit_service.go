@@ -0,0 +1,187 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	auditv1 "ehedges.net/ccgui/backend/gen/audit/v1"
+	"ehedges.net/ccgui/backend/internal/repository"
+	"ehedges.net/ccgui/backend/internal/websocket"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	defaultAuditPageSize = 100
+	maxAuditPageSize     = 1000
+)
+
+var ErrInvalidAuditQuery = errors.New("invalid audit query")
+
+// AuditEvent is an action to record in the audit log.
+type AuditEvent struct {
+	// Principal is the caller that acted, or nil if it did not authenticate.
+	Principal  *Principal
+	RemoteAddr string
+	Action     string
+	Target     string
+	Outcome    auditv1.AuditOutcome
+	// Err is why the action was denied or failed.
+	Err error
+}
+
+type AuditService interface {
+	// Record adds an event to the audit log. Failures to record are logged
+	// rather than returned, so auditing never fails the action itself.
+	Record(ctx context.Context, event AuditEvent)
+	List(ctx context.Context, req *auditv1.ListAuditEventsRequest) (*auditv1.ListAuditEventsResponse, error)
+}
+
+// AuditServiceImpl stores the audit log. It also records the authentication
+// decisions the websocket hub makes about computer sessions.
+type AuditServiceImpl struct {
+	repo repository.AuditRepository
+	keys APIKeyService
+}
+
+func NewAuditService(repo repository.AuditRepository, keys APIKeyService) *AuditServiceImpl {
+	return &AuditServiceImpl{
+		repo: repo,
+		keys: keys,
+	}
+}
+
+func (s *AuditServiceImpl) Record(ctx context.Context, event AuditEvent) {
+	record := repository.AuditEventRecord{
+		Time:       time.Now().UTC(),
+		RemoteAddr: event.RemoteAddr,
+		Action:     event.Action,
+		Target:     event.Target,
+		Outcome:    auditOutcomeToRecord(event.Outcome),
+	}
+	if event.Principal != nil {
+		record.ActorKeyID = event.Principal.KeyID
+		record.ActorUserID = event.Principal.UserID
+		record.ActorName = event.Principal.Name
+	}
+	if event.Err != nil {
+		record.Error = event.Err.Error()
+	}
+	// Record even if the request that acted was cancelled.
+	ctx = context.WithoutCancel(ctx)
+	if _, err := s.repo.Create(ctx, record); err != nil {
+		slog.Error("failed to record audit event", "action", record.Action, "target", record.Target, "err", err)
+	}
+}
+
+func (s *AuditServiceImpl) SessionAudit(ctx context.Context, event websocket.SessionAuditEvent) {
+	audit := AuditEvent{
+		RemoteAddr: event.RemoteAddr,
+		Action:     event.Action,
+		Outcome:    auditv1.AuditOutcome_AUDIT_OUTCOME_SUCCESS,
+		Err:        event.Err,
+	}
+	if event.Err != nil {
+		audit.Outcome = auditv1.AuditOutcome_AUDIT_OUTCOME_DENIED
+	}
+	if event.ComputerID >= 0 {
+		audit.Target = fmt.Sprintf("computer:%d", event.ComputerID)
+	}
+	if event.KeyID != "" {
+		audit.Principal = &Principal{KeyID: event.KeyID}
+		if key, err := s.keys.Get(ctx, event.KeyID); err == nil {
+			audit.Principal = KeyPrincipal(key)
+		}
+	}
+	s.Record(ctx, audit)
+}
+
+func (s *AuditServiceImpl) List(ctx context.Context, req *auditv1.ListAuditEventsRequest) (*auditv1.ListAuditEventsResponse, error) {
+	query := repository.AuditEventQuery{
+		ActorKeyID:  req.GetActorKeyId(),
+		ActorUserID: req.GetActorUserId(),
+		Action:      req.GetAction(),
+		Target:      req.GetTarget(),
+		Outcome:     auditOutcomeToRecord(req.GetOutcome()),
+		Limit:       defaultAuditPageSize,
+	}
+	if req.GetPageSize() > 0 {
+		query.Limit = int(min(req.GetPageSize(), maxAuditPageSize))
+	}
+	if req.GetStartTime() != nil {
+		if err := req.GetStartTime().CheckValid(); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidAuditQuery, err)
+		}
+		query.Start = req.GetStartTime().AsTime()
+	}
+	if req.GetEndTime() != nil {
+		if err := req.GetEndTime().CheckValid(); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidAuditQuery, err)
+		}
+		query.End = req.GetEndTime().AsTime()
+	}
+	if token := req.GetPageToken(); token != "" {
+		beforeID, err := strconv.ParseUint(token, 10, 64)
+		if err != nil || beforeID == 0 {
+			return nil, fmt.Errorf("%w: bad page token", ErrInvalidAuditQuery)
+		}
+		query.BeforeID = beforeID
+	}
+
+	records, err := s.repo.List(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	response := &auditv1.ListAuditEventsResponse{
+		Events: make([]*auditv1.AuditEvent, 0, len(records)),
+	}
+	for _, record := range records {
+		response.Events = append(response.Events, toAuditEvent(record))
+	}
+	if len(records) == query.Limit {
+		response.NextPageToken = strconv.FormatUint(records[len(records)-1].ID, 10)
+	}
+	return response, nil
+}
+
+func toAuditEvent(record *repository.AuditEventRecord) *auditv1.AuditEvent {
+	return &auditv1.AuditEvent{
+		Id:          record.ID,
+		Time:        timestamppb.New(record.Time),
+		ActorKeyId:  record.ActorKeyID,
+		ActorUserId: record.ActorUserID,
+		ActorName:   record.ActorName,
+		RemoteAddr:  record.RemoteAddr,
+		Action:      record.Action,
+		Target:      record.Target,
+		Outcome:     auditOutcomeFromRecord(record.Outcome),
+		Error:       record.Error,
+	}
+}
+
+func auditOutcomeToRecord(outcome auditv1.AuditOutcome) repository.AuditOutcome {
+	switch outcome {
+	case auditv1.AuditOutcome_AUDIT_OUTCOME_SUCCESS:
+		return repository.AuditOutcomeSuccess
+	case auditv1.AuditOutcome_AUDIT_OUTCOME_DENIED:
+		return repository.AuditOutcomeDenied
+	case auditv1.AuditOutcome_AUDIT_OUTCOME_FAILED:
+		return repository.AuditOutcomeFailed
+	}
+	return ""
+}
+
+func auditOutcomeFromRecord(outcome repository.AuditOutcome) auditv1.AuditOutcome {
+	switch outcome {
+	case repository.AuditOutcomeSuccess:
+		return auditv1.AuditOutcome_AUDIT_OUTCOME_SUCCESS
+	case repository.AuditOutcomeDenied:
+		return auditv1.AuditOutcome_AUDIT_OUTCOME_DENIED
+	case repository.AuditOutcomeFailed:
+		return auditv1.AuditOutcome_AUDIT_OUTCOME_FAILED
+	}
+	return auditv1.AuditOutcome_AUDIT_OUTCOME_UNSPECIFIED
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	commandv1 "ehedges.net/ccgui/backend/gen/command/v1"
+	"ehedges.net/ccgui/backend/internal/websocket"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+type CommandService interface {
+	Send(ctx context.Context, target *commandv1.Target, name string, data *structpb.Value) ([]*commandv1.Delivery, error)
+}
+
+// CommandDispatcher delivers commands to connected computers.
+type CommandDispatcher interface {
+	Dispatch(target websocket.DispatchTarget, name string, data any) ([]websocket.Delivery, error)
+}
+
+// CommandServiceImpl resolves command targets to computers and dispatches
+// commands to them.
+type CommandServiceImpl struct {
+	dispatcher CommandDispatcher
+	computers  ComputerDirectory
+}
+
+func NewCommandService(dispatcher CommandDispatcher, computers ComputerDirectory) *CommandServiceImpl {
+	return &CommandServiceImpl{
+		dispatcher: dispatcher,
+		computers:  computers,
+	}
+}
+
+func (s *CommandServiceImpl) Send(ctx context.Context, target *commandv1.Target, name string, data *structpb.Value) ([]*commandv1.Delivery, error) {
+	dispatchTarget, err := s.resolveTarget(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	var payload any
+	if data != nil {
+		payload = valueToLua(data)
+	}
+	deliveries, err := s.dispatcher.Dispatch(dispatchTarget, name, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*commandv1.Delivery, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		result := &commandv1.Delivery{
+			ComputerId: int32(delivery.ComputerID),
+			Status:     commandv1.DeliveryStatus_DELIVERY_STATUS_DELIVERED,
+			Sessions:   uint32(delivery.Sessions),
+		}
+		switch {
+		case errors.Is(delivery.Err, websocket.ErrComputerOffline):
+			result.Status = commandv1.DeliveryStatus_DELIVERY_STATUS_OFFLINE
+		case delivery.Err != nil:
+			result.Status = commandv1.DeliveryStatus_DELIVERY_STATUS_FAILED
+			result.Error = delivery.Err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// resolveTarget resolves the target's tags and groups to the known computers
+// they select.
+func (s *CommandServiceImpl) resolveTarget(ctx context.Context, target *commandv1.Target) (websocket.DispatchTarget, error) {
+	selector := ComputerSelector{
+		Tags:   target.GetTags(),
+		Groups: target.GetGroups(),
+	}
+	if !target.GetAll() && len(target.GetComputerIds()) == 0 && selector.Empty() {
+		return websocket.DispatchTarget{}, fmt.Errorf("%w: target selects no computers", websocket.ErrInvalidCommand)
+	}
+	dispatchTarget := websocket.DispatchTarget{All: target.GetAll()}
+	for _, id := range target.GetComputerIds() {
+		if id < 0 {
+			return websocket.DispatchTarget{}, ErrInvalidComputerID
+		}
+		dispatchTarget.ComputerIDs = append(dispatchTarget.ComputerIDs, int(id))
+	}
+	if !selector.Empty() {
+		if s.computers == nil {
+			return websocket.DispatchTarget{}, fmt.Errorf("%w: tag and group selectors are not available", websocket.ErrInvalidCommand)
+		}
+		ids, err := s.computers.Select(ctx, selector)
+		if err != nil {
+			return websocket.DispatchTarget{}, err
+		}
+		dispatchTarget.ComputerIDs = append(dispatchTarget.ComputerIDs, ids...)
+	}
+	return dispatchTarget, nil
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"sync"
+
+	computerv1 "ehedges.net/ccgui/backend/gen/computer/v1"
+)
+
+const (
+	computerEventHistory = 256
+	computerEventBuffer  = 64
+)
+
+// computerEventLog numbers computer events and keeps the most recent ones so
+// that watchers can resume after a reconnect without missing a transition.
+type computerEventLog struct {
+	mu      sync.Mutex
+	seq     uint64
+	history []*computerv1.ComputerEvent
+	subs    map[chan *computerv1.ComputerEvent]struct{}
+}
+
+func newComputerEventLog() *computerEventLog {
+	return &computerEventLog{
+		subs: make(map[chan *computerv1.ComputerEvent]struct{}),
+	}
+}
+
+func (l *computerEventLog) sequence() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seq
+}
+
+func (l *computerEventLog) publish(event *computerv1.ComputerEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq++
+	event.Sequence = l.seq
+	l.history = append(l.history, event)
+	if len(l.history) > computerEventHistory {
+		l.history = l.history[len(l.history)-computerEventHistory:]
+	}
+	for ch := range l.subs {
+		select {
+		case ch <- event:
+		default:
+			// The watcher fell behind. Closing its channel ends the stream so it
+			// can resume from the last sequence it saw.
+			delete(l.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns the held events newer than after, and a channel of events
+// published from then on. resync is true if events after the requested
+// sequence have already been discarded.
+func (l *computerEventLog) subscribe(after uint64) (replay []*computerv1.ComputerEvent, resync bool, ch <-chan *computerv1.ComputerEvent, unsubscribe func()) {
+	sub := make(chan *computerv1.ComputerEvent, computerEventBuffer)
+	l.mu.Lock()
+	if after > 0 {
+		if after > l.seq {
+			resync = true
+		} else if len(l.history) > 0 && l.history[0].Sequence > after+1 {
+			resync = true
+		}
+		for _, event := range l.history {
+			if event.Sequence > after {
+				replay = append(replay, event)
+			}
+		}
+	}
+	l.subs[sub] = struct{}{}
+	l.mu.Unlock()
+	return replay, resync, sub, func() {
+		l.mu.Lock()
+		if _, ok := l.subs[sub]; ok {
+			delete(l.subs, sub)
+			close(sub)
+		}
+		l.mu.Unlock()
+	}
+}
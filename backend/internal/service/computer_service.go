@@ -0,0 +1,496 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"time"
+
+	computerv1 "ehedges.net/ccgui/backend/gen/computer/v1"
+	"ehedges.net/ccgui/backend/internal/repository"
+	"ehedges.net/ccgui/backend/internal/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var ErrComputerNotFound = errors.New("computer not found")
+var ErrInvalidComputerID = errors.New("invalid computer id")
+var ErrInvalidTag = errors.New("invalid tag")
+var ErrGroupNotFound = errors.New("group not found")
+
+// maxComputerTags bounds the tags of one computer.
+const maxComputerTags = 32
+
+// tagPattern is the form of tags and group names.
+var tagPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:/-]{0,63}$`)
+
+// ComputerSelector picks computers by ID, tag or group. A computer is
+// selected if it matches any of the fields.
+type ComputerSelector struct {
+	ComputerIDs []int
+	Tags        []string
+	Groups      []string
+}
+
+// Empty reports whether the selector has nothing to match on.
+func (s ComputerSelector) Empty() bool {
+	return len(s.ComputerIDs) == 0 && len(s.Tags) == 0 && len(s.Groups) == 0
+}
+
+func (s ComputerSelector) matches(record *repository.ComputerRecord) bool {
+	if slices.Contains(s.ComputerIDs, record.ID) {
+		return true
+	}
+	for _, tag := range record.Tags {
+		if slices.Contains(s.Tags, tag) {
+			return true
+		}
+	}
+	for _, group := range record.Groups {
+		if slices.Contains(s.Groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+type ComputerPresence interface {
+	ComputerSessions(id int) []websocket.SessionInfo
+	CloseByComputerID(id int, reason string)
+}
+
+type ComputerService interface {
+	// List returns the known computers matching selector, or all of them if
+	// it is empty.
+	List(ctx context.Context, selector ComputerSelector) ([]*computerv1.Computer, error)
+	Get(ctx context.Context, id int) (*computerv1.Computer, error)
+	Forget(ctx context.Context, id int) (*computerv1.Computer, error)
+	EventSequence() uint64
+	Watch(afterSequence uint64) (replay []*computerv1.ComputerEvent, resync bool, events <-chan *computerv1.ComputerEvent, unsubscribe func())
+	SetTags(ctx context.Context, id int, tags []string) (*computerv1.Computer, error)
+	ListGroups(ctx context.Context) ([]*computerv1.Group, error)
+	PutGroup(ctx context.Context, name string, description string, computerIDs []int) (*computerv1.Group, error)
+	DeleteGroup(ctx context.Context, name string) (*computerv1.Group, error)
+}
+
+// ComputerDirectory resolves computers' tags and groups for the services that
+// select or label computers by them.
+type ComputerDirectory interface {
+	// Select returns the IDs of the known computers matching selector, sorted.
+	Select(ctx context.Context, selector ComputerSelector) ([]int, error)
+	// ComputerTags returns the tags and groups of a known computer.
+	ComputerTags(ctx context.Context, id int) (tags []string, groups []string, err error)
+}
+
+// ComputerServiceImpl persists the computers announced over the websocket and
+// merges them with the hub's view of which ones are currently connected.
+type ComputerServiceImpl struct {
+	repo     repository.ComputerRepository
+	presence ComputerPresence
+	events   *computerEventLog
+}
+
+func NewComputerService(repo repository.ComputerRepository, presence ComputerPresence) *ComputerServiceImpl {
+	return &ComputerServiceImpl{
+		repo:     repo,
+		presence: presence,
+		events:   newComputerEventLog(),
+	}
+}
+
+func (s *ComputerServiceImpl) List(ctx context.Context, selector ComputerSelector) ([]*computerv1.Computer, error) {
+	records, err := s.repo.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	computers := make([]*computerv1.Computer, 0, len(records))
+	for _, record := range records {
+		if selector.Empty() || selector.matches(record) {
+			computers = append(computers, s.toComputer(record))
+		}
+	}
+	return computers, nil
+}
+
+func (s *ComputerServiceImpl) Select(ctx context.Context, selector ComputerSelector) ([]int, error) {
+	if selector.Empty() {
+		return nil, nil
+	}
+	records, err := s.repo.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, record := range records {
+		if selector.matches(record) {
+			ids = append(ids, record.ID)
+		}
+	}
+	return ids, nil
+}
+
+func (s *ComputerServiceImpl) ComputerTags(ctx context.Context, id int) ([]string, []string, error) {
+	record, err := s.repo.GetByID(ctx, id)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return nil, nil, ErrComputerNotFound
+		}
+		return nil, nil, err
+	}
+	return record.Tags, record.Groups, nil
+}
+
+func (s *ComputerServiceImpl) SetTags(ctx context.Context, id int, tags []string) (*computerv1.Computer, error) {
+	if id < 0 {
+		return nil, ErrInvalidComputerID
+	}
+	tags, err := normalizeTags(tags)
+	if err != nil {
+		return nil, err
+	}
+	if len(tags) > maxComputerTags {
+		return nil, fmt.Errorf("%w: a computer may have at most %d tags", ErrInvalidTag, maxComputerTags)
+	}
+	record, err := s.repo.SetTags(ctx, id, tags)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return nil, ErrComputerNotFound
+		}
+		return nil, err
+	}
+	computer := s.toComputer(record)
+	s.publish(computerv1.ComputerEventType_COMPUTER_EVENT_TYPE_TAGS_CHANGED, computer, "")
+	return computer, nil
+}
+
+func (s *ComputerServiceImpl) ListGroups(ctx context.Context) ([]*computerv1.Group, error) {
+	records, err := s.repo.ListGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]*computerv1.Group, 0, len(records))
+	for _, record := range records {
+		groups = append(groups, toGroup(record))
+	}
+	return groups, nil
+}
+
+func (s *ComputerServiceImpl) PutGroup(ctx context.Context, name string, description string, computerIDs []int) (*computerv1.Group, error) {
+	if !tagPattern.MatchString(name) {
+		return nil, fmt.Errorf("%w: group name %q", ErrInvalidTag, name)
+	}
+	records, err := s.repo.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[int]bool, len(records))
+	for _, record := range records {
+		known[record.ID] = true
+	}
+	ids := make([]int, 0, len(computerIDs))
+	for _, id := range computerIDs {
+		if id < 0 {
+			return nil, ErrInvalidComputerID
+		}
+		if !known[id] {
+			return nil, fmt.Errorf("%w: %d", ErrComputerNotFound, id)
+		}
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+
+	var previous []int
+	if existing, err := s.repo.GetGroup(ctx, name); err == nil {
+		previous = existing.ComputerIDs
+	} else if !errors.Is(err, repository.ErrNotFound) {
+		return nil, err
+	}
+	record, err := s.repo.PutGroup(ctx, repository.ComputerGroupRecord{
+		Name:        name,
+		Description: description,
+		ComputerIDs: ids,
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.publishMembershipChanges(ctx, previous, record.ComputerIDs)
+	return toGroup(record), nil
+}
+
+func (s *ComputerServiceImpl) DeleteGroup(ctx context.Context, name string) (*computerv1.Group, error) {
+	record, err := s.repo.DeleteGroup(ctx, name)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return nil, ErrGroupNotFound
+		}
+		return nil, err
+	}
+	s.publishMembershipChanges(ctx, record.ComputerIDs, nil)
+	return toGroup(record), nil
+}
+
+// publishMembershipChanges reports the computers that joined or left a group.
+func (s *ComputerServiceImpl) publishMembershipChanges(ctx context.Context, before []int, after []int) {
+	for _, id := range before {
+		if !slices.Contains(after, id) {
+			s.publishTagsChanged(ctx, id)
+		}
+	}
+	for _, id := range after {
+		if !slices.Contains(before, id) {
+			s.publishTagsChanged(ctx, id)
+		}
+	}
+}
+
+func (s *ComputerServiceImpl) publishTagsChanged(ctx context.Context, id int) {
+	record, err := s.repo.GetByID(ctx, id)
+	if err != nil {
+		// The computer was forgotten in the meantime.
+		return
+	}
+	s.publish(computerv1.ComputerEventType_COMPUTER_EVENT_TYPE_TAGS_CHANGED, s.toComputer(record), "")
+}
+
+// normalizeTags validates tags, returning them sorted without duplicates.
+func normalizeTags(tags []string) ([]string, error) {
+	for _, tag := range tags {
+		if !tagPattern.MatchString(tag) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidTag, tag)
+		}
+	}
+	tags = slices.Clone(tags)
+	slices.Sort(tags)
+	return slices.Compact(tags), nil
+}
+
+func (s *ComputerServiceImpl) Get(ctx context.Context, id int) (*computerv1.Computer, error) {
+	if id < 0 {
+		return nil, ErrInvalidComputerID
+	}
+	record, err := s.repo.GetByID(ctx, id)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return nil, ErrComputerNotFound
+		}
+		return nil, err
+	}
+	return s.toComputer(record), nil
+}
+
+// Forget disconnects any live sessions for the computer and deletes its stored
+// history. The computer is registered again the next time it says hello.
+func (s *ComputerServiceImpl) Forget(ctx context.Context, id int) (*computerv1.Computer, error) {
+	if id < 0 {
+		return nil, ErrInvalidComputerID
+	}
+	record, err := s.repo.GetByID(ctx, id)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return nil, ErrComputerNotFound
+		}
+		return nil, err
+	}
+	computer := s.toComputer(record)
+	if s.presence != nil {
+		s.presence.CloseByComputerID(id, "computer forgotten")
+	}
+	if _, err := s.repo.DeleteByID(ctx, id); err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return nil, ErrComputerNotFound
+		}
+		return nil, err
+	}
+	return computer, nil
+}
+
+// EventSequence returns the sequence of the most recent computer event.
+func (s *ComputerServiceImpl) EventSequence() uint64 {
+	return s.events.sequence()
+}
+
+func (s *ComputerServiceImpl) Watch(afterSequence uint64) ([]*computerv1.ComputerEvent, bool, <-chan *computerv1.ComputerEvent, func()) {
+	return s.events.subscribe(afterSequence)
+}
+
+func (s *ComputerServiceImpl) ComputerConnected(ctx context.Context, info websocket.ComputerInfo) error {
+	record, err := s.upsert(ctx, info)
+	if err != nil {
+		return err
+	}
+	s.publish(computerv1.ComputerEventType_COMPUTER_EVENT_TYPE_CONNECTED, s.toComputer(record), "")
+	return nil
+}
+
+func (s *ComputerServiceImpl) ComputerUpdated(ctx context.Context, previous websocket.ComputerInfo, info websocket.ComputerInfo) error {
+	record, err := s.upsert(ctx, info)
+	if err != nil {
+		return err
+	}
+	if previous.Label != info.Label {
+		s.publish(computerv1.ComputerEventType_COMPUTER_EVENT_TYPE_LABEL_CHANGED, s.toComputer(record), "")
+	}
+	return nil
+}
+
+func (s *ComputerServiceImpl) ComputerMonitorsChanged(ctx context.Context, info websocket.ComputerInfo) error {
+	record, err := s.repo.GetByID(ctx, info.ID)
+	if err != nil {
+		return err
+	}
+	s.publish(computerv1.ComputerEventType_COMPUTER_EVENT_TYPE_MONITORS_CHANGED, s.toComputer(record), "")
+	return nil
+}
+
+func (s *ComputerServiceImpl) ComputerDisconnected(ctx context.Context, info websocket.ComputerInfo, closeReason string) error {
+	eventType := computerv1.ComputerEventType_COMPUTER_EVENT_TYPE_DISCONNECTED
+	if closeReason != "" {
+		eventType = computerv1.ComputerEventType_COMPUTER_EVENT_TYPE_KICKED
+	}
+	err := s.repo.TouchLastSeen(ctx, info.ID, time.Now())
+	if errors.Is(err, repository.ErrNotFound) {
+		// The computer was forgotten while connected; report what the session
+		// knew about it.
+		s.publish(eventType, &computerv1.Computer{
+			Id:        int32(info.ID),
+			Label:     info.Label,
+			Host:      info.Host,
+			CcVersion: info.CCVersion,
+			Kind:      computerKindToProto(string(info.Kind)),
+			Advanced:  info.Advanced,
+		}, closeReason)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	record, err := s.repo.GetByID(ctx, info.ID)
+	if err != nil {
+		return err
+	}
+	s.publish(eventType, s.toComputer(record), closeReason)
+	return nil
+}
+
+func (s *ComputerServiceImpl) publish(eventType computerv1.ComputerEventType, computer *computerv1.Computer, reason string) {
+	s.events.publish(&computerv1.ComputerEvent{
+		Type:     eventType,
+		Time:     timestamppb.Now(),
+		Computer: computer,
+		Reason:   reason,
+	})
+}
+
+func (s *ComputerServiceImpl) upsert(ctx context.Context, info websocket.ComputerInfo) (*repository.ComputerRecord, error) {
+	return s.repo.Upsert(ctx, repository.ComputerUpsert{
+		ID:        info.ID,
+		Label:     info.Label,
+		Host:      info.Host,
+		CCVersion: info.CCVersion,
+		Kind:      string(info.Kind),
+		Advanced:  info.Advanced,
+		SeenAt:    time.Now(),
+	})
+}
+
+func (s *ComputerServiceImpl) toComputer(record *repository.ComputerRecord) *computerv1.Computer {
+	var sessions []*computerv1.Session
+	var monitors []*computerv1.Monitor
+	if s.presence != nil {
+		for _, info := range s.presence.ComputerSessions(record.ID) {
+			sessions = append(sessions, &computerv1.Session{
+				RemoteAddress: info.RemoteAddr,
+				ConnectedAt:   timestamppb.New(info.ConnectedAt),
+				KeyId:         info.KeyID,
+			})
+			for _, monitor := range info.Monitors {
+				monitors = append(monitors, &computerv1.Monitor{
+					Name:      monitor.Name,
+					WindowId:  uint32(monitor.Window),
+					Width:     uint32(monitor.Width),
+					Height:    uint32(monitor.Height),
+					TextScale: monitor.TextScale,
+				})
+			}
+		}
+	}
+	sort.Slice(monitors, func(i, j int) bool { return monitors[i].WindowId < monitors[j].WindowId })
+	return &computerv1.Computer{
+		Id:        int32(record.ID),
+		Label:     record.Label,
+		Host:      record.Host,
+		CcVersion: record.CCVersion,
+		Kind:      computerKindToProto(record.Kind),
+		Advanced:  record.Advanced,
+		FirstSeen: timestamppb.New(record.FirstSeen),
+		LastSeen:  timestamppb.New(record.LastSeen),
+		Online:    len(sessions) > 0,
+		Sessions:  sessions,
+		Monitors:  monitors,
+		Tags:      record.Tags,
+		Groups:    record.Groups,
+	}
+}
+
+func toGroup(record *repository.ComputerGroupRecord) *computerv1.Group {
+	ids := make([]int32, 0, len(record.ComputerIDs))
+	for _, id := range record.ComputerIDs {
+		ids = append(ids, int32(id))
+	}
+	return &computerv1.Group{
+		Name:        record.Name,
+		Description: record.Description,
+		ComputerIds: ids,
+		CreatedAt:   timestamppb.New(record.CreatedAt),
+	}
+}
+
+func computerKindToProto(kind string) computerv1.ComputerKind {
+	switch websocket.ComputerKind(kind) {
+	case websocket.ComputerKindComputer:
+		return computerv1.ComputerKind_COMPUTER_KIND_COMPUTER
+	case websocket.ComputerKindTurtle:
+		return computerv1.ComputerKind_COMPUTER_KIND_TURTLE
+	case websocket.ComputerKindPocket:
+		return computerv1.ComputerKind_COMPUTER_KIND_POCKET
+	default:
+		return computerv1.ComputerKind_COMPUTER_KIND_UNSPECIFIED
+	}
+}
+
+// MethodComputerTags is the call computers make to learn their own tags and
+// groups.
+const MethodComputerTags = "computer.tags"
+
+// TagsCall answers a computer's MethodComputerTags call with its tags and
+// groups.
+func (s *ComputerServiceImpl) TagsCall(ctx websocket.WSRequestContext, args msgpack.RawMessage) (any, error) {
+	info, ok := ctx.Computer()
+	if !ok {
+		return nil, websocket.NewCallError(websocket.CallErrorInvalidArgument, "call made before hello")
+	}
+	tags, groups, err := s.ComputerTags(ctx, info.ID)
+	if err != nil {
+		if errors.Is(err, ErrComputerNotFound) {
+			return nil, websocket.NewCallError(websocket.CallErrorNotFound, "computer %d is not known", info.ID)
+		}
+		return nil, err
+	}
+	// Results are the array of values the call returns in Lua.
+	return []any{map[string]any{
+		"tags":   nonNil(tags),
+		"groups": nonNil(groups),
+	}}, nil
+}
+
+// nonNil returns an empty slice for nil, so it encodes as an empty array.
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
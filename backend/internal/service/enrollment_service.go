@@ -0,0 +1,320 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	authv1 "ehedges.net/ccgui/backend/gen/auth/v1"
+	enrollmentv1 "ehedges.net/ccgui/backend/gen/enrollment/v1"
+	"ehedges.net/ccgui/backend/internal/websocket"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// enrollmentTTL is how long a pairing code may be approved for.
+	enrollmentTTL = 10 * time.Minute
+	// maxPendingEnrollments and maxPendingEnrollmentsPerHost bound how many
+	// computers may wait to enroll at once, since /enroll is unauthenticated.
+	maxPendingEnrollments        = 64
+	maxPendingEnrollmentsPerHost = 8
+	maxEnrollmentLabelLength     = 64
+
+	// enrollmentCodeAlphabet leaves out characters easily mistaken for
+	// others on a computer's screen: 0, 1, I, L and O.
+	enrollmentCodeAlphabet = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+	enrollmentCodeLength   = 6
+)
+
+var ErrEnrollmentNotFound = errors.New("enrollment not found")
+var ErrTooManyEnrollments = errors.New("too many computers are waiting to enroll")
+
+// ErrEnrollmentDenied is sent to computers turned away by an operator.
+var ErrEnrollmentDenied = errors.New("enrollment denied")
+
+// ErrEnrollmentNotDelivered is returned when a computer goes away before it
+// receives the key it was approved for. The key is deleted.
+var ErrEnrollmentNotDelivered = errors.New("the computer went away before it received its key")
+
+// errEnrollmentFailed is sent to computers whose key could not be issued,
+// without revealing why.
+var errEnrollmentFailed = errors.New("failed to issue a key")
+
+type EnrollmentService interface {
+	List(ctx context.Context) []*enrollmentv1.Enrollment
+	// Approve issues a key to the computer showing code, if principal may
+	// connect as it. The key is bound to that computer.
+	Approve(ctx context.Context, principal *Principal, code string) (*enrollmentv1.ApproveEnrollmentResponse, error)
+	// Deny turns away the computer waiting to enroll with id.
+	Deny(ctx context.Context, id string) (*enrollmentv1.Enrollment, error)
+}
+
+type pendingEnrollment struct {
+	id         string
+	code       string
+	computerID int
+	label      string
+	remoteAddr string
+	startedAt  time.Time
+	expiresAt  time.Time
+	result     chan websocket.EnrollmentResult
+	// claimed is set once an operator approves or denies the enrollment,
+	// which stays pending until its connection is done.
+	claimed bool
+	// gone is closed once the enrollment's connection is done.
+	gone chan struct{}
+}
+
+func (p *pendingEnrollment) toProto() *enrollmentv1.Enrollment {
+	return &enrollmentv1.Enrollment{
+		Id:         p.id,
+		ComputerId: int32(p.computerID),
+		Label:      p.label,
+		RemoteAddr: p.remoteAddr,
+		StartedAt:  timestamppb.New(p.startedAt),
+		ExpiresAt:  timestamppb.New(p.expiresAt),
+	}
+}
+
+// EnrollmentServiceImpl keeps computers waiting to enroll in memory: a
+// computer only waits while its /enroll connection stays open.
+type EnrollmentServiceImpl struct {
+	keys       APIKeyService
+	authorizer *KeyAuthorizer
+
+	mu      sync.Mutex
+	pending map[string]*pendingEnrollment // by code
+}
+
+func NewEnrollmentService(keys APIKeyService, authorizer *KeyAuthorizer) *EnrollmentServiceImpl {
+	return &EnrollmentServiceImpl{
+		keys:       keys,
+		authorizer: authorizer,
+		pending:    make(map[string]*pendingEnrollment),
+	}
+}
+
+func (s *EnrollmentServiceImpl) BeginEnrollment(ctx context.Context, req websocket.EnrollmentRequest) (*websocket.PendingEnrollment, error) {
+	label := strings.TrimSpace(req.Label)
+	if len(label) > maxEnrollmentLabelLength {
+		label = label[:maxEnrollmentLabelLength]
+	}
+	host := remoteHost(req.RemoteAddr)
+	now := time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked(now)
+	if len(s.pending) >= maxPendingEnrollments {
+		return nil, ErrTooManyEnrollments
+	}
+	fromHost := 0
+	for _, pending := range s.pending {
+		if remoteHost(pending.remoteAddr) == host {
+			fromHost++
+		}
+	}
+	if fromHost >= maxPendingEnrollmentsPerHost {
+		return nil, ErrTooManyEnrollments
+	}
+	code, err := s.newCodeLocked()
+	if err != nil {
+		return nil, err
+	}
+	pending := &pendingEnrollment{
+		id:         uuid.NewString(),
+		code:       code,
+		computerID: req.ComputerID,
+		label:      label,
+		remoteAddr: req.RemoteAddr,
+		startedAt:  now,
+		expiresAt:  now.Add(enrollmentTTL),
+		result:     make(chan websocket.EnrollmentResult, 1),
+		gone:       make(chan struct{}),
+	}
+	s.pending[code] = pending
+	return &websocket.PendingEnrollment{
+		Code:      formatEnrollmentCode(code),
+		ExpiresAt: pending.expiresAt,
+		Result:    pending.result,
+	}, nil
+}
+
+func (s *EnrollmentServiceImpl) CancelEnrollment(code string) {
+	code = normalizeEnrollmentCode(code)
+	s.mu.Lock()
+	if pending, ok := s.pending[code]; ok {
+		delete(s.pending, code)
+		close(pending.gone)
+	}
+	s.mu.Unlock()
+}
+
+func (s *EnrollmentServiceImpl) List(ctx context.Context) []*enrollmentv1.Enrollment {
+	s.mu.Lock()
+	s.pruneLocked(time.Now().UTC())
+	pending := make([]*pendingEnrollment, 0, len(s.pending))
+	for _, p := range s.pending {
+		if !p.claimed {
+			pending = append(pending, p)
+		}
+	}
+	s.mu.Unlock()
+
+	slices.SortFunc(pending, func(a, b *pendingEnrollment) int {
+		return a.startedAt.Compare(b.startedAt)
+	})
+	enrollments := make([]*enrollmentv1.Enrollment, 0, len(pending))
+	for _, p := range pending {
+		enrollments = append(enrollments, p.toProto())
+	}
+	return enrollments
+}
+
+func (s *EnrollmentServiceImpl) Approve(ctx context.Context, principal *Principal, code string) (*enrollmentv1.ApproveEnrollmentResponse, error) {
+	code = normalizeEnrollmentCode(code)
+	s.mu.Lock()
+	pending, ok := s.pending[code]
+	if ok && (pending.claimed || !time.Now().Before(pending.expiresAt)) {
+		ok = false
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil, ErrEnrollmentNotFound
+	}
+	// Callers may not hand out keys that can do more than they can.
+	if err := s.authorizer.AuthorizeComputer(ctx, principal, ScopeComputerConnect, pending.computerID); err != nil {
+		return nil, err
+	}
+
+	// Claim the enrollment so it is approved at most once. It is only still
+	// pending while its connection is open.
+	s.mu.Lock()
+	if s.pending[code] != pending || pending.claimed {
+		s.mu.Unlock()
+		return nil, ErrEnrollmentNotFound
+	}
+	pending.claimed = true
+	s.mu.Unlock()
+
+	name := pending.label
+	if name == "" {
+		name = fmt.Sprintf("computer %d", pending.computerID)
+	}
+	key, err := s.keys.Generate(ctx, name, KeyOptions{
+		Scopes:         []Scope{ScopeComputerConnect},
+		ComputerIDs:    []int{pending.computerID},
+		BindToComputer: true,
+	})
+	if err != nil {
+		pending.result <- websocket.EnrollmentResult{Err: errEnrollmentFailed}
+		return nil, err
+	}
+	delivered := make(chan error, 1)
+	pending.result <- websocket.EnrollmentResult{Key: key.GetKey(), Delivered: delivered}
+	select {
+	case err = <-delivered:
+	case <-pending.gone:
+		// The key may have been delivered just before the connection ended.
+		select {
+		case err = <-delivered:
+		default:
+			err = errors.New("connection closed")
+		}
+	}
+	if err != nil {
+		// Nobody holds the key, so it would never be used.
+		if _, deleteErr := s.keys.Delete(context.WithoutCancel(ctx), key.GetId()); deleteErr != nil {
+			slog.Error("failed to delete undelivered enrollment key", "key_id", key.GetId(), "err", deleteErr)
+		}
+		return nil, fmt.Errorf("%w: %v", ErrEnrollmentNotDelivered, err)
+	}
+	slog.Info("approved enrollment", "computer_id", pending.computerID, "key_id", key.GetId(), "by", principal.String())
+
+	return &enrollmentv1.ApproveEnrollmentResponse{
+		Enrollment: pending.toProto(),
+		Key: &authv1.KeySummary{
+			Id:              key.GetId(),
+			Name:            key.GetName(),
+			Scopes:          key.GetScopes(),
+			ComputerIds:     key.GetComputerIds(),
+			BoundToComputer: key.GetBoundToComputer(),
+		},
+	}, nil
+}
+
+func (s *EnrollmentServiceImpl) Deny(ctx context.Context, id string) (*enrollmentv1.Enrollment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, pending := range s.pending {
+		if pending.id != id || pending.claimed {
+			continue
+		}
+		// The enrollment is forgotten once its connection is done.
+		pending.claimed = true
+		pending.result <- websocket.EnrollmentResult{Err: ErrEnrollmentDenied}
+		return pending.toProto(), nil
+	}
+	return nil, ErrEnrollmentNotFound
+}
+
+// pruneLocked forgets expired enrollments whose connections have not yet
+// noticed. Claimed enrollments are left for their connections to finish.
+// s.mu must be held.
+func (s *EnrollmentServiceImpl) pruneLocked(now time.Time) {
+	for code, pending := range s.pending {
+		if !pending.claimed && !now.Before(pending.expiresAt) {
+			delete(s.pending, code)
+			close(pending.gone)
+		}
+	}
+}
+
+// newCodeLocked returns a random code no pending enrollment uses. s.mu must
+// be held.
+func (s *EnrollmentServiceImpl) newCodeLocked() (string, error) {
+	// Rejecting bytes past the largest multiple of the alphabet's length
+	// keeps every character equally likely.
+	limit := byte(256 - 256%len(enrollmentCodeAlphabet))
+	for {
+		code := make([]byte, 0, enrollmentCodeLength)
+		buf := make([]byte, 16)
+		for len(code) < enrollmentCodeLength {
+			if _, err := rand.Read(buf); err != nil {
+				return "", err
+			}
+			for _, b := range buf {
+				if b < limit && len(code) < enrollmentCodeLength {
+					code = append(code, enrollmentCodeAlphabet[int(b)%len(enrollmentCodeAlphabet)])
+				}
+			}
+		}
+		if _, taken := s.pending[string(code)]; !taken {
+			return string(code), nil
+		}
+	}
+}
+
+// formatEnrollmentCode splits a code in two to make it easier to read.
+func formatEnrollmentCode(code string) string {
+	return code[:enrollmentCodeLength/2] + "-" + code[enrollmentCodeLength/2:]
+}
+
+// normalizeEnrollmentCode undoes formatting of a code typed in by an
+// operator.
+func normalizeEnrollmentCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+}
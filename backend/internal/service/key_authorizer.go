@@ -0,0 +1,141 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+var ErrPermissionDenied = errors.New("permission denied")
+
+// KeyAuthorizer checks what callers may do: which scopes they hold, and
+// which computers they may act on. A caller restricted to some computers by
+// ID or tag may not make requests that are not about particular computers,
+// such as managing keys or groups.
+type KeyAuthorizer struct {
+	keys      APIKeyService
+	computers ComputerDirectory
+}
+
+func NewKeyAuthorizer(keys APIKeyService, computers ComputerDirectory) *KeyAuthorizer {
+	return &KeyAuthorizer{
+		keys:      keys,
+		computers: computers,
+	}
+}
+
+// Authorize checks that principal holds scope and is not restricted to some
+// computers.
+func (a *KeyAuthorizer) Authorize(principal *Principal, scope Scope) error {
+	if err := requireScope(principal, scope); err != nil {
+		return err
+	}
+	if principal.Restricted() {
+		return fmt.Errorf("%w: %s is restricted to some computers", ErrPermissionDenied, principal)
+	}
+	return nil
+}
+
+// AuthorizeComputer checks that principal holds scope and may act on the
+// computer.
+func (a *KeyAuthorizer) AuthorizeComputer(ctx context.Context, principal *Principal, scope Scope, computerID int) error {
+	if err := requireScope(principal, scope); err != nil {
+		return err
+	}
+	allowed, err := a.Allows(ctx, principal, computerID)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return fmt.Errorf("%w: %s may not act on computer %d", ErrPermissionDenied, principal, computerID)
+	}
+	return nil
+}
+
+// AuthorizeListing checks that principal holds scope, for requests listing
+// computers or their data. Principals restricted to some computers may make
+// them, but must only be shown the computers Allows them.
+func (a *KeyAuthorizer) AuthorizeListing(principal *Principal, scope Scope) error {
+	return requireScope(principal, scope)
+}
+
+// AuthorizeSelection checks that principal holds scope and may act on every
+// computer the selector picks, or on every computer if all is set.
+func (a *KeyAuthorizer) AuthorizeSelection(ctx context.Context, principal *Principal, scope Scope, all bool, selector ComputerSelector) error {
+	if all {
+		return a.Authorize(principal, scope)
+	}
+	if err := requireScope(principal, scope); err != nil {
+		return err
+	}
+	if !principal.Restricted() {
+		return nil
+	}
+	selected, err := a.computers.Select(ctx, ComputerSelector{Tags: selector.Tags, Groups: selector.Groups})
+	if err != nil {
+		return err
+	}
+	for _, id := range slices.Concat(selector.ComputerIDs, selected) {
+		if err := a.AuthorizeComputer(ctx, principal, scope, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AuthorizeConnect checks that the key with the given ID may connect to the
+// websocket as a computer.
+func (a *KeyAuthorizer) AuthorizeConnect(ctx context.Context, keyID string) error {
+	key, err := a.keys.Get(ctx, keyID)
+	if err != nil {
+		return err
+	}
+	return requireScope(KeyPrincipal(key), ScopeComputerConnect)
+}
+
+// AuthorizeIdentity checks that the key with the given ID may connect as the
+// computer. Computers matched by tag must already be known, so a key
+// restricted to tags cannot introduce new computers. Keys bound to their
+// computer are exclusive to one session.
+func (a *KeyAuthorizer) AuthorizeIdentity(ctx context.Context, keyID string, computerID int) (bool, error) {
+	key, err := a.keys.Get(ctx, keyID)
+	if err != nil {
+		return false, err
+	}
+	if err := a.AuthorizeComputer(ctx, KeyPrincipal(key), ScopeComputerConnect, computerID); err != nil {
+		return false, err
+	}
+	return key.GetBoundToComputer(), nil
+}
+
+// Allows reports whether principal may act on the computer, whatever its
+// scopes.
+func (a *KeyAuthorizer) Allows(ctx context.Context, principal *Principal, computerID int) (bool, error) {
+	if !principal.Restricted() || slices.Contains(principal.ComputerIDs, computerID) {
+		return true, nil
+	}
+	if len(principal.ComputerTags) == 0 || computerID < 0 {
+		return false, nil
+	}
+	tags, _, err := a.computers.ComputerTags(ctx, computerID)
+	if err != nil {
+		if errors.Is(err, ErrComputerNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	for _, tag := range tags {
+		if slices.Contains(principal.ComputerTags, tag) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func requireScope(principal *Principal, scope Scope) error {
+	if !principal.HasScope(scope) {
+		return fmt.Errorf("%w: %s lacks the %s scope", ErrPermissionDenied, principal, scope)
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	logv1 "ehedges.net/ccgui/backend/gen/log/v1"
+	"ehedges.net/ccgui/backend/internal/otlp"
+	"ehedges.net/ccgui/backend/internal/websocket"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// computerLogHistory is the number of records kept per computer for TailLogs.
+const computerLogHistory = 500
+
+// Log record attributes, following the OpenTelemetry code.* conventions.
+const (
+	attrCodeFunction   = "code.function"
+	attrCodeFilepath   = "code.filepath"
+	attrCodeLineno     = "code.lineno"
+	attrCodeStacktrace = "code.stacktrace"
+
+	logScopeName = "ccgui"
+)
+
+type LogService interface {
+	// Tail returns the computer's held records newer than after and at or
+	// above minLevel, oldest first, keeping at most the limit most recent.
+	// It also returns the sequence of the latest record held.
+	Tail(computerID int, limit int, after uint64, minLevel logv1.LogLevel) ([]*logv1.LogRecord, uint64, error)
+}
+
+type LogExporter interface {
+	ExportLogs(data *otlp.LogsData) error
+}
+
+// LogServiceImpl accepts log records forwarded by computers. Each record is
+// written to the server's own log, exported to the OTLP collector and kept in
+// a bounded per-computer buffer for the UI.
+type LogServiceImpl struct {
+	exporter  LogExporter
+	computers ComputerDirectory
+
+	mu      sync.Mutex
+	buffers map[int]*computerLogBuffer
+}
+
+func NewLogService(exporter LogExporter, computers ComputerDirectory) *LogServiceImpl {
+	return &LogServiceImpl{
+		exporter:  exporter,
+		computers: computers,
+		buffers:   make(map[int]*computerLogBuffer),
+	}
+}
+
+// computerLogBuffer is a ring of a computer's most recent records.
+type computerLogBuffer struct {
+	seq     uint64
+	records []*logv1.LogRecord
+	next    int
+}
+
+func (b *computerLogBuffer) append(record *logv1.LogRecord) {
+	b.seq++
+	record.Sequence = b.seq
+	if len(b.records) < computerLogHistory {
+		b.records = append(b.records, record)
+		return
+	}
+	b.records[b.next] = record
+	b.next = (b.next + 1) % computerLogHistory
+}
+
+// ordered returns the held records, oldest first.
+func (b *computerLogBuffer) ordered() []*logv1.LogRecord {
+	ordered := make([]*logv1.LogRecord, 0, len(b.records))
+	ordered = append(ordered, b.records[b.next:]...)
+	return append(ordered, b.records[:b.next]...)
+}
+
+func (s *LogServiceImpl) ComputerLog(ctx context.Context, computer websocket.ComputerInfo, record websocket.LogRecord) error {
+	attrs := []any{"computer_id", computer.ID, "label", computer.Label}
+	if record.Source != nil {
+		attrs = append(attrs, "source", fmt.Sprintf("%s:%d", record.Source.ShortSrc, record.Source.CurrentLine))
+	}
+	slog.Log(ctx, slogLevel(record.Level), record.Message, attrs...)
+
+	s.mu.Lock()
+	buffer, ok := s.buffers[computer.ID]
+	if !ok {
+		buffer = &computerLogBuffer{}
+		s.buffers[computer.ID] = buffer
+	}
+	buffer.append(toLogRecord(record))
+	s.mu.Unlock()
+
+	if s.exporter == nil {
+		return nil
+	}
+	resource := append(computerResourceAttributes(computer), computerTagAttributes(ctx, s.computers, computer.ID)...)
+	return s.exporter.ExportLogs(&otlp.LogsData{
+		ResourceLogs: []otlp.ResourceLogs{{
+			Resource: &otlp.Resource{Attributes: resource},
+			ScopeLogs: []otlp.ScopeLogs{{
+				Scope:      &otlp.InstrumentationScope{Name: logScopeName},
+				LogRecords: []otlp.LogRecord{toOTLPLogRecord(record)},
+			}},
+		}},
+	})
+}
+
+func (s *LogServiceImpl) Tail(computerID int, limit int, after uint64, minLevel logv1.LogLevel) ([]*logv1.LogRecord, uint64, error) {
+	if computerID < 0 {
+		return nil, 0, ErrInvalidComputerID
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	buffer, ok := s.buffers[computerID]
+	if !ok {
+		return nil, 0, nil
+	}
+	var records []*logv1.LogRecord
+	for _, record := range buffer.ordered() {
+		if record.GetSequence() > after && record.GetLevel() >= minLevel {
+			records = append(records, record)
+		}
+	}
+	if limit > 0 && len(records) > limit {
+		records = records[len(records)-limit:]
+	}
+	return records, buffer.seq, nil
+}
+
+func slogLevel(level websocket.LogLevel) slog.Level {
+	switch level {
+	case websocket.LogLevelTrace:
+		return slog.LevelDebug - 4
+	case websocket.LogLevelDebug:
+		return slog.LevelDebug
+	case websocket.LogLevelInfo:
+		return slog.LevelInfo
+	case websocket.LogLevelWarning:
+		return slog.LevelWarn
+	case websocket.LogLevelError:
+		return slog.LevelError
+	default:
+		return slog.LevelError + 4
+	}
+}
+
+func severityNumber(level websocket.LogLevel) otlp.SeverityNumber {
+	switch level {
+	case websocket.LogLevelTrace:
+		return otlp.SeverityTrace
+	case websocket.LogLevelDebug:
+		return otlp.SeverityDebug
+	case websocket.LogLevelInfo:
+		return otlp.SeverityInfo
+	case websocket.LogLevelWarning:
+		return otlp.SeverityWarn
+	case websocket.LogLevelError:
+		return otlp.SeverityError
+	default:
+		return otlp.SeverityFatal
+	}
+}
+
+func toOTLPLogRecord(record websocket.LogRecord) otlp.LogRecord {
+	body := otlp.StringValue(record.Message)
+	out := otlp.LogRecord{
+		TimeUnixNano:         otlp.Uint64(record.Time.UnixNano()),
+		ObservedTimeUnixNano: otlp.Uint64(time.Now().UnixNano()),
+		SeverityNumber:       severityNumber(record.Level),
+		SeverityText:         record.Level.String(),
+		Body:                 &body,
+	}
+	if source := record.Source; source != nil {
+		if source.Name != "" {
+			out.Attributes = append(out.Attributes, otlp.KeyValue{Key: attrCodeFunction, Value: otlp.StringValue(source.Name)})
+		}
+		if source.ShortSrc != "" {
+			out.Attributes = append(out.Attributes, otlp.KeyValue{Key: attrCodeFilepath, Value: otlp.StringValue(source.ShortSrc)})
+		}
+		if source.CurrentLine > 0 {
+			out.Attributes = append(out.Attributes, otlp.KeyValue{Key: attrCodeLineno, Value: otlp.IntValue(int64(source.CurrentLine))})
+		}
+	}
+	if len(record.Trace) > 0 {
+		out.Attributes = append(out.Attributes, otlp.KeyValue{Key: attrCodeStacktrace, Value: otlp.StringValue(formatTraceback(record.Trace))})
+	}
+	return out
+}
+
+// formatTraceback renders a stack trace the way Lua's debug.traceback does.
+func formatTraceback(trace []websocket.FunctionInfo) string {
+	var b strings.Builder
+	b.WriteString("stack traceback:")
+	for _, frame := range trace {
+		b.WriteString("\n\t")
+		b.WriteString(frame.ShortSrc)
+		if frame.CurrentLine > 0 {
+			fmt.Fprintf(&b, ":%d", frame.CurrentLine)
+		}
+		b.WriteString(": in ")
+		switch {
+		case frame.What == "main":
+			b.WriteString("main chunk")
+		case frame.Name != "":
+			fmt.Fprintf(&b, "function '%s'", frame.Name)
+		case frame.LineDefined > 0:
+			fmt.Fprintf(&b, "function <%s:%d>", frame.ShortSrc, frame.LineDefined)
+		default:
+			b.WriteString("?")
+		}
+	}
+	return b.String()
+}
+
+func toLogRecord(record websocket.LogRecord) *logv1.LogRecord {
+	out := &logv1.LogRecord{
+		Time: timestamppb.New(record.Time),
+		// The proto enum reserves zero for LOG_LEVEL_UNSPECIFIED.
+		Level:   logv1.LogLevel(record.Level + 1),
+		Message: record.Message,
+	}
+	if record.Source != nil {
+		out.Source = toFunctionInfo(*record.Source)
+	}
+	for _, frame := range record.Trace {
+		out.Trace = append(out.Trace, toFunctionInfo(frame))
+	}
+	return out
+}
+
+func toFunctionInfo(info websocket.FunctionInfo) *logv1.FunctionInfo {
+	return &logv1.FunctionInfo{
+		Source:          info.Source,
+		ShortSrc:        info.ShortSrc,
+		CurrentLine:     int32(info.CurrentLine),
+		LineDefined:     int32(info.LineDefined),
+		LastLineDefined: int32(info.LastLineDefined),
+		What:            info.What,
+		Name:            info.Name,
+		NameWhat:        info.NameWhat,
+	}
+}
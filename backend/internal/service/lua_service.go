@@ -0,0 +1,129 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	luav1 "ehedges.net/ccgui/backend/gen/lua/v1"
+	"ehedges.net/ccgui/backend/internal/websocket"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	// callLuaExecute is the method computers answer to run a chunk.
+	callLuaExecute = "lua.execute"
+
+	maxLuaTimeout = 5 * time.Minute
+	// maxLuaCodeSize bounds the chunk sent to a computer.
+	maxLuaCodeSize = 256 << 10
+	// maxLuaResults bounds the return values accepted from a chunk.
+	maxLuaResults = 256
+)
+
+var ErrInvalidLuaChunk = errors.New("invalid lua chunk")
+
+type LuaService interface {
+	// Execute runs code on the computer, waiting at most timeout, or
+	// websocket.DefaultCallTimeout if it is zero.
+	Execute(ctx context.Context, computerID int, code string, timeout time.Duration) (*luav1.ExecuteLuaResponse, error)
+}
+
+// LuaServiceImpl runs Lua chunks on computers over their websocket
+// connection. The computer runs each chunk in its own environment, capturing
+// what it prints.
+type LuaServiceImpl struct {
+	caller ComputerCaller
+}
+
+func NewLuaService(caller ComputerCaller) *LuaServiceImpl {
+	return &LuaServiceImpl{
+		caller: caller,
+	}
+}
+
+func (s *LuaServiceImpl) Execute(ctx context.Context, computerID int, code string, timeout time.Duration) (*luav1.ExecuteLuaResponse, error) {
+	if computerID < 0 {
+		return nil, ErrInvalidComputerID
+	}
+	if code == "" {
+		return nil, fmt.Errorf("%w: code is required", ErrInvalidLuaChunk)
+	}
+	if len(code) > maxLuaCodeSize {
+		return nil, fmt.Errorf("%w: code is longer than %d bytes", ErrInvalidLuaChunk, maxLuaCodeSize)
+	}
+	if timeout < 0 || timeout > maxLuaTimeout {
+		return nil, fmt.Errorf("%w: timeout must be between 0 and %s", ErrInvalidLuaChunk, maxLuaTimeout)
+	}
+	if timeout == 0 {
+		timeout = websocket.DefaultCallTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	raw, err := s.caller.Call(ctx, computerID, callLuaExecute, code)
+	if err != nil {
+		return nil, err
+	}
+	returns, err := decodeLuaReturns(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(returns) == 0 {
+		return nil, fmt.Errorf("%w: %s returned nothing", ErrInvalidLuaValue, callLuaExecute)
+	}
+	return decodeLuaOutcome(returns[0])
+}
+
+// decodeLuaOutcome converts the table a computer reports for a chunk:
+// {ok, output, results, n, error, traceback}, where results holds n values
+// and may have holes where the chunk returned nil.
+func decodeLuaOutcome(v any) (*luav1.ExecuteLuaResponse, error) {
+	fields, ok := luaTable(v)
+	if !ok {
+		return nil, fmt.Errorf("%w: outcome is %T, not a table", ErrInvalidLuaValue, v)
+	}
+	response := &luav1.ExecuteLuaResponse{}
+	response.Success, _ = fields["ok"].(bool)
+	response.Output, _ = fields["output"].(string)
+	response.Error, _ = fields["error"].(string)
+	response.Traceback, _ = fields["traceback"].(string)
+	response.Output = validUTF8(response.Output)
+	response.Error = validUTF8(response.Error)
+	response.Traceback = validUTF8(response.Traceback)
+
+	count, _ := toFloat(fields["n"])
+	if count < 0 || count > maxLuaResults {
+		return nil, fmt.Errorf("%w: chunk returned more than %d values", ErrInvalidLuaValue, maxLuaResults)
+	}
+	results := luaPacked(fields["results"], int(count))
+	response.Results = make([]*structpb.Value, 0, len(results))
+	for _, result := range results {
+		value, err := luaToValue(result)
+		if err != nil {
+			return nil, err
+		}
+		response.Results = append(response.Results, value)
+	}
+	return response, nil
+}
+
+// luaPacked returns the first n values of a Lua sequence that may have nil
+// holes, which msgpack encodes as a map keyed by index.
+func luaPacked(v any, n int) []any {
+	values := make([]any, n)
+	if items, ok := v.([]any); ok {
+		copy(values, items)
+		return values
+	}
+	fields, _ := luaTable(v)
+	for key, item := range fields {
+		i, err := strconv.Atoi(key)
+		if err == nil && i >= 1 && i <= n {
+			values[i-1] = item
+		}
+	}
+	return values
+}
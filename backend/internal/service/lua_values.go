@@ -0,0 +1,215 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// maxLuaValueDepth bounds how deeply nested tables returned by a computer may
+// be.
+const maxLuaValueDepth = 32
+
+var ErrInvalidLuaValue = errors.New("invalid lua value")
+
+// decodeLuaReturns decodes the msgpack array of values returned by a call to
+// a computer.
+func decodeLuaReturns(raw msgpack.RawMessage) ([]any, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	// Lua tables may have keys of any type, e.g. the sparse slot numbers
+	// returned by inventory.list.
+	dec := msgpack.NewDecoder(bytes.NewReader(raw))
+	dec.SetMapDecoder(func(d *msgpack.Decoder) (any, error) {
+		return d.DecodeUntypedMap()
+	})
+	decoded, err := dec.DecodeInterface()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidLuaValue, err)
+	}
+	if decoded == nil {
+		return nil, nil
+	}
+	values, ok := luaList(decoded)
+	if !ok {
+		return nil, fmt.Errorf("%w: return values are not a list", ErrInvalidLuaValue)
+	}
+	return values, nil
+}
+
+// luaList returns v as a list if it is one. Lua has no separate empty list, so
+// an empty map counts too.
+func luaList(v any) ([]any, bool) {
+	switch v := v.(type) {
+	case []any:
+		return v, true
+	case map[string]any:
+		return nil, len(v) == 0
+	case map[any]any:
+		return nil, len(v) == 0
+	}
+	return nil, false
+}
+
+// luaTable returns v as a table keyed by strings, formatting other keys.
+func luaTable(v any) (map[string]any, bool) {
+	switch v := v.(type) {
+	case map[string]any:
+		return v, true
+	case map[any]any:
+		fields := make(map[string]any, len(v))
+		for key, item := range v {
+			fields[fmt.Sprint(key)] = item
+		}
+		return fields, true
+	}
+	return nil, false
+}
+
+// luaToValue converts a value decoded from msgpack to a protobuf Value.
+// Tables with non-string keys become structs with the keys formatted as
+// strings; strings that are not valid UTF-8 have the invalid bytes replaced.
+func luaToValue(v any) (*structpb.Value, error) {
+	return luaToValueDepth(v, 0)
+}
+
+func luaToValueDepth(v any, depth int) (*structpb.Value, error) {
+	if depth > maxLuaValueDepth {
+		return nil, fmt.Errorf("%w: tables nested too deeply", ErrInvalidLuaValue)
+	}
+	switch v := v.(type) {
+	case nil:
+		return structpb.NewNullValue(), nil
+	case bool:
+		return structpb.NewBoolValue(v), nil
+	case string:
+		return structpb.NewStringValue(validUTF8(v)), nil
+	case []byte:
+		return structpb.NewStringValue(validUTF8(string(v))), nil
+	case int8, int16, int32, int64, uint8, uint16, uint32, uint64, float32, float64:
+		n, _ := toFloat(v)
+		if math.IsNaN(n) || math.IsInf(n, 0) {
+			// JSON, and so Value, cannot represent these.
+			return structpb.NewStringValue(fmt.Sprint(n)), nil
+		}
+		return structpb.NewNumberValue(n), nil
+	case []any:
+		values := make([]*structpb.Value, 0, len(v))
+		for _, item := range v {
+			value, err := luaToValueDepth(item, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return structpb.NewListValue(&structpb.ListValue{Values: values}), nil
+	case map[string]any:
+		fields := make(map[string]*structpb.Value, len(v))
+		for key, item := range v {
+			value, err := luaToValueDepth(item, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			fields[validUTF8(key)] = value
+		}
+		return structpb.NewStructValue(&structpb.Struct{Fields: fields}), nil
+	case map[any]any:
+		fields := make(map[string]*structpb.Value, len(v))
+		for key, item := range v {
+			value, err := luaToValueDepth(item, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			fields[validUTF8(fmt.Sprint(key))] = value
+		}
+		return structpb.NewStructValue(&structpb.Struct{Fields: fields}), nil
+	}
+	return nil, fmt.Errorf("%w: unsupported type %T", ErrInvalidLuaValue, v)
+}
+
+// valueToLua converts a protobuf Value to a value to send to Lua. Whole
+// numbers become integers, which some peripheral methods require.
+func valueToLua(v *structpb.Value) any {
+	switch kind := v.GetKind().(type) {
+	case *structpb.Value_BoolValue:
+		return kind.BoolValue
+	case *structpb.Value_StringValue:
+		return kind.StringValue
+	case *structpb.Value_NumberValue:
+		n := kind.NumberValue
+		if n == math.Trunc(n) && math.Abs(n) < 1<<53 {
+			return int64(n)
+		}
+		return n
+	case *structpb.Value_ListValue:
+		values := make([]any, 0, len(kind.ListValue.GetValues()))
+		for _, item := range kind.ListValue.GetValues() {
+			values = append(values, valueToLua(item))
+		}
+		return values
+	case *structpb.Value_StructValue:
+		fields := make(map[string]any, len(kind.StructValue.GetFields()))
+		for key, item := range kind.StructValue.GetFields() {
+			fields[key] = valueToLua(item)
+		}
+		return fields
+	}
+	return nil
+}
+
+func toFloat(v any) (float64, bool) {
+	switch n := v.(type) {
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// luaStrings converts a decoded Lua list of strings.
+func luaStrings(v any) ([]string, error) {
+	items, ok := luaList(v)
+	if !ok {
+		return nil, fmt.Errorf("%w: expected a list of strings", ErrInvalidLuaValue)
+	}
+	out := make([]string, 0, len(items))
+	for _, item := range items {
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: expected a string, got %T", ErrInvalidLuaValue, item)
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+func validUTF8(s string) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+	return strings.ToValidUTF8(s, "�")
+}
@@ -0,0 +1,380 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"time"
+
+	metricsv1 "ehedges.net/ccgui/backend/gen/metrics/v1"
+	"ehedges.net/ccgui/backend/internal/otlp"
+	"ehedges.net/ccgui/backend/internal/repository"
+	"ehedges.net/ccgui/backend/internal/websocket"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Resource attributes identifying the computer that sent telemetry. They are
+// taken from the session's handshake and overwrite anything the computer
+// claims itself.
+const (
+	attrServiceName       = "service.name"
+	attrServiceInstanceID = "service.instance.id"
+	attrComputerID        = "cc.computer.id"
+	attrComputerLabel     = "cc.computer.label"
+	attrComputerKind      = "cc.computer.kind"
+	attrComputerTags      = "cc.computer.tags"
+	attrComputerGroups    = "cc.computer.groups"
+
+	computerServiceName = "computercraft"
+)
+
+const (
+	defaultMetricsQueryRange = time.Hour
+	maxMetricsQueryPoints    = 11000
+	maxMetricsQuerySeries    = 500
+	metricsPruneInterval     = time.Hour
+)
+
+var ErrInvalidMetricsQuery = errors.New("invalid metrics query")
+
+type MetricsService interface {
+	Query(ctx context.Context, query MetricsQuery) ([]*metricsv1.MetricSeries, time.Duration, error)
+}
+
+// MetricsQuery selects the series of one metric and the range to return.
+// Zero times and steps take the defaults described on QueryMetricsRequest.
+type MetricsQuery struct {
+	Name       string
+	ComputerID *int
+	// Computers, if not empty, limits the series to those of the computers
+	// it selects.
+	Computers ComputerSelector
+	Labels    map[string]string
+	Start     time.Time
+	End       time.Time
+	Step      time.Duration
+}
+
+type MetricsExporter interface {
+	ExportMetrics(data *otlp.MetricsData) error
+}
+
+// MetricsStoreOptions configures the embedded metrics store.
+type MetricsStoreOptions struct {
+	// Resolution is the width of the buckets data points are aggregated into.
+	Resolution time.Duration
+	// Retention is how long buckets are kept. Zero keeps them forever.
+	Retention time.Duration
+}
+
+// MetricsServiceImpl accepts metrics flushed by computers, keeps them in the
+// embedded store and forwards them to the OTLP collector.
+type MetricsServiceImpl struct {
+	exporter  MetricsExporter
+	repo      repository.MetricRepository
+	computers ComputerDirectory
+	opts      MetricsStoreOptions
+}
+
+func NewMetricsService(exporter MetricsExporter, repo repository.MetricRepository, computers ComputerDirectory, opts MetricsStoreOptions) *MetricsServiceImpl {
+	if opts.Resolution <= 0 {
+		opts.Resolution = time.Minute
+	}
+	return &MetricsServiceImpl{
+		exporter:  exporter,
+		repo:      repo,
+		computers: computers,
+		opts:      opts,
+	}
+}
+
+func (s *MetricsServiceImpl) ComputerMetrics(ctx context.Context, computer websocket.ComputerInfo, data *otlp.MetricsData) error {
+	if len(data.ResourceMetrics) == 0 {
+		return nil
+	}
+	var errs []error
+	if samples := s.samples(computer, data); len(samples) > 0 {
+		if err := s.repo.MergeSamples(ctx, samples); err != nil {
+			errs = append(errs, fmt.Errorf("store metrics: %w", err))
+		}
+	}
+	resource := append(computerResourceAttributes(computer), computerTagAttributes(ctx, s.computers, computer.ID)...)
+	data.SetResourceAttributes(resource...)
+	if s.exporter != nil {
+		if err := s.exporter.ExportMetrics(data); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// samples converts the gauges, sums and histograms in data to store samples.
+// Other metric types and points that have already expired are dropped.
+func (s *MetricsServiceImpl) samples(computer websocket.ComputerInfo, data *otlp.MetricsData) []repository.MetricSample {
+	var cutoff time.Time
+	if s.opts.Retention > 0 {
+		cutoff = time.Now().Add(-s.opts.Retention)
+	}
+	var samples []repository.MetricSample
+	add := func(metric otlp.Metric, attributes []otlp.KeyValue, timeUnixNano otlp.Uint64, kind repository.MetricKind, temporality otlp.AggregationTemporality, monotonic bool, bounds []float64, point repository.MetricPointRecord) {
+		t := time.Unix(0, int64(timeUnixNano))
+		if t.Before(cutoff) {
+			return
+		}
+		point.Bucket = t.Truncate(s.opts.Resolution)
+		point.LastTime = t
+		labels := make(map[string]string, len(attributes))
+		for _, attribute := range attributes {
+			labels[attribute.Key] = attribute.Value.String()
+		}
+		samples = append(samples, repository.MetricSample{
+			Key:        repository.MetricSeriesKey{ComputerID: computer.ID, Name: metric.Name, Labels: labels},
+			Unit:       metric.Unit,
+			Kind:       kind,
+			Cumulative: temporality == otlp.AggregationTemporalityCumulative,
+			Monotonic:  monotonic,
+			Bounds:     bounds,
+			Point:      point,
+		})
+	}
+	for _, rm := range data.ResourceMetrics {
+		for _, sm := range rm.ScopeMetrics {
+			for _, metric := range sm.Metrics {
+				switch {
+				case metric.Gauge != nil:
+					for _, dp := range metric.Gauge.DataPoints {
+						add(metric, dp.Attributes, dp.TimeUnixNano, repository.MetricKindGauge, otlp.AggregationTemporalityUnspecified, false, nil, numberPoint(dp.Value()))
+					}
+				case metric.Sum != nil:
+					for _, dp := range metric.Sum.DataPoints {
+						add(metric, dp.Attributes, dp.TimeUnixNano, repository.MetricKindSum, metric.Sum.AggregationTemporality, metric.Sum.IsMonotonic, nil, numberPoint(dp.Value()))
+					}
+				case metric.Histogram != nil:
+					for _, dp := range metric.Histogram.DataPoints {
+						add(metric, dp.Attributes, dp.TimeUnixNano, repository.MetricKindHistogram, metric.Histogram.AggregationTemporality, false, dp.ExplicitBounds, histogramPoint(dp))
+					}
+				}
+			}
+		}
+	}
+	return samples
+}
+
+func numberPoint(value float64) repository.MetricPointRecord {
+	return repository.MetricPointRecord{Last: value, Min: value, Max: value, Sum: value, Count: 1}
+}
+
+func histogramPoint(dp otlp.HistogramDataPoint) repository.MetricPointRecord {
+	point := repository.MetricPointRecord{Count: uint64(dp.Count)}
+	if dp.Sum != nil {
+		point.Sum = *dp.Sum
+	}
+	if point.Count > 0 {
+		point.Last = point.Sum / float64(point.Count)
+	}
+	point.Min, point.Max = point.Last, point.Last
+	if dp.Min != nil {
+		point.Min = *dp.Min
+	}
+	if dp.Max != nil {
+		point.Max = *dp.Max
+	}
+	for _, count := range dp.BucketCounts {
+		point.BucketCounts = append(point.BucketCounts, uint64(count))
+	}
+	return point
+}
+
+func (s *MetricsServiceImpl) Query(ctx context.Context, query MetricsQuery) ([]*metricsv1.MetricSeries, time.Duration, error) {
+	if query.Name == "" {
+		return nil, 0, fmt.Errorf("%w: metric name is required", ErrInvalidMetricsQuery)
+	}
+	if query.ComputerID != nil && *query.ComputerID < 0 {
+		return nil, 0, ErrInvalidComputerID
+	}
+	end := query.End
+	if end.IsZero() {
+		end = time.Now()
+	}
+	start := query.Start
+	if start.IsZero() {
+		start = end.Add(-defaultMetricsQueryRange)
+	}
+	if !start.Before(end) {
+		return nil, 0, fmt.Errorf("%w: start must be before end", ErrInvalidMetricsQuery)
+	}
+	if query.Step < 0 {
+		return nil, 0, fmt.Errorf("%w: step must not be negative", ErrInvalidMetricsQuery)
+	}
+	resolution := s.opts.Resolution
+	step := max(resolution, (query.Step+resolution-1)/resolution*resolution)
+	start = start.Truncate(step)
+	if end.Sub(start)/step > maxMetricsQueryPoints {
+		return nil, 0, fmt.Errorf("%w: range would return more than %d points per series; increase the step", ErrInvalidMetricsQuery, maxMetricsQueryPoints)
+	}
+
+	records, err := s.repo.ListSeries(ctx, query.Name, query.ComputerID)
+	if err != nil {
+		return nil, 0, err
+	}
+	var selected []int
+	if !query.Computers.Empty() {
+		if s.computers == nil {
+			return nil, 0, fmt.Errorf("%w: computer selectors are not available", ErrInvalidMetricsQuery)
+		}
+		selected, err = s.computers.Select(ctx, query.Computers)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	var matched []*repository.MetricSeriesRecord
+	for _, record := range records {
+		if !query.Computers.Empty() && !slices.Contains(selected, record.ComputerID) {
+			continue
+		}
+		if labelsMatch(record.Labels, query.Labels) {
+			matched = append(matched, record)
+		}
+	}
+	if len(matched) > maxMetricsQuerySeries {
+		return nil, 0, fmt.Errorf("%w: query matches more than %d series; filter by computer or labels", ErrInvalidMetricsQuery, maxMetricsQuerySeries)
+	}
+	ids := make([]int64, 0, len(matched))
+	for _, record := range matched {
+		ids = append(ids, record.ID)
+	}
+	points, err := s.repo.ListPoints(ctx, ids, start, end)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	bySeries := make(map[int64][]*repository.MetricPointRecord, len(matched))
+	for _, point := range points {
+		bySeries[point.SeriesID] = append(bySeries[point.SeriesID], point)
+	}
+	series := make([]*metricsv1.MetricSeries, 0, len(matched))
+	for _, record := range matched {
+		out := toMetricSeries(record)
+		// Points arrive ordered by bucket, so each step's buckets are
+		// consecutive.
+		var current *repository.MetricPointRecord
+		for _, point := range bySeries[record.ID] {
+			bucket := point.Bucket.Truncate(step)
+			if current != nil && !current.Bucket.Equal(bucket) {
+				out.Points = append(out.Points, toMetricPoint(record, current))
+				current = nil
+			}
+			if current == nil {
+				current = &repository.MetricPointRecord{Bucket: bucket}
+			}
+			current.Merge(*point, record.Cumulative)
+		}
+		if current != nil {
+			out.Points = append(out.Points, toMetricPoint(record, current))
+		}
+		series = append(series, out)
+	}
+	return series, step, nil
+}
+
+func labelsMatch(labels map[string]string, filter map[string]string) bool {
+	for key, value := range filter {
+		if actual, ok := labels[key]; !ok || actual != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Run deletes points older than the retention period until ctx is cancelled.
+func (s *MetricsServiceImpl) Run(ctx context.Context) {
+	if s.opts.Retention <= 0 {
+		return
+	}
+	ticker := time.NewTicker(metricsPruneInterval)
+	defer ticker.Stop()
+	for {
+		deleted, err := s.repo.DeletePointsBefore(ctx, time.Now().Add(-s.opts.Retention))
+		if err != nil {
+			slog.Warn("failed to prune metrics", "err", err)
+		} else if deleted > 0 {
+			slog.Debug("pruned metrics", "points", deleted)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func computerResourceAttributes(computer websocket.ComputerInfo) []otlp.KeyValue {
+	return []otlp.KeyValue{
+		{Key: attrServiceName, Value: otlp.StringValue(computerServiceName)},
+		{Key: attrServiceInstanceID, Value: otlp.StringValue(strconv.Itoa(computer.ID))},
+		{Key: attrComputerID, Value: otlp.IntValue(int64(computer.ID))},
+		{Key: attrComputerLabel, Value: otlp.StringValue(computer.Label)},
+		{Key: attrComputerKind, Value: otlp.StringValue(string(computer.Kind))},
+	}
+}
+
+func toMetricSeries(record *repository.MetricSeriesRecord) *metricsv1.MetricSeries {
+	kind := metricsv1.MetricKind_METRIC_KIND_UNSPECIFIED
+	switch record.Kind {
+	case repository.MetricKindGauge:
+		kind = metricsv1.MetricKind_METRIC_KIND_GAUGE
+	case repository.MetricKindSum:
+		kind = metricsv1.MetricKind_METRIC_KIND_SUM
+	case repository.MetricKindHistogram:
+		kind = metricsv1.MetricKind_METRIC_KIND_HISTOGRAM
+	}
+	return &metricsv1.MetricSeries{
+		Name:           record.Name,
+		ComputerId:     int32(record.ComputerID),
+		Labels:         record.Labels,
+		Unit:           record.Unit,
+		Kind:           kind,
+		Cumulative:     record.Cumulative,
+		Monotonic:      record.Monotonic,
+		ExplicitBounds: record.Bounds,
+	}
+}
+
+func toMetricPoint(series *repository.MetricSeriesRecord, point *repository.MetricPointRecord) *metricsv1.MetricPoint {
+	value := point.Last
+	if series.Kind == repository.MetricKindSum && !series.Cumulative {
+		value = point.Sum
+	} else if series.Kind == repository.MetricKindHistogram && point.Count > 0 {
+		value = point.Sum / float64(point.Count)
+	}
+	return &metricsv1.MetricPoint{
+		Time:         timestamppb.New(point.Bucket),
+		Value:        value,
+		Min:          point.Min,
+		Max:          point.Max,
+		Sum:          point.Sum,
+		Count:        point.Count,
+		BucketCounts: point.BucketCounts,
+	}
+}
+
+// computerTagAttributes returns the computer's tags and groups as resource
+// attributes, so they can be used as labels downstream. It returns none if
+// they cannot be looked up.
+func computerTagAttributes(ctx context.Context, computers ComputerDirectory, id int) []otlp.KeyValue {
+	if computers == nil {
+		return nil
+	}
+	tags, groups, err := computers.ComputerTags(ctx, id)
+	if err != nil {
+		slog.Debug("failed to look up computer tags", "computer_id", id, "err", err)
+		return nil
+	}
+	return []otlp.KeyValue{
+		{Key: attrComputerTags, Value: otlp.StringArrayValue(tags)},
+		{Key: attrComputerGroups, Value: otlp.StringArrayValue(groups)},
+	}
+}
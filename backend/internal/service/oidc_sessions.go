@@ -0,0 +1,95 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"slices"
+
+	auditv1 "ehedges.net/ccgui/backend/gen/audit/v1"
+	"ehedges.net/ccgui/backend/internal/oidc"
+)
+
+// AuditActionOIDCLogin is the audit action of signing in with an OpenID
+// Connect provider.
+const AuditActionOIDCLogin = "oidc.login"
+
+var ErrNoRole = errors.New("none of your groups may use this dashboard")
+
+// GroupRoles maps a user's groups at an identity provider to their role.
+type GroupRoles struct {
+	// Admins, Operators and Viewers list the groups whose members get each
+	// role. Users in several get the most powerful.
+	Admins    []string
+	Operators []string
+	Viewers   []string
+	// Default is the role of users in none of the groups. If empty, they
+	// may not sign in.
+	Default Role
+}
+
+// RoleFor returns the role of a user in groups.
+func (g GroupRoles) RoleFor(groups []string) (Role, bool) {
+	inAny := func(roleGroups []string) bool {
+		return slices.ContainsFunc(groups, func(group string) bool {
+			return slices.Contains(roleGroups, group)
+		})
+	}
+	switch {
+	case inAny(g.Admins):
+		return RoleAdmin, true
+	case inAny(g.Operators):
+		return RoleOperator, true
+	case inAny(g.Viewers):
+		return RoleViewer, true
+	}
+	return g.Default, g.Default != ""
+}
+
+// OIDCSessions starts sessions for users an OpenID Connect provider signs
+// in, giving them the role their groups map to.
+type OIDCSessions struct {
+	users UserService
+	roles GroupRoles
+	audit AuditService
+}
+
+func NewOIDCSessions(users UserService, roles GroupRoles, audit AuditService) *OIDCSessions {
+	return &OIDCSessions{
+		users: users,
+		roles: roles,
+		audit: audit,
+	}
+}
+
+func (s *OIDCSessions) IssueSession(ctx context.Context, identity oidc.Identity, remoteAddr string) (string, error) {
+	event := AuditEvent{
+		RemoteAddr: remoteAddr,
+		Action:     AuditActionOIDCLogin,
+		Target:     "username:" + identity.Username,
+		Outcome:    auditv1.AuditOutcome_AUDIT_OUTCOME_SUCCESS,
+	}
+	defer func() { s.audit.Record(ctx, event) }()
+
+	role, ok := s.roles.RoleFor(identity.Groups)
+	if !ok {
+		event.Outcome = auditv1.AuditOutcome_AUDIT_OUTCOME_DENIED
+		event.Err = ErrNoRole
+		return "", ErrNoRole
+	}
+	response, err := s.users.ExternalLogin(ctx, ExternalIdentity{
+		Issuer:   identity.Issuer,
+		Subject:  identity.Subject,
+		Username: identity.Username,
+	}, role, remoteAddr)
+	if err != nil {
+		event.Outcome = auditv1.AuditOutcome_AUDIT_OUTCOME_FAILED
+		event.Err = err
+		if errors.Is(err, ErrUserExists) {
+			return "", err
+		}
+		return "", errors.New("could not sign you in")
+	}
+	event.Principal = UserPrincipal(response.GetUser())
+	event.Target = "user:" + response.GetUser().GetId()
+	return response.GetToken(), nil
+}
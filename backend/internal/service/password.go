@@ -0,0 +1,93 @@
+package service
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Passwords are hashed with argon2id (version 19) and stored as
+//
+//	argon2id$m=<memory KiB>,t=<iterations>,p=<threads>$<salt>$<hash>
+//
+// with the salt and hash in unpadded base64url. The parameters are those
+// RFC 9106 recommends when 2 GiB of memory per hash is too much. Passwords
+// are rehashed with the current parameters when users log in.
+const (
+	passwordAlgorithm  = "argon2id"
+	passwordMemory     = 64 * 1024
+	passwordIterations = 3
+	passwordThreads    = 4
+	passwordSaltLength = 16
+	passwordHashLength = 32
+
+	// maxConcurrentPasswordHashes bounds the memory taken hashing passwords,
+	// which anyone may make the server do by logging in.
+	maxConcurrentPasswordHashes = 4
+)
+
+var passwordHashSlots = make(chan struct{}, maxConcurrentPasswordHashes)
+
+var errMalformedPasswordHash = errors.New("malformed password hash")
+
+// hashPassword returns the encoded hash of password with a new salt.
+func hashPassword(password string) (string, error) {
+	salt, err := generateRandomBytes(passwordSaltLength)
+	if err != nil {
+		return "", err
+	}
+	hash := deriveKey(password, salt, passwordIterations, passwordMemory, passwordThreads, passwordHashLength)
+	return strings.Join([]string{
+		passwordAlgorithm,
+		passwordParams(passwordMemory, passwordIterations, passwordThreads),
+		base64.RawURLEncoding.EncodeToString(salt),
+		base64.RawURLEncoding.EncodeToString(hash),
+	}, "$"), nil
+}
+
+// checkPassword reports whether password matches encoded, and whether
+// encoded should be replaced because it uses outdated parameters.
+func checkPassword(password string, encoded string) (ok bool, rehash bool, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != passwordAlgorithm {
+		return false, false, errMalformedPasswordHash
+	}
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[1], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false, false, errMalformedPasswordHash
+	}
+	if memory == 0 || iterations == 0 || threads == 0 || parts[1] != passwordParams(memory, iterations, threads) {
+		return false, false, errMalformedPasswordHash
+	}
+	salt, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false, false, errMalformedPasswordHash
+	}
+	want, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil || len(want) == 0 {
+		return false, false, errMalformedPasswordHash
+	}
+	got := deriveKey(password, salt, iterations, memory, threads, uint32(len(want)))
+	if subtle.ConstantTimeCompare(got, want) != 1 {
+		return false, false, nil
+	}
+	outdated := memory < passwordMemory || iterations < passwordIterations || len(want) < passwordHashLength
+	return true, outdated, nil
+}
+
+func passwordParams(memory uint32, iterations uint32, threads uint8) string {
+	return fmt.Sprintf("m=%d,t=%d,p=%d", memory, iterations, threads)
+}
+
+// deriveKey hashes password with argon2id, waiting while
+// maxConcurrentPasswordHashes other passwords are being hashed.
+func deriveKey(password string, salt []byte, iterations uint32, memory uint32, threads uint8, length uint32) []byte {
+	passwordHashSlots <- struct{}{}
+	defer func() { <-passwordHashSlots }()
+	return argon2.IDKey([]byte(password), salt, iterations, memory, threads, length)
+}
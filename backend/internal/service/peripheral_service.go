@@ -0,0 +1,136 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	peripheralv1 "ehedges.net/ccgui/backend/gen/peripheral/v1"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Methods computers answer for the peripheral service.
+const (
+	callPeripheralList = "peripheral.list"
+	callPeripheralCall = "peripheral.call"
+)
+
+var ErrInvalidPeripheralCall = errors.New("invalid peripheral call")
+
+type PeripheralService interface {
+	List(ctx context.Context, computerID int) ([]*peripheralv1.Peripheral, error)
+	Call(ctx context.Context, computerID int, name string, method string, args []*structpb.Value) ([]*structpb.Value, error)
+}
+
+// ComputerCaller makes calls to connected computers.
+type ComputerCaller interface {
+	Call(ctx context.Context, computerID int, method string, args ...any) (msgpack.RawMessage, error)
+}
+
+// PeripheralServiceImpl proxies peripheral calls to computers over their
+// websocket connection.
+type PeripheralServiceImpl struct {
+	caller ComputerCaller
+}
+
+func NewPeripheralService(caller ComputerCaller) *PeripheralServiceImpl {
+	return &PeripheralServiceImpl{
+		caller: caller,
+	}
+}
+
+func (s *PeripheralServiceImpl) List(ctx context.Context, computerID int) ([]*peripheralv1.Peripheral, error) {
+	if computerID < 0 {
+		return nil, ErrInvalidComputerID
+	}
+	raw, err := s.caller.Call(ctx, computerID, callPeripheralList)
+	if err != nil {
+		return nil, err
+	}
+	returns, err := decodeLuaReturns(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(returns) == 0 {
+		return nil, fmt.Errorf("%w: %s returned nothing", ErrInvalidLuaValue, callPeripheralList)
+	}
+	items, ok := luaList(returns[0])
+	if !ok {
+		return nil, fmt.Errorf("%w: %s did not return a list", ErrInvalidLuaValue, callPeripheralList)
+	}
+
+	peripherals := make([]*peripheralv1.Peripheral, 0, len(items))
+	for _, item := range items {
+		peripheral, err := decodePeripheral(item)
+		if err != nil {
+			return nil, err
+		}
+		peripherals = append(peripherals, peripheral)
+	}
+	sort.Slice(peripherals, func(i, j int) bool {
+		return peripherals[i].GetName() < peripherals[j].GetName()
+	})
+	return peripherals, nil
+}
+
+func decodePeripheral(v any) (*peripheralv1.Peripheral, error) {
+	fields, ok := luaTable(v)
+	if !ok {
+		return nil, fmt.Errorf("%w: peripheral is %T, not a table", ErrInvalidLuaValue, v)
+	}
+	name, ok := fields["name"].(string)
+	if !ok || name == "" {
+		return nil, fmt.Errorf("%w: peripheral has no name", ErrInvalidLuaValue)
+	}
+	types, err := luaStrings(fields["types"])
+	if err != nil {
+		return nil, fmt.Errorf("peripheral %s types: %w", name, err)
+	}
+	methods, err := luaStrings(fields["methods"])
+	if err != nil {
+		return nil, fmt.Errorf("peripheral %s methods: %w", name, err)
+	}
+	sort.Strings(methods)
+	return &peripheralv1.Peripheral{
+		Name:    name,
+		Types:   types,
+		Methods: methods,
+	}, nil
+}
+
+func (s *PeripheralServiceImpl) Call(ctx context.Context, computerID int, name string, method string, args []*structpb.Value) ([]*structpb.Value, error) {
+	if computerID < 0 {
+		return nil, ErrInvalidComputerID
+	}
+	if name == "" {
+		return nil, fmt.Errorf("%w: name is required", ErrInvalidPeripheralCall)
+	}
+	if method == "" {
+		return nil, fmt.Errorf("%w: method is required", ErrInvalidPeripheralCall)
+	}
+	callArgs := make([]any, 0, len(args)+2)
+	callArgs = append(callArgs, name, method)
+	for _, arg := range args {
+		callArgs = append(callArgs, valueToLua(arg))
+	}
+
+	raw, err := s.caller.Call(ctx, computerID, callPeripheralCall, callArgs...)
+	if err != nil {
+		return nil, err
+	}
+	returns, err := decodeLuaReturns(raw)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*structpb.Value, 0, len(returns))
+	for _, value := range returns {
+		result, err := luaToValue(value)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
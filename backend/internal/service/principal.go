@@ -0,0 +1,132 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	authv1 "ehedges.net/ccgui/backend/gen/auth/v1"
+	userv1 "ehedges.net/ccgui/backend/gen/user/v1"
+)
+
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// Principal is the caller a request authenticated as.
+type Principal struct {
+	// KeyID is the ID of the API key the caller presented, if any.
+	KeyID string
+	// UserID is the ID of the user whose session token the caller
+	// presented, if any.
+	UserID string
+	// Name is a human-readable name for the caller.
+	Name string
+	// Scopes lists what the caller may do.
+	Scopes []Scope
+	// ComputerIDs and ComputerTags restrict the caller to those computers,
+	// or to computers with any of those tags, if either is set.
+	ComputerIDs  []int
+	ComputerTags []string
+}
+
+func (p *Principal) String() string {
+	if p.UserID != "" {
+		return fmt.Sprintf("user %q", p.Name)
+	}
+	return fmt.Sprintf("key %q", p.Name)
+}
+
+// HasScope reports whether the caller holds scope.
+func (p *Principal) HasScope(scope Scope) bool {
+	return slices.Contains(p.Scopes, scope)
+}
+
+// Restricted reports whether the caller may only act on some computers.
+func (p *Principal) Restricted() bool {
+	return len(p.ComputerIDs) > 0 || len(p.ComputerTags) > 0
+}
+
+// KeyPrincipal returns the principal of a caller presenting key.
+func KeyPrincipal(key *authv1.KeySummary) *Principal {
+	principal := &Principal{
+		KeyID:        key.GetId(),
+		Name:         key.GetName(),
+		ComputerTags: key.GetComputerTags(),
+	}
+	for _, scope := range key.GetScopes() {
+		principal.Scopes = append(principal.Scopes, Scope(scope))
+	}
+	for _, id := range key.GetComputerIds() {
+		principal.ComputerIDs = append(principal.ComputerIDs, int(id))
+	}
+	return principal
+}
+
+// UserPrincipal returns the principal of a signed-in user, who holds the
+// scopes of their role.
+func UserPrincipal(user *userv1.User) *Principal {
+	principal := &Principal{
+		UserID: user.GetId(),
+		Name:   user.GetUsername(),
+	}
+	// A user with an unknown role may do nothing.
+	if role, err := RoleFromProto(user.GetRole()); err == nil {
+		principal.Scopes = RoleScopes(role)
+	}
+	return principal
+}
+
+type principalContextKey struct{}
+
+// ContextWithPrincipal returns a copy of ctx carrying principal.
+func ContextWithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalContextKey{}, principal)
+}
+
+// PrincipalFromContext returns the principal of the request ctx belongs to.
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalContextKey{}).(*Principal)
+	return principal, ok
+}
+
+// Authenticator resolves bearer tokens to principals.
+type Authenticator interface {
+	// Authenticate returns the principal token belongs to, or
+	// ErrUnauthenticated if it is not a valid credential.
+	Authenticate(ctx context.Context, token string) (*Principal, error)
+}
+
+type keyAuthenticator struct {
+	keys APIKeyService
+}
+
+// NewKeyAuthenticator returns an authenticator accepting API keys.
+func NewKeyAuthenticator(keys APIKeyService) Authenticator {
+	return &keyAuthenticator{keys: keys}
+}
+
+func (a *keyAuthenticator) Authenticate(ctx context.Context, token string) (*Principal, error) {
+	key, ok := a.keys.Lookup(token)
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+	return KeyPrincipal(key), nil
+}
+
+type sessionAuthenticator struct {
+	users UserService
+}
+
+// NewSessionAuthenticator returns an authenticator accepting the session
+// tokens users get by logging in.
+func NewSessionAuthenticator(users UserService) Authenticator {
+	return &sessionAuthenticator{users: users}
+}
+
+func (a *sessionAuthenticator) Authenticate(ctx context.Context, token string) (*Principal, error) {
+	user, err := a.users.Session(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	return UserPrincipal(user), nil
+}
@@ -0,0 +1,600 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	terminalv1 "ehedges.net/ccgui/backend/gen/terminal/v1"
+	"ehedges.net/ccgui/backend/internal/rawterm"
+	"ehedges.net/ccgui/backend/internal/recording"
+	"ehedges.net/ccgui/backend/internal/screen"
+	"ehedges.net/ccgui/backend/internal/websocket"
+)
+
+const terminalSubscriberBuffer = 128
+
+// maxReplaySpeed bounds how fast a recording can be played back.
+const maxReplaySpeed = 16
+
+var ErrTerminalNotFound = errors.New("terminal not found")
+var ErrWindowNotFound = errors.New("window not found")
+var ErrInvalidInput = errors.New("invalid input event")
+var ErrInvalidReplay = errors.New("invalid replay request")
+
+type TerminalService interface {
+	ListWindows(ctx context.Context, computerID int) ([]*terminalv1.Window, error)
+	Watch(computerID int, windowID *uint32) (snapshot []*terminalv1.WatchTerminalResponse, updates <-chan *terminalv1.WatchTerminalResponse, unsubscribe func())
+	SendInput(ctx context.Context, computerID int, windowID uint32, events []*terminalv1.InputEvent) error
+	ListRecordings(ctx context.Context, computerID int) ([]recording.Info, error)
+	Replay(ctx context.Context, recordingID string, speed float64, from time.Duration, send func(offset time.Duration, update *terminalv1.WatchTerminalResponse) error) error
+}
+
+// ComputerSender delivers input to computers and reports the monitors their
+// sessions are mirroring.
+type ComputerSender interface {
+	SendToComputer(id int, message websocket.Message, data any) error
+	ComputerSessions(id int) []websocket.SessionInfo
+}
+
+// terminalWindow holds the latest state of a window. Text mode screens are
+// kept as a model so viewers can be sent diffs; graphics mode frames are kept
+// as the raw packet body.
+type terminalWindow struct {
+	info   rawterm.WindowInfo
+	screen *screen.Screen
+	raw    []byte
+}
+
+// terminalScreens is the latest state of each window of one rawterm stream.
+// It backs both the live relay and recording replays.
+type terminalScreens struct {
+	windows map[uint8]*terminalWindow
+}
+
+func newTerminalScreens() terminalScreens {
+	return terminalScreens{windows: make(map[uint8]*terminalWindow)}
+}
+
+// computerTerminal is the relay state for one computer: the framing buffer
+// for its rawterm stream, the latest screen of each window, its viewers and
+// the recording of the current session.
+type computerTerminal struct {
+	terminalScreens
+	reader    rawterm.FrameReader
+	subs      map[chan *terminalv1.WatchTerminalResponse]*uint32
+	recording *recording.Writer
+}
+
+// TerminalServiceImpl relays rawterm output from computers to browser viewers
+// and records it for later replay.
+type TerminalServiceImpl struct {
+	sender     ComputerSender
+	recordings *recording.Store
+	mu         sync.Mutex
+	terminals  map[int]*computerTerminal
+}
+
+// NewTerminalService creates the relay. Sessions are not recorded when
+// recordings is nil.
+func NewTerminalService(sender ComputerSender, recordings *recording.Store) *TerminalServiceImpl {
+	return &TerminalServiceImpl{
+		sender:     sender,
+		recordings: recordings,
+		terminals:  make(map[int]*computerTerminal),
+	}
+}
+
+func (s *TerminalServiceImpl) ListWindows(ctx context.Context, computerID int) ([]*terminalv1.Window, error) {
+	monitors := s.monitorNames(computerID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	terminal := s.terminals[computerID]
+	if terminal == nil {
+		return nil, ErrTerminalNotFound
+	}
+	windows := make([]*terminalv1.Window, 0, len(terminal.windows))
+	for id, window := range terminal.windows {
+		windows = append(windows, &terminalv1.Window{
+			Id:      uint32(id),
+			Title:   window.info.Title,
+			Width:   uint32(window.info.Width),
+			Height:  uint32(window.info.Height),
+			Monitor: monitors[id],
+		})
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i].Id < windows[j].Id })
+	return windows, nil
+}
+
+// Watch returns the latest window and screen packets for the computer,
+// followed by a channel of every packet relayed after them. A nil windowID
+// watches all windows. The channel is closed if the viewer falls behind.
+func (s *TerminalServiceImpl) Watch(computerID int, windowID *uint32) ([]*terminalv1.WatchTerminalResponse, <-chan *terminalv1.WatchTerminalResponse, func()) {
+	sub := make(chan *terminalv1.WatchTerminalResponse, terminalSubscriberBuffer)
+	s.mu.Lock()
+	terminal := s.terminalLocked(computerID)
+	snapshot := terminal.snapshot(windowID)
+	terminal.subs[sub] = windowID
+	s.mu.Unlock()
+	return snapshot, sub, func() {
+		s.mu.Lock()
+		if _, ok := terminal.subs[sub]; ok {
+			delete(terminal.subs, sub)
+			close(sub)
+		}
+		if len(terminal.subs) == 0 && len(terminal.windows) == 0 && s.terminals[computerID] == terminal {
+			delete(s.terminals, computerID)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// SendInput validates the events, encodes them as rawterm packets and sends
+// them to the computer. Nothing is sent unless every event is valid.
+func (s *TerminalServiceImpl) SendInput(ctx context.Context, computerID int, windowID uint32, events []*terminalv1.InputEvent) error {
+	if windowID > 0xFF {
+		return fmt.Errorf("%w: window id %d out of range", ErrWindowNotFound, windowID)
+	}
+	s.mu.Lock()
+	terminal := s.terminals[computerID]
+	windowOpen := false
+	if terminal != nil {
+		_, windowOpen = terminal.windows[uint8(windowID)]
+	}
+	s.mu.Unlock()
+	if terminal == nil {
+		return ErrTerminalNotFound
+	}
+	if !windowOpen {
+		return ErrWindowNotFound
+	}
+
+	monitor := s.monitorNames(computerID)[uint8(windowID)]
+	frames := make([][]byte, 0, len(events))
+	for i, event := range events {
+		packet, err := inputPacket(uint8(windowID), monitor, event)
+		if err != nil {
+			return fmt.Errorf("%w: event %d: %v", ErrInvalidInput, i, err)
+		}
+		frames = append(frames, rawterm.EncodeFrame(packet))
+	}
+	for _, frame := range frames {
+		if err := s.sender.SendToComputer(computerID, websocket.MessageTerminal, frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// monitorNames maps window IDs to the peripheral names of the monitors
+// mirrored into them.
+func (s *TerminalServiceImpl) monitorNames(computerID int) map[uint8]string {
+	names := make(map[uint8]string)
+	for _, session := range s.sender.ComputerSessions(computerID) {
+		for _, monitor := range session.Monitors {
+			names[monitor.Window] = monitor.Name
+		}
+	}
+	return names
+}
+
+// inputPacket encodes an input event for a window. monitor is the peripheral
+// name of the monitor mirrored into the window, or empty for other windows.
+func inputPacket(window uint8, monitor string, event *terminalv1.InputEvent) (rawterm.Packet, error) {
+	switch e := event.GetEvent().(type) {
+	case *terminalv1.InputEvent_Key:
+		if e.Key.GetKey() > 0xFF {
+			return rawterm.Packet{}, fmt.Errorf("key code %d out of range", e.Key.GetKey())
+		}
+		return rawterm.KeyPacket(window, uint8(e.Key.GetKey()), e.Key.GetUp(), e.Key.GetHeld()), nil
+	case *terminalv1.InputEvent_Char:
+		char := e.Char.GetCharacter()
+		r, size := utf8.DecodeRuneInString(char)
+		if size == 0 || size != len(char) || r == utf8.RuneError || r > 0xFF {
+			return rawterm.Packet{}, fmt.Errorf("character must be a single ISO-8859-1 character")
+		}
+		return rawterm.CharPacket(window, byte(r)), nil
+	case *terminalv1.InputEvent_Paste:
+		return rawterm.EventPacket(window, "paste", toLatin1(e.Paste.GetText()))
+	case *terminalv1.InputEvent_Mouse:
+		var eventType rawterm.MouseEventType
+		switch e.Mouse.GetType() {
+		case terminalv1.MouseEventType_MOUSE_EVENT_TYPE_CLICK:
+			eventType = rawterm.MouseClick
+		case terminalv1.MouseEventType_MOUSE_EVENT_TYPE_UP:
+			eventType = rawterm.MouseUp
+		case terminalv1.MouseEventType_MOUSE_EVENT_TYPE_SCROLL:
+			eventType = rawterm.MouseScroll
+		case terminalv1.MouseEventType_MOUSE_EVENT_TYPE_DRAG:
+			eventType = rawterm.MouseDrag
+		default:
+			return rawterm.Packet{}, fmt.Errorf("mouse event type is required")
+		}
+		if e.Mouse.GetButton() > 0xFF {
+			return rawterm.Packet{}, fmt.Errorf("mouse button %d out of range", e.Mouse.GetButton())
+		}
+		if e.Mouse.GetX() == 0 || e.Mouse.GetY() == 0 {
+			return rawterm.Packet{}, fmt.Errorf("mouse coordinates are 1-based")
+		}
+		return rawterm.MousePacket(window, eventType, uint8(e.Mouse.GetButton()), e.Mouse.GetX(), e.Mouse.GetY()), nil
+	case *terminalv1.InputEvent_MonitorTouch:
+		if monitor == "" {
+			return rawterm.Packet{}, fmt.Errorf("window is not a monitor")
+		}
+		if e.MonitorTouch.GetX() == 0 || e.MonitorTouch.GetY() == 0 {
+			return rawterm.Packet{}, fmt.Errorf("touch coordinates are 1-based")
+		}
+		return rawterm.EventPacket(window, "monitor_touch", monitor, e.MonitorTouch.GetX(), e.MonitorTouch.GetY())
+	case *terminalv1.InputEvent_Terminate:
+		return rawterm.EventPacket(window, "terminate")
+	default:
+		return rawterm.Packet{}, fmt.Errorf("event is required")
+	}
+}
+
+// toLatin1 maps text onto the single-byte character set used by CC strings.
+// NUL bytes would end the string early on the wire, so they are dropped.
+func toLatin1(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		switch {
+		case r == 0:
+		case r > 0xFF:
+			b.WriteByte('?')
+		default:
+			b.WriteByte(byte(r))
+		}
+	}
+	return b.String()
+}
+
+func (s *TerminalServiceImpl) TerminalData(ctx context.Context, computer websocket.ComputerInfo, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	terminal := s.terminalLocked(computer.ID)
+	packets, errs := terminal.reader.Write(data)
+	for _, err := range errs {
+		slog.Warn("dropped rawterm frame", "computer_id", computer.ID, "err", err)
+	}
+	if len(packets) > 0 && terminal.recording == nil && s.recordings != nil {
+		writer, err := s.recordings.Create(computer.ID)
+		if err != nil {
+			slog.Warn("failed to start terminal recording", "computer_id", computer.ID, "err", err)
+		} else {
+			terminal.recording = writer
+		}
+	}
+	for _, packet := range packets {
+		s.applyLocked(terminal, packet)
+	}
+	return nil
+}
+
+// TerminalDetached tells viewers that every window of a disconnected computer
+// has closed, ends its recording, and discards the relay state for it.
+func (s *TerminalServiceImpl) TerminalDetached(computer websocket.ComputerInfo) {
+	// The recording is closed after unlocking, as that writes its last
+	// frames to disk.
+	if writer := s.detach(computer); writer != nil {
+		if err := writer.Close(); err != nil {
+			slog.Warn("failed to close terminal recording", "recording_id", writer.ID(), "err", err)
+		}
+	}
+}
+
+func (s *TerminalServiceImpl) detach(computer websocket.ComputerInfo) *recording.Writer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	terminal := s.terminals[computer.ID]
+	if terminal == nil {
+		return nil
+	}
+	for id, window := range terminal.windows {
+		info := window.info
+		info.Change = rawterm.WindowChangeClosed
+		s.applyLocked(terminal, rawterm.Packet{
+			Type:   rawterm.PacketWindowChange,
+			Window: id,
+			Data:   info.Encode(),
+		})
+	}
+	writer := terminal.recording
+	terminal.recording = nil
+	terminal.reader = rawterm.FrameReader{}
+	if len(terminal.subs) == 0 {
+		delete(s.terminals, computer.ID)
+	}
+	return writer
+}
+
+func (s *TerminalServiceImpl) ListRecordings(ctx context.Context, computerID int) ([]recording.Info, error) {
+	if s.recordings == nil {
+		return nil, nil
+	}
+	return s.recordings.List(computerID)
+}
+
+// Replay plays a recording back through send, starting with a snapshot of
+// every window as it was at from and then each later update, paced at speed
+// times the original rate. Speed zero means real time.
+func (s *TerminalServiceImpl) Replay(ctx context.Context, recordingID string, speed float64, from time.Duration, send func(offset time.Duration, update *terminalv1.WatchTerminalResponse) error) error {
+	if speed == 0 {
+		speed = 1
+	}
+	if speed < 0 || speed > maxReplaySpeed {
+		return fmt.Errorf("%w: speed must be between 0 and %d", ErrInvalidReplay, maxReplaySpeed)
+	}
+	if from < 0 {
+		return fmt.Errorf("%w: start offset must not be negative", ErrInvalidReplay)
+	}
+	if s.recordings == nil {
+		return recording.ErrNotFound
+	}
+	reader, err := s.recordings.Open(recordingID)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	screens := newTerminalScreens()
+	var started time.Time
+	sendSnapshot := func() error {
+		started = time.Now()
+		for _, update := range screens.snapshot(nil) {
+			if err := send(from, update); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for {
+		offset, packet, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if offset >= from && started.IsZero() {
+			if err := sendSnapshot(); err != nil {
+				return err
+			}
+		}
+		update := screens.apply(packet)
+		if started.IsZero() || update == nil {
+			continue
+		}
+		wait := time.Until(started.Add(time.Duration(float64(offset-from) / speed)))
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+		if err := send(offset, update); err != nil {
+			return err
+		}
+	}
+	if started.IsZero() {
+		// Seeking past the end shows the final state.
+		return sendSnapshot()
+	}
+	return nil
+}
+
+func (s *TerminalServiceImpl) terminalLocked(computerID int) *computerTerminal {
+	terminal := s.terminals[computerID]
+	if terminal == nil {
+		terminal = &computerTerminal{
+			terminalScreens: newTerminalScreens(),
+			subs:            make(map[chan *terminalv1.WatchTerminalResponse]*uint32),
+		}
+		s.terminals[computerID] = terminal
+	}
+	return terminal
+}
+
+func (s *TerminalServiceImpl) applyLocked(terminal *computerTerminal, packet rawterm.Packet) {
+	response := terminal.apply(packet)
+	if response == nil {
+		return
+	}
+	if terminal.recording != nil {
+		if err := terminal.recording.Write(packet); err != nil {
+			slog.Warn("failed to write terminal recording", "recording_id", terminal.recording.ID(), "err", err)
+		}
+	}
+
+	for sub, windowID := range terminal.subs {
+		if windowID != nil && *windowID != uint32(packet.Window) {
+			continue
+		}
+		select {
+		case sub <- response:
+		default:
+			delete(terminal.subs, sub)
+			close(sub)
+		}
+	}
+}
+
+// snapshot returns the window change and latest screen of each window, in
+// window order. A nil windowID includes every window.
+func (t *terminalScreens) snapshot(windowID *uint32) []*terminalv1.WatchTerminalResponse {
+	var snapshot []*terminalv1.WatchTerminalResponse
+	ids := make([]int, 0, len(t.windows))
+	for id := range t.windows {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		if windowID != nil && uint32(id) != *windowID {
+			continue
+		}
+		window := t.windows[uint8(id)]
+		snapshot = append(snapshot, newTerminalResponse(rawterm.Packet{
+			Type:   rawterm.PacketWindowChange,
+			Window: uint8(id),
+			Data:   window.info.Encode(),
+		}))
+		if window.screen != nil {
+			snapshot = append(snapshot, newSnapshotResponse(uint8(id), window.screen))
+		} else if window.raw != nil {
+			snapshot = append(snapshot, newTerminalResponse(rawterm.Packet{
+				Type:   rawterm.PacketTerminalContents,
+				Window: uint8(id),
+				Data:   window.raw,
+			}))
+		}
+	}
+	return snapshot
+}
+
+// apply updates the windows with a packet and returns the update to send
+// viewers, or nil if there is nothing to tell them.
+func (t *terminalScreens) apply(packet rawterm.Packet) *terminalv1.WatchTerminalResponse {
+	response := newTerminalResponse(packet)
+	switch packet.Type {
+	case rawterm.PacketTerminalContents:
+		window := t.windows[packet.Window]
+		if window == nil {
+			window = &terminalWindow{}
+			t.windows[packet.Window] = window
+		}
+		next, err := screen.Decode(packet.Data)
+		if errors.Is(err, screen.ErrUnsupportedMode) {
+			window.screen = nil
+			window.raw = append([]byte(nil), packet.Data...)
+			break
+		}
+		if err != nil {
+			slog.Warn("dropped rawterm screen", "window_id", packet.Window, "err", err)
+			return nil
+		}
+		previous := window.screen
+		window.screen = next
+		window.raw = nil
+		if previous == nil {
+			response = newSnapshotResponse(packet.Window, next)
+			break
+		}
+		diff := previous.Diff(next)
+		if diff.Empty() {
+			// rawterm redraws every window on a short timer whether or not
+			// anything changed; there is nothing to tell viewers.
+			return nil
+		}
+		if diff.Resized {
+			response = newSnapshotResponse(packet.Window, next)
+		} else {
+			response = newDiffResponse(packet.Window, next, diff)
+		}
+	case rawterm.PacketWindowChange:
+		info, err := rawterm.ParseWindowChange(packet.Data)
+		if err != nil {
+			slog.Warn("dropped rawterm window change", "window_id", packet.Window, "err", err)
+			return nil
+		}
+		if info.Change == rawterm.WindowChangeUpdate {
+			window := t.windows[packet.Window]
+			if window == nil {
+				window = &terminalWindow{}
+				t.windows[packet.Window] = window
+			}
+			window.info = info
+		} else {
+			delete(t.windows, packet.Window)
+		}
+	case rawterm.PacketShowMessage:
+	default:
+		// Input and negotiation packets travel from viewers to computers and
+		// are not relayed back out.
+		return nil
+	}
+	return response
+}
+
+func newTerminalResponse(packet rawterm.Packet) *terminalv1.WatchTerminalResponse {
+	return &terminalv1.WatchTerminalResponse{
+		WindowId: uint32(packet.Window),
+		Update:   &terminalv1.WatchTerminalResponse_Packet{Packet: packet.Bytes()},
+	}
+}
+
+func newSnapshotResponse(window uint8, s *screen.Screen) *terminalv1.WatchTerminalResponse {
+	return &terminalv1.WatchTerminalResponse{
+		WindowId: uint32(window),
+		Update:   &terminalv1.WatchTerminalResponse_Snapshot{Snapshot: screenToProto(s)},
+	}
+}
+
+func newDiffResponse(window uint8, s *screen.Screen, diff screen.Diff) *terminalv1.WatchTerminalResponse {
+	spans := make([]*terminalv1.ScreenSpan, 0, len(diff.Spans))
+	for _, span := range diff.Spans {
+		spans = append(spans, &terminalv1.ScreenSpan{
+			Row:    uint32(span.Row),
+			Column: uint32(span.Column),
+			Cells: &terminalv1.ScreenRow{
+				Text:       span.Text,
+				Foreground: string(span.Foreground),
+				Background: string(span.Background),
+			},
+		})
+	}
+	var palette map[uint32]uint32
+	if len(diff.Palette) > 0 {
+		palette = make(map[uint32]uint32, len(diff.Palette))
+		for index, color := range diff.Palette {
+			palette[uint32(index)] = color
+		}
+	}
+	var cursor *terminalv1.Cursor
+	if diff.CursorChanged {
+		cursor = cursorToProto(s)
+	}
+	return &terminalv1.WatchTerminalResponse{
+		WindowId: uint32(window),
+		Update: &terminalv1.WatchTerminalResponse_Diff{Diff: &terminalv1.ScreenDiff{
+			Spans:   spans,
+			Palette: palette,
+			Cursor:  cursor,
+		}},
+	}
+}
+
+func screenToProto(s *screen.Screen) *terminalv1.Screen {
+	rows := make([]*terminalv1.ScreenRow, 0, s.Height)
+	for y := 0; y < s.Height; y++ {
+		rows = append(rows, &terminalv1.ScreenRow{
+			Text:       s.Text[y],
+			Foreground: string(s.Foreground[y]),
+			Background: string(s.Background[y]),
+		})
+	}
+	return &terminalv1.Screen{
+		Width:   uint32(s.Width),
+		Height:  uint32(s.Height),
+		Rows:    rows,
+		Palette: s.Palette[:],
+		Cursor:  cursorToProto(s),
+	}
+}
+
+func cursorToProto(s *screen.Screen) *terminalv1.Cursor {
+	return &terminalv1.Cursor{
+		X:     uint32(s.CursorX),
+		Y:     uint32(s.CursorY),
+		Blink: s.CursorBlink,
+	}
+}
@@ -0,0 +1,500 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	userv1 "ehedges.net/ccgui/backend/gen/user/v1"
+	"ehedges.net/ccgui/backend/internal/repository"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// sessionTTL is how long a session lasts after logging in.
+	sessionTTL = 12 * time.Hour
+	// sessionTokenPrefix starts every session token, telling them apart
+	// from API keys.
+	sessionTokenPrefix   = "ccs_"
+	sessionTokenLength   = 32
+	sessionPruneInterval = 10 * time.Minute
+
+	minPasswordLength = 8
+	maxPasswordLength = 256
+
+	// loginAttemptsPerHost logins may be tried from one address per
+	// loginAttemptWindow.
+	loginAttemptsPerHost = 10
+	loginAttemptWindow   = time.Minute
+	// maxLoginHosts bounds how many addresses' attempts are tracked.
+	// Logins from new addresses are refused while it is reached.
+	maxLoginHosts = 4096
+)
+
+var ErrUserNotFound = errors.New("user not found")
+var ErrUserExists = errors.New("user already exists")
+var ErrInvalidUserID = errors.New("invalid user id")
+var ErrInvalidUsername = errors.New("invalid username")
+var ErrInvalidPassword = errors.New("invalid password")
+var ErrInvalidRole = errors.New("invalid role")
+
+// ErrExternalUser is returned when setting the password of a user signed in
+// by an identity provider.
+var ErrExternalUser = errors.New("user signs in with an identity provider")
+
+// ErrInvalidCredentials is returned when logging in with an unknown username
+// or the wrong password. Which of the two is deliberately not revealed.
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+var ErrTooManyLogins = errors.New("too many login attempts, try again later")
+
+// usernamePattern is the form of usernames.
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// Role is what a user may do.
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"
+	RoleOperator Role = "operator"
+	RoleAdmin    Role = "admin"
+)
+
+// roleScopes are the scopes each role grants.
+var roleScopes = map[Role][]Scope{
+	RoleViewer: {ScopeTerminalView},
+	RoleOperator: {
+		ScopeTerminalView,
+		ScopeTerminalInput,
+		ScopePeripheralCall,
+		ScopeCommandSend,
+	},
+	RoleAdmin: Scopes,
+}
+
+// RoleScopes returns the scopes role grants.
+func RoleScopes(role Role) []Scope {
+	return roleScopes[role]
+}
+
+// RoleFromProto returns the role of a request, or ErrInvalidRole.
+func RoleFromProto(role userv1.Role) (Role, error) {
+	switch role {
+	case userv1.Role_ROLE_VIEWER:
+		return RoleViewer, nil
+	case userv1.Role_ROLE_OPERATOR:
+		return RoleOperator, nil
+	case userv1.Role_ROLE_ADMIN:
+		return RoleAdmin, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrInvalidRole, role)
+}
+
+func roleToProto(role Role) userv1.Role {
+	switch role {
+	case RoleViewer:
+		return userv1.Role_ROLE_VIEWER
+	case RoleOperator:
+		return userv1.Role_ROLE_OPERATOR
+	case RoleAdmin:
+		return userv1.Role_ROLE_ADMIN
+	}
+	return userv1.Role_ROLE_UNSPECIFIED
+}
+
+type UserService interface {
+	Create(ctx context.Context, username string, password string, role Role) (*userv1.User, error)
+	Delete(ctx context.Context, id string) (*userv1.User, error)
+	Get(ctx context.Context, id string) (*userv1.User, error)
+	List(ctx context.Context) ([]*userv1.User, error)
+	// SetPassword changes a user's password, ending their sessions.
+	SetPassword(ctx context.Context, id string, password string) error
+	// CheckPassword returns ErrInvalidCredentials unless password is the
+	// user's password, or ErrExternalUser if they have none.
+	CheckPassword(ctx context.Context, id string, password string) error
+	// Login starts a session for the user if password is theirs.
+	Login(ctx context.Context, username string, password string, remoteAddr string) (*userv1.LoginResponse, error)
+	// ExternalLogin starts a session for a user an identity provider signed
+	// in, creating them if they are new and otherwise updating their
+	// username and role.
+	ExternalLogin(ctx context.Context, identity ExternalIdentity, role Role, remoteAddr string) (*userv1.LoginResponse, error)
+	// Logout ends the session with the given token.
+	Logout(ctx context.Context, token string) error
+	// Session returns the user whose session has the given token, or
+	// ErrUnauthenticated if it is not a live session.
+	Session(ctx context.Context, token string) (*userv1.User, error)
+}
+
+// ExternalIdentity is a user as an identity provider knows them.
+type ExternalIdentity struct {
+	Issuer   string
+	Subject  string
+	Username string
+}
+
+type UserServiceImpl struct {
+	repo   repository.UserRepository
+	logins loginLimiter
+}
+
+func NewUserService(repo repository.UserRepository) *UserServiceImpl {
+	return &UserServiceImpl{
+		repo:   repo,
+		logins: loginLimiter{attempts: make(map[string]*loginAttempts)},
+	}
+}
+
+func (s *UserServiceImpl) Create(ctx context.Context, username string, password string, role Role) (*userv1.User, error) {
+	if !usernamePattern.MatchString(username) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidUsername, username)
+	}
+	if _, ok := roleScopes[role]; !ok {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidRole, role)
+	}
+	hash, err := newPasswordHash(password)
+	if err != nil {
+		return nil, err
+	}
+	record, err := s.repo.Create(ctx, repository.UserCreate{
+		Username:     username,
+		PasswordHash: hash,
+		Role:         string(role),
+	})
+	if err != nil {
+		if errors.Is(err, repository.ErrDuplicate) {
+			return nil, fmt.Errorf("%w: %q", ErrUserExists, username)
+		}
+		return nil, err
+	}
+	return toUser(record), nil
+}
+
+func (s *UserServiceImpl) Delete(ctx context.Context, id string) (*userv1.User, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidUserID, err)
+	}
+	record, err := s.repo.DeleteByID(ctx, id)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return toUser(record), nil
+}
+
+func (s *UserServiceImpl) Get(ctx context.Context, id string) (*userv1.User, error) {
+	record, err := s.getRecord(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return toUser(record), nil
+}
+
+func (s *UserServiceImpl) List(ctx context.Context) ([]*userv1.User, error) {
+	records, err := s.repo.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	users := make([]*userv1.User, 0, len(records))
+	for _, record := range records {
+		users = append(users, toUser(record))
+	}
+	return users, nil
+}
+
+func (s *UserServiceImpl) SetPassword(ctx context.Context, id string, password string) error {
+	record, err := s.getRecord(ctx, id)
+	if err != nil {
+		return err
+	}
+	if record.Issuer != "" {
+		return ErrExternalUser
+	}
+	hash, err := newPasswordHash(password)
+	if err != nil {
+		return err
+	}
+	if err := s.repo.SetPasswordHash(ctx, id, hash); err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return ErrUserNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *UserServiceImpl) CheckPassword(ctx context.Context, id string, password string) error {
+	record, err := s.getRecord(ctx, id)
+	if err != nil {
+		return err
+	}
+	if record.Issuer != "" {
+		return ErrExternalUser
+	}
+	ok, _, err := checkPassword(password, record.PasswordHash)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+func (s *UserServiceImpl) Login(ctx context.Context, username string, password string, remoteAddr string) (*userv1.LoginResponse, error) {
+	if !s.logins.allow(remoteHost(remoteAddr), time.Now()) {
+		return nil, ErrTooManyLogins
+	}
+	record, err := s.repo.GetByUsername(ctx, username)
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		return nil, err
+	}
+	if record == nil || record.PasswordHash == "" {
+		// Take as long as checking a real password, so response times do
+		// not reveal which usernames exist.
+		checkPassword(password, dummyPasswordHash())
+		return nil, ErrInvalidCredentials
+	}
+	ok, rehash, err := checkPassword(password, record.PasswordHash)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	if rehash {
+		s.rehashPassword(ctx, record, password)
+	}
+	return s.startSession(ctx, record, remoteAddr)
+}
+
+func (s *UserServiceImpl) ExternalLogin(ctx context.Context, identity ExternalIdentity, role Role, remoteAddr string) (*userv1.LoginResponse, error) {
+	if _, ok := roleScopes[role]; !ok {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidRole, role)
+	}
+	username := externalUsername(identity.Username)
+	record, err := s.repo.GetByExternalID(ctx, identity.Issuer, identity.Subject)
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		record, err = s.repo.Create(ctx, repository.UserCreate{
+			Username: username,
+			Role:     string(role),
+			Issuer:   identity.Issuer,
+			Subject:  identity.Subject,
+		})
+	case err == nil && (record.Username != username || record.Role != string(role)):
+		record, err = s.repo.UpdateProfile(ctx, record.ID, username, string(role))
+	}
+	if err != nil {
+		if errors.Is(err, repository.ErrDuplicate) {
+			return nil, fmt.Errorf("%w: %q", ErrUserExists, username)
+		}
+		return nil, err
+	}
+	return s.startSession(ctx, record, remoteAddr)
+}
+
+// startSession creates a session for a user who has logged in.
+func (s *UserServiceImpl) startSession(ctx context.Context, record *repository.UserRecord, remoteAddr string) (*userv1.LoginResponse, error) {
+	rawToken, err := generateRandomBytes(sessionTokenLength)
+	if err != nil {
+		return nil, err
+	}
+	token := sessionTokenPrefix + base64.RawURLEncoding.EncodeToString(rawToken)
+	now := time.Now().UTC()
+	session := repository.UserSessionRecord{
+		TokenHash:  hashAPIKey(token),
+		UserID:     record.ID,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(sessionTTL),
+		RemoteAddr: remoteAddr,
+	}
+	if err := s.repo.CreateSession(ctx, session); err != nil {
+		return nil, err
+	}
+	return &userv1.LoginResponse{
+		Token:     token,
+		ExpiresAt: timestamppb.New(session.ExpiresAt),
+		User:      toUser(record),
+	}, nil
+}
+
+// rehashPassword replaces a user's password hash with one using the current
+// parameters. Their sessions are kept, since the password is unchanged.
+func (s *UserServiceImpl) rehashPassword(ctx context.Context, record *repository.UserRecord, password string) {
+	hash, err := hashPassword(password)
+	if err == nil {
+		err = s.repo.RehashPassword(ctx, record.ID, hash)
+	}
+	if err != nil {
+		slog.Warn("failed to rehash password", "user_id", record.ID, "err", err)
+	}
+}
+
+func (s *UserServiceImpl) Logout(ctx context.Context, token string) error {
+	return s.repo.DeleteSession(ctx, hashAPIKey(token))
+}
+
+func (s *UserServiceImpl) Session(ctx context.Context, token string) (*userv1.User, error) {
+	if !strings.HasPrefix(token, sessionTokenPrefix) {
+		return nil, ErrUnauthenticated
+	}
+	session, err := s.repo.GetSession(ctx, hashAPIKey(token))
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return nil, ErrUnauthenticated
+		}
+		return nil, err
+	}
+	if !time.Now().Before(session.ExpiresAt) {
+		return nil, ErrUnauthenticated
+	}
+	record, err := s.repo.GetByID(ctx, session.UserID)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return nil, ErrUnauthenticated
+		}
+		return nil, err
+	}
+	return toUser(record), nil
+}
+
+// Run deletes expired sessions and forgets old login attempts until ctx is
+// done.
+func (s *UserServiceImpl) Run(ctx context.Context) {
+	ticker := time.NewTicker(sessionPruneInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := s.repo.DeleteExpiredSessions(ctx, time.Now().UTC()); err != nil {
+			slog.Warn("failed to delete expired sessions", "err", err)
+		}
+		s.logins.mu.Lock()
+		s.logins.pruneLocked(time.Now())
+		s.logins.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// loginLimiter counts login attempts from each address in fixed windows.
+type loginLimiter struct {
+	mu       sync.Mutex
+	attempts map[string]*loginAttempts // by host
+}
+
+type loginAttempts struct {
+	start time.Time
+	count int
+}
+
+// allow records an attempt from host, reporting whether it may go ahead.
+func (l *loginLimiter) allow(host string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	attempts, ok := l.attempts[host]
+	if !ok || now.Sub(attempts.start) >= loginAttemptWindow {
+		if !ok && len(l.attempts) >= maxLoginHosts {
+			l.pruneLocked(now)
+			if len(l.attempts) >= maxLoginHosts {
+				return false
+			}
+		}
+		attempts = &loginAttempts{start: now}
+		l.attempts[host] = attempts
+	}
+	attempts.count++
+	return attempts.count <= loginAttemptsPerHost
+}
+
+// pruneLocked forgets addresses whose windows have ended. l.mu must be held.
+func (l *loginLimiter) pruneLocked(now time.Time) {
+	for host, attempts := range l.attempts {
+		if now.Sub(attempts.start) >= loginAttemptWindow {
+			delete(l.attempts, host)
+		}
+	}
+}
+
+func (s *UserServiceImpl) getRecord(ctx context.Context, id string) (*repository.UserRecord, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidUserID, err)
+	}
+	record, err := s.repo.GetByID(ctx, id)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return record, nil
+}
+
+// newPasswordHash checks password is acceptable and hashes it.
+func newPasswordHash(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", fmt.Errorf("%w: must be at least %d characters", ErrInvalidPassword, minPasswordLength)
+	}
+	if len(password) > maxPasswordLength {
+		return "", fmt.Errorf("%w: must be at most %d characters", ErrInvalidPassword, maxPasswordLength)
+	}
+	return hashPassword(password)
+}
+
+// externalUsername makes an identity provider's username for a user valid
+// here, replacing characters usernames may not contain.
+func externalUsername(name string) string {
+	username := []byte("u")
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9',
+			r == '_', r == '.', r == '-':
+			username = append(username, byte(r))
+		default:
+			username = append(username, '_')
+		}
+	}
+	// Keep the "u" only if the name does not start with a letter or digit.
+	if len(username) > 1 && usernamePattern.MatchString(string(username[1:2])) {
+		username = username[1:]
+	}
+	return string(username[:min(len(username), 64)])
+}
+
+// dummyPasswordHash is checked against when logging in as an unknown user.
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, err := hashPassword("not a real password")
+	if err != nil {
+		panic(err)
+	}
+	return hash
+})
+
+func toUser(record *repository.UserRecord) *userv1.User {
+	return &userv1.User{
+		Id:        record.ID,
+		Username:  record.Username,
+		Role:      roleToProto(Role(record.Role)),
+		CreatedAt: timestamppb.New(record.CreatedAt),
+		Issuer:    record.Issuer,
+	}
+}
+
+func remoteHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,64 @@
+package telemetry
+
+import (
+	"context"
+	"strings"
+
+	"connectrpc.com/connect"
+	"ehedges.net/ccgui/backend/internal/otlp"
+)
+
+type connectInterceptor struct {
+	telemetry *Telemetry
+}
+
+// NewConnectInterceptor returns an interceptor that records a server span for
+// every Connect RPC handled, continuing the caller's trace if it sent a
+// traceparent header.
+func NewConnectInterceptor(t *Telemetry) connect.Interceptor {
+	return &connectInterceptor{telemetry: t}
+}
+
+func (i *connectInterceptor) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
+	return func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		if req.Spec().IsClient {
+			return next(ctx, req)
+		}
+		ctx, span := i.start(ctx, req.Spec(), req.Header().Get("traceparent"))
+		resp, err := next(ctx, req)
+		end(span, err)
+		return resp, err
+	}
+}
+
+func (i *connectInterceptor) WrapStreamingClient(next connect.StreamingClientFunc) connect.StreamingClientFunc {
+	return next
+}
+
+func (i *connectInterceptor) WrapStreamingHandler(next connect.StreamingHandlerFunc) connect.StreamingHandlerFunc {
+	return func(ctx context.Context, conn connect.StreamingHandlerConn) error {
+		ctx, span := i.start(ctx, conn.Spec(), conn.RequestHeader().Get("traceparent"))
+		err := next(ctx, conn)
+		end(span, err)
+		return err
+	}
+}
+
+func (i *connectInterceptor) start(ctx context.Context, spec connect.Spec, traceparent string) (context.Context, *Span) {
+	// Procedures look like "/hello.v1.HelloService/Say".
+	name := strings.TrimPrefix(spec.Procedure, "/")
+	service, method, _ := strings.Cut(name, "/")
+	return i.telemetry.StartRemote(ctx, traceparent, name, otlp.SpanKindServer,
+		otlp.KeyValue{Key: "rpc.system", Value: otlp.StringValue("connect_rpc")},
+		otlp.KeyValue{Key: "rpc.service", Value: otlp.StringValue(service)},
+		otlp.KeyValue{Key: "rpc.method", Value: otlp.StringValue(method)},
+	)
+}
+
+func end(span *Span, err error) {
+	if err != nil {
+		span.SetAttributes(otlp.KeyValue{Key: "rpc.connect_rpc.error_code", Value: otlp.StringValue(connect.CodeOf(err).String())})
+		span.SetError(err)
+	}
+	span.End()
+}
@@ -0,0 +1,50 @@
+package telemetry
+
+import (
+	authv1 "ehedges.net/ccgui/backend/gen/auth/v1"
+	"ehedges.net/ccgui/backend/internal/otlp"
+	"ehedges.net/ccgui/backend/internal/service"
+)
+
+// KeyFailureCounter counts API keys that failed validation.
+type KeyFailureCounter struct {
+	failures *Counter
+}
+
+func NewKeyFailureCounter(t *Telemetry) *KeyFailureCounter {
+	return &KeyFailureCounter{
+		failures: t.Counter("ccgui.auth.key_validation_failures", "{failure}", "API keys that failed validation, by transport."),
+	}
+}
+
+// Wrap returns keys with failed validations counted under the given
+// transport, e.g. "websocket".
+func (c *KeyFailureCounter) Wrap(keys service.APIKeyService, transport string) service.APIKeyService {
+	return &countingKeyService{
+		APIKeyService: keys,
+		failures:      c.failures,
+		transport:     otlp.KeyValue{Key: "ccgui.transport", Value: otlp.StringValue(transport)},
+	}
+}
+
+type countingKeyService struct {
+	service.APIKeyService
+	failures  *Counter
+	transport otlp.KeyValue
+}
+
+func (s *countingKeyService) Validate(plain string) bool {
+	valid := s.APIKeyService.Validate(plain)
+	if !valid {
+		s.failures.Add(1, s.transport)
+	}
+	return valid
+}
+
+func (s *countingKeyService) Lookup(plain string) (*authv1.KeySummary, bool) {
+	summary, ok := s.APIKeyService.Lookup(plain)
+	if !ok {
+		s.failures.Add(1, s.transport)
+	}
+	return summary, ok
+}
@@ -0,0 +1,107 @@
+package telemetry
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"ehedges.net/ccgui/backend/internal/otlp"
+)
+
+// Counter is a cumulative sum with one value per distinct set of attributes.
+type Counter struct {
+	name        string
+	description string
+	unit        string
+	monotonic   bool
+
+	mu     sync.Mutex
+	points map[string]*counterPoint
+}
+
+type counterPoint struct {
+	attributes []otlp.KeyValue
+	value      int64
+}
+
+// Counter registers a counter that only increases.
+func (t *Telemetry) Counter(name string, unit string, description string) *Counter {
+	return t.register(name, unit, description, true)
+}
+
+// UpDownCounter registers a counter that can also decrease, e.g. to track
+// how many of something currently exist.
+func (t *Telemetry) UpDownCounter(name string, unit string, description string) *Counter {
+	return t.register(name, unit, description, false)
+}
+
+func (t *Telemetry) register(name string, unit string, description string, monotonic bool) *Counter {
+	counter := &Counter{
+		name:        name,
+		description: description,
+		unit:        unit,
+		monotonic:   monotonic,
+		points:      make(map[string]*counterPoint),
+	}
+	t.mu.Lock()
+	t.counters = append(t.counters, counter)
+	t.mu.Unlock()
+	return counter
+}
+
+// Add adds delta to the value for the given attributes. Attribute values
+// should come from a small, fixed set so the number of series stays bounded.
+func (c *Counter) Add(delta int64, attributes ...otlp.KeyValue) {
+	key := attributeKey(attributes)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	point, ok := c.points[key]
+	if !ok {
+		point = &counterPoint{attributes: append([]otlp.KeyValue(nil), attributes...)}
+		c.points[key] = point
+	}
+	point.value += delta
+}
+
+func (c *Counter) metric(start otlp.Uint64, now otlp.Uint64) (otlp.Metric, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.points) == 0 {
+		return otlp.Metric{}, false
+	}
+	keys := make([]string, 0, len(c.points))
+	for key := range c.points {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	dataPoints := make([]otlp.NumberDataPoint, 0, len(keys))
+	for _, key := range keys {
+		point := c.points[key]
+		value := otlp.Int64(point.value)
+		dataPoints = append(dataPoints, otlp.NumberDataPoint{
+			Attributes:        point.attributes,
+			StartTimeUnixNano: start,
+			TimeUnixNano:      now,
+			AsInt:             &value,
+		})
+	}
+	return otlp.Metric{
+		Name:        c.name,
+		Description: c.description,
+		Unit:        c.unit,
+		Sum: &otlp.Sum{
+			DataPoints:             dataPoints,
+			AggregationTemporality: otlp.AggregationTemporalityCumulative,
+			IsMonotonic:            c.monotonic,
+		},
+	}, true
+}
+
+func attributeKey(attributes []otlp.KeyValue) string {
+	parts := make([]string, 0, len(attributes))
+	for _, attribute := range attributes {
+		parts = append(parts, attribute.Key+"="+attribute.Value.String())
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "\x00")
+}
@@ -0,0 +1,144 @@
+// Package telemetry instruments the server itself: spans for Connect RPCs and
+// websocket messages, and counters for its traffic, exported over OTLP.
+//
+// It implements only what the server needs rather than the OpenTelemetry SDK:
+// spans are batched and exported periodically, and counters are exported as
+// cumulative sums.
+package telemetry
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"ehedges.net/ccgui/backend/internal/otlp"
+)
+
+const (
+	scopeName = "ehedges.net/ccgui/backend"
+
+	spanFlushInterval   = 5 * time.Second
+	metricFlushInterval = 15 * time.Second
+	// maxPendingSpans bounds the spans held between flushes. Spans ended
+	// while the buffer is full are dropped.
+	maxPendingSpans = 2048
+)
+
+type Exporter interface {
+	ExportTraces(data *otlp.TracesData) error
+	ExportMetrics(data *otlp.MetricsData) error
+}
+
+// Telemetry collects the server's spans and counters. Call Run to export them.
+type Telemetry struct {
+	exporter  Exporter
+	resource  otlp.Resource
+	startedAt time.Time
+
+	mu       sync.Mutex
+	spans    []otlp.Span
+	dropped  int
+	counters []*Counter
+}
+
+// New creates a Telemetry that identifies itself to the collector as
+// serviceName.
+func New(exporter Exporter, serviceName string) *Telemetry {
+	return &Telemetry{
+		exporter: exporter,
+		resource: otlp.Resource{Attributes: []otlp.KeyValue{
+			{Key: "service.name", Value: otlp.StringValue(serviceName)},
+		}},
+		startedAt: time.Now(),
+	}
+}
+
+// Run exports spans and counters until ctx is cancelled, then exports once
+// more.
+func (t *Telemetry) Run(ctx context.Context) {
+	spanTicker := time.NewTicker(spanFlushInterval)
+	defer spanTicker.Stop()
+	metricTicker := time.NewTicker(metricFlushInterval)
+	defer metricTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			t.flushSpans()
+			t.flushMetrics()
+			return
+		case <-spanTicker.C:
+			t.flushSpans()
+		case <-metricTicker.C:
+			t.flushMetrics()
+		}
+	}
+}
+
+func (t *Telemetry) flushSpans() {
+	t.mu.Lock()
+	spans := t.spans
+	dropped := t.dropped
+	t.spans = nil
+	t.dropped = 0
+	t.mu.Unlock()
+	if dropped > 0 {
+		slog.Warn("dropped spans", "count", dropped)
+	}
+	if len(spans) == 0 {
+		return
+	}
+	resource := t.resource
+	err := t.exporter.ExportTraces(&otlp.TracesData{
+		ResourceSpans: []otlp.ResourceSpans{{
+			Resource: &resource,
+			ScopeSpans: []otlp.ScopeSpans{{
+				Scope: &otlp.InstrumentationScope{Name: scopeName},
+				Spans: spans,
+			}},
+		}},
+	})
+	if err != nil {
+		slog.Warn("failed to export spans", "err", err)
+	}
+}
+
+func (t *Telemetry) flushMetrics() {
+	t.mu.Lock()
+	counters := append([]*Counter(nil), t.counters...)
+	t.mu.Unlock()
+	now := otlp.Uint64(time.Now().UnixNano())
+	start := otlp.Uint64(t.startedAt.UnixNano())
+	var metrics []otlp.Metric
+	for _, counter := range counters {
+		if metric, ok := counter.metric(start, now); ok {
+			metrics = append(metrics, metric)
+		}
+	}
+	if len(metrics) == 0 {
+		return
+	}
+	resource := t.resource
+	err := t.exporter.ExportMetrics(&otlp.MetricsData{
+		ResourceMetrics: []otlp.ResourceMetrics{{
+			Resource: &resource,
+			ScopeMetrics: []otlp.ScopeMetrics{{
+				Scope:   &otlp.InstrumentationScope{Name: scopeName},
+				Metrics: metrics,
+			}},
+		}},
+	})
+	if err != nil {
+		slog.Warn("failed to export metrics", "err", err)
+	}
+}
+
+func (t *Telemetry) record(span otlp.Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.spans) >= maxPendingSpans {
+		t.dropped++
+		return
+	}
+	t.spans = append(t.spans, span)
+}
@@ -0,0 +1,130 @@
+package telemetry
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"ehedges.net/ccgui/backend/internal/otlp"
+)
+
+type spanContextKey struct{}
+
+// SpanContext identifies a span so that child spans can refer to it.
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+}
+
+// Span is an operation in progress. End it exactly once.
+type Span struct {
+	telemetry *Telemetry
+
+	mu   sync.Mutex
+	span otlp.Span
+	done bool
+}
+
+// Start begins a span, as a child of the span in ctx if there is one.
+func (t *Telemetry) Start(ctx context.Context, name string, kind otlp.SpanKind, attributes ...otlp.KeyValue) (context.Context, *Span) {
+	parent, _ := ctx.Value(spanContextKey{}).(SpanContext)
+	return t.start(ctx, parent, name, kind, attributes)
+}
+
+// StartRemote begins a span continuing the trace in a W3C traceparent
+// header, or a new trace if the header is missing or malformed.
+func (t *Telemetry) StartRemote(ctx context.Context, traceparent string, name string, kind otlp.SpanKind, attributes ...otlp.KeyValue) (context.Context, *Span) {
+	parent, _ := parseTraceparent(traceparent)
+	return t.start(ctx, parent, name, kind, attributes)
+}
+
+func (t *Telemetry) start(ctx context.Context, parent SpanContext, name string, kind otlp.SpanKind, attributes []otlp.KeyValue) (context.Context, *Span) {
+	traceID := parent.TraceID
+	if traceID == "" {
+		traceID = randomHex(16)
+	}
+	span := &Span{
+		telemetry: t,
+		span: otlp.Span{
+			TraceID:           traceID,
+			SpanID:            randomHex(8),
+			ParentSpanID:      parent.SpanID,
+			Name:              name,
+			Kind:              kind,
+			StartTimeUnixNano: otlp.Uint64(time.Now().UnixNano()),
+			Attributes:        attributes,
+		},
+	}
+	return context.WithValue(ctx, spanContextKey{}, span.Context()), span
+}
+
+// Context returns the span's identity.
+func (s *Span) Context() SpanContext {
+	return SpanContext{TraceID: s.span.TraceID, SpanID: s.span.SpanID}
+}
+
+// SetName renames the span, for when its name is only known once the
+// operation has progressed.
+func (s *Span) SetName(name string) {
+	s.mu.Lock()
+	s.span.Name = name
+	s.mu.Unlock()
+}
+
+func (s *Span) SetAttributes(attributes ...otlp.KeyValue) {
+	s.mu.Lock()
+	s.span.Attributes = append(s.span.Attributes, attributes...)
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed. A nil err leaves the status unset.
+func (s *Span) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.span.Status = &otlp.Status{Code: otlp.StatusCodeError, Message: err.Error()}
+	s.mu.Unlock()
+}
+
+// End finishes the span and queues it for export.
+func (s *Span) End() {
+	s.mu.Lock()
+	if s.done {
+		s.mu.Unlock()
+		return
+	}
+	s.done = true
+	s.span.EndTimeUnixNano = otlp.Uint64(time.Now().UnixNano())
+	span := s.span
+	s.mu.Unlock()
+	s.telemetry.record(span)
+}
+
+// parseTraceparent parses a version 00 W3C traceparent header.
+func parseTraceparent(header string) (SpanContext, error) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}, fmt.Errorf("malformed traceparent %q", header)
+	}
+	for _, part := range parts[1:] {
+		if _, err := hex.DecodeString(part); err != nil {
+			return SpanContext{}, fmt.Errorf("malformed traceparent %q", header)
+		}
+	}
+	if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return SpanContext{}, fmt.Errorf("traceparent %q has an invalid id", header)
+	}
+	return SpanContext{TraceID: strings.ToLower(parts[1]), SpanID: strings.ToLower(parts[2])}, nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	// crypto/rand.Read never returns an error.
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
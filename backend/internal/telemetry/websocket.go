@@ -0,0 +1,60 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+
+	"ehedges.net/ccgui/backend/internal/otlp"
+	"ehedges.net/ccgui/backend/internal/websocket"
+)
+
+// unmatchedRoute stands in for the path of messages no route handled, so
+// malformed paths do not each become a span name or counter series.
+const unmatchedRoute = "unmatched"
+
+// HubInstrumentation traces and counts the websocket hub's traffic.
+type HubInstrumentation struct {
+	telemetry *Telemetry
+	clients   *Counter
+	messages  *Counter
+	errors    *Counter
+}
+
+func NewHubInstrumentation(t *Telemetry) *HubInstrumentation {
+	return &HubInstrumentation{
+		telemetry: t,
+		clients:   t.UpDownCounter("ccgui.websocket.clients", "{client}", "Connected websocket clients."),
+		messages:  t.Counter("ccgui.websocket.messages", "{message}", "Websocket messages received, by route."),
+		errors:    t.Counter("ccgui.websocket.message_errors", "{message}", "Websocket messages rejected as malformed or unroutable."),
+	}
+}
+
+func (h *HubInstrumentation) ClientConnected(ctx context.Context) {
+	h.clients.Add(1)
+}
+
+func (h *HubInstrumentation) ClientDisconnected(ctx context.Context) {
+	h.clients.Add(-1)
+}
+
+func (h *HubInstrumentation) StartMessage(ctx context.Context) (context.Context, func(path string, err error)) {
+	ctx, span := h.telemetry.Start(ctx, unmatchedRoute, otlp.SpanKindServer)
+	return ctx, func(path string, err error) {
+		route := path
+		if route == "" {
+			route = unmatchedRoute
+		}
+		attribute := otlp.KeyValue{Key: "ccgui.websocket.route", Value: otlp.StringValue(route)}
+		span.SetName(route)
+		span.SetAttributes(attribute)
+		span.SetError(err)
+		span.End()
+		h.messages.Add(1, attribute)
+		switch {
+		case errors.Is(err, websocket.ErrRouteNotFound):
+			h.errors.Add(1, otlp.KeyValue{Key: "error.type", Value: otlp.StringValue("route_not_found")})
+		case errors.Is(err, websocket.ErrInvalidMessage):
+			h.errors.Add(1, otlp.KeyValue{Key: "error.type", Value: otlp.StringValue("invalid_message")})
+		}
+	}
+}
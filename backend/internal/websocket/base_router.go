@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log/slog"
 
+	"ehedges.net/ccgui/backend/internal/otlp"
 	"github.com/gorilla/websocket"
 	"github.com/vmihailenco/msgpack/v5"
 )
@@ -15,12 +16,45 @@ const (
 	BaseRouteInvalid BaseRoute = iota - 1
 	BaseRoutePing
 	BaseRoutePong
+	BaseRouteHello
+	BaseRouteTerminal
+	BaseRouteMonitors
+	BaseRouteMetrics
+	BaseRouteLog
+	BaseRouteCall
+	BaseRouteCallResult
+	baseRouteEnd
 )
 
+// String names the route in paths, logs and span names.
+func (r BaseRoute) String() string {
+	switch r {
+	case BaseRoutePing:
+		return "ping"
+	case BaseRoutePong:
+		return "pong"
+	case BaseRouteHello:
+		return "hello"
+	case BaseRouteTerminal:
+		return "terminal"
+	case BaseRouteMonitors:
+		return "monitors"
+	case BaseRouteMetrics:
+		return "metrics"
+	case BaseRouteLog:
+		return "log"
+	case BaseRouteCall:
+		return "call"
+	case BaseRouteCallResult:
+		return "call_result"
+	}
+	return "invalid"
+}
+
 func BaseRouteFromInt(i int) BaseRoute {
 	if i < 0 {
 		return BaseRouteInvalid
-	} else if i > int(BaseRoutePong) {
+	} else if i >= int(baseRouteEnd) {
 		return BaseRouteInvalid
 	} else {
 		return BaseRoute(i)
@@ -30,24 +64,24 @@ func BaseRouteFromInt(i int) BaseRoute {
 func baseRouterDecoder(dec *msgpack.Decoder) (BaseRoute, error) {
 	pathRaw, err := dec.DecodeInt()
 	if err != nil {
-		return BaseRouteInvalid, err
+		return BaseRouteInvalid, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
 	}
 
 	path := BaseRouteFromInt(pathRaw)
 
 	if path == BaseRouteInvalid {
-		return path, errors.New("invalid route")
+		return path, fmt.Errorf("%w: %d", ErrRouteNotFound, pathRaw)
 	}
 
 	return path, nil
 }
 
 func handlePing(data int, ctx WSRequestContext) error {
-	if ctx.conn == nil {
+	if ctx.session == nil {
 		return errors.New("no websocket connection in context")
 	}
 	buf := makeMessage(MessagePong, data)
-	err := ctx.conn.WriteMessage(websocket.BinaryMessage, buf.Bytes())
+	err := ctx.session.WriteMessage(websocket.BinaryMessage, buf.Bytes())
 	slog.Info("sent message", "message", fmt.Sprintf("% X", buf), "data", data)
 	return err
 }
@@ -56,11 +90,158 @@ func handlePong(data int, ctx WSRequestContext) error {
 	return nil
 }
 
+// helloPayload is the handshake a computer sends after connecting, built from
+// os.getComputerID(), os.getComputerLabel(), _HOST, _CC_VERSION and the
+// presence of the turtle/pocket APIs and a colour terminal.
+type helloPayload struct {
+	ID        *int   `msgpack:"id"`
+	Label     string `msgpack:"label"`
+	Host      string `msgpack:"host"`
+	CCVersion string `msgpack:"cc_version"`
+	Turtle    bool   `msgpack:"turtle"`
+	Pocket    bool   `msgpack:"pocket"`
+	Advanced  bool   `msgpack:"advanced"`
+}
+
+func decodeHello(dec *msgpack.Decoder) (helloPayload, error) {
+	var payload helloPayload
+	if err := dec.Decode(&payload); err != nil {
+		return payload, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+	if payload.ID == nil || *payload.ID < 0 {
+		return payload, fmt.Errorf("%w: hello requires a non-negative computer id", ErrInvalidMessage)
+	}
+	if payload.Turtle && payload.Pocket {
+		return payload, fmt.Errorf("%w: computer cannot be both a turtle and a pocket computer", ErrInvalidMessage)
+	}
+	return payload, nil
+}
+
+func handleHello(data helloPayload, ctx WSRequestContext) error {
+	if ctx.session == nil {
+		return errors.New("no websocket connection in context")
+	}
+	kind := ComputerKindComputer
+	if data.Turtle {
+		kind = ComputerKindTurtle
+	} else if data.Pocket {
+		kind = ComputerKindPocket
+	}
+	info := ComputerInfo{
+		ID:        *data.ID,
+		Label:     data.Label,
+		Host:      data.Host,
+		CCVersion: data.CCVersion,
+		Kind:      kind,
+		Advanced:  data.Advanced,
+	}
+	if err := ctx.session.hub.identify(ctx, ctx.session, info); err != nil {
+		return err
+	}
+	slog.Info("computer identified", "computer_id", info.ID, "label", info.Label, "kind", info.Kind)
+	return nil
+}
+
+// handleTerminal accepts raw mode data written by a rawterm server window,
+// forwarded verbatim by the computer's delegate.
+func handleTerminal(data []byte, ctx WSRequestContext) error {
+	if ctx.session == nil {
+		return errors.New("no websocket connection in context")
+	}
+	return ctx.session.hub.terminalData(ctx, ctx.session, data)
+}
+
+// monitorPayload is one entry of the monitor list a computer sends whenever a
+// monitor is attached, detached or resized. Window is the rawterm window the
+// monitor is mirrored into.
+type monitorPayload struct {
+	Name      string  `msgpack:"name"`
+	Window    int     `msgpack:"window"`
+	Width     int     `msgpack:"width"`
+	Height    int     `msgpack:"height"`
+	TextScale float64 `msgpack:"text_scale"`
+}
+
+func decodeMonitors(dec *msgpack.Decoder) ([]MonitorInfo, error) {
+	var payload []monitorPayload
+	if err := dec.Decode(&payload); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+	monitors := make([]MonitorInfo, 0, len(payload))
+	names := make(map[string]struct{}, len(payload))
+	windows := make(map[int]struct{}, len(payload))
+	for _, monitor := range payload {
+		if monitor.Name == "" {
+			return nil, fmt.Errorf("%w: monitor requires a peripheral name", ErrInvalidMessage)
+		}
+		// Window 0 is the computer's own terminal.
+		if monitor.Window < 1 || monitor.Window > 0xFF {
+			return nil, fmt.Errorf("%w: monitor %q has invalid window %d", ErrInvalidMessage, monitor.Name, monitor.Window)
+		}
+		if monitor.Width < 0 || monitor.Height < 0 {
+			return nil, fmt.Errorf("%w: monitor %q has invalid size", ErrInvalidMessage, monitor.Name)
+		}
+		if monitor.TextScale < 0.5 || monitor.TextScale > 5 {
+			return nil, fmt.Errorf("%w: monitor %q has invalid text scale %v", ErrInvalidMessage, monitor.Name, monitor.TextScale)
+		}
+		if _, ok := names[monitor.Name]; ok {
+			return nil, fmt.Errorf("%w: duplicate monitor %q", ErrInvalidMessage, monitor.Name)
+		}
+		if _, ok := windows[monitor.Window]; ok {
+			return nil, fmt.Errorf("%w: duplicate monitor window %d", ErrInvalidMessage, monitor.Window)
+		}
+		names[monitor.Name] = struct{}{}
+		windows[monitor.Window] = struct{}{}
+		monitors = append(monitors, MonitorInfo{
+			Name:      monitor.Name,
+			Window:    uint8(monitor.Window),
+			Width:     monitor.Width,
+			Height:    monitor.Height,
+			TextScale: monitor.TextScale,
+		})
+	}
+	return monitors, nil
+}
+
+func handleMonitors(data []MonitorInfo, ctx WSRequestContext) error {
+	if ctx.session == nil {
+		return errors.New("no websocket connection in context")
+	}
+	return ctx.session.hub.updateMonitors(ctx, ctx.session, data)
+}
+
+// decodeMetrics decodes the MetricsData flushed by runMetricCollector in
+// cc-tstl/src/api/event.ts.
+func decodeMetrics(dec *msgpack.Decoder) (*otlp.MetricsData, error) {
+	var data otlp.MetricsData
+	if err := dec.Decode(&data); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+	if err := data.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+	return &data, nil
+}
+
+func handleMetrics(data *otlp.MetricsData, ctx WSRequestContext) error {
+	if ctx.session == nil {
+		return errors.New("no websocket connection in context")
+	}
+	return ctx.session.hub.metricsData(ctx, ctx.session, data)
+}
+
 func NewBaseRouter() *Router[BaseRoute] {
 	router := NewRouter(baseRouterDecoder)
 
 	router.Register(BaseRoutePing, NewDecodedRoute((*msgpack.Decoder).DecodeInt, handlePing))
 	router.Register(BaseRoutePong, NewDecodedRoute((*msgpack.Decoder).DecodeInt, handlePong))
+	router.Register(BaseRouteHello, NewDecodedRoute(decodeHello, handleHello))
+	router.Register(BaseRouteTerminal, NewDecodedRoute((*msgpack.Decoder).DecodeBytes, handleTerminal))
+	router.Register(BaseRouteMonitors, NewDecodedRoute(decodeMonitors, handleMonitors))
+	router.Register(BaseRouteMetrics, NewDecodedRoute(decodeMetrics, handleMetrics))
+	router.Register(BaseRouteLog, NewDecodedRoute(decodeLog, handleLog))
+	router.Register(BaseRouteCall, NewDecodedRoute(decodeCall, handleCall))
+	router.Register(BaseRouteCallResult, NewDecodedRoute(decodeCallResult, handleCallResult))
 
 	return router
 }
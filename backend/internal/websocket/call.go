@@ -0,0 +1,292 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	// DefaultCallTimeout bounds calls made without a deadline, in either
+	// direction.
+	DefaultCallTimeout = 30 * time.Second
+	// maxCallTimeout caps the timeout a computer may ask for.
+	maxCallTimeout = 5 * time.Minute
+)
+
+var ErrMethodCollision = errors.New("call method already registered")
+
+// CallErrorCode classifies a failed call. The codes follow the Connect error
+// codes so callers can pass them through.
+type CallErrorCode string
+
+const (
+	CallErrorUnknown          CallErrorCode = "unknown"
+	CallErrorInvalidArgument  CallErrorCode = "invalid_argument"
+	CallErrorNotFound         CallErrorCode = "not_found"
+	CallErrorPermissionDenied CallErrorCode = "permission_denied"
+	CallErrorDeadlineExceeded CallErrorCode = "deadline_exceeded"
+	CallErrorUnimplemented    CallErrorCode = "unimplemented"
+	CallErrorUnavailable      CallErrorCode = "unavailable"
+	CallErrorInternal         CallErrorCode = "internal"
+)
+
+// CallError is the error reply to a call, sent by whichever side handled it.
+type CallError struct {
+	Code    CallErrorCode `msgpack:"code"`
+	Message string        `msgpack:"message"`
+}
+
+func NewCallError(code CallErrorCode, format string, args ...any) *CallError {
+	return &CallError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *CallError) Error() string {
+	return string(e.Code) + ": " + e.Message
+}
+
+// CallHandler handles a call made by a computer. args is the msgpack encoded
+// argument array. The returned value is encoded as the result; return a
+// *CallError to choose the error code.
+type CallHandler func(ctx WSRequestContext, args msgpack.RawMessage) (any, error)
+
+// callRequest is a call in either direction. TimeoutMs is how long the caller
+// will wait; zero means DefaultCallTimeout.
+type callRequest struct {
+	ID        uint64             `msgpack:"id"`
+	Method    string             `msgpack:"method"`
+	Args      msgpack.RawMessage `msgpack:"args"`
+	TimeoutMs int64              `msgpack:"timeout_ms,omitempty"`
+}
+
+// callResponse answers the callRequest with the same ID. Exactly one of
+// Result and Error is set; a call returning nothing has a nil result.
+type callResponse struct {
+	ID     uint64             `msgpack:"id"`
+	Result msgpack.RawMessage `msgpack:"result,omitempty"`
+	Error  *CallError         `msgpack:"error,omitempty"`
+}
+
+type callResult struct {
+	result msgpack.RawMessage
+	err    error
+}
+
+// Call invokes method on the computer with the given arguments and waits for
+// its reply, the context to end, or the session to close. Calls made without
+// a deadline time out after DefaultCallTimeout. The result is the msgpack
+// encoded array of the method's return values.
+func (s *Session) Call(ctx context.Context, method string, args ...any) (msgpack.RawMessage, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultCallTimeout)
+		defer cancel()
+	}
+	if args == nil {
+		args = []any{}
+	}
+	encodedArgs, err := msgpack.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := make(chan callResult, 1)
+	s.callMu.Lock()
+	if s.callsClosed {
+		s.callMu.Unlock()
+		return nil, ErrComputerOffline
+	}
+	s.nextCallID++
+	id := s.nextCallID
+	s.pendingCalls[id] = reply
+	s.callMu.Unlock()
+	defer func() {
+		s.callMu.Lock()
+		delete(s.pendingCalls, id)
+		s.callMu.Unlock()
+	}()
+
+	request := callRequest{ID: id, Method: method, Args: encodedArgs}
+	if deadline, ok := ctx.Deadline(); ok {
+		request.TimeoutMs = max(1, time.Until(deadline).Milliseconds())
+	}
+	buf := makeMessage(MessageCall, request)
+	if err := s.WriteMessage(websocket.BinaryMessage, buf.Bytes()); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrComputerOffline, err)
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("call %s: %w", method, ctx.Err())
+	case result := <-reply:
+		return result.result, result.err
+	}
+}
+
+// resolveCall delivers a computer's reply to the pending call.
+func (s *Session) resolveCall(response callResponse) {
+	s.callMu.Lock()
+	reply, ok := s.pendingCalls[response.ID]
+	delete(s.pendingCalls, response.ID)
+	s.callMu.Unlock()
+	if !ok {
+		// The caller already gave up.
+		slog.Debug("discarding reply to unknown call", "id", response.ID)
+		return
+	}
+	if response.Error != nil {
+		reply <- callResult{err: response.Error}
+		return
+	}
+	reply <- callResult{result: response.Result}
+}
+
+// failCalls fails every pending call and any made later, once the session has
+// gone away.
+func (s *Session) failCalls() {
+	s.callMu.Lock()
+	defer s.callMu.Unlock()
+	s.callsClosed = true
+	for id, reply := range s.pendingCalls {
+		reply <- callResult{err: ErrComputerOffline}
+		delete(s.pendingCalls, id)
+	}
+}
+
+// HandleCall registers the handler for calls computers make to method.
+func (h *Hub) HandleCall(method string, handler CallHandler) error {
+	if handler == nil {
+		return fmt.Errorf("%w: nil handler", ErrInvalidMessage)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, taken := h.callHandlers[method]; taken {
+		return ErrMethodCollision
+	}
+	h.callHandlers[method] = handler
+	return nil
+}
+
+// Call invokes method on a connected computer. If the computer has several
+// sessions, the most recently connected one is called.
+func (h *Hub) Call(ctx context.Context, computerID int, method string, args ...any) (msgpack.RawMessage, error) {
+	h.mu.RLock()
+	var session *Session
+	for conn := range h.byComputerID[computerID] {
+		candidate, ok := h.clients[conn]
+		if ok && (session == nil || candidate.connectedAt.After(session.connectedAt)) {
+			session = candidate
+		}
+	}
+	h.mu.RUnlock()
+	if session == nil {
+		return nil, ErrComputerOffline
+	}
+	return session.Call(ctx, method, args...)
+}
+
+func decodeCall(dec *msgpack.Decoder) (callRequest, error) {
+	var request callRequest
+	if err := dec.Decode(&request); err != nil {
+		return request, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+	if request.ID == 0 {
+		return request, fmt.Errorf("%w: call requires an id", ErrInvalidMessage)
+	}
+	if request.Method == "" {
+		return request, fmt.Errorf("%w: call requires a method", ErrInvalidMessage)
+	}
+	return request, nil
+}
+
+// handleCall runs the registered handler for a computer's call in the
+// background, so a slow handler does not hold up the session's other
+// messages, and replies when it finishes.
+func handleCall(request callRequest, ctx WSRequestContext) error {
+	if ctx.session == nil {
+		return errors.New("no websocket connection in context")
+	}
+	hub := ctx.session.hub
+	hub.mu.RLock()
+	handler, ok := hub.callHandlers[request.Method]
+	hub.mu.RUnlock()
+	if !ok {
+		return ctx.session.reply(request.ID, nil, NewCallError(CallErrorUnimplemented, "unknown method %q", request.Method))
+	}
+
+	timeout := DefaultCallTimeout
+	if request.TimeoutMs > 0 {
+		timeout = min(time.Duration(request.TimeoutMs)*time.Millisecond, maxCallTimeout)
+	}
+	// The request context ends when the connection does, so handlers stop
+	// once nobody is left to reply to.
+	callCtx, cancel := context.WithTimeout(ctx.Context, timeout)
+	ctx.Context = callCtx
+	go func() {
+		defer cancel()
+		result, err := handler(ctx, request.Args)
+		if err := ctx.session.reply(request.ID, result, err); err != nil {
+			slog.Warn("failed to reply to call", "method", request.Method, "err", err)
+		}
+	}()
+	return nil
+}
+
+// reply sends the outcome of a computer's call back to it.
+func (s *Session) reply(id uint64, result any, err error) error {
+	response := callResponse{ID: id}
+	if err != nil {
+		response.Error = toCallError(err)
+	} else {
+		encoded, marshalErr := msgpack.Marshal(result)
+		if marshalErr != nil {
+			response.Error = NewCallError(CallErrorInternal, "encode result: %v", marshalErr)
+		} else {
+			response.Result = encoded
+		}
+	}
+	buf := makeMessage(MessageCallResult, response)
+	return s.WriteMessage(websocket.BinaryMessage, buf.Bytes())
+}
+
+func toCallError(err error) *CallError {
+	var callErr *CallError
+	switch {
+	case errors.As(err, &callErr):
+		return callErr
+	case errors.Is(err, ErrInvalidMessage):
+		return NewCallError(CallErrorInvalidArgument, "%v", err)
+	case errors.Is(err, context.DeadlineExceeded):
+		return NewCallError(CallErrorDeadlineExceeded, "%v", err)
+	case errors.Is(err, ErrComputerOffline):
+		return NewCallError(CallErrorUnavailable, "%v", err)
+	}
+	return NewCallError(CallErrorInternal, "%v", err)
+}
+
+func decodeCallResult(dec *msgpack.Decoder) (callResponse, error) {
+	var response callResponse
+	if err := dec.Decode(&response); err != nil {
+		return response, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+	if response.ID == 0 {
+		return response, fmt.Errorf("%w: call result requires an id", ErrInvalidMessage)
+	}
+	if response.Error != nil && response.Error.Code == "" {
+		response.Error.Code = CallErrorUnknown
+	}
+	return response, nil
+}
+
+func handleCallResult(response callResponse, ctx WSRequestContext) error {
+	if ctx.session == nil {
+		return errors.New("no websocket connection in context")
+	}
+	ctx.session.resolveCall(response)
+	return nil
+}
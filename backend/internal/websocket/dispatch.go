@@ -0,0 +1,94 @@
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/gorilla/websocket"
+)
+
+var ErrInvalidCommand = errors.New("invalid command")
+
+// maxCommandLength bounds a command's name.
+const maxCommandLength = 256
+
+// DispatchTarget selects the computers a command is sent to: every connected
+// computer, or the listed ones.
+type DispatchTarget struct {
+	All         bool
+	ComputerIDs []int
+}
+
+// Delivery is the outcome of dispatching a command to one computer. Sessions
+// is the number of the computer's sessions the command was written to; Err is
+// set if it was not written to all of them, and is ErrComputerOffline if the
+// computer had none.
+type Delivery struct {
+	ComputerID int
+	Sessions   int
+	Err        error
+}
+
+// command is the body of a MessageCommand. Computers queue it as a
+// "ccgui_command" event with the name and data as parameters.
+type command struct {
+	Name string `msgpack:"name"`
+	Data any    `msgpack:"data"`
+}
+
+// Dispatch sends a command to the target computers without waiting for them
+// to act on it, and reports the delivery to each, ordered by computer ID.
+// Computers with several sessions receive the command on each of them.
+func (h *Hub) Dispatch(target DispatchTarget, name string, data any) ([]Delivery, error) {
+	if name == "" {
+		return nil, fmt.Errorf("%w: name is required", ErrInvalidCommand)
+	}
+	if len(name) > maxCommandLength {
+		return nil, fmt.Errorf("%w: name is longer than %d bytes", ErrInvalidCommand, maxCommandLength)
+	}
+	buf := makeMessage(MessageCommand, command{Name: name, Data: data})
+
+	h.mu.RLock()
+	sessions := make(map[int][]*Session)
+	if target.All {
+		for id := range h.byComputerID {
+			sessions[id] = nil
+		}
+	}
+	for _, id := range target.ComputerIDs {
+		sessions[id] = nil
+	}
+	for id := range sessions {
+		for conn := range h.byComputerID[id] {
+			if session, ok := h.clients[conn]; ok {
+				sessions[id] = append(sessions[id], session)
+			}
+		}
+	}
+	h.mu.RUnlock()
+
+	deliveries := make([]Delivery, 0, len(sessions))
+	for id, targets := range sessions {
+		delivery := Delivery{ComputerID: id}
+		if len(targets) == 0 {
+			delivery.Err = ErrComputerOffline
+		}
+		var errs []error
+		for _, session := range targets {
+			if err := session.WriteMessage(websocket.BinaryMessage, buf.Bytes()); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			delivery.Sessions++
+		}
+		if len(errs) > 0 {
+			delivery.Err = errors.Join(errs...)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].ComputerID < deliveries[j].ComputerID
+	})
+	return deliveries, nil
+}
@@ -0,0 +1,208 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Messages of the /enroll protocol. A computer without a key sends
+// [EnrollRouteRequest, {id, label}]. The server answers
+// [EnrollMessageCode, {code, expires_in}], then once an operator approves the
+// code [EnrollMessageKey, {key}], or [EnrollMessageRejected, {reason}], and
+// closes the connection.
+const (
+	EnrollRouteRequest = 1
+
+	EnrollMessageCode     = 0
+	EnrollMessageKey      = 1
+	EnrollMessageRejected = 2
+)
+
+const (
+	// enrollRequestTimeout is how long a computer has to send its request
+	// after connecting.
+	enrollRequestTimeout = 30 * time.Second
+	enrollPingInterval   = 30 * time.Second
+	enrollWriteTimeout   = 10 * time.Second
+	// enrollMaxMessageSize bounds what an unauthenticated computer may send.
+	enrollMaxMessageSize = 4 << 10
+)
+
+// EnrollmentRequest is a computer asking for a key.
+type EnrollmentRequest struct {
+	ComputerID int
+	Label      string
+	RemoteAddr string
+}
+
+// PendingEnrollment is a computer waiting for an operator to approve the
+// code it shows.
+type PendingEnrollment struct {
+	Code      string
+	ExpiresAt time.Time
+	// Result delivers the key once the enrollment is approved, or an error
+	// if it is denied.
+	Result <-chan EnrollmentResult
+}
+
+type EnrollmentResult struct {
+	Key string
+	Err error
+	// Delivered, if set, is sent whether Key was written to the computer.
+	Delivered chan<- error
+}
+
+// Enroller issues keys to computers that ask for one, once an operator
+// approves them.
+type Enroller interface {
+	// BeginEnrollment registers a computer waiting to enroll.
+	BeginEnrollment(ctx context.Context, req EnrollmentRequest) (*PendingEnrollment, error)
+	// CancelEnrollment forgets an enrollment once its connection is done,
+	// whether the computer went away, its code expired or it got a result.
+	CancelEnrollment(code string)
+}
+
+func (h *Hub) SetEnroller(enroller Enroller) {
+	h.mu.Lock()
+	h.enroller = enroller
+	h.mu.Unlock()
+}
+
+type enrollRequestPayload struct {
+	ID    *int   `msgpack:"id"`
+	Label string `msgpack:"label"`
+}
+
+// HandleEnroll serves /enroll, where computers without a key connect,
+// unauthenticated, to get one.
+func (h *Hub) HandleEnroll(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	enroller := h.enroller
+	h.mu.RUnlock()
+	if enroller == nil {
+		http.NotFound(w, r)
+		return
+	}
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Error("failed to upgrade websocket", "err", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(enrollMaxMessageSize)
+
+	conn.SetReadDeadline(time.Now().Add(enrollRequestTimeout))
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	payload, err := decodeEnrollRequest(message)
+	if err != nil {
+		rejectEnrollment(conn, err.Error())
+		return
+	}
+	pending, err := enroller.BeginEnrollment(r.Context(), EnrollmentRequest{
+		ComputerID: *payload.ID,
+		Label:      payload.Label,
+		RemoteAddr: r.RemoteAddr,
+	})
+	if err != nil {
+		rejectEnrollment(conn, err.Error())
+		return
+	}
+	defer enroller.CancelEnrollment(pending.Code)
+	slog.Info("computer waiting to enroll", "computer_id", *payload.ID, "label", payload.Label, "remote_addr", r.RemoteAddr)
+	err = writeEnrollMessage(conn, EnrollMessageCode, map[string]any{
+		"code":       pending.Code,
+		"expires_in": int(time.Until(pending.ExpiresAt).Seconds()),
+	})
+	if err != nil {
+		return
+	}
+
+	// The computer sends nothing more, so reading only notices it leaving.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	expired := time.NewTimer(time.Until(pending.ExpiresAt))
+	defer expired.Stop()
+	ping := time.NewTicker(enrollPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case result := <-pending.Result:
+			if result.Err != nil {
+				rejectEnrollment(conn, result.Err.Error())
+				return
+			}
+			err := writeEnrollMessage(conn, EnrollMessageKey, map[string]any{"key": result.Key})
+			if result.Delivered != nil {
+				result.Delivered <- err
+			}
+			if err != nil {
+				slog.Warn("failed to deliver enrolled key", "computer_id", *payload.ID, "err", err)
+				return
+			}
+			slog.Info("computer enrolled", "computer_id", *payload.ID)
+			closeEnrollment(conn, "enrolled")
+			return
+		case <-expired.C:
+			rejectEnrollment(conn, "the code expired before it was approved")
+			return
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(enrollWriteTimeout)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+func decodeEnrollRequest(message []byte) (enrollRequestPayload, error) {
+	var payload enrollRequestPayload
+	dec := msgpack.NewDecoder(bytes.NewReader(message))
+	length, err := dec.DecodeArrayLen()
+	if err != nil || length != 2 {
+		return payload, fmt.Errorf("%w: expected [route, request]", ErrInvalidMessage)
+	}
+	route, err := dec.DecodeInt()
+	if err != nil || route != EnrollRouteRequest {
+		return payload, fmt.Errorf("%w: expected an enrollment request", ErrInvalidMessage)
+	}
+	if err := dec.Decode(&payload); err != nil {
+		return payload, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+	if payload.ID == nil || *payload.ID < 0 {
+		return payload, fmt.Errorf("%w: enrollment requires a non-negative computer id", ErrInvalidMessage)
+	}
+	return payload, nil
+}
+
+func writeEnrollMessage(conn *websocket.Conn, message int, data any) error {
+	conn.SetWriteDeadline(time.Now().Add(enrollWriteTimeout))
+	return conn.WriteMessage(websocket.BinaryMessage, makeMessage(message, data).Bytes())
+}
+
+func rejectEnrollment(conn *websocket.Conn, reason string) {
+	writeEnrollMessage(conn, EnrollMessageRejected, map[string]any{"reason": reason})
+	closeEnrollment(conn, "enrollment refused")
+}
+
+func closeEnrollment(conn *websocket.Conn, reason string) {
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason), time.Now().Add(enrollWriteTimeout))
+}
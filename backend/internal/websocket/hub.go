@@ -9,29 +9,136 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 
+	"ehedges.net/ccgui/backend/internal/otlp"
 	"github.com/gorilla/websocket"
 	"github.com/vmihailenco/msgpack/v5"
 )
 
+var ErrComputerOffline = errors.New("computer is not connected")
+var ErrComputerForbidden = errors.New("key may not connect as this computer")
+
+// errSessionClosed is returned when a session is closed while it identifies
+// as a computer.
+var errSessionClosed = errors.New("session closed")
+
 type Hub struct {
-	upgrader  websocket.Upgrader
-	clients   map[*websocket.Conn]bool
-	broadcast chan []byte
-	mu        sync.RWMutex
-	validator APIKeyValidator
-	byKeyID   map[string]map[*websocket.Conn]struct{}
-	router    Route
+	upgrader     websocket.Upgrader
+	clients      map[*websocket.Conn]*Session
+	mu           sync.RWMutex
+	validator    APIKeyValidator
+	authorizer   SessionAuthorizer
+	auditor      SessionAuditor
+	byKeyID      map[string]map[*websocket.Conn]struct{}
+	byComputerID map[int]map[*websocket.Conn]struct{}
+	identifying  map[int]*computerLock
+	router       Route
+	tracker      ComputerTracker
+	terminals    TerminalSink
+	metrics      MetricsSink
+	logs         LogSink
+	instruments  Instrumentation
+	callHandlers map[string]CallHandler
+	enroller     Enroller
 }
 
 type APIKeyValidator interface {
 	Validate(plain string) bool
 }
 
+// APIKeyResolver resolves keys to their IDs and the hashes of their secrets,
+// recording where each was used.
 type APIKeyResolver interface {
-	ResolveID(plain string) (string, bool)
+	ResolveID(plain string, remoteAddr string) (id string, secretHash string, ok bool)
+}
+
+// SessionAuthorizer decides what the key a session authenticated with may do.
+// It is only consulted for sessions that authenticated with a key.
+type SessionAuthorizer interface {
+	// AuthorizeConnect is called before a session is accepted.
+	AuthorizeConnect(ctx context.Context, keyID string) error
+	// AuthorizeIdentity is called when a session first identifies itself as
+	// a computer. exclusive reports whether the key is bound to the computer,
+	// in which case the session replaces any other using the key.
+	AuthorizeIdentity(ctx context.Context, keyID string, computerID int) (exclusive bool, err error)
+}
+
+const (
+	// SessionActionConnect is audited when a session is refused before it
+	// is accepted.
+	SessionActionConnect = "websocket.connect"
+	// SessionActionIdentify is audited when a session first identifies as a
+	// computer, or is refused for it.
+	SessionActionIdentify = "websocket.identify"
+	// SessionActionSupersede is audited when a session is closed because
+	// another identified with the same key, which is bound to one computer.
+	SessionActionSupersede = "websocket.supersede"
+)
+
+// supersedeTimeout is how long a session replacing others waits for them to
+// go away.
+const supersedeTimeout = 5 * time.Second
+
+// SessionAuditEvent is an authentication decision about a session.
+type SessionAuditEvent struct {
+	Action string
+	// KeyID is the key the session presented, if it was valid.
+	KeyID      string
+	RemoteAddr string
+	// ComputerID is the computer the session identified as, or -1.
+	ComputerID int
+	// Err is why the session was refused, or nil if it was allowed.
+	Err error
+}
+
+// SessionAuditor records the hub's authentication decisions.
+type SessionAuditor interface {
+	SessionAudit(ctx context.Context, event SessionAuditEvent)
+}
+
+// ComputerTracker is notified as sessions identify themselves as computers,
+// report their monitors, and go away. closeReason is empty unless the server
+// closed the session itself, e.g. because its key was deleted.
+type ComputerTracker interface {
+	ComputerConnected(ctx context.Context, info ComputerInfo) error
+	ComputerUpdated(ctx context.Context, previous ComputerInfo, info ComputerInfo) error
+	ComputerMonitorsChanged(ctx context.Context, info ComputerInfo) error
+	ComputerDisconnected(ctx context.Context, info ComputerInfo, closeReason string) error
 }
 
+// TerminalSink receives the rawterm stream of identified computers.
+// TerminalDetached is called once a computer's last session goes away.
+type TerminalSink interface {
+	TerminalData(ctx context.Context, computer ComputerInfo, data []byte) error
+	TerminalDetached(computer ComputerInfo)
+}
+
+// MetricsSink receives the OTLP metrics flushed by identified computers.
+type MetricsSink interface {
+	ComputerMetrics(ctx context.Context, computer ComputerInfo, data *otlp.MetricsData) error
+}
+
+// Instrumentation observes the hub's connections and messages.
+type Instrumentation interface {
+	ClientConnected(ctx context.Context)
+	ClientDisconnected(ctx context.Context)
+	// StartMessage is called as each message arrives. The returned function
+	// is called once the message has been handled, with the path of the route
+	// that handled it (empty if no route matched) and the handler's error.
+	StartMessage(ctx context.Context) (context.Context, func(path string, err error))
+}
+
+// LogSink receives the log records forwarded by identified computers.
+type LogSink interface {
+	ComputerLog(ctx context.Context, computer ComputerInfo, record LogRecord) error
+}
+
+// maxMessageSize bounds messages read from computers. The largest are
+// terminal frames, which hold at most two run-length encoded layers of a
+// screen.MaxWidth by screen.MaxHeight terminal.
+const maxMessageSize = 8 << 20
+
 func NewHub(validator APIKeyValidator) *Hub {
 	return &Hub{
 		upgrader: websocket.Upgrader{
@@ -39,10 +146,12 @@ func NewHub(validator APIKeyValidator) *Hub {
 				return true
 			},
 		},
-		clients:   make(map[*websocket.Conn]bool),
-		broadcast: make(chan []byte),
-		validator: validator,
-		byKeyID:   make(map[string]map[*websocket.Conn]struct{}),
+		clients:      make(map[*websocket.Conn]*Session),
+		validator:    validator,
+		byKeyID:      make(map[string]map[*websocket.Conn]struct{}),
+		byComputerID: make(map[int]map[*websocket.Conn]struct{}),
+		identifying:  make(map[int]*computerLock),
+		callHandlers: make(map[string]CallHandler),
 	}
 }
 
@@ -53,87 +162,172 @@ func (h *Hub) SetRouter(router Route) {
 
 }
 
+func (h *Hub) SetSessionAuthorizer(authorizer SessionAuthorizer) {
+	h.mu.Lock()
+	h.authorizer = authorizer
+	h.mu.Unlock()
+}
+
+func (h *Hub) SetSessionAuditor(auditor SessionAuditor) {
+	h.mu.Lock()
+	h.auditor = auditor
+	h.mu.Unlock()
+}
+
+func (h *Hub) SetComputerTracker(tracker ComputerTracker) {
+	h.mu.Lock()
+	h.tracker = tracker
+	h.mu.Unlock()
+}
+
+func (h *Hub) SetTerminalSink(sink TerminalSink) {
+	h.mu.Lock()
+	h.terminals = sink
+	h.mu.Unlock()
+}
+
+func (h *Hub) SetMetricsSink(sink MetricsSink) {
+	h.mu.Lock()
+	h.metrics = sink
+	h.mu.Unlock()
+}
+
+func (h *Hub) SetInstrumentation(instruments Instrumentation) {
+	h.mu.Lock()
+	h.instruments = instruments
+	h.mu.Unlock()
+}
+
+func (h *Hub) SetLogSink(sink LogSink) {
+	h.mu.Lock()
+	h.logs = sink
+	h.mu.Unlock()
+}
+
 type WSRequestContext struct {
 	context.Context
-	conn *websocket.Conn
-	path string
+	session *Session
+	path    string
+	// resolved, if set, receives the path as each router extends it, so the
+	// full path is known after routing returns.
+	resolved *string
+}
+
+// Computer returns the identity the sending session announced, if any.
+func (c WSRequestContext) Computer() (ComputerInfo, bool) {
+	if c.session == nil {
+		return ComputerInfo{}, false
+	}
+	return c.session.Computer()
 }
 
 func (h *Hub) HandleWS(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	authorizer := h.authorizer
+	auditor := h.auditor
+	h.mu.RUnlock()
 	if h.validator != nil && !h.isAuthorized(r) {
+		if auditor != nil {
+			auditor.SessionAudit(r.Context(), SessionAuditEvent{
+				Action:     SessionActionConnect,
+				RemoteAddr: r.RemoteAddr,
+				ComputerID: -1,
+				Err:        errors.New("missing or invalid API key"),
+			})
+		}
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	keyID := h.resolveKeyID(r)
+	keyID, secretHash := h.resolveKeyID(r)
+	if authorizer != nil && keyID != "" {
+		if err := authorizer.AuthorizeConnect(r.Context(), keyID); err != nil {
+			slog.Warn("websocket key not allowed to connect", "key_id", keyID, "err", err)
+			if auditor != nil {
+				auditor.SessionAudit(r.Context(), SessionAuditEvent{
+					Action:     SessionActionConnect,
+					KeyID:      keyID,
+					RemoteAddr: r.RemoteAddr,
+					ComputerID: -1,
+					Err:        err,
+				})
+			}
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+	}
 
 	conn, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		slog.Error("failed to upgrade websocket", "err", err)
 		return
 	}
+	conn.SetReadLimit(maxMessageSize)
 
 	defer conn.Close()
 
+	session := newSession(h, conn, keyID, secretHash, r.RemoteAddr)
+
 	h.mu.Lock()
-	h.clients[conn] = true
+	h.clients[conn] = session
 	if keyID != "" {
 		h.attachKeyIDLocked(conn, keyID)
 	}
+	instruments := h.instruments
 	h.mu.Unlock()
 
+	if instruments != nil {
+		instruments.ClientConnected(r.Context())
+		defer instruments.ClientDisconnected(r.Context())
+	}
+	defer h.disconnect(session)
+
 	for {
 		_, message, err := conn.ReadMessage()
 		if err != nil {
-			h.mu.Lock()
-			delete(h.clients, conn)
-			if keyID != "" {
-				h.detachKeyIDLocked(conn, keyID)
-			}
-			h.mu.Unlock()
 			break
 		}
-		if h.router != nil {
-			dec := msgpack.NewDecoder(bytes.NewReader(message))
-			arrayLength, err := dec.DecodeArrayLen()
-			slog.Info("message received", "message string", message, "message bytes", fmt.Sprintf("% X", message), "array length", arrayLength)
-			if err != nil {
-				slog.Error("failed to decode array length from websocket message")
-				continue
-			}
-			wsContext := WSRequestContext{
-				Context: r.Context(),
-				conn:    conn,
-				path:    "",
-			}
-			if err := h.router.Handle(wsContext, arrayLength, dec); err != nil {
-				if errors.Is(err, ErrRouteNotFound) || errors.Is(err, ErrInvalidMessage) {
-					slog.Warn("websocket route error", "err", err)
-				} else {
-					slog.Error("websocket handler error", "err", err)
-				}
-			}
+		if h.router == nil {
+			slog.Error("hub router not defined; dropping message")
 			continue
-		} else {
-			slog.Error("hub router not defined")
 		}
-		h.broadcast <- message
+		h.handleMessage(r.Context(), session, message, instruments)
 	}
-	// TODO: Route messages to controllers instead of broadcasting.
 }
 
-func (h *Hub) Run() {
-	for {
-		message := <-h.broadcast
-
-		h.mu.Lock()
-		for client := range h.clients {
-			if err := client.WriteMessage(websocket.TextMessage, message); err != nil {
-				client.Close()
-				delete(h.clients, client)
+func (h *Hub) handleMessage(ctx context.Context, session *Session, message []byte, instruments Instrumentation) {
+	var resolved string
+	var err error
+	if instruments != nil {
+		var done func(path string, err error)
+		ctx, done = instruments.StartMessage(ctx)
+		defer func() {
+			if errors.Is(err, ErrRouteNotFound) {
+				resolved = ""
 			}
+			done(resolved, err)
+		}()
+	}
+	dec := msgpack.NewDecoder(bytes.NewReader(message))
+	arrayLength, err := dec.DecodeArrayLen()
+	slog.Info("message received", "message string", message, "message bytes", fmt.Sprintf("% X", message), "array length", arrayLength)
+	if err != nil {
+		err = fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+		slog.Error("failed to decode array length from websocket message")
+		return
+	}
+	wsContext := WSRequestContext{
+		Context:  ctx,
+		session:  session,
+		path:     "",
+		resolved: &resolved,
+	}
+	if err = h.router.Handle(wsContext, arrayLength, dec); err != nil {
+		if errors.Is(err, ErrRouteNotFound) || errors.Is(err, ErrInvalidMessage) {
+			slog.Warn("websocket route error", "err", err)
+		} else {
+			slog.Error("websocket handler error", "err", err)
 		}
-		h.mu.Unlock()
 	}
 }
 
@@ -156,7 +350,9 @@ func (h *Hub) isAuthorized(r *http.Request) bool {
 	return false
 }
 
-func (h *Hub) CloseByKeyID(id string) {
+// CloseByKeyID closes every session authenticated with the key, giving reason
+// as the close reason.
+func (h *Hub) CloseByKeyID(id string, reason string) {
 	if id == "" {
 		return
 	}
@@ -164,33 +360,369 @@ func (h *Hub) CloseByKeyID(id string) {
 	conns := h.byKeyID[id]
 	delete(h.byKeyID, id)
 	for conn := range conns {
+		if session, ok := h.clients[conn]; ok {
+			session.close(websocket.CloseNormalClosure, reason)
+		} else {
+			conn.Close()
+		}
+		delete(h.clients, conn)
+	}
+	h.mu.Unlock()
+}
+
+// CloseBySecretHash closes every session authenticated with the key secret
+// with the given hash, giving reason as the close reason. Sessions using the
+// key's other secret stay open.
+func (h *Hub) CloseBySecretHash(hash string, reason string) {
+	if hash == "" {
+		return
+	}
+	h.mu.Lock()
+	for conn, session := range h.clients {
+		if session.secretHash != hash {
+			continue
+		}
+		session.close(websocket.CloseNormalClosure, reason)
+		h.detachKeyIDLocked(conn, session.keyID)
+		delete(h.clients, conn)
+	}
+	h.mu.Unlock()
+}
+
+// ComputerSessions returns the open sessions that have identified themselves
+// as the given computer.
+func (h *Hub) ComputerSessions(id int) []SessionInfo {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	conns := h.byComputerID[id]
+	sessions := make([]SessionInfo, 0, len(conns))
+	for conn := range conns {
+		if session, ok := h.clients[conn]; ok {
+			sessions = append(sessions, session.Info())
+		}
+	}
+	return sessions
+}
+
+// SendToComputer writes a message to every session identified as the given
+// computer.
+func (h *Hub) SendToComputer(id int, message Message, data any) error {
+	buf := makeMessage(message, data)
+	h.mu.RLock()
+	sessions := make([]*Session, 0, len(h.byComputerID[id]))
+	for conn := range h.byComputerID[id] {
+		if session, ok := h.clients[conn]; ok {
+			sessions = append(sessions, session)
+		}
+	}
+	h.mu.RUnlock()
+	if len(sessions) == 0 {
+		return ErrComputerOffline
+	}
+	var errs []error
+	for _, session := range sessions {
+		if err := session.WriteMessage(websocket.BinaryMessage, buf.Bytes()); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (h *Hub) CloseByComputerID(id int, reason string) {
+	h.mu.Lock()
+	conns := h.byComputerID[id]
+	delete(h.byComputerID, id)
+	for conn := range conns {
+		if session, ok := h.clients[conn]; ok {
+			session.close(websocket.CloseNormalClosure, reason)
+		} else {
+			conn.Close()
+		}
 		delete(h.clients, conn)
-		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "key deleted"))
-		conn.Close()
 	}
 	h.mu.Unlock()
 }
 
-func (h *Hub) resolveKeyID(r *http.Request) string {
+// identify binds a session to the computer it announced in its handshake. A
+// session may repeat the handshake to update its label, but may not change
+// which computer it claims to be. Sessions whose key may not act as the
+// computer are closed.
+func (h *Hub) identify(ctx context.Context, session *Session, info ComputerInfo) error {
+	previous, identified := session.Computer()
+	if identified && previous.ID != info.ID {
+		return fmt.Errorf("%w: session already identified as computer %d", ErrInvalidMessage, previous.ID)
+	}
+	// Sessions identify as a computer one at a time, so two sessions for a
+	// bound key cannot replace each other.
+	unlock, err := h.lockComputer(session, info.ID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	h.mu.RLock()
+	authorizer := h.authorizer
+	auditor := h.auditor
+	tracker := h.tracker
+	h.mu.RUnlock()
+	if identified {
+		session.setComputer(info)
+		if tracker == nil {
+			return nil
+		}
+		return tracker.ComputerUpdated(ctx, previous, info)
+	}
+
+	if session.keyID != "" {
+		var exclusive bool
+		var err error
+		if authorizer != nil {
+			exclusive, err = authorizer.AuthorizeIdentity(ctx, session.keyID, info.ID)
+		}
+		if auditor != nil {
+			auditor.SessionAudit(ctx, SessionAuditEvent{
+				Action:     SessionActionIdentify,
+				KeyID:      session.keyID,
+				RemoteAddr: session.remoteAddr,
+				ComputerID: info.ID,
+				Err:        err,
+			})
+		}
+		if err != nil {
+			session.close(websocket.ClosePolicyViolation, fmt.Sprintf("key may not connect as computer %d", info.ID))
+			return fmt.Errorf("%w: computer %d: %v", ErrComputerForbidden, info.ID, err)
+		}
+		if exclusive {
+			h.supersede(ctx, session, info.ID)
+		}
+	}
+
+	h.mu.Lock()
+	_, open := h.clients[session.conn]
+	if open {
+		session.setComputer(info)
+		h.attachComputerIDLocked(session.conn, info.ID)
+	}
+	h.mu.Unlock()
+	if !open {
+		return fmt.Errorf("computer %d: %w", info.ID, errSessionClosed)
+	}
+
+	if tracker == nil {
+		return nil
+	}
+	if err := tracker.ComputerConnected(ctx, info); err != nil {
+		// Leave the session unidentified, so it is not reported disconnected
+		// without having been reported connected.
+		h.mu.Lock()
+		h.detachComputerIDLocked(session.conn, info.ID)
+		session.clearComputer()
+		h.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// computerLock serializes sessions identifying as one computer.
+type computerLock struct {
+	ch      chan struct{}
+	waiters int
+}
+
+// lockComputer waits until no other session is identifying as the computer
+// id, returning a function that lets the next one go. It gives up if session
+// is closed while waiting, e.g. because a session identifying first replaced
+// it.
+func (h *Hub) lockComputer(session *Session, id int) (func(), error) {
+	h.mu.Lock()
+	lock := h.identifying[id]
+	if lock == nil {
+		lock = &computerLock{ch: make(chan struct{}, 1)}
+		h.identifying[id] = lock
+	}
+	lock.waiters++
+	h.mu.Unlock()
+
+	release := func() {
+		h.mu.Lock()
+		lock.waiters--
+		if lock.waiters == 0 {
+			delete(h.identifying, id)
+		}
+		h.mu.Unlock()
+	}
+	select {
+	case lock.ch <- struct{}{}:
+	case <-session.closed:
+		release()
+		return nil, fmt.Errorf("computer %d: %w", id, errSessionClosed)
+	}
+	select {
+	case <-session.closed:
+		<-lock.ch
+		release()
+		return nil, fmt.Errorf("computer %d: %w", id, errSessionClosed)
+	default:
+	}
+	return func() {
+		<-lock.ch
+		release()
+	}, nil
+}
+
+// updateMonitors replaces the monitors a session has reported.
+func (h *Hub) updateMonitors(ctx context.Context, session *Session, monitors []MonitorInfo) error {
+	info, identified := session.Computer()
+	if !identified {
+		return fmt.Errorf("%w: monitors sent before hello", ErrInvalidMessage)
+	}
+	session.setMonitors(monitors)
+	h.mu.RLock()
+	tracker := h.tracker
+	h.mu.RUnlock()
+	if tracker == nil {
+		return nil
+	}
+	return tracker.ComputerMonitorsChanged(ctx, info)
+}
+
+func (h *Hub) terminalData(ctx context.Context, session *Session, data []byte) error {
+	info, identified := session.Computer()
+	if !identified {
+		return fmt.Errorf("%w: terminal data sent before hello", ErrInvalidMessage)
+	}
+	h.mu.RLock()
+	terminals := h.terminals
+	h.mu.RUnlock()
+	if terminals == nil {
+		return nil
+	}
+	return terminals.TerminalData(ctx, info, data)
+}
+
+func (h *Hub) metricsData(ctx context.Context, session *Session, data *otlp.MetricsData) error {
+	info, identified := session.Computer()
+	if !identified {
+		return fmt.Errorf("%w: metrics sent before hello", ErrInvalidMessage)
+	}
+	h.mu.RLock()
+	metrics := h.metrics
+	h.mu.RUnlock()
+	if metrics == nil {
+		return nil
+	}
+	return metrics.ComputerMetrics(ctx, info, data)
+}
+
+func (h *Hub) logData(ctx context.Context, session *Session, record LogRecord) error {
+	info, identified := session.Computer()
+	if !identified {
+		return fmt.Errorf("%w: log sent before hello", ErrInvalidMessage)
+	}
+	h.mu.RLock()
+	logs := h.logs
+	h.mu.RUnlock()
+	if logs == nil {
+		return nil
+	}
+	return logs.ComputerLog(ctx, info, record)
+}
+
+// supersede closes the other sessions using session's key, which is bound to
+// computerID. It waits for them to go away, so the computer is not reported
+// disconnected after session identifies as it.
+func (h *Hub) supersede(ctx context.Context, session *Session, computerID int) {
+	h.mu.RLock()
+	var others []*Session
+	for conn := range h.byKeyID[session.keyID] {
+		if other, ok := h.clients[conn]; ok && other != session {
+			others = append(others, other)
+		}
+	}
+	auditor := h.auditor
+	h.mu.RUnlock()
+	if len(others) == 0 {
+		return
+	}
+
+	for _, other := range others {
+		slog.Warn("closing session replaced by a new session for its bound key",
+			"key_id", session.keyID, "computer_id", computerID,
+			"remote_addr", other.remoteAddr, "new_remote_addr", session.remoteAddr)
+		if auditor != nil {
+			auditor.SessionAudit(ctx, SessionAuditEvent{
+				Action:     SessionActionSupersede,
+				KeyID:      session.keyID,
+				RemoteAddr: other.remoteAddr,
+				ComputerID: computerID,
+			})
+		}
+		other.close(websocket.CloseNormalClosure, "replaced by a new session for this key")
+	}
+	timeout := time.NewTimer(supersedeTimeout)
+	defer timeout.Stop()
+	for _, other := range others {
+		select {
+		case <-other.done:
+		case <-timeout.C:
+			slog.Warn("replaced sessions did not close in time", "key_id", session.keyID)
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (h *Hub) disconnect(session *Session) {
+	defer close(session.done)
+	session.failCalls()
+	h.mu.Lock()
+	delete(h.clients, session.conn)
+	if session.keyID != "" {
+		h.detachKeyIDLocked(session.conn, session.keyID)
+	}
+	info, identified := session.Computer()
+	// Other sessions for the computer, e.g. one replacing a stale socket,
+	// keep streaming its terminal.
+	lastSession := false
+	if identified {
+		h.detachComputerIDLocked(session.conn, info.ID)
+		lastSession = len(h.byComputerID[info.ID]) == 0
+	}
+	tracker := h.tracker
+	terminals := h.terminals
+	h.mu.Unlock()
+
+	if lastSession && terminals != nil {
+		terminals.TerminalDetached(info)
+	}
+	if identified && tracker != nil {
+		if err := tracker.ComputerDisconnected(context.Background(), info, session.CloseReason()); err != nil {
+			slog.Error("failed to record computer disconnect", "computer_id", info.ID, "err", err)
+		}
+	}
+}
+
+func (h *Hub) resolveKeyID(r *http.Request) (id string, secretHash string) {
 	resolver, ok := h.validator.(APIKeyResolver)
 	if !ok {
-		return ""
+		return "", ""
 	}
 	if key := r.URL.Query().Get("api_key"); key != "" {
-		if id, ok := resolver.ResolveID(key); ok {
-			return id
+		if id, secretHash, ok := resolver.ResolveID(key, r.RemoteAddr); ok {
+			return id, secretHash
 		}
-		return ""
+		return "", ""
 	}
 	if authHeader := r.Header.Get("Authorization"); authHeader != "" {
 		const prefix = "Bearer "
 		if strings.HasPrefix(authHeader, prefix) {
-			if id, ok := resolver.ResolveID(strings.TrimPrefix(authHeader, prefix)); ok {
-				return id
+			if id, secretHash, ok := resolver.ResolveID(strings.TrimPrefix(authHeader, prefix), r.RemoteAddr); ok {
+				return id, secretHash
 			}
 		}
 	}
-	return ""
+	return "", ""
 }
 
 func (h *Hub) attachKeyIDLocked(conn *websocket.Conn, id string) {
@@ -212,3 +744,23 @@ func (h *Hub) detachKeyIDLocked(conn *websocket.Conn, id string) {
 		delete(h.byKeyID, id)
 	}
 }
+
+func (h *Hub) attachComputerIDLocked(conn *websocket.Conn, id int) {
+	conns := h.byComputerID[id]
+	if conns == nil {
+		conns = make(map[*websocket.Conn]struct{})
+		h.byComputerID[id] = conns
+	}
+	conns[conn] = struct{}{}
+}
+
+func (h *Hub) detachComputerIDLocked(conn *websocket.Conn, id int) {
+	conns := h.byComputerID[id]
+	if conns == nil {
+		return
+	}
+	delete(conns, conn)
+	if len(conns) == 0 {
+		delete(h.byComputerID, id)
+	}
+}
@@ -0,0 +1,118 @@
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"ehedges.net/ccgui/backend/internal/otlp"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// LogLevel mirrors LogLevel in cc-tstl/src/api/event.ts.
+type LogLevel int
+
+const (
+	LogLevelTrace LogLevel = iota
+	LogLevelDebug
+	LogLevelInfo
+	LogLevelWarning
+	LogLevelError
+	LogLevelCritical
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelTrace:
+		return "TRACE"
+	case LogLevelDebug:
+		return "DEBUG"
+	case LogLevelInfo:
+		return "INFO"
+	case LogLevelWarning:
+		return "WARNING"
+	case LogLevelError:
+		return "ERROR"
+	case LogLevelCritical:
+		return "CRITICAL"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// FunctionInfo is the serialisable subset of the table returned by Lua's
+// debug.getinfo().
+type FunctionInfo struct {
+	Source          string `msgpack:"source"`
+	ShortSrc        string `msgpack:"short_src"`
+	CurrentLine     int    `msgpack:"currentline"`
+	LineDefined     int    `msgpack:"linedefined"`
+	LastLineDefined int    `msgpack:"lastlinedefined"`
+	What            string `msgpack:"what"`
+	Name            string `msgpack:"name"`
+	NameWhat        string `msgpack:"namewhat"`
+}
+
+// LogRecord is a single LogEvent forwarded by a computer.
+type LogRecord struct {
+	Time    time.Time
+	Level   LogLevel
+	Message string
+	// Source is the function that logged the record, if the computer sent it.
+	Source *FunctionInfo
+	// Trace is the stack at the time of logging, innermost frame first.
+	Trace []FunctionInfo
+}
+
+const (
+	maxLogMessageSize = 16 << 10
+	maxLogTraceDepth  = 64
+)
+
+// logPayload is a LogEvent as sent by the computer's log forwarder.
+// TimeUnixNano is os.epoch("utc") scaled to nanoseconds; records without it
+// are stamped with the time they arrived.
+type logPayload struct {
+	Level        *int           `msgpack:"level"`
+	Message      string         `msgpack:"message"`
+	TimeUnixNano otlp.Uint64    `msgpack:"time_unix_nano"`
+	Info         *FunctionInfo  `msgpack:"info"`
+	Trace        []FunctionInfo `msgpack:"trace"`
+}
+
+func decodeLog(dec *msgpack.Decoder) (LogRecord, error) {
+	var payload logPayload
+	if err := dec.Decode(&payload); err != nil {
+		return LogRecord{}, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+	if payload.Level == nil {
+		return LogRecord{}, fmt.Errorf("%w: log record requires a level", ErrInvalidMessage)
+	}
+	level := LogLevel(*payload.Level)
+	if level < LogLevelTrace || level > LogLevelCritical {
+		return LogRecord{}, fmt.Errorf("%w: invalid log level %d", ErrInvalidMessage, *payload.Level)
+	}
+	if len(payload.Message) > maxLogMessageSize {
+		return LogRecord{}, fmt.Errorf("%w: log message exceeds %d bytes", ErrInvalidMessage, maxLogMessageSize)
+	}
+	if len(payload.Trace) > maxLogTraceDepth {
+		payload.Trace = payload.Trace[:maxLogTraceDepth]
+	}
+	record := LogRecord{
+		Time:    time.Now(),
+		Level:   level,
+		Message: payload.Message,
+		Source:  payload.Info,
+		Trace:   payload.Trace,
+	}
+	if payload.TimeUnixNano != 0 {
+		record.Time = time.Unix(0, int64(payload.TimeUnixNano))
+	}
+	return record, nil
+}
+
+func handleLog(data LogRecord, ctx WSRequestContext) error {
+	if ctx.session == nil {
+		return errors.New("no websocket connection in context")
+	}
+	return ctx.session.hub.logData(ctx, ctx.session, data)
+}
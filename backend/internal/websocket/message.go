@@ -11,6 +11,10 @@ type Message int
 const (
 	MessagePing Message = iota
 	MessagePong
+	MessageTerminal
+	MessageCall
+	MessageCallResult
+	MessageCommand
 )
 
 func makeMessage(a ...any) *bytes.Buffer {
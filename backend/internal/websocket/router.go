@@ -80,6 +80,9 @@ func (r *Router[A]) Handle(ctx WSRequestContext, pathLength int, dec *msgpack.De
 	}
 
 	ctx.path += "/" + fmt.Sprint(path)
+	if ctx.resolved != nil {
+		*ctx.resolved = ctx.path
+	}
 
 	if pathLength-1 < 2 {
 		slog.Info("reached route", "path", ctx.path)
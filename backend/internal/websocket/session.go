@@ -0,0 +1,167 @@
+package websocket
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type ComputerKind string
+
+const (
+	ComputerKindComputer ComputerKind = "computer"
+	ComputerKindTurtle   ComputerKind = "turtle"
+	ComputerKindPocket   ComputerKind = "pocket"
+)
+
+// ComputerInfo is the identity a computer announces in its hello handshake.
+type ComputerInfo struct {
+	ID        int
+	Label     string
+	Host      string
+	CCVersion string
+	Kind      ComputerKind
+	Advanced  bool
+}
+
+// MonitorInfo is a monitor peripheral mirrored by a computer into its own
+// rawterm window.
+type MonitorInfo struct {
+	Name      string
+	Window    uint8
+	Width     int
+	Height    int
+	TextScale float64
+}
+
+// SessionInfo is a point-in-time view of a session.
+type SessionInfo struct {
+	KeyID       string
+	RemoteAddr  string
+	ConnectedAt time.Time
+	Monitors    []MonitorInfo
+}
+
+// Session is a single websocket connection held by the hub.
+type Session struct {
+	hub         *Hub
+	conn        *websocket.Conn
+	keyID       string
+	secretHash  string // of the key secret the session authenticated with
+	remoteAddr  string
+	connectedAt time.Time
+
+	writeMu sync.Mutex
+
+	callMu       sync.Mutex
+	nextCallID   uint64
+	pendingCalls map[uint64]chan callResult
+	callsClosed  bool
+
+	mu          sync.RWMutex
+	computer    *ComputerInfo
+	monitors    []MonitorInfo
+	closeReason string
+
+	// closed is closed once the server closes the session.
+	closed    chan struct{}
+	closeOnce sync.Once
+	// done is closed once the hub has forgotten the session.
+	done chan struct{}
+}
+
+func newSession(hub *Hub, conn *websocket.Conn, keyID string, secretHash string, remoteAddr string) *Session {
+	return &Session{
+		hub:          hub,
+		conn:         conn,
+		keyID:        keyID,
+		secretHash:   secretHash,
+		remoteAddr:   remoteAddr,
+		connectedAt:  time.Now(),
+		pendingCalls: make(map[uint64]chan callResult),
+		closed:       make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+func (s *Session) KeyID() string {
+	return s.keyID
+}
+
+func (s *Session) RemoteAddr() string {
+	return s.remoteAddr
+}
+
+func (s *Session) ConnectedAt() time.Time {
+	return s.connectedAt
+}
+
+func (s *Session) Info() SessionInfo {
+	return SessionInfo{
+		KeyID:       s.keyID,
+		RemoteAddr:  s.remoteAddr,
+		ConnectedAt: s.connectedAt,
+		Monitors:    s.Monitors(),
+	}
+}
+
+// Computer returns the identity announced by the session, if any.
+func (s *Session) Computer() (ComputerInfo, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.computer == nil {
+		return ComputerInfo{}, false
+	}
+	return *s.computer, true
+}
+
+func (s *Session) setComputer(info ComputerInfo) {
+	s.mu.Lock()
+	s.computer = &info
+	s.mu.Unlock()
+}
+
+func (s *Session) clearComputer() {
+	s.mu.Lock()
+	s.computer = nil
+	s.mu.Unlock()
+}
+
+// Monitors returns the monitors the session last reported.
+func (s *Session) Monitors() []MonitorInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]MonitorInfo(nil), s.monitors...)
+}
+
+func (s *Session) setMonitors(monitors []MonitorInfo) {
+	s.mu.Lock()
+	s.monitors = monitors
+	s.mu.Unlock()
+}
+
+// WriteMessage serialises writes to the underlying connection, which does not
+// support concurrent writers.
+func (s *Session) WriteMessage(messageType int, data []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.conn.WriteMessage(messageType, data)
+}
+
+// CloseReason returns the reason given when the server closed the session, or
+// an empty string if the session has not been closed by the server.
+func (s *Session) CloseReason() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.closeReason
+}
+
+func (s *Session) close(code int, reason string) {
+	s.mu.Lock()
+	s.closeReason = reason
+	s.mu.Unlock()
+	s.closeOnce.Do(func() { close(s.closed) })
+	s.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
+	s.conn.Close()
+}
@@ -723,10 +723,12 @@ export class LogLevel {
     public static readonly CRITICAL = new LogLevel(5, "CRITICAL");
 
     private static readonly LEVELS = [
+        LogLevel.TRACE,
         LogLevel.DEBUG,
         LogLevel.INFO,
         LogLevel.WARNING,
         LogLevel.ERROR,
+        LogLevel.CRITICAL,
     ];
     public static fromLevel(level: number): LogLevel {
         if (level < 0 || level >= LogLevel.LEVELS.length) {
@@ -787,7 +789,7 @@ export class LogEvent implements IEvent {
         info?: Partial<debug.FunctionInfo>,
         trace?: Partial<debug.FunctionInfo>[],
     ) {
-        os.queueEvent("log", level, message, info, trace);
+        os.queueEvent("log", level.getLevel(), message, info, trace);
     }
 }
 addEventInit(LogEvent);
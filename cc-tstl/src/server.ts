@@ -1,4 +1,7 @@
 import type { RawtermDelegate, RawtermRenderTarget, RawtermServerWindow } from "./api/rawterm";
+import { pack, unpack } from "./api/MessagePack";
+import { runMetricCollector } from "./api/event";
+import type { MetricsData } from "./api/metrics";
 
 type RawtermModule = typeof import("./api/rawterm");
 
@@ -7,9 +10,36 @@ declare const _HOST: string | undefined;
 declare const arg: string[] | undefined;
 
 const MIN_CC_VERSION = "1.85.0";
-const REMOTE_WS_BASE_URL = "wss://remote.craftos-pc.cc/";
 const REMOTE_HTTP_BASE_URL = "https://remote.craftos-pc.cc/";
 const RAWTERM_EXPECTED_SIZE = 31339;
+const BACKEND_WS_URL = (settings.get("ccgui.url") as string | undefined) ?? "ws://localhost:8080/ws";
+const BACKEND_ENROLL_URL =
+    (settings.get("ccgui.enroll_url") as string | undefined) ?? string.gsub(BACKEND_WS_URL, "/ws$", "/enroll")[0];
+
+// Routes and message types of the CCGui websocket protocol.
+const BASE_ROUTE_PONG = 1;
+const BASE_ROUTE_HELLO = 2;
+const BASE_ROUTE_TERMINAL = 3;
+const BASE_ROUTE_MONITORS = 4;
+const BASE_ROUTE_METRICS = 5;
+const BASE_ROUTE_LOG = 6;
+const BASE_ROUTE_CALL = 7;
+const BASE_ROUTE_CALL_RESULT = 8;
+const MESSAGE_PING = 0;
+const MESSAGE_TERMINAL = 2;
+const MESSAGE_CALL = 3;
+const MESSAGE_CALL_RESULT = 4;
+const MESSAGE_COMMAND = 5;
+
+// Routes and message types of the enrollment protocol, used by computers
+// without an API key to ask for one.
+const ENROLL_ROUTE_REQUEST = 1;
+const ENROLL_MESSAGE_CODE = 0;
+const ENROLL_MESSAGE_KEY = 1;
+const ENROLL_MESSAGE_REJECTED = 2;
+
+/** Seconds to wait for the backend to answer a call. */
+const DEFAULT_CALL_TIMEOUT = 30;
 
 function versionToParts(version: string): [number, number, number] {
     const parts = version.split(".");
@@ -87,6 +117,222 @@ function loadRawtermModule(): RawtermModule {
     return rawtermModule ?? (dofile("rawterm.lua") as RawtermModule);
 }
 
+interface MonitorReport {
+    name: string;
+    window: number;
+    width: number;
+    height: number;
+    text_scale: number;
+}
+
+/** A LogEvent as sent to the backend, with function info reduced to plain fields. */
+interface LogReport {
+    level: number;
+    message: string;
+    time_unix_nano: number;
+    info?: FunctionInfoReport;
+    trace?: FunctionInfoReport[];
+}
+
+interface FunctionInfoReport {
+    source?: string;
+    short_src?: string;
+    currentline?: number;
+    linedefined?: number;
+    lastlinedefined?: number;
+    what?: string;
+    name?: string;
+    namewhat?: string;
+}
+
+function functionInfoReport(info: unknown): FunctionInfoReport | undefined {
+    if (type(info) !== "table") return undefined;
+    // debug.getinfo() also returns the function itself, which cannot be packed.
+    const { source, short_src, currentline, linedefined, lastlinedefined, what, name, namewhat } =
+        info as Partial<debug.FunctionInfo>;
+    return { source, short_src, currentline, linedefined, lastlinedefined, what, name, namewhat };
+}
+
+/**
+ * A command sent by the backend to a group of computers. It is queued as a
+ * "ccgui_command" event with the name and data, for local programs to handle.
+ */
+interface Command {
+    name: string;
+    data?: unknown;
+}
+
+/** A call in either direction; args are the method's arguments. */
+interface CallRequest {
+    id: number;
+    method: string;
+    args?: unknown[];
+    timeout_ms?: number;
+}
+
+interface CallErrorReport {
+    code: string;
+    message: string;
+}
+
+/** The answer to the CallRequest with the same id: the method's return values or an error. */
+interface CallResult {
+    id: number;
+    result?: unknown[];
+    error?: CallErrorReport;
+}
+
+type CallHandler = (...args: unknown[]) => unknown;
+
+/**
+ * Methods the backend can call on this computer, by name. Each call runs in its
+ * own coroutine, so handlers may wait for events; use callError(...) to fail
+ * with a specific error code.
+ */
+const callHandlers: Record<string, CallHandler> = {};
+
+function callError(code: string, message: string): never {
+    throw { code, message };
+}
+
+interface BackendDelegate extends RawtermDelegate {
+    /** Replace the list of monitors the backend shows for this computer. */
+    sendMonitors(monitors: MonitorReport[]): void;
+    /** Forward metrics collected from local metric providers. */
+    sendMetrics(data: MetricsData): void;
+    /** Forward a log record raised with LogEvent.emit. */
+    sendLog(record: LogReport): void;
+    /** Answer a call the backend made. */
+    sendCallResult(result: CallResult): void;
+    /**
+     * Call a method on the backend and wait for its return values. Throws a
+     * CallErrorReport if the backend replies with an error or does not reply in
+     * time.
+     */
+    call(method: string, args: unknown[], timeoutSeconds?: number): unknown[];
+}
+
+function backendDelegate(url: string, apiKey: string): BackendDelegate {
+    const headers = new LuaMap<string, string>();
+    headers.set("Authorization", "Bearer " + apiKey);
+    const [websocket, connectError] = http.websocket(url, headers);
+    if (websocket === false) {
+        error("Could not connect to server: " + connectError);
+    }
+    websocket.send(
+        pack([
+            BASE_ROUTE_HELLO,
+            {
+                id: os.getComputerID(),
+                label: os.getComputerLabel() ?? "",
+                host: _HOST ?? "",
+                cc_version: _CC_VERSION ?? "",
+                turtle: (globalThis as any).turtle !== undefined,
+                pocket: (globalThis as any).pocket !== undefined,
+                advanced: term.isColour(),
+            },
+        ]),
+        true
+    );
+    let nextCallId = 0;
+    return {
+        close: () => websocket.close(),
+        receive: (timeout?: number) => {
+            while (true) {
+                const message = websocket.receive(timeout);
+                if (message === undefined) return undefined;
+                const [messageType, data] = unpack(message) as [number, unknown];
+                if (messageType === MESSAGE_TERMINAL) {
+                    return data as string;
+                } else if (messageType === MESSAGE_PING) {
+                    websocket.send(pack([BASE_ROUTE_PONG, data]), true);
+                } else if (messageType === MESSAGE_CALL) {
+                    os.queueEvent("ccgui_call", data);
+                } else if (messageType === MESSAGE_CALL_RESULT) {
+                    os.queueEvent("ccgui_call_result", data);
+                } else if (messageType === MESSAGE_COMMAND) {
+                    const command = data as Command;
+                    os.queueEvent("ccgui_command", command.name, command.data);
+                }
+            }
+        },
+        send: (data: string) => {
+            websocket.send(pack([BASE_ROUTE_TERMINAL, data]), true);
+        },
+        sendMonitors: (monitors: MonitorReport[]) => {
+            websocket.send(pack([BASE_ROUTE_MONITORS, monitors]), true);
+        },
+        sendMetrics: (data: MetricsData) => {
+            websocket.send(pack([BASE_ROUTE_METRICS, data]), true);
+        },
+        sendLog: (record: LogReport) => {
+            websocket.send(pack([BASE_ROUTE_LOG, record]), true);
+        },
+        sendCallResult: (result: CallResult) => {
+            websocket.send(pack([BASE_ROUTE_CALL_RESULT, result]), true);
+        },
+        call: (method: string, args: unknown[], timeoutSeconds = DEFAULT_CALL_TIMEOUT) => {
+            nextCallId += 1;
+            const id = nextCallId;
+            const request: CallRequest = { id, method, args, timeout_ms: timeoutSeconds * 1000 };
+            websocket.send(pack([BASE_ROUTE_CALL, request]), true);
+            const timer = os.startTimer(timeoutSeconds);
+            while (true) {
+                const [eventName, value] = os.pullEvent() as LuaMultiReturn<[string, unknown]>;
+                if (eventName === "ccgui_call_result" && (value as CallResult).id === id) {
+                    os.cancelTimer(timer);
+                    const result = value as CallResult;
+                    if (result.error !== undefined) throw result.error;
+                    return result.result ?? [];
+                } else if (eventName === "timer" && value === timer) {
+                    return callError("deadline_exceeded", "backend did not answer " + method);
+                }
+            }
+        }
+    };
+}
+
+/**
+ * Asks the backend for an API key, showing a pairing code for an operator to
+ * approve in the web UI. Returns the key once approved.
+ */
+function enroll(url: string): string {
+    const [websocket, connectError] = http.websocket(url);
+    if (websocket === false) {
+        error("Could not connect to server: " + connectError);
+    }
+    websocket.send(
+        pack([
+            ENROLL_ROUTE_REQUEST,
+            {
+                id: os.getComputerID(),
+                label: os.getComputerLabel() ?? "",
+            },
+        ]),
+        true
+    );
+    while (true) {
+        const message = websocket.receive();
+        if (message === undefined) {
+            error("Enrollment failed: the server closed the connection");
+        }
+        const [messageType, data] = unpack(message) as [number, Record<string, any>];
+        if (messageType === ENROLL_MESSAGE_CODE) {
+            print("This computer has no API key. To enroll it, approve this code in CCGui:");
+            print("");
+            print("    " + data.code);
+            print("");
+            print("The code expires in " + math.floor((data.expires_in as number) / 60) + " minutes.");
+        } else if (messageType === ENROLL_MESSAGE_KEY) {
+            websocket.close();
+            return data.key as string;
+        } else if (messageType === ENROLL_MESSAGE_REJECTED) {
+            websocket.close();
+            error("Enrollment failed: " + data.reason);
+        }
+    }
+}
+
 function wrapDelegate(base: RawtermDelegate): RawtermDelegate {
     const baseClose = base.close;
     const baseReceive = base.receive;
@@ -149,15 +395,19 @@ ensureStringPackPolyfill();
 
 const rawterm = loadRawtermModule();
 const args = table.pack(...(arg || []));
-const serverId = args[1] as string;
-const programName = args[2] as string | undefined;
-
-print("Connecting to " + REMOTE_WS_BASE_URL + "...");
-const [baseDelegate, connectError] = rawterm.wsDelegate(REMOTE_WS_BASE_URL + serverId);
-if (!baseDelegate) {
-    error("Could not connect to server: " + connectError);
+const programName = args[1] as string | undefined;
+let apiKey = settings.get("ccgui.api_key") as string | undefined;
+if (!apiKey) {
+    print("Enrolling with " + BACKEND_ENROLL_URL + "...");
+    apiKey = enroll(BACKEND_ENROLL_URL);
+    settings.set("ccgui.api_key", apiKey);
+    settings.save();
+    print("Enrolled. The API key was saved to the ccgui.api_key setting.");
 }
-const delegate = wrapDelegate(baseDelegate);
+
+print("Connecting to " + BACKEND_WS_URL + "...");
+const backend = backendDelegate(BACKEND_WS_URL, apiKey);
+const delegate = wrapDelegate(backend);
 
 const basePeripheralCall = peripheral.call;
 
@@ -204,6 +454,84 @@ function createMonitorWindow(name: string, width: number, height: number, id: nu
     return { id, name, window };
 }
 
+function serveCall(request: CallRequest): void {
+    const handler = callHandlers[request.method];
+    if (handler === undefined) {
+        backend.sendCallResult({
+            id: request.id,
+            error: { code: "unimplemented", message: "unknown method " + request.method },
+        });
+        return;
+    }
+    const args = request.args ?? [];
+    const outcome = packEvent(pcall(handler, ...args));
+    if (outcome[1]) {
+        const result: unknown[] = [];
+        for (let i = 2; i <= outcome.n; i++) {
+            result.push(outcome[i]);
+        }
+        backend.sendCallResult({ id: request.id, result });
+        return;
+    }
+    const err = outcome[2];
+    if (type(err) === "table" && typeof (err as CallErrorReport).code === "string") {
+        const { code, message } = err as CallErrorReport;
+        backend.sendCallResult({ id: request.id, error: { code, message: tostring(message) } });
+    } else {
+        backend.sendCallResult({ id: request.id, error: { code: "unknown", message: tostring(err) } });
+    }
+}
+
+/**
+ * Serves calls from the backend until the connection closes, running each in
+ * its own coroutine so that calls arriving while a handler waits for an event
+ * are not lost.
+ */
+function serveCalls(): void {
+    // Running calls, with the event each is waiting for.
+    const running = new LuaTable<LuaThread, string | undefined>();
+    while (isConnected) {
+        const event = packEvent(os.pullEventRaw());
+        const finished: LuaThread[] = [];
+        for (const [callCoroutine, filter] of running) {
+            if (filter === undefined || filter === event[1] || event[1] === "terminate") {
+                const [ok, nextFilter] = coroutine.resume(callCoroutine, table.unpack(event, 1, event.n));
+                if (ok && coroutine.status(callCoroutine) === "suspended") {
+                    running.set(callCoroutine, nextFilter as string | undefined);
+                } else {
+                    finished.push(callCoroutine);
+                }
+            }
+        }
+        for (const callCoroutine of finished) {
+            running.delete(callCoroutine);
+        }
+        if (event[1] === "ccgui_call") {
+            const request = event[2] as CallRequest;
+            const callCoroutine = coroutine.create(() => serveCall(request));
+            const [ok, filter] = coroutine.resume(callCoroutine);
+            if (ok && coroutine.status(callCoroutine) === "suspended") {
+                running.set(callCoroutine, filter as string | undefined);
+            }
+        }
+    }
+}
+
+function reportMonitors(): void {
+    const monitors: MonitorReport[] = [];
+    for (const [name, entry] of pairs(monitorsByName)) {
+        const [width, height] = basePeripheralCall(name, "getSize") as LuaMultiReturn<[number, number]>;
+        monitors.push({
+            name,
+            window: entry.id,
+            width,
+            height,
+            text_scale: basePeripheralCall(name, "getTextScale") as number,
+        });
+    }
+    backend.sendMonitors(monitors);
+}
+
 const foundMonitors = table.pack(peripheral.find("monitor"));
 for (let i = 1; i <= foundMonitors.n; i++) {
     const monitor = foundMonitors[i] as unknown as any;
@@ -212,6 +540,7 @@ for (let i = 1; i <= foundMonitors.n; i++) {
     monitorsByName[monitorName] = createMonitorWindow(monitorName, width, height, nextMonitorId);
     nextMonitorId += 1;
 }
+reportMonitors();
 
 peripheral.call = ((name: string, method: string, ...args: unknown[]) => {
     const entry = monitorsByName[name];
@@ -221,6 +550,171 @@ peripheral.call = ((name: string, method: string, ...args: unknown[]) => {
     return basePeripheralCall(name, method, ...args);
 }) as typeof peripheral.call;
 
+callHandlers["peripheral.list"] = () => {
+    const peripherals: { name: string; types: string[]; methods: string[] }[] = [];
+    for (const name of peripheral.getNames()) {
+        const types = packEvent(peripheral.getType(name));
+        const typeNames: string[] = [];
+        for (let i = 1; i <= types.n; i++) {
+            typeNames.push(types[i] as string);
+        }
+        peripherals.push({ name, types: typeNames, methods: peripheral.getMethods(name) || [] });
+    }
+    return peripherals;
+};
+
+callHandlers["peripheral.call"] = (name: unknown, method: unknown, ...args: unknown[]) => {
+    if (typeof name !== "string" || typeof method !== "string") {
+        return callError("invalid_argument", "expected a peripheral name and method");
+    }
+    const methods = peripheral.isPresent(name) ? peripheral.getMethods(name) : undefined;
+    if (methods === undefined) {
+        return callError("not_found", "no peripheral named " + name);
+    }
+    if (!methods.includes(method)) {
+        return callError("not_found", "peripheral " + name + " has no method " + method);
+    }
+    // Calls to mirrored monitors go through their windows, as local calls do.
+    return peripheral.call(name, method, ...args);
+};
+
+/** Bounds the output captured from a chunk run by lua.execute. */
+const MAX_LUA_OUTPUT = 64 * 1024;
+
+interface LuaFailure {
+    message: string;
+    traceback: string;
+}
+
+/**
+ * Globals chunks run by lua.execute may use. Everything that reaches files,
+ * settings, the network or other programs is left out, so chunks cannot read
+ * this computer's API key or change how it starts.
+ */
+const SANDBOX_GLOBALS = [
+    "assert", "error", "getmetatable", "ipairs", "next", "pairs", "pcall", "rawequal", "rawget", "rawlen",
+    "rawset", "select", "setmetatable", "tonumber", "tostring", "type", "unpack", "xpcall", "sleep",
+    "_HOST", "_VERSION",
+];
+const SANDBOX_LIBRARIES = [
+    "bit32", "colors", "colours", "coroutine", "keys", "math", "peripheral", "pocket", "redstone", "rs",
+    "string", "table", "textutils", "turtle", "utf8", "vector",
+];
+const SANDBOX_OS_FUNCTIONS = [
+    "cancelAlarm", "cancelTimer", "clock", "computerID", "computerLabel", "date", "day", "epoch",
+    "getComputerID", "getComputerLabel", "pullEvent", "pullEventRaw", "queueEvent", "setAlarm", "sleep",
+    "startTimer", "time", "version",
+];
+
+/** Copies the listed entries of source, or all of them, into a new table. */
+function pick(source: Record<string, unknown>, names?: string[]): Record<string, unknown> {
+    const copy: Record<string, unknown> = {};
+    if (names === undefined) {
+        for (const [name, value] of pairs(source)) {
+            copy[name] = value;
+        }
+        return copy;
+    }
+    for (const name of names) {
+        copy[name] = source[name];
+    }
+    return copy;
+}
+
+/**
+ * Builds the environment of a chunk run by lua.execute. Libraries are copied,
+ * so chunks cannot replace functions the rest of the computer uses.
+ */
+function sandboxEnvironment(overrides: Record<string, unknown>): Record<string, unknown> {
+    const globals = _G as Record<string, unknown>;
+    const env = pick(globals, SANDBOX_GLOBALS);
+    for (const name of SANDBOX_LIBRARIES) {
+        const library = globals[name];
+        env[name] = type(library) === "table" ? pick(library as Record<string, unknown>) : library;
+    }
+    env.os = pick(globals.os as Record<string, unknown>, SANDBOX_OS_FUNCTIONS);
+    for (const [name, value] of pairs(overrides)) {
+        env[name] = value;
+    }
+    env._G = env;
+    return env;
+}
+
+/**
+ * Runs a chunk sent by the backend in a sandboxed environment, capturing what
+ * it prints instead of drawing it. See SANDBOX_GLOBALS for what it may use.
+ */
+callHandlers["lua.execute"] = (code: unknown) => {
+    if (typeof code !== "string") {
+        return callError("invalid_argument", "expected Lua source");
+    }
+    const output: string[] = [];
+    let outputLength = 0;
+    const capture = (text: string) => {
+        if (outputLength >= MAX_LUA_OUTPUT) {
+            return;
+        }
+        if (outputLength + text.length >= MAX_LUA_OUTPUT) {
+            text = text.substring(0, MAX_LUA_OUTPUT - outputLength) + "\n[output truncated]";
+        }
+        output.push(text);
+        outputLength += text.length;
+    };
+    const capturePrint = (...values: unknown[]) => {
+        const packed = table.pack(...values);
+        const parts: string[] = [];
+        for (let i = 1; i <= packed.n; i++) {
+            parts.push(tostring(packed[i]));
+        }
+        const line = parts.join("\t") + "\n";
+        capture(line);
+        return line.length;
+    };
+    const env = sandboxEnvironment({
+        print: capturePrint,
+        printError: capturePrint,
+        write: (text: unknown) => capture(tostring(text)),
+    });
+
+    const [chunk, compileError] = load(code, "=ccgui", "t", env);
+    if (chunk === undefined) {
+        return { ok: false, output: "", error: tostring(compileError), results: [], n: 0 };
+    }
+    const outcome = packEvent(
+        xpcall(chunk, (err: unknown): LuaFailure => ({
+            message: tostring(err),
+            traceback: debug.traceback(undefined, 2),
+        }))
+    );
+    if (!outcome[1]) {
+        const failure = outcome[2] as LuaFailure;
+        return {
+            ok: false,
+            output: output.join(""),
+            error: failure.message,
+            traceback: failure.traceback,
+            results: [],
+            n: 0,
+        };
+    }
+    // Results may have nil holes, so they are sent with their count.
+    const results = new LuaTable<number, unknown>();
+    for (let i = 2; i <= outcome.n; i++) {
+        results.set(i - 1, outcome[i]);
+    }
+    return { ok: true, output: output.join(""), results, n: outcome.n - 1 };
+};
+
+/**
+ * The ccgui API available to programs on this computer. call(method, ...)
+ * calls a method on the backend, returning its results or throwing a
+ * CallErrorReport; tags() returns this computer's tags and groups.
+ */
+(_G as any).ccgui = {
+    call: (method: string, ...args: unknown[]) => table.unpack(backend.call(method, args)),
+    tags: () => backend.call("computer.tags", [])[0] as { tags: string[]; groups: string[] },
+};
+
 const previousTerm = term.redirect(mainWindow as unknown as ITerminal);
 
 const [parallelOk, parallelError] = pcall(parallel.waitForAny,
@@ -256,7 +750,7 @@ const [parallelOk, parallelError] = pcall(parallel.waitForAny,
                     event = packEvent(os.pullEventRaw(eventFilter));
                     if (
                         !(
-                            (event[1] === "websocket_message" && event[2] === REMOTE_WS_BASE_URL + serverId) ||
+                            (event[1] === "websocket_message" && event[2] === BACKEND_WS_URL) ||
                             (event[1] === "timer" && event[2] === refreshTimerId)
                         )
                     ) {
@@ -286,6 +780,43 @@ const [parallelOk, parallelError] = pcall(parallel.waitForAny,
             } while (timerId !== refreshTimerId);
         }
     },
+    () => {
+        const intervalSeconds = (settings.get("ccgui.metrics_interval") as number | undefined) ?? 10;
+        // The collector returns on terminate; keep collecting until the
+        // connection closes.
+        while (isConnected) {
+            runMetricCollector({
+                interval_seconds: intervalSeconds,
+                on_flush: (data) => {
+                    if (data.resource_metrics.length > 0) {
+                        backend.sendMetrics(data);
+                    }
+                },
+            });
+        }
+    },
+    serveCalls,
+    () => {
+        while (isConnected) {
+            const [, level, message, info, trace] = os.pullEventRaw("log") as LuaMultiReturn<
+                [string, number, string, unknown, unknown]
+            >;
+            const record: LogReport = {
+                level,
+                message: tostring(message),
+                time_unix_nano: os.epoch("utc") * 1000000,
+                info: functionInfoReport(info),
+            };
+            if (type(trace) === "table") {
+                record.trace = [];
+                for (const frame of trace as unknown[]) {
+                    const report = functionInfoReport(frame);
+                    if (report !== undefined) record.trace.push(report);
+                }
+            }
+            backend.sendLog(record);
+        }
+    },
     () => {
         while (true) {
             const [eventName, peripheralName] = os.pullEventRaw() as LuaMultiReturn<[string, string]>;
@@ -294,16 +825,19 @@ const [parallelOk, parallelError] = pcall(parallel.waitForAny,
                 const [width, height] = basePeripheralCall(peripheralName, "getSize") as LuaMultiReturn<[number, number]>;
                 monitorsByName[peripheralName] = createMonitorWindow(peripheralName, width, height, nextMonitorId);
                 nextMonitorId += 1;
+                reportMonitors();
             } else if (eventName === "peripheral_detach" && monitorsByName[peripheralName]) {
                 monitorsByName[peripheralName].window.close();
                 delete (monitorsByName as Record<string, MonitorEntry | undefined>)[peripheralName];
+                reportMonitors();
             } else if (eventName === "term_resize") {
                 const [width, height] = term.getSize();
                 mainWindow.reposition(undefined, undefined, width, height);
             } else if (eventName === "monitor_resize" && monitorsByName[peripheralName]) {
                 const [width, height] = basePeripheralCall(peripheralName, "getSize") as LuaMultiReturn<[number, number]>;
                 monitorsByName[peripheralName].window.reposition(undefined, undefined, width, height);
-            } else if (eventName === "websocket_closed" && peripheralName === REMOTE_WS_BASE_URL + serverId) {
+                reportMonitors();
+            } else if (eventName === "websocket_closed" && peripheralName === BACKEND_WS_URL) {
                 isConnected = false;
             }
         }
@@ -6,6 +6,8 @@ import {
 import { pack, unpack } from "./api/MessagePack";
 import { base64encode, verifyVersion } from "./utils";
 
+declare const _CC_VERSION: string | undefined;
+
 const REMOTE_BASE_URL = "ws://localhost:8080/ws";
 
 verifyVersion();
@@ -24,6 +26,7 @@ class WebsocketService {
         }
         this.websocket = websocket;
         this.url = url;
+        this.hello();
         try {
             parallel.waitForAll(
                 () => this.handleClose(),
@@ -94,6 +97,22 @@ class WebsocketService {
         return this.websocket !== undefined;
     }
 
+    public hello() {
+        const data = pack([
+            2,
+            {
+                id: os.getComputerID(),
+                label: os.getComputerLabel() ?? "",
+                host: _HOST,
+                cc_version: _CC_VERSION ?? "",
+                turtle: (globalThis as any).turtle !== undefined,
+                pocket: (globalThis as any).pocket !== undefined,
+                advanced: term.isColour(),
+            },
+        ]);
+        this.websocket?.send(data, true);
+    }
+
     public ping(value: number) {
         const data = pack([0, value]);
         print(base64encode(data));
@@ -110,10 +110,111 @@
 //   );
 // }
 
+import { useEffect, useState } from "react";
+import { Code, ConnectError, createClient } from "@connectrpc/connect";
 import { ComponentExample } from "@/components/component-example";
+import { EnrollmentPanel } from "@/components/enrollment-panel";
+import { LoginForm } from "@/components/login-form";
+import { MonitorScreens } from "@/components/monitor-screens";
+import { Button } from "@/components/ui/button";
+import { UserService } from "@/gen/user/v1/user_connect";
+import type { WhoAmIResponse } from "@/gen/user/v1/user_pb";
+import { SESSION_STORAGE_KEY, transport } from "@/lib/transport";
 
-export function App() {
+const userClient = createClient(UserService, transport);
+
+// takeLoginResult reads what single sign-on sent back in the URL fragment,
+// storing the new session and returning any error, then clears the fragment
+// so the token does not linger in the address bar.
+function takeLoginResult(): string {
+  const params = new URLSearchParams(window.location.hash.slice(1));
+  const session = params.get("session");
+  const error = params.get("login_error");
+  if (session === null && error === null) {
+    return "";
+  }
+  if (session) {
+    localStorage.setItem(SESSION_STORAGE_KEY, session);
+  }
+  history.replaceState(
+    null,
+    "",
+    window.location.pathname + window.location.search,
+  );
+  return error ?? "";
+}
+
+const loginError = takeLoginResult();
+
+function Content() {
+  const computer = new URLSearchParams(window.location.search).get("computer");
+  if (computer !== null && /^\d+$/.test(computer)) {
+    return <MonitorScreens computerId={Number(computer)} />;
+  }
   return <ComponentExample />;
 }
 
+export function App() {
+  // Bumped to check who we are again after signing in or out.
+  const [generation, setGeneration] = useState(0);
+  const [caller, setCaller] = useState<WhoAmIResponse | null>();
+
+  useEffect(() => {
+    let cancelled = false;
+    userClient.whoAmI({}).then(
+      (response) => {
+        if (!cancelled) setCaller(response);
+      },
+      (err) => {
+        if (ConnectError.from(err).code === Code.Unauthenticated) {
+          // The session expired or was ended elsewhere.
+          localStorage.removeItem(SESSION_STORAGE_KEY);
+        }
+        if (!cancelled) setCaller(null);
+      },
+    );
+    return () => {
+      cancelled = true;
+    };
+  }, [generation]);
+
+  async function signOut() {
+    try {
+      await userClient.logout({});
+    } catch {
+      // The session is forgotten below either way.
+    }
+    localStorage.removeItem(SESSION_STORAGE_KEY);
+    setGeneration((g) => g + 1);
+  }
+
+  if (caller === undefined) {
+    return null;
+  }
+  if (caller === null) {
+    return (
+      <LoginForm
+        initialError={loginError}
+        onLogin={() => setGeneration((g) => g + 1)}
+      />
+    );
+  }
+  return (
+    <>
+      {caller.user && (
+        <div className="flex items-center justify-end gap-3 border-b px-4 py-2 text-sm">
+          <span className="text-muted-foreground">
+            Signed in as {caller.user.username}
+          </span>
+          <Button variant="outline" size="sm" onClick={signOut}>
+            Sign out
+          </Button>
+        </div>
+      )}
+      {caller.scopes.includes("computers:admin") && <EnrollmentPanel />}
+      <Content />
+    </>
+  );
+}
+
 export default App
\ No newline at end of file
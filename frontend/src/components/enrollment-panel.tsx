@@ -0,0 +1,136 @@
+import * as React from "react"
+import { ConnectError, createClient } from "@connectrpc/connect"
+
+import { Button } from "@/components/ui/button"
+import {
+  Card,
+  CardContent,
+  CardDescription,
+  CardHeader,
+  CardTitle,
+} from "@/components/ui/card"
+import { Field, FieldGroup, FieldLabel } from "@/components/ui/field"
+import { Input } from "@/components/ui/input"
+import { EnrollmentService } from "@/gen/enrollment/v1/enrollment_connect"
+import type { Enrollment } from "@/gen/enrollment/v1/enrollment_pb"
+import { transport } from "@/lib/transport"
+
+const enrollmentClient = createClient(EnrollmentService, transport)
+
+// How often to look for computers waiting to enroll.
+const REFRESH_INTERVAL_MS = 5000
+
+// EnrollmentPanel lists computers waiting to enroll and approves the pairing
+// code shown on a computer's screen, issuing it a key.
+function EnrollmentPanel() {
+  const [enrollments, setEnrollments] = React.useState<Enrollment[]>([])
+  const [code, setCode] = React.useState("")
+  const [message, setMessage] = React.useState("")
+  const [error, setError] = React.useState("")
+  const [approving, setApproving] = React.useState(false)
+
+  const refresh = React.useCallback(async () => {
+    try {
+      const res = await enrollmentClient.listEnrollments({})
+      setEnrollments(res.enrollments)
+    } catch (err) {
+      setError(ConnectError.from(err).message)
+    }
+  }, [])
+
+  React.useEffect(() => {
+    refresh()
+    const interval = window.setInterval(refresh, REFRESH_INTERVAL_MS)
+    return () => window.clearInterval(interval)
+  }, [refresh])
+
+  async function approve(event: React.FormEvent) {
+    event.preventDefault()
+    setApproving(true)
+    try {
+      const res = await enrollmentClient.approveEnrollment({ code })
+      setMessage(
+        `Computer ${res.enrollment?.computerId} was issued the key "${res.key?.name}".`
+      )
+      setError("")
+      setCode("")
+    } catch (err) {
+      setMessage("")
+      setError(ConnectError.from(err).rawMessage)
+    } finally {
+      setApproving(false)
+      refresh()
+    }
+  }
+
+  async function deny(id: string) {
+    try {
+      await enrollmentClient.denyEnrollment({ id })
+      setError("")
+    } catch (err) {
+      setError(ConnectError.from(err).rawMessage)
+    } finally {
+      refresh()
+    }
+  }
+
+  if (enrollments.length === 0 && !message && !error) {
+    return null
+  }
+
+  return (
+    <Card className="mx-auto my-4 max-w-xl">
+      <CardHeader>
+        <CardTitle>Computers waiting to enroll</CardTitle>
+        <CardDescription>
+          Enter the code shown on a computer's screen to give it a key.
+        </CardDescription>
+      </CardHeader>
+      <CardContent>
+        <form onSubmit={approve}>
+          <FieldGroup>
+            <Field>
+              <FieldLabel htmlFor="enrollment-code">Pairing code</FieldLabel>
+              <Input
+                id="enrollment-code"
+                autoComplete="off"
+                placeholder="ABC-DEF"
+                value={code}
+                onChange={(event) => setCode(event.target.value)}
+                required
+              />
+            </Field>
+            {error && <p className="text-destructive">{error}</p>}
+            {message && <p className="text-muted-foreground">{message}</p>}
+            <Button type="submit" disabled={approving}>
+              Approve
+            </Button>
+          </FieldGroup>
+        </form>
+        <ul className="mt-4 flex flex-col gap-2 text-sm">
+          {enrollments.map((enrollment) => (
+            <li key={enrollment.id} className="flex items-center gap-3">
+              <span className="grow">
+                Computer {enrollment.computerId}
+                {enrollment.label && ` "${enrollment.label}"`}
+                <span className="text-muted-foreground">
+                  {" "}
+                  from {enrollment.remoteAddr}
+                </span>
+              </span>
+              <Button
+                variant="outline"
+                size="sm"
+                onClick={() => deny(enrollment.id)}
+              >
+                Deny
+              </Button>
+            </li>
+          ))}
+        </ul>
+      </CardContent>
+    </Card>
+  )
+}
+
+export { EnrollmentPanel }
@@ -0,0 +1,128 @@
+import * as React from "react"
+import { ConnectError, createClient } from "@connectrpc/connect"
+
+import {
+  Card,
+  CardContent,
+  CardDescription,
+  CardHeader,
+  CardTitle,
+} from "@/components/ui/card"
+import { LogService } from "@/gen/log/v1/log_connect"
+import { LogLevel, type LogRecord } from "@/gen/log/v1/log_pb"
+import { transport } from "@/lib/transport"
+
+const logClient = createClient(LogService, transport)
+
+// The server keeps the last 500 records per computer.
+const maxRecords = 500
+const pollIntervalMs = 2000
+
+const levelNames: Record<LogLevel, string> = {
+  [LogLevel.UNSPECIFIED]: "?",
+  [LogLevel.TRACE]: "TRACE",
+  [LogLevel.DEBUG]: "DEBUG",
+  [LogLevel.INFO]: "INFO",
+  [LogLevel.WARNING]: "WARN",
+  [LogLevel.ERROR]: "ERROR",
+  [LogLevel.CRITICAL]: "CRIT",
+}
+
+function levelClass(level: LogLevel) {
+  if (level >= LogLevel.ERROR) return "text-destructive"
+  if (level === LogLevel.WARNING) return "text-yellow-500"
+  if (level <= LogLevel.DEBUG) return "text-muted-foreground"
+  return ""
+}
+
+// LogTail polls TailLogs for a computer's newest log records.
+function LogTail({ computerId }: { computerId: number }) {
+  const [records, setRecords] = React.useState<LogRecord[]>([])
+  const [minLevel, setMinLevel] = React.useState(LogLevel.TRACE)
+  const [error, setError] = React.useState("")
+
+  React.useEffect(() => {
+    const abort = new AbortController()
+    let after = BigInt(0)
+    let timer: ReturnType<typeof setTimeout> | undefined
+    setRecords([])
+
+    async function poll() {
+      try {
+        const res = await logClient.tailLogs(
+          { computerId, afterSequence: after, minLevel },
+          { signal: abort.signal }
+        )
+        // A lower sequence means the server restarted and began counting
+        // again.
+        const restarted = res.sequence < after
+        after = res.sequence
+        setRecords((current) =>
+          [...(restarted ? [] : current), ...res.records].slice(-maxRecords)
+        )
+        setError("")
+      } catch (err) {
+        if (abort.signal.aborted) return
+        setError(ConnectError.from(err).message)
+      }
+      timer = setTimeout(poll, pollIntervalMs)
+    }
+    poll()
+    return () => {
+      abort.abort()
+      clearTimeout(timer)
+    }
+  }, [computerId, minLevel])
+
+  return (
+    <Card>
+      <CardHeader>
+        <CardTitle>Log</CardTitle>
+        <CardDescription>
+          Showing{" "}
+          <select
+            className="bg-transparent"
+            value={minLevel}
+            onChange={(event) => setMinLevel(Number(event.target.value))}
+          >
+            {[
+              LogLevel.TRACE,
+              LogLevel.DEBUG,
+              LogLevel.INFO,
+              LogLevel.WARNING,
+              LogLevel.ERROR,
+              LogLevel.CRITICAL,
+            ].map((level) => (
+              <option key={level} value={level}>
+                {levelNames[level]}
+              </option>
+            ))}
+          </select>{" "}
+          and above
+        </CardDescription>
+      </CardHeader>
+      <CardContent className="max-h-96 overflow-auto font-mono text-xs">
+        {records.length === 0 && !error && (
+          <p className="text-muted-foreground">No log records.</p>
+        )}
+        {records.map((record) => (
+          <div key={record.sequence.toString()} className={levelClass(record.level)}>
+            <span className="text-muted-foreground">
+              {record.time?.toDate().toLocaleTimeString()}
+            </span>{" "}
+            [{levelNames[record.level]}]{" "}
+            {record.source && (
+              <span className="text-muted-foreground">
+                {record.source.shortSrc}:{record.source.currentLine}{" "}
+              </span>
+            )}
+            {record.message}
+          </div>
+        ))}
+        {error && <p className="text-destructive mt-2">{error}</p>}
+      </CardContent>
+    </Card>
+  )
+}
+
+export { LogTail }
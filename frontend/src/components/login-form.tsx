@@ -0,0 +1,110 @@
+import * as React from "react"
+import { ConnectError, createClient } from "@connectrpc/connect"
+
+import { Button } from "@/components/ui/button"
+import {
+  Card,
+  CardContent,
+  CardDescription,
+  CardHeader,
+  CardTitle,
+} from "@/components/ui/card"
+import { Field, FieldGroup, FieldLabel } from "@/components/ui/field"
+import { Input } from "@/components/ui/input"
+import { UserService } from "@/gen/user/v1/user_connect"
+import { API_URL, SESSION_STORAGE_KEY, transport } from "@/lib/transport"
+
+const userClient = createClient(UserService, transport)
+
+// LoginForm signs a user in, storing their session token for the transport.
+// If the server has single sign-on, users may instead sign in with it, which
+// brings them back with a new session or initialError.
+function LoginForm({
+  onLogin,
+  initialError = "",
+}: {
+  onLogin: () => void
+  initialError?: string
+}) {
+  const [username, setUsername] = React.useState("")
+  const [password, setPassword] = React.useState("")
+  const [error, setError] = React.useState(initialError)
+  const [submitting, setSubmitting] = React.useState(false)
+  const [oidcEnabled, setOidcEnabled] = React.useState(false)
+
+  React.useEffect(() => {
+    userClient.getLoginOptions({}).then(
+      (options) => setOidcEnabled(options.oidcEnabled),
+      () => setOidcEnabled(false)
+    )
+  }, [])
+
+  async function submit(event: React.FormEvent) {
+    event.preventDefault()
+    setSubmitting(true)
+    try {
+      const response = await userClient.login({ username, password })
+      localStorage.setItem(SESSION_STORAGE_KEY, response.token)
+      setError("")
+      onLogin()
+    } catch (err) {
+      setError(ConnectError.from(err).rawMessage)
+    } finally {
+      setPassword("")
+      setSubmitting(false)
+    }
+  }
+
+  return (
+    <div className="flex min-h-screen items-center justify-center p-6">
+      <Card className="w-full max-w-sm">
+        <CardHeader>
+          <CardTitle>Sign in</CardTitle>
+          <CardDescription>Sign in to manage your computers.</CardDescription>
+        </CardHeader>
+        <CardContent>
+          <form onSubmit={submit}>
+            <FieldGroup>
+              <Field>
+                <FieldLabel htmlFor="login-username">Username</FieldLabel>
+                <Input
+                  id="login-username"
+                  autoComplete="username"
+                  value={username}
+                  onChange={(event) => setUsername(event.target.value)}
+                  required
+                />
+              </Field>
+              <Field>
+                <FieldLabel htmlFor="login-password">Password</FieldLabel>
+                <Input
+                  id="login-password"
+                  type="password"
+                  autoComplete="current-password"
+                  value={password}
+                  onChange={(event) => setPassword(event.target.value)}
+                  required
+                />
+              </Field>
+              {error && <p className="text-destructive">{error}</p>}
+              <Button type="submit" disabled={submitting}>
+                Sign in
+              </Button>
+              {oidcEnabled && (
+                <Button
+                  type="button"
+                  variant="outline"
+                  onClick={() => window.location.assign(`${API_URL}/oidc/login`)}
+                >
+                  Sign in with single sign-on
+                </Button>
+              )}
+            </FieldGroup>
+          </form>
+        </CardContent>
+      </Card>
+    </div>
+  )
+}
+
+export { LoginForm }
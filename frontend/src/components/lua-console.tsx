@@ -0,0 +1,84 @@
+import * as React from "react"
+import { ConnectError, createClient } from "@connectrpc/connect"
+
+import { Button } from "@/components/ui/button"
+import {
+  Card,
+  CardContent,
+  CardDescription,
+  CardHeader,
+  CardTitle,
+} from "@/components/ui/card"
+import { Textarea } from "@/components/ui/textarea"
+import { LuaService } from "@/gen/lua/v1/lua_connect"
+import type { ExecuteLuaResponse } from "@/gen/lua/v1/lua_pb"
+import { transport } from "@/lib/transport"
+
+const luaClient = createClient(LuaService, transport)
+
+// LuaConsole runs Lua chunks on a computer. It needs an API key with the
+// lua:exec scope.
+function LuaConsole({ computerId }: { computerId: number }) {
+  const [code, setCode] = React.useState("")
+  const [response, setResponse] = React.useState<ExecuteLuaResponse>()
+  const [error, setError] = React.useState("")
+  const [running, setRunning] = React.useState(false)
+
+  async function run() {
+    setRunning(true)
+    try {
+      setResponse(await luaClient.executeLua({ computerId, code }))
+      setError("")
+    } catch (err) {
+      setResponse(undefined)
+      setError(ConnectError.from(err).message)
+    } finally {
+      setRunning(false)
+    }
+  }
+
+  return (
+    <Card>
+      <CardHeader>
+        <CardTitle>Lua</CardTitle>
+        <CardDescription>
+          Run a chunk on the computer in a sandbox without file or network access.
+        </CardDescription>
+      </CardHeader>
+      <CardContent className="flex flex-col gap-3">
+        <Textarea
+          className="font-mono text-xs"
+          value={code}
+          onChange={(event) => setCode(event.target.value)}
+          placeholder="return peripheral.getNames()"
+        />
+        <div>
+          <Button disabled={!code || running} onClick={run}>
+            Run
+          </Button>
+        </div>
+        {response && (
+          <pre className="max-h-96 overflow-auto font-mono text-xs">
+            {response.output}
+            {response.success
+              ? response.results.length > 0 &&
+                JSON.stringify(
+                  response.results.map((value) => value.toJson()),
+                  null,
+                  2
+                )
+              : (
+                <span className="text-destructive">
+                  {response.error}
+                  {response.traceback && "\n" + response.traceback}
+                </span>
+              )}
+          </pre>
+        )}
+        {error && <p className="text-destructive">{error}</p>}
+      </CardContent>
+    </Card>
+  )
+}
+
+export { LuaConsole }
@@ -0,0 +1,143 @@
+import * as React from "react"
+import { ConnectError, createClient } from "@connectrpc/connect"
+
+import { LogTail } from "@/components/log-tail"
+import { LuaConsole } from "@/components/lua-console"
+import { PeripheralConsole } from "@/components/peripheral-console"
+import { TerminalScreen } from "@/components/terminal-screen"
+import {
+  Card,
+  CardContent,
+  CardDescription,
+  CardHeader,
+  CardTitle,
+} from "@/components/ui/card"
+import { ComputerService } from "@/gen/computer/v1/computer_connect"
+import type { Monitor } from "@/gen/computer/v1/computer_pb"
+import { TerminalService } from "@/gen/terminal/v1/terminal_connect"
+import { applyUpdate, type TerminalState } from "@/lib/terminal"
+import { transport } from "@/lib/transport"
+
+const computerClient = createClient(ComputerService, transport)
+const terminalClient = createClient(TerminalService, transport)
+
+function MonitorView({
+  computerId,
+  monitor,
+}: {
+  computerId: number
+  monitor: Monitor
+}) {
+  const [state, setState] = React.useState<TerminalState | null>(null)
+  const [error, setError] = React.useState("")
+
+  React.useEffect(() => {
+    const abort = new AbortController()
+    setState(null)
+    ;(async () => {
+      try {
+        const stream = terminalClient.watchTerminal(
+          { computerId, windowId: monitor.windowId },
+          { signal: abort.signal }
+        )
+        for await (const update of stream) {
+          setState((current) => applyUpdate(current, update))
+        }
+      } catch (err) {
+        if (!abort.signal.aborted) {
+          setError(ConnectError.from(err).message)
+        }
+      }
+    })()
+    return () => abort.abort()
+  }, [computerId, monitor.windowId])
+
+  async function touch(x: number, y: number) {
+    try {
+      await terminalClient.sendInput({
+        computerId,
+        windowId: monitor.windowId,
+        events: [{ event: { case: "monitorTouch", value: { x, y } } }],
+      })
+      setError("")
+    } catch (err) {
+      setError(ConnectError.from(err).message)
+    }
+  }
+
+  return (
+    <Card>
+      <CardHeader>
+        <CardTitle>{monitor.name}</CardTitle>
+        <CardDescription>
+          {monitor.width}×{monitor.height} at text scale {monitor.textScale}
+        </CardDescription>
+      </CardHeader>
+      <CardContent className="overflow-auto">
+        {state !== null ? (
+          <TerminalScreen state={state} onCellClick={touch} />
+        ) : (
+          <p className="text-muted-foreground">Waiting for the monitor…</p>
+        )}
+        {error && <p className="text-destructive mt-2">{error}</p>}
+      </CardContent>
+    </Card>
+  )
+}
+
+// MonitorScreens renders every monitor a computer is mirroring, each in its
+// own card. Clicking a monitor sends a monitor_touch event.
+function MonitorScreens({ computerId }: { computerId: number }) {
+  const [monitors, setMonitors] = React.useState<Monitor[]>([])
+  const [error, setError] = React.useState("")
+
+  React.useEffect(() => {
+    const abort = new AbortController()
+    ;(async () => {
+      try {
+        const list = await computerClient.listComputers(
+          {},
+          { signal: abort.signal }
+        )
+        const computer = list.computers.find((c) => c.id === computerId)
+        setMonitors(computer?.monitors ?? [])
+        const events = computerClient.watchComputers(
+          { afterSequence: list.sequence },
+          { signal: abort.signal }
+        )
+        for await (const { event } of events) {
+          if (event?.computer?.id === computerId) {
+            setMonitors(event.computer.monitors)
+          }
+        }
+      } catch (err) {
+        if (!abort.signal.aborted) {
+          setError(ConnectError.from(err).message)
+        }
+      }
+    })()
+    return () => abort.abort()
+  }, [computerId])
+
+  return (
+    <div className="mx-auto flex max-w-6xl flex-col gap-6 p-6">
+      <h1 className="text-lg font-medium">Computer {computerId} monitors</h1>
+      {error && <p className="text-destructive">{error}</p>}
+      {monitors.length === 0 && !error && (
+        <p className="text-muted-foreground">No monitors attached.</p>
+      )}
+      {monitors.map((monitor) => (
+        <MonitorView
+          key={`${monitor.windowId}:${monitor.name}`}
+          computerId={computerId}
+          monitor={monitor}
+        />
+      ))}
+      <PeripheralConsole computerId={computerId} />
+      <LuaConsole computerId={computerId} />
+      <LogTail computerId={computerId} />
+    </div>
+  )
+}
+
+export { MonitorScreens }
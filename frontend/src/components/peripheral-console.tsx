@@ -0,0 +1,147 @@
+import * as React from "react"
+import { Value, type JsonValue } from "@bufbuild/protobuf"
+import { ConnectError, createClient } from "@connectrpc/connect"
+
+import { Button } from "@/components/ui/button"
+import {
+  Card,
+  CardContent,
+  CardDescription,
+  CardHeader,
+  CardTitle,
+} from "@/components/ui/card"
+import { Textarea } from "@/components/ui/textarea"
+import { PeripheralService } from "@/gen/peripheral/v1/peripheral_connect"
+import type { Peripheral } from "@/gen/peripheral/v1/peripheral_pb"
+import { transport } from "@/lib/transport"
+
+const peripheralClient = createClient(PeripheralService, transport)
+
+// PeripheralConsole lists a computer's peripherals and calls their methods.
+// Arguments are entered as a JSON array; results are shown as JSON.
+function PeripheralConsole({ computerId }: { computerId: number }) {
+  const [peripherals, setPeripherals] = React.useState<Peripheral[]>([])
+  const [name, setName] = React.useState("")
+  const [method, setMethod] = React.useState("")
+  const [args, setArgs] = React.useState("[]")
+  const [result, setResult] = React.useState("")
+  const [error, setError] = React.useState("")
+  const [calling, setCalling] = React.useState(false)
+
+  const refresh = React.useCallback(async () => {
+    try {
+      const res = await peripheralClient.listPeripherals({ computerId })
+      setPeripherals(res.peripherals)
+      setError("")
+    } catch (err) {
+      setError(ConnectError.from(err).message)
+    }
+  }, [computerId])
+
+  React.useEffect(() => {
+    refresh()
+  }, [refresh])
+
+  const selected = peripherals.find((peripheral) => peripheral.name === name)
+
+  async function call() {
+    let parsed: JsonValue
+    try {
+      parsed = JSON.parse(args) as JsonValue
+    } catch {
+      setError("Arguments must be a JSON array.")
+      return
+    }
+    if (!Array.isArray(parsed)) {
+      setError("Arguments must be a JSON array.")
+      return
+    }
+    setCalling(true)
+    try {
+      const res = await peripheralClient.callPeripheral({
+        computerId,
+        name,
+        method,
+        args: parsed.map((arg) => Value.fromJson(arg)),
+      })
+      setResult(
+        JSON.stringify(
+          res.results.map((value) => value.toJson()),
+          null,
+          2
+        )
+      )
+      setError("")
+    } catch (err) {
+      setResult("")
+      setError(ConnectError.from(err).message)
+    } finally {
+      setCalling(false)
+    }
+  }
+
+  return (
+    <Card>
+      <CardHeader>
+        <CardTitle>Peripherals</CardTitle>
+        <CardDescription>
+          Call a peripheral method as if the computer ran peripheral.call.
+        </CardDescription>
+      </CardHeader>
+      <CardContent className="flex flex-col gap-3">
+        <div className="flex flex-wrap items-center gap-2">
+          <select
+            className="bg-transparent"
+            value={name}
+            onChange={(event) => {
+              setName(event.target.value)
+              setMethod("")
+            }}
+          >
+            <option value="">Peripheral…</option>
+            {peripherals.map((peripheral) => (
+              <option key={peripheral.name} value={peripheral.name}>
+                {peripheral.name} ({peripheral.types.join(", ")})
+              </option>
+            ))}
+          </select>
+          <select
+            className="bg-transparent"
+            value={method}
+            disabled={!selected}
+            onChange={(event) => setMethod(event.target.value)}
+          >
+            <option value="">Method…</option>
+            {selected?.methods.map((methodName) => (
+              <option key={methodName} value={methodName}>
+                {methodName}
+              </option>
+            ))}
+          </select>
+          <Button variant="outline" size="sm" onClick={refresh}>
+            Refresh
+          </Button>
+        </div>
+        <Textarea
+          className="font-mono text-xs"
+          value={args}
+          onChange={(event) => setArgs(event.target.value)}
+          placeholder="[]"
+        />
+        <div>
+          <Button disabled={!name || !method || calling} onClick={call}>
+            Call
+          </Button>
+        </div>
+        {result && (
+          <pre className="max-h-96 overflow-auto font-mono text-xs">
+            {result}
+          </pre>
+        )}
+        {error && <p className="text-destructive">{error}</p>}
+      </CardContent>
+    </Card>
+  )
+}
+
+export { PeripheralConsole }
@@ -0,0 +1,88 @@
+import * as React from "react"
+
+import { paletteColor, type TerminalState } from "@/lib/terminal"
+import { cn } from "@/lib/utils"
+
+interface Run {
+  text: string
+  foreground: string
+  background: string
+}
+
+// rowRuns groups a row into runs of cells sharing the same colours, so a row
+// renders as a handful of spans rather than one per cell.
+function rowRuns(state: TerminalState, y: number): Run[] {
+  const runs: Run[] = []
+  const text = state.text[y]
+  const foreground = state.foreground[y]
+  const background = state.background[y]
+  for (let x = 0; x < state.width; x++) {
+    const byte = text[x] ?? 0x20
+    const char = byte < 0x20 ? " " : String.fromCharCode(byte)
+    const last = runs[runs.length - 1]
+    if (
+      last !== undefined &&
+      last.foreground === foreground[x] &&
+      last.background === background[x]
+    ) {
+      last.text += char
+    } else {
+      runs.push({ text: char, foreground: foreground[x], background: background[x] })
+    }
+  }
+  return runs
+}
+
+function TerminalScreen({
+  state,
+  onCellClick,
+  className,
+  ...props
+}: Omit<React.ComponentProps<"div">, "onClick"> & {
+  state: TerminalState
+  // Called with 1-based cell coordinates.
+  onCellClick?: (x: number, y: number) => void
+}) {
+  function handleClick(event: React.MouseEvent<HTMLDivElement>) {
+    if (onCellClick === undefined) {
+      return
+    }
+    const rect = event.currentTarget.getBoundingClientRect()
+    const x = Math.floor(((event.clientX - rect.left) / rect.width) * state.width) + 1
+    const y = Math.floor(((event.clientY - rect.top) / rect.height) * state.height) + 1
+    if (x >= 1 && x <= state.width && y >= 1 && y <= state.height) {
+      onCellClick(x, y)
+    }
+  }
+
+  return (
+    <div
+      data-slot="terminal-screen"
+      className={cn(
+        "w-fit font-mono text-sm leading-none whitespace-pre select-none",
+        onCellClick !== undefined && "cursor-pointer",
+        className
+      )}
+      onClick={handleClick}
+      {...props}
+    >
+      {Array.from({ length: state.height }, (_, y) => (
+        <div key={y} className="flex">
+          {rowRuns(state, y).map((run, i) => (
+            <span
+              key={i}
+              style={{
+                color: paletteColor(state, run.foreground),
+                backgroundColor: paletteColor(state, run.background),
+              }}
+            >
+              {run.text}
+            </span>
+          ))}
+        </div>
+      ))}
+    </div>
+  )
+}
+
+export { TerminalScreen }
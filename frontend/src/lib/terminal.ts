@@ -0,0 +1,119 @@
+import type {
+  Screen,
+  WatchTerminalResponse,
+} from "@/gen/terminal/v1/terminal_pb"
+
+// Rawterm packet type and window change codes, see backend/internal/rawterm.
+const PACKET_WINDOW_CHANGE = 4
+const WINDOW_CHANGE_UPDATE = 0
+
+export interface TerminalCursor {
+  x: number
+  y: number
+  blink: boolean
+}
+
+// TerminalState is a text mode screen in term.blit form, kept up to date from
+// WatchTerminal snapshots and diffs.
+export interface TerminalState {
+  width: number
+  height: number
+  text: Uint8Array[]
+  foreground: string[]
+  background: string[]
+  palette: number[]
+  cursor: TerminalCursor
+}
+
+function fromSnapshot(screen: Screen): TerminalState {
+  return {
+    width: screen.width,
+    height: screen.height,
+    text: screen.rows.map((row) => row.text),
+    foreground: screen.rows.map((row) => row.foreground),
+    background: screen.rows.map((row) => row.background),
+    palette: [...screen.palette],
+    cursor: {
+      x: screen.cursor?.x ?? 0,
+      y: screen.cursor?.y ?? 0,
+      blink: screen.cursor?.blink ?? false,
+    },
+  }
+}
+
+function splice(row: string, column: number, cells: string): string {
+  return row.slice(0, column) + cells + row.slice(column + cells.length)
+}
+
+// applyUpdate returns the state after a WatchTerminal update. It returns null
+// once the window closes.
+export function applyUpdate(
+  state: TerminalState | null,
+  update: WatchTerminalResponse
+): TerminalState | null {
+  switch (update.update.case) {
+    case "snapshot":
+      return fromSnapshot(update.update.value)
+    case "diff": {
+      if (state === null) {
+        return null
+      }
+      const diff = update.update.value
+      const next: TerminalState = {
+        ...state,
+        text: [...state.text],
+        foreground: [...state.foreground],
+        background: [...state.background],
+        palette: [...state.palette],
+      }
+      for (const span of diff.spans) {
+        const cells = span.cells
+        if (cells === undefined || span.row >= next.height) {
+          continue
+        }
+        const text = next.text[span.row].slice()
+        text.set(cells.text, span.column)
+        next.text[span.row] = text
+        next.foreground[span.row] = splice(
+          next.foreground[span.row],
+          span.column,
+          cells.foreground
+        )
+        next.background[span.row] = splice(
+          next.background[span.row],
+          span.column,
+          cells.background
+        )
+      }
+      for (const [index, color] of Object.entries(diff.palette)) {
+        next.palette[Number(index)] = color
+      }
+      if (diff.cursor !== undefined) {
+        next.cursor = {
+          x: diff.cursor.x,
+          y: diff.cursor.y,
+          blink: diff.cursor.blink,
+        }
+      }
+      return next
+    }
+    case "packet": {
+      const packet = update.update.value
+      if (
+        packet[0] === PACKET_WINDOW_CHANGE &&
+        packet.length > 2 &&
+        packet[2] !== WINDOW_CHANGE_UPDATE
+      ) {
+        return null
+      }
+      return state
+    }
+    default:
+      return state
+  }
+}
+
+export function paletteColor(state: TerminalState, blit: string): string {
+  const color = state.palette[parseInt(blit, 16)] ?? 0
+  return `#${color.toString(16).padStart(6, "0")}`
+}
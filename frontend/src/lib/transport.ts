@@ -0,0 +1,27 @@
+import type { Interceptor } from "@connectrpc/connect"
+import { createConnectTransport } from "@connectrpc/connect-web"
+
+// localStorage key holding the session token of the signed-in user.
+export const SESSION_STORAGE_KEY = "ccgui.session"
+
+// localStorage key holding an API key, sent when nobody is signed in. Useful
+// for unattended displays.
+export const API_KEY_STORAGE_KEY = "ccgui.apiKey"
+
+const withCredentials: Interceptor = (next) => async (req) => {
+  const token =
+    localStorage.getItem(SESSION_STORAGE_KEY) ??
+    localStorage.getItem(API_KEY_STORAGE_KEY)
+  if (token) {
+    req.header.set("Authorization", `Bearer ${token}`)
+  }
+  return next(req)
+}
+
+export const API_URL: string =
+  import.meta.env.VITE_API_URL ?? "http://localhost:8080"
+
+export const transport = createConnectTransport({
+  baseUrl: API_URL,
+  interceptors: [withCredentials],
+})